@@ -0,0 +1,130 @@
+//go:build js && wasm
+
+// eclipse-hdr-wasm is the pipeline built for WebAssembly, so that a
+// web page can stack photos in the browser. It sets up one global:
+//
+//   eclipseHDR.stack(photos, options) -> Promise
+//
+// where photos is an array of {name, data}, data being an ArrayBuffer
+// (or Uint8Array) holding one TIFF (linear, with EXIF; DNGs need cgo),
+// and options (which can be left out) is:
+//
+//   {settings:   ["key=value", ...],   // as for `-set`, e.g. color config for TIFFs
+//    preset:     "quick-preview",
+//    tonemapper: "reinhard05",         // default fattal02
+//    onProgress: function(stage, done, total) {...}}
+//
+// The promise resolves to {width, height, rgba}, rgba being a
+// Uint8ClampedArray that's ready for `new ImageData(rgba, width, height)`.
+package main
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"syscall/js"
+	"time"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eclipse"
+)
+
+func main() {
+	js.Global().Set("eclipseHDR", js.ValueOf(map[string]interface{}{
+		"stack": js.FuncOf(stack),
+	}))
+	select {} // the funcs have to outlive main
+}
+
+// stack runs the pipeline in the background (a func called from JS
+// mustn't block), and returns a promise for the result.
+func stack(this js.Value, args []js.Value) interface{} {
+	handler := js.FuncOf(func(this js.Value, pargs []js.Value) interface{} {
+		resolve, reject := pargs[0], pargs[1]
+		go func() {
+			result, err := run(args)
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	defer handler.Release() // the Promise calls it straight away
+	return js.Global().Get("Promise").New(handler)
+}
+
+func run(args []js.Value) (interface{}, error) {
+	if len(args) < 1 || args[0].Type() != js.TypeObject {
+		return nil, fmt.Errorf("stack: wanted an array of photos")
+	}
+	opts := js.ValueOf(map[string]interface{}{})
+	if len(args) > 1 && args[1].Type() == js.TypeObject {
+		opts = args[1]
+	}
+
+	photos := []eclipse.Photo{}
+	for i:=0; i<args[0].Length(); i++ {
+		p := args[0].Index(i)
+		name := p.Get("name").String()
+		data := js.Global().Get("Uint8Array").New(p.Get("data"))
+		b := make([]byte, data.Length())
+		js.CopyBytesToGo(b, data)
+		photo, err := eclipse.DecodePhoto(name, b)
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+
+	pipelineOpts := []eclipse.PipelineOption{eclipse.WithPhotos(photos...)}
+	if preset := opts.Get("preset"); preset.Type() == js.TypeString {
+		pipelineOpts = append(pipelineOpts, eclipse.WithPreset(preset.String()))
+	}
+	if settings := opts.Get("settings"); settings.Type() == js.TypeObject {
+		kvs := []string{}
+		for i:=0; i<settings.Length(); i++ {
+			kvs = append(kvs, settings.Index(i).String())
+		}
+		pipelineOpts = append(pipelineOpts, eclipse.WithSettings(kvs...))
+	}
+	if fn := opts.Get("onProgress"); fn.Type() == js.TypeFunction {
+		pipelineOpts = append(pipelineOpts, eclipse.WithProgress(jsProgress{fn}))
+	}
+
+	fi, err := eclipse.NewPipeline(pipelineOpts...).Run(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	tonemapper := "fattal02"
+	if tmo := opts.Get("tonemapper"); tmo.Type() == js.TypeString {
+		tonemapper = tmo.String()
+	}
+	img, err := fi.Render(tonemapper)
+	if err != nil {
+		return nil, err
+	}
+
+	rgba, ok := img.(*image.RGBA)
+	if !ok || rgba.Bounds().Min != (image.Point{}) || rgba.Stride != 4*rgba.Bounds().Dx() {
+		rgba = image.NewRGBA(image.Rectangle{Max: img.Bounds().Size()})
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	pix := js.Global().Get("Uint8ClampedArray").New(len(rgba.Pix))
+	js.CopyBytesToJS(pix, rgba.Pix)
+	return js.ValueOf(map[string]interface{}{
+		"width":  rgba.Bounds().Dx(),
+		"height": rgba.Bounds().Dy(),
+		"rgba":   pix,
+	}), nil
+}
+
+// jsProgress passes progress on to a JS func(stage, done, total).
+type jsProgress struct {
+	fn js.Value
+}
+
+func (p jsProgress)StageStarted(stage string, total int)        { p.fn.Invoke(stage, 0, total) }
+func (p jsProgress)StageProgress(stage string, done, total int) { p.fn.Invoke(stage, done, total) }
+func (p jsProgress)StageFinished(stage string, elapsed time.Duration) {}
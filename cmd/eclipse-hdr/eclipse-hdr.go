@@ -1,14 +1,47 @@
 package main
 
 import(
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/abworrall/eclipse-hdr/pkg/eclipse"
 )
 
+// settingsFlag collects repeated flags (e.g. `-set key=value`), in order.
+type settingsFlag []string
+
+func (s *settingsFlag)String() string     { return fmt.Sprintf("%v", []string(*s)) }
+func (s *settingsFlag)Set(kv string) error { *s = append(*s, kv); return nil }
+
+// verbosityFlag counts how many times `-v` was given (or takes an
+// explicit value, e.g. `-v=2`).
+type verbosityFlag int
+
+func (v *verbosityFlag)String() string   { return fmt.Sprintf("%d", int(*v)) }
+func (v *verbosityFlag)IsBoolFlag() bool { return true }
+func (v *verbosityFlag)Set(s string) error {
+	if s == "true" {
+		*v++
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	*v = verbosityFlag(n)
+	return err
+}
+
 var(
-	fVerbosity int
+	fVerbosity verbosityFlag
+	fVeryVerbose bool
+	fQuiet bool
 	fOutputWidth float64
 	fDoEclipseAlignment bool
 	fDoFineTunedAlignment bool
@@ -16,51 +49,310 @@ var(
 	fDeveloper string
 	fTonemapper string
 	fFuserLuminance float64
+	fPhase string
+	fDryRun bool
+	fLogFormat string
+	fThreads int
+	fMaxMemory string
+	fPreset string
+	fWatch bool
+	fOutputDir string
+	fCacheDir string
+	fWorkDir string
+	fKeepGoing bool
+	fPreview bool
+	fFastPNG bool
+	fSettings settingsFlag
+	fSelect settingsFlag
+	fWatchInterval time.Duration
+	fMetricsAddr string
+	fPprofAddr string
+	fCPUProfile string
+	fMemProfile string
+	fTrace string
 )
 
 func init() {
-	flag.IntVar(&fVerbosity, "v", 0, "how verbose to get")
-	flag.Float64Var(&fOutputWidth, "width", 4, "width of output image, in solar diameters")
+	def := eclipse.NewConfig()
 
-	flag.BoolVar(&fDoEclipseAlignment, "aligneclipse", true, "assume pics are of an eclipse, and try to align them")
-	flag.BoolVar(&fDoFineTunedAlignment, "alignfinetune", false, "do a very slow pass to finetune image alignment")
+	flag.Var(&fVerbosity, "v", "verbose: log per-frame detail")
+	flag.BoolVar(&fVeryVerbose, "vv", false, "very verbose: also log per-pixel detail")
+	flag.BoolVar(&fQuiet, "q", false, "quiet: only log warnings and errors")
+	flag.StringVar(&fPreset, "preset", "", "start from a preset config (conf.yaml and flags override it): "+eclipse.ListPresets())
+	flag.Float64Var(&fOutputWidth, "width", def.OutputWidthInSolarDiameters, "width of output image, in solar diameters")
 
-	flag.StringVar(&fFuser, "fuser", "mostexposed", "how to fuse the exposures into one HDR exposure")
-	flag.StringVar(&fDeveloper, "developer", "dng", "how to develop the color (prior to tonemapping)")
-	flag.StringVar(&fTonemapper, "tonemapper", "all", "how to tonemap from HDR to LDR: "+eclipse.ListTonemappers())
-	flag.Float64Var(&fFuserLuminance, "fuserluminance", 0.8, "layer discarded during fusion if pixel>this (0.0->1.0) ")
+	flag.BoolVar(&fDoEclipseAlignment, "aligneclipse", def.DoEclipseAlignment, "assume pics are of an eclipse, and try to align them")
+	flag.BoolVar(&fDoFineTunedAlignment, "alignfinetune", def.DoFineTunedAlignment, "do a very slow pass to finetune image alignment")
+
+	flag.StringVar(&fFuser, "fuser", def.Fuser, "how to fuse the exposures into one HDR exposure")
+	flag.StringVar(&fDeveloper, "developer", def.Developer, "how to develop the color (prior to tonemapping)")
+	flag.StringVar(&fTonemapper, "tonemapper", def.Tonemapper, "how to tonemap from HDR to LDR: "+eclipse.ListTonemappers())
+	flag.Float64Var(&fFuserLuminance, "fuserluminance", def.FuserLuminance, "layer discarded during fusion if pixel>this (0.0->1.0) ")
+	flag.Var(&fSettings, "set", "override a config value, e.g. -set whitebalance.mode=solar (can be repeated); also via "+eclipse.EnvPrefix+"WHITEBALANCE_MODE=solar")
+	flag.Var(&fSelect, "select", "only use photos that match, e.g. -select 'iso<=800' -select 'exposure>=1/500' (replaces any select in conf.yaml)")
+	flag.StringVar(&fOutputDir, "outdir", "", "where to write the output files (default: the current dir)")
+	flag.StringVar(&fCacheDir, "cache", "", "cache limbs, alignments and stacks in this dir, and reuse them when nothing has changed")
+	flag.StringVar(&fWorkDir, "workdir", "", "where scratch files go (default: the system temp dir); see work.cleanup")
+	flag.BoolVar(&fWatch, "watch", false, "keep watching the dirs, and redo a quick stack whenever new photos show up")
+	flag.DurationVar(&fWatchInterval, "watchinterval", 5*time.Second, "how often -watch looks for new photos")
+	flag.BoolVar(&fDryRun, "dryrun", false, "just read the metadata, and print what would be done")
+	flag.BoolVar(&fKeepGoing, "keepgoing", false, "if a frame fails (bad file, no lunar limb, bad alignment), drop it and carry on")
+	flag.BoolVar(&fFastPNG, "fastpng", false, "write PNGs with the parallel encoder (or output.png: fast in conf.yaml)")
+	flag.BoolVar(&fPreview, "preview", false, "a quick run at quarter size, with cheaper warping & stacking, for trying out settings; outputs go in preview/")
+	flag.IntVar(&fThreads, "j", 0, "max number of worker threads (default: one per CPU)")
+	flag.StringVar(&fMaxMemory, "maxmemory", "", "keep memory use (roughly) under this, e.g. 8GB, by using fewer workers where they need a lot")
+	flag.StringVar(&fMetricsAddr, "metrics", "", "serve each stage's timing & memory totals (as expvars, at /debug/vars) on this address, e.g. localhost:6060")
+	flag.StringVar(&fPprofAddr, "pprof", "", "serve live profiles (at /debug/pprof) on this address, e.g. localhost:6060; handy with -watch")
+	flag.StringVar(&fCPUProfile, "cpuprofile", "", "write a CPU profile (labelled by stage) to this file")
+	flag.StringVar(&fMemProfile, "memprofile", "", "write a memory profile to this file, at the end")
+	flag.StringVar(&fTrace, "trace", "", "write an execution trace (with a region per stage) to this file")
+	flag.StringVar(&fLogFormat, "logformat", "text", "how to log: text, or json (one event per line, with stage timings and metrics)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [phase] [flags] files...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  phase is one of %s (default: all)\n", eclipse.ListPhases())
+		fmt.Fprintf(flag.CommandLine.Output(), "   or: %s init dir   (scan the photos in dir, and write a starter dir/conf.yaml)\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "   or: %s doctor files...   (check the photos and configs before a long run)\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "   or: %s bench files...   (time the main stages on these photos)\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "   or: %s migrate conf.yaml...   (update config files to the current format)\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	// If finetuning, pick smaller images
-	if fDoFineTunedAlignment {
-		fOutputWidth = 2.0
+	// The phase (or command) can come before or after the flags
+	fPhase = "all"
+	if flag.NArg() > 0 && (eclipse.IsPhase(flag.Arg(0)) || commands[flag.Arg(0)] != nil) {
+		fPhase = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	if fVeryVerbose {
+		fVerbosity = 2
+	} else if fQuiet {
+		fVerbosity = -1
+	}
+	eclipse.SetVerbosity(int(fVerbosity))
+
+	switch fLogFormat {
+	case "text":
+	case "json":
+		logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: eclipse.LogLevel()}))
+		slog.SetDefault(logger) // log.Printf messages become JSON too
+		eclipse.SetDefaultLogger(logger) // the messages & events; there's no progress line, with a logger
+	default:
+		log.Fatalf("-logformat '%s' not recognized, wanted text or json", fLogFormat)
+	}
+
+	serveDebug(fMetricsAddr, fPprofAddr)
+
+	if !fQuiet {
+		log.Printf("eclipse-hdr starting\n")
+	}
+}
+
+// commands are things that aren't phases of the pipeline.
+var commands = map[string]func(args []string) error{
+	"init":    runInit,
+	"doctor":  runDoctor,
+	"bench":   runBench,
+	"migrate": runMigrate,
+}
+
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("migrate wants some config files")
+	}
+	for _, filename := range args {
+		notes, err := eclipse.MigrateConfigFile(filename)
+		if err != nil {
+			return err
+		} else if len(notes) == 0 {
+			log.Printf("%s: already at config version %d\n", filename, eclipse.CurrentConfigVersion)
+		}
+		for _, note := range notes {
+			log.Printf("%s: %s\n", filename, note)
+		}
+	}
+	return nil
+}
+
+func runBench(args []string) error {
+	base := eclipse.NewConfig()
+	if fPreset != "" {
+		if err := base.ApplyPreset(fPreset); err != nil {
+			return err
+		}
+	}
+	b := eclipse.NewBenchmark(base, args...)
+	b.Overrides = overrides()
+	b.Configure = applyFlags
+	report, err := b.Run(interruptContext())
+	fmt.Print(report)
+	return err
+}
+
+// errDoctorFailed is what runDoctor returns when it found problems; the
+// report has already said what they were, so main just exits non-zero.
+var errDoctorFailed = errors.New("doctor found problems")
+
+func runDoctor(args []string) error {
+	report, ok := eclipse.Doctor(args...)
+	fmt.Print(report)
+	if !ok {
+		return errDoctorFailed
 	}
+	return nil
+}
+
+func runInit(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("init wants one dir, got %q", args)
+	}
+	filename, err := eclipse.InitConfig(args[0])
+	if err == nil {
+		log.Printf("Wrote %s; have a look, and then run `%s %s`\n", filename, os.Args[0], args[0])
+	}
+	return err
+}
 
-	log.Printf("eclipse-hdr starting\n")
+// overrides are the config settings from the environment and `-set`,
+// plus the flags that loading needs to know about (so they can't wait
+// for applyFlags).
+func overrides() []string {
+	settings := append(eclipse.EnvOverrides(os.Environ()), fSettings...)
+	if flagWasSet("keepgoing") {
+		settings = append(settings, fmt.Sprintf("keepgoing=%v", fKeepGoing))
+	}
+	if fPreview {
+		settings = append(settings, fmt.Sprintf("preview=%d", eclipse.PreviewScale))
+	}
+	if len(fSelect) > 0 {
+		quoted := []string{}
+		for _, s := range fSelect {
+			quoted = append(quoted, strconv.Quote(s))
+		}
+		settings = append(settings, "select=[" + strings.Join(quoted, ",") + "]")
+	}
+	return settings
 }
 
 func main() {
+	stopProfiling, err := startProfiling()
+	if err == nil {
+		err = run()
+	}
+	stopProfiling()
+	if err == errDoctorFailed {
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	if command := commands[fPhase]; command != nil {
+		return command(flag.Args())
+	}
 
 	img := eclipse.NewFusedImage()
-	if err := img.LoadFilesAndDirs(flag.Args()...); err != nil {
-		log.Fatal(err)
+	if fPreset != "" {
+		if err := img.Config.ApplyPreset(fPreset); err != nil {
+			return err
+		}
 	}
+	img.Overrides = overrides()
+	if fMetricsAddr != "" {
+		img.Config.Metrics = eclipse.ExpvarMetrics{} // applyFlags is too late for loading
+	}
+
+	if fWatch {
+		w := eclipse.NewWatcher(img.Config, fWatchInterval, flag.Args()...)
+		w.Overrides = img.Overrides
+		w.Configure = applyFlags
+		w.Run(interruptContext())
+		log.Printf("Stopped watching\n")
+		return nil
+	}
+
+	if fDryRun {
+		if err := img.LoadMetadata(flag.Args()...); err != nil {
+			return err
+		}
+		applyFlags(&img.Config)
+		fmt.Print(img.Plan(fPhase))
+		return nil
+	}
+
+	p := eclipse.NewPipeline(
+		eclipse.WithConfig(img.Config),
+		eclipse.WithSettings(img.Overrides...),
+		eclipse.WithInputs(flag.Args()...),
+		eclipse.WithPhase(fPhase),
+		eclipse.WithConfigFunc(func(cfg *eclipse.Config) {
+			applyFlags(cfg)
+			if cfg.Verbosity > 0 {
+				log.Printf("Initial configuration:-\n\n%s\n", cfg.AsYaml())
+			}
+		}),
+	)
+	ctx := interruptContext()
+	if _, err := p.Run(ctx); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Interrupted; stopped before finishing")
+		}
+		return err
+	}
+	return nil
+}
 
-	img.Config.Fuser = fFuser
-	img.Config.Developer = fDeveloper
-	img.Config.Tonemapper = fTonemapper
-	img.Config.OutputWidthInSolarDiameters = fOutputWidth
-	img.Config.DoEclipseAlignment = fDoEclipseAlignment
-	img.Config.DoFineTunedAlignment = fDoFineTunedAlignment
-	img.Config.Verbosity = fVerbosity
-	img.Config.FuserLuminance = fFuserLuminance
+// interruptContext is cancelled by Ctrl-C, so a run can stop cleanly
+// (without, say, writing a half-done stack into the cache). A second
+// Ctrl-C kills it straight away.
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
 
-	if img.Config.Verbosity > 0 {
-		log.Printf("Initial configuration:-\n\n%s\n", img.Config.AsYaml())
+// applyFlags overrides the config with any flags that were given on
+// the command line, so that they beat both the preset and conf.yaml.
+func applyFlags(cfg *eclipse.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "fuser":          cfg.Fuser = fFuser
+		case "developer":      cfg.Developer = fDeveloper
+		case "tonemapper":     cfg.Tonemapper = fTonemapper
+		case "width":          cfg.OutputWidthInSolarDiameters = fOutputWidth
+		case "aligneclipse":   cfg.DoEclipseAlignment = fDoEclipseAlignment
+		case "alignfinetune":  cfg.DoFineTunedAlignment = fDoFineTunedAlignment
+		case "fuserluminance": cfg.FuserLuminance = fFuserLuminance
+		case "j":              cfg.Threads = fThreads
+		case "maxmemory":      cfg.MaxMemory = fMaxMemory
+		case "outdir":         cfg.Output.Dir = fOutputDir
+		case "cache":          cfg.CacheDir = fCacheDir
+		case "workdir":        cfg.Work.Dir = fWorkDir
+		case "keepgoing":      cfg.KeepGoing = fKeepGoing
+		case "fastpng":        cfg.Output.PNG = map[bool]string{true: "fast", false: "std"}[fFastPNG]
+		}
+	})
+	cfg.Verbosity = int(fVerbosity)
+	if cfg.Verbosity > 0 {
+		cfg.DebugSink = eclipse.DebugFiles{}
 	}
+	if fMetricsAddr != "" {
+		cfg.Metrics = eclipse.ExpvarMetrics{}
+	}
+
+	// If finetuning, pick smaller images
+	if fDoFineTunedAlignment && !flagWasSet("width") {
+		cfg.OutputWidthInSolarDiameters = 2.0
+	}
+}
 
-	img.Align()
-	img.Fuse()
-	img.WriteToHDR("fused.hdr")
-	img.Tonemap()
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
 }
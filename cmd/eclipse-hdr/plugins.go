@@ -0,0 +1,11 @@
+package main
+
+// To build extensions into eclipse-hdr (your own fusers, developers,
+// limb detectors, tonemappers or enhancement stages), import their
+// packages here for their side effects; each one registers what it
+// provides from an init() func (see pkg/eclipse/registry.go), and the
+// config can then ask for it by name.
+//
+//   import(
+//     _ "github.com/you/eclipse-hdr-wavelets"
+//   )
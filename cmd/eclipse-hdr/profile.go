@@ -0,0 +1,96 @@
+package main
+
+import(
+	"fmt"
+	"log"
+	"net/http"
+	_ "net/http/pprof" // serves /debug/pprof, for -pprof
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// startProfiling starts whatever profiles the flags asked for, and
+// returns a func that finishes them off (which has to be called
+// before exiting, or they are left incomplete). The CPU profile is
+// labelled by stage, and the trace has a region per stage.
+func startProfiling() (func(), error) {
+	stops := []func(){}
+	stop := func() {
+		for i := len(stops)-1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if fCPUProfile != "" {
+		f, err := os.Create(fCPUProfile)
+		if err != nil {
+			return stop, fmt.Errorf("-cpuprofile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return stop, fmt.Errorf("-cpuprofile: %v", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+			log.Printf("Wrote CPU profile to %s\n", fCPUProfile)
+		})
+	}
+
+	if fTrace != "" {
+		f, err := os.Create(fTrace)
+		if err != nil {
+			stop()
+			return func() {}, fmt.Errorf("-trace: %v", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stop()
+			return func() {}, fmt.Errorf("-trace: %v", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+			log.Printf("Wrote execution trace to %s\n", fTrace)
+		})
+	}
+
+	if fMemProfile != "" {
+		stops = append(stops, func() {
+			f, err := os.Create(fMemProfile)
+			if err != nil {
+				log.Printf("WARNING: -memprofile: %v\n", err)
+				return
+			}
+			defer f.Close()
+			runtime.GC() // so the profile is up to date
+			if err := pprof.Lookup("allocs").WriteTo(f, 0); err != nil {
+				log.Printf("WARNING: -memprofile: %v\n", err)
+				return
+			}
+			log.Printf("Wrote memory profile to %s\n", fMemProfile)
+		})
+	}
+
+	return stop, nil
+}
+
+// serveDebug serves the expvars (for -metrics) and pprof (for -pprof);
+// they share the default mux, so one server does for both if they are
+// on the same address.
+func serveDebug(addrs ...string) {
+	served := map[string]bool{}
+	for _, addr := range addrs {
+		if addr == "" || served[addr] {
+			continue
+		}
+		served[addr] = true
+		go func(addr string) {
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				log.Printf("WARNING: serving on %s: %v\n", addr, err)
+			}
+		}(addr)
+	}
+}
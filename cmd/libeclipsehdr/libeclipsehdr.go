@@ -0,0 +1,234 @@
+// libeclipsehdr is the pipeline as a C shared library, for calling
+// from Python (ctypes, cffi), Julia etc. Build it with
+//
+//   go build -buildmode=c-shared -o libeclipsehdr.so ./cmd/libeclipsehdr
+//
+// which also writes libeclipsehdr.h. A run goes like this:
+//
+//   h = ehdr_new()
+//   ehdr_set(h, "tonemapper=fattal02")                    (any number of `-set` style settings)
+//   ehdr_add_input(h, "eclipse2024/")                     (photos, dirs, conf.yaml files ...)
+//   ehdr_add_photo(h, "a", rgb, w, h, 100, 5.6, 1, 500)   (... or photos in memory, not both)
+//   ehdr_run(h, "stack")                                  (a phase; 0 if OK, else see ehdr_error)
+//   ehdr_size(h, &w, &h); ehdr_pixels(h, out)             (the fused HDR pixels)
+//   ehdr_render(h, "fattal02", out)                       (or a tonemapped image)
+//   ehdr_free(h)
+//
+// A handle must only be used by one thread at a time; separate handles
+// can run at once.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"runtime/cgo"
+	"unsafe"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eclipse"
+)
+
+// A run is everything behind one handle.
+type run struct {
+	inputs    []string
+	photos    []eclipse.Photo
+	settings  []string
+	fi         *eclipse.FusedImage
+
+	err        *C.char // The last error, owned by the run
+}
+
+func main() {} // needed for c-shared, never called
+
+func lookup(h C.uintptr_t) *run {
+	return cgo.Handle(h).Value().(*run)
+}
+
+// fail records err as the run's last error, and returns -1.
+func (r *run)fail(err error) C.int {
+	if r.err != nil {
+		C.free(unsafe.Pointer(r.err))
+	}
+	r.err = C.CString(err.Error())
+	return -1
+}
+
+// ehdr_new returns a handle for a new run; free it with ehdr_free.
+//export ehdr_new
+func ehdr_new() C.uintptr_t {
+	return C.uintptr_t(cgo.NewHandle(&run{}))
+}
+
+//export ehdr_free
+func ehdr_free(h C.uintptr_t) {
+	if r := lookup(h); r.err != nil {
+		C.free(unsafe.Pointer(r.err))
+	}
+	cgo.Handle(h).Delete()
+}
+
+// ehdr_error returns the last error, or NULL; it belongs to the handle,
+// and lasts until the next error, or ehdr_free.
+//export ehdr_error
+func ehdr_error(h C.uintptr_t) *C.char {
+	return lookup(h).err
+}
+
+// ehdr_set adds a `key=value` config setting, as for `-set`.
+//export ehdr_set
+func ehdr_set(h C.uintptr_t, kv *C.char) {
+	r := lookup(h)
+	r.settings = append(r.settings, C.GoString(kv))
+}
+
+// ehdr_add_input adds a photo, dir or config file to load.
+//export ehdr_add_input
+func ehdr_add_input(h C.uintptr_t, path *C.char) {
+	r := lookup(h)
+	r.inputs = append(r.inputs, C.GoString(path))
+}
+
+// ehdr_add_photo adds a photo from memory: width*height pixels of
+// linear camera RGB, 16 bits per channel, interleaved (e.g. a numpy
+// uint16 array of shape (height, width, 3)). The pixels are copied, so
+// the caller can free them straight away. The exposure time is a
+// fraction of a second, e.g. 1/500.
+//export ehdr_add_photo
+func ehdr_add_photo(h C.uintptr_t, name *C.char, rgb *C.uint16_t, width, height, iso C.int, fnumber C.double, expNum, expDenom C.int64_t) C.int {
+	r := lookup(h)
+	w, ht := int(width), int(height)
+	if w <= 0 || ht <= 0 || rgb == nil {
+		return r.fail(fmt.Errorf("ehdr_add_photo: no pixels"))
+	}
+	src := unsafe.Slice((*uint16)(unsafe.Pointer(rgb)), w*ht*3)
+	img := image.NewRGBA64(image.Rect(0, 0, w, ht))
+	for i:=0; i<w*ht; i++ {
+		for c:=0; c<3; c++ {
+			img.Pix[i*8 + c*2]   = uint8(src[i*3 + c] >> 8)
+			img.Pix[i*8 + c*2+1] = uint8(src[i*3 + c])
+		}
+		img.Pix[i*8 + 6], img.Pix[i*8 + 7] = 0xff, 0xff
+	}
+	r.photos = append(r.photos, eclipse.Photo{
+		Name:         C.GoString(name),
+		Image:        img,
+		ISO:          int(iso),
+		FNumber:      float64(fnumber),
+		ExposureTime: [2]int64{int64(expNum), int64(expDenom)},
+	})
+	return 0
+}
+
+// ehdr_run runs a phase (e.g. "align", "stack", "all"); 0 if it worked.
+// Photos from ehdr_add_photo are run in memory, so there are no files
+// written (and `review` & `render` can't be run).
+//export ehdr_run
+func ehdr_run(h C.uintptr_t, phase *C.char) C.int {
+	r := lookup(h)
+	opts := []eclipse.PipelineOption{eclipse.WithSettings(r.settings...), eclipse.WithPhase(C.GoString(phase))}
+	if len(r.photos) > 0 {
+		opts = append(opts, eclipse.WithPhotos(r.photos...))
+	}
+	if len(r.inputs) > 0 {
+		opts = append(opts, eclipse.WithInputs(r.inputs...))
+	}
+	fi, err := eclipse.NewPipeline(opts...).Run(context.Background())
+	if err != nil {
+		return r.fail(err)
+	}
+	r.fi = fi
+	return 0
+}
+
+// ehdr_num_frames is how many frames were stacked, after ehdr_run.
+//export ehdr_num_frames
+func ehdr_num_frames(h C.uintptr_t) C.int {
+	if r := lookup(h); r.fi != nil {
+		return C.int(r.fi.NumFrames())
+	}
+	return 0
+}
+
+// ehdr_frame_name is the name (or filename) of frame i; frames are in
+// ascending EV, not the order they were added. Free it with free().
+//export ehdr_frame_name
+func ehdr_frame_name(h C.uintptr_t, i C.int) *C.char {
+	r := lookup(h)
+	if r.fi == nil || int(i) < 0 || int(i) >= r.fi.NumFrames() {
+		return nil
+	}
+	return C.CString(r.fi.Frame(int(i)).Filename)
+}
+
+// ehdr_alignment fills in how frame i was aligned to frame 0; its
+// translation (in pixels) and its rotation (in degrees).
+//export ehdr_alignment
+func ehdr_alignment(h C.uintptr_t, i C.int, tx, ty, rotDeg *C.double) C.int {
+	r := lookup(h)
+	if r.fi == nil || int(i) < 0 || int(i) >= r.fi.NumFrames() {
+		return r.fail(fmt.Errorf("ehdr_alignment: no frame %d", int(i)))
+	}
+	xf := r.fi.Frame(int(i)).AlignmentTransform
+	*tx, *ty, *rotDeg = C.double(xf.TranslateByX), C.double(xf.TranslateByY), C.double(xf.RotateByDeg)
+	return 0
+}
+
+// ehdr_size gives the size of the fused image.
+//export ehdr_size
+func ehdr_size(h C.uintptr_t, width, height *C.int) C.int {
+	r := lookup(h)
+	if r.fi == nil {
+		return r.fail(fmt.Errorf("ehdr_size: nothing has been run"))
+	}
+	*width, *height = C.int(r.fi.Bounds().Dx()), C.int(r.fi.Bounds().Dy())
+	return 0
+}
+
+// ehdr_pixels copies the fused HDR pixels (linear RGB, after color
+// development) into out, which must hold width*height*3 floats.
+//export ehdr_pixels
+func ehdr_pixels(h C.uintptr_t, out *C.float) C.int {
+	r := lookup(h)
+	if r.fi == nil || len(r.fi.Pixels) == 0 {
+		return r.fail(fmt.Errorf("ehdr_pixels: no fused pixels; run `stack` or later"))
+	}
+	b := r.fi.Bounds()
+	dst := unsafe.Slice((*float32)(unsafe.Pointer(out)), b.Dx()*b.Dy()*3)
+	for y:=0; y<b.Dy(); y++ {
+		for x:=0; x<b.Dx(); x++ {
+			rgb := r.fi.Pix(x, y).DevelopedRGB
+			i := (y*b.Dx() + x) * 3
+			dst[i], dst[i+1], dst[i+2] = float32(rgb.R), float32(rgb.G), float32(rgb.B)
+		}
+	}
+	return 0
+}
+
+// ehdr_render tonemaps the fused image, into out, which must hold
+// width*height*4 bytes (RGBA).
+//export ehdr_render
+func ehdr_render(h C.uintptr_t, tonemapper *C.char, out *C.uint8_t) C.int {
+	r := lookup(h)
+	if r.fi == nil {
+		return r.fail(fmt.Errorf("ehdr_render: nothing has been run"))
+	}
+	img, err := r.fi.Render(C.GoString(tonemapper))
+	if err != nil {
+		return r.fail(err)
+	}
+	b := img.Bounds()
+	rgba := &image.RGBA{
+		Pix:    unsafe.Slice((*uint8)(unsafe.Pointer(out)), b.Dx()*b.Dy()*4),
+		Stride: b.Dx()*4,
+		Rect:   image.Rectangle{Max: b.Size()},
+	}
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return 0
+}
@@ -1,19 +1,22 @@
 module github.com/abworrall/eclipse-hdr
 
-go 1.20
+go 1.21
 
 // replace github.com/abworrall/go-dng => ../go-dng
 
 require (
-	github.com/abworrall/go-dng v0.0.0-20230601173813-8760bfaafc38 // indirect
+	github.com/abworrall/go-dng v0.0.0-20230601173813-8760bfaafc38
+	github.com/fogleman/gg v1.3.0
+	github.com/mdouchement/hdr v0.2.4
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	golang.org/x/image v0.7.0
+	gonum.org/v1/gonum v0.12.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
 	github.com/codahale/hdrhistogram v0.0.0-20161010025455-3a0bb77429bd // indirect
-	github.com/fogleman/gg v1.3.0 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
-	github.com/mdouchement/hdr v0.2.4 // indirect
-	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd // indirect
 	github.com/skypies/util v0.1.31 // indirect
-	golang.org/x/image v0.7.0 // indirect
-	gonum.org/v1/gonum v0.12.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
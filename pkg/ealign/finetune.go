@@ -0,0 +1,190 @@
+package ealign
+
+import(
+	"context"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// A Search fine tunes a transform, by trying a wide range of small
+// changes to it in parallel, to find out which one fits best (i.e. has
+// the lowest error metric). It knows nothing about the frames; Score
+// does the comparing.
+type Search struct {
+	// Score returns the error metric for a candidate transform (the less
+	// similar the frames, the higher); name identifies the candidate,
+	// e.g. for debug images. It is called from several goroutines at once.
+	Score    func(xform Transform, name string) float64
+
+	Workers  int
+	Progress func(pass string, total int) Progress        // Optional
+	Debugf   func(format string, args ...interface{})     // Optional
+}
+
+// Progress hears about each candidate scored in a pass, and when the
+// pass is done.
+type Progress interface {
+	Add(n int)
+	Done()
+}
+
+func (s Search)debugf(format string, args ...interface{}) {
+	if s.Debugf != nil {
+		s.Debugf(format, args...)
+	}
+}
+
+// FineTune starts from base, which should superimpose the centres of
+// the lunar limbs, and explores translations out to radDelta pixels
+// (the difference in the radii of the limbs; they need to line up, so
+// it can't need more than that), and then rotations.
+func (s Search)FineTune(ctx context.Context, base Transform, radDelta float64) Transform {
+	if radDelta < 2.0 { radDelta = 2.0 }
+
+	// Step 0. We start with a translation that superimposes the centre of the lunarlimbs.
+	best := base
+	width, step := 0.0, 0.0
+	xforms := []Transform{}
+
+	s.debugf("Align finetune:\n")
+	s.debugf(" -- orig  : %s\n", base)
+
+	// Step 1. Try various whole-pixel translations. We pick an area to
+	// look in that's based on the difference in lunar radii in the
+	// images; more or less, these need to line up, so we don't need to
+	// explore any further.
+	width = radDelta
+	step = 1.0
+	xforms = xforms[:0]
+	for x:=-1*width; x<=width; x += step {
+		for y:=-1*width; y<=width; y += step {
+			xform := best
+			xform.TranslateByX += x
+			xform.TranslateByY += y
+			xforms = append(xforms, xform)
+		}
+	}
+	best = s.scoreConcurrently(ctx, xforms, "pass1a")
+
+	// Step 2. In a much smaller area, explore fractional pixel
+	// translations. This relies on Catmull Rom interpolation.
+	width = 2.0
+	step = 0.10
+	xforms = xforms[:0]
+	for x:=-1*width; x<=width; x += step {
+		for y:=-1*width; y<=width; y += step {
+			xform := best
+			xform.TranslateByX += x
+			xform.TranslateByY += y
+			xforms = append(xforms, xform)
+		}
+	}
+	best = s.scoreConcurrently(ctx, xforms, "pass1b")
+
+	// Step 3. Now we think we have the images centred on each other,
+	// try some coarse rotations. (This will only be useful if the
+	// images were separated by quite a lot of time)
+	rotWidth := 10.0
+	rotStep  := 1.0
+	xforms = xforms[:0]
+	for theta := -1.0*(rotWidth/2.0); theta < rotWidth/2.0; theta += rotStep {
+		xform := best
+		// Note - the rotation center is not really well defined here :/
+		xform.RotateByDeg = theta
+		xforms = append(xforms, xform)
+	}
+	best = s.scoreConcurrently(ctx, xforms, "pass2a")
+
+	// Step 4. Try a smaller amount of fine-grained rotations.
+	rotWidth = 2.0 // should be 10
+	rotStep  = 0.05
+	xforms = xforms[:0]
+	for theta := -1.0*(rotWidth/2.0); theta < rotWidth/2.0; theta += rotStep {
+		xform := best
+		// Note - the rotation center is not really well defined here
+		xform.RotateByDeg += theta
+		xforms = append(xforms, xform)
+	}
+	best = s.scoreConcurrently(ctx, xforms, "pass2b")
+
+	if best.RotateByDeg < 0.0001 { best.RotateByDeg = 0.0 }
+
+	return best
+}
+
+type fineTuneJob struct {
+	// Inputs for the job
+	Name        string
+	Index       int         // Ties go to the lowest, so the pick doesn't depend on which worker finished first
+	XForm       Transform
+
+	// Output
+	ErrorMetric float64
+}
+
+// scoreConcurrently uses a pool of goroutines to compute the error
+// metrics for each of the proposed transforms, and return the one with
+// the lowest error.
+func (s Search)scoreConcurrently(ctx context.Context, xforms []Transform, name string) Transform {
+	var wg sync.WaitGroup
+	jobsChan    := make(chan fineTuneJob, len(xforms))
+	resultsChan := make(chan fineTuneJob, len(xforms))
+
+	var progress Progress
+	if s.Progress != nil {
+		progress = s.Progress(name, len(xforms))
+	}
+
+	// Kick off worker pool
+	nWorkers := s.Workers
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	for i:=0; i<nWorkers; i++ {
+		wg.Add(1)
+
+		go func() {
+			for job := range jobsChan {
+				if ctx.Err() != nil {
+					continue // drain the rest
+				}
+				job.ErrorMetric = s.Score(job.XForm, job.Name)
+				resultsChan<- job
+				if progress != nil {
+					progress.Add(1)
+				}
+			}
+			defer wg.Done()
+		}()
+	}
+
+	// Feed in jobs
+	for i, xform := range xforms {
+		job := fineTuneJob{fmt.Sprintf("%s-%03d", name, i), i, xform, 0.0}
+		jobsChan<- job
+	}
+
+	close(jobsChan)
+	wg.Wait()
+	close(resultsChan)
+	if progress != nil {
+		progress.Done()
+	}
+
+	// results processor
+	bestResult := fineTuneJob{ErrorMetric: math.MaxFloat64}
+	for result := range resultsChan {
+		if result.ErrorMetric < bestResult.ErrorMetric ||
+			(result.ErrorMetric == bestResult.ErrorMetric && result.Index < bestResult.Index) {
+			bestResult = result
+		}
+	}
+
+	xform := bestResult.XForm
+	xform.ErrorMetric = bestResult.ErrorMetric
+
+	s.debugf(" -- %s: %s (%d tried)\n", name, xform, len(xforms))
+
+	return xform
+}
@@ -0,0 +1,82 @@
+// Package ealign aligns frames onto each other: the transforms that
+// map one onto another, warping a frame by a transform, and the search
+// for the transform that lines up two frames best.
+package ealign
+
+import(
+	"context"
+	"fmt"
+	"image"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A Transform maps a pixel location in a later layer to a pixel
+// location in the base layer, that corresponds to the same point in the
+// sky.
+//
+// If you use an equatorial mount, this is all redundant.
+type Transform struct {
+	Name            string
+
+	TranslateByX    float64
+	TranslateByY    float64
+	RotationCenterX float64
+	RotationCenterY float64
+	RotateByDeg     float64
+
+	ErrorMetric     float64
+}
+
+func (xform Transform)String() string {
+	str := fmt.Sprintf("Align[%s (%6.2f,%6.2f)", xform.Name, xform.TranslateByX, xform.TranslateByY)
+	if xform.RotateByDeg != 0.0 {
+		str += fmt.Sprintf(", %5.2fdeg", xform.RotateByDeg)
+	}
+	if xform.ErrorMetric != 0.0 {
+		str += fmt.Sprintf(", err:%6.0f", xform.ErrorMetric)
+	}
+	return str + "]"
+}
+
+func (xform Transform)XFormImage(src image.Image) image.Image {
+	return xform.Warp(context.Background(), src, 1)
+}
+
+// Warp warps the image into an eimage.Planar, with `workers` goroutines
+// (see eimage.ForTiles), so it can stop (leaving the rest black) if ctx
+// is cancelled.
+func (xform Transform)Warp(ctx context.Context, src image.Image, workers int) *eimage.Planar {
+	return xform.WarpInto(ctx, eimage.NewPlanar(src.Bounds()), src, workers)
+}
+
+// WarpInto is Warp, into dst (see eimage.Planar.WarpInto).
+func (xform Transform)WarpInto(ctx context.Context, dst *eimage.Planar, src image.Image, workers int) *eimage.Planar {
+	return xform.WarpWith(ctx, dst, src, eimage.CatmullRom, workers)
+}
+
+// WarpWith is WarpInto, sampling with the given kernel.
+func (xform Transform)WarpWith(ctx context.Context, dst *eimage.Planar, src image.Image, interp eimage.Interpolation, workers int) *eimage.Planar {
+	pl := eimage.ToPlanar(src)
+	dst = pl.WarpWith(ctx, dst, xform.ToMatrix(), interp, workers)
+	if pl != src {
+		pl.Release() // just a copy, for warping
+	}
+	return dst
+}
+
+func (at Transform)ToMatrix() emath.Aff3 {
+	// Step 1: translate so lunar limb centers are coincident
+	m := emath.Identity().Translate(at.TranslateByX, at.TranslateByY)
+
+	// [TBD] Step 2: scale (about lunar center) so that lunar radius is the same
+
+	// Step 3: rotate (about lunar center) so that coronas match
+	if at.RotateByDeg != 0 {
+		mR := emath.RotateAbout(at.RotateByDeg, at.RotationCenterX, at.RotationCenterY)
+		m = mR.Mult(m)
+	}
+
+	return m
+}
@@ -0,0 +1,166 @@
+package eastro
+
+import(
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Where the planets and the brighter stars are, for labelling them.
+// The planets come from the Keplerian elements (and rates) of Standish's
+// "Approximate Positions of the Planets" (JPL; table 1, for 1800-2050),
+// which are good to an arcminute or so; the stars are precessed from
+// J2000 (Meeus chapter 21), without nutation or aberration (both under
+// 20"). Either way, that's a small fraction of a solar radius.
+
+// planetElements are a, e, I, L, long.peri & long.node (AU & degrees),
+// each with its rate per century.
+type planetElements [6][2]float64
+
+var planets = map[string]planetElements{
+	"mercury": {{0.38709927, 0.00000037}, {0.20563593, 0.00001906}, {7.00497902, -0.00594749},
+		{252.25032350, 149472.67411175}, {77.45779628, 0.16047689}, {48.33076593, -0.12534081}},
+	"venus":   {{0.72333566, 0.00000390}, {0.00677672, -0.00004107}, {3.39467605, -0.00078890},
+		{181.97909950, 58517.81538729}, {131.60246718, 0.00268329}, {76.67984255, -0.27769418}},
+	"earth":   {{1.00000261, 0.00000562}, {0.01671123, -0.00004392}, {-0.00001531, -0.01294668},
+		{100.46457166, 35999.37244981}, {102.93768193, 0.32327364}, {0.0, 0.0}}, // the earth-moon barycenter
+	"mars":    {{1.52371034, 0.00001847}, {0.09339410, 0.00007882}, {1.84969142, -0.00813131},
+		{-4.55343205, 19140.30268499}, {-23.94362959, 0.44441088}, {49.55953891, -0.29257343}},
+	"jupiter": {{5.20288700, -0.00011607}, {0.04838624, -0.00013253}, {1.30439695, -0.00183714},
+		{34.39644051, 3034.74612775}, {14.72847983, 0.21252668}, {100.47390909, 0.20469106}},
+	"saturn":  {{9.53667594, -0.00125060}, {0.05386179, -0.00050991}, {2.48599187, 0.00193609},
+		{49.95424423, 1222.49362201}, {92.59887831, -0.41897216}, {113.66242448, -0.28867794}},
+	"uranus":  {{19.18916464, -0.00196176}, {0.04725744, -0.00004397}, {0.77263783, -0.00242939},
+		{313.23810451, 428.48202785}, {170.95427630, 0.40805281}, {74.01692503, 0.04240589}},
+	"neptune": {{30.06992276, 0.00026291}, {0.00859048, 0.00005105}, {1.77004347, 0.00035372},
+		{-55.12002969, 218.45945325}, {44.96476227, -0.32241464}, {131.78422574, -0.00508664}},
+}
+
+var planetRadiusKm = map[string]float64{
+	"mercury": 2439.7, "venus": 6051.8, "mars": 3389.5, "jupiter": 69911.0,
+	"saturn": 58232.0, "uranus": 25362.0, "neptune": 24622.0,
+}
+
+// The brightest stars (and a few that are often near the sun in an
+// eclipse), J2000 right ascension & declination, in degrees.
+var Stars = map[string][2]float64{
+	"achernar":   {24.4285, -57.2368},
+	"aldebaran":  {68.9802, 16.5093},
+	"altair":     {297.6958, 8.8683},
+	"antares":    {247.3519, -26.4320},
+	"arcturus":   {213.9153, 19.1824},
+	"betelgeuse": {88.7929, 7.4071},
+	"canopus":    {95.9880, -52.6957},
+	"capella":    {79.1723, 45.9980},
+	"castor":     {113.6495, 31.8886},
+	"deneb":      {310.3580, 45.2803},
+	"fomalhaut":  {344.4127, -29.6222},
+	"pollux":     {116.3290, 28.0262},
+	"procyon":    {114.8255, 5.2250},
+	"regulus":    {152.0930, 11.9672},
+	"rigel":      {78.6345, -8.2016},
+	"sirius":     {101.2872, -16.7161},
+	"spica":      {201.2983, -11.1613},
+	"vega":       {279.2347, 38.7837},
+}
+
+// ListBodies is the names that Body knows.
+func ListBodies() []string {
+	names := []string{}
+	for name := range planets {
+		if name != "earth" {
+			names = append(names, name)
+		}
+	}
+	for name := range Stars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Body is where the named planet or star appears, at time t (UTC),
+// from the center of the earth (parallax is well under an arcminute,
+// for all of them).
+func Body(name string, t time.Time, deltaT float64) (Position, error) {
+	name = strings.ToLower(name)
+	if coords, exists := Stars[name]; exists {
+		return Star(coords[0], coords[1], t, deltaT), nil
+	} else if _, exists := planets[name]; exists && name != "earth" {
+		return Planet(name, t, deltaT), nil
+	}
+	return Position{}, fmt.Errorf("body '%s' not known, wanted one of %v", name, ListBodies())
+}
+
+// Star is where a star at the given J2000 coords (degrees) appears, at
+// time t (UTC): its coords precessed to the date.
+func Star(ra, dec float64, t time.Time, deltaT float64) Position {
+	ra, dec = precess(ra, dec, centuries(JulianEphemerisDay(t, deltaT)))
+	return Position{RA: ra, Dec: dec}
+}
+
+// Planet is where the named planet (which has to be in `planets`)
+// appears, at time t (UTC), allowing for the light time.
+func Planet(name string, t time.Time, deltaT float64) Position {
+	T := centuries(JulianEphemerisDay(t, deltaT))
+	earth := heliocentric(planets["earth"], T)
+	var x, y, z float64
+	lightTime := 0.0 // in centuries
+	for i := 0; i < 2; i++ {
+		p := heliocentric(planets[name], T - lightTime)
+		x, y, z = p[0] - earth[0], p[1] - earth[1], p[2] - earth[2]
+		lightTime = math.Sqrt(x*x + y*y + z*z) * 499.004784 / 86400.0 / 36525.0 // 499s for light to go 1 AU
+	}
+
+	// Ecliptic to equatorial, both J2000, then onto the date
+	eps := 23.43928 * deg
+	xe, ye, ze := x, math.Cos(eps)*y - math.Sin(eps)*z, math.Sin(eps)*y + math.Cos(eps)*z
+	ra := math.Mod(math.Atan2(ye, xe) / deg + 360.0, 360.0)
+	dec := math.Atan2(ze, math.Hypot(xe, ye)) / deg
+	ra, dec = precess(ra, dec, T)
+
+	dist := math.Sqrt(x*x + y*y + z*z) * auKm
+	return Position{RA: ra, Dec: dec, Distance: dist, Semidiameter: math.Asin(planetRadiusKm[name] / dist) / deg * 3600.0}
+}
+
+// heliocentric is the planet's position (AU; J2000 ecliptic), T
+// centuries of TT from J2000.
+func heliocentric(el planetElements, T float64) [3]float64 {
+	v := [6]float64{}
+	for i := range el {
+		v[i] = el[i][0] + el[i][1]*T
+	}
+	a, e, I, L, peri, node := v[0], v[1], v[2]*deg, v[3], v[4], v[5]
+	w, M := (peri - node) * deg, math.Mod(L - peri, 360.0) * deg
+
+	E := M + e*math.Sin(M) // Kepler's equation, by Newton's method
+	for i := 0; i < 10; i++ {
+		dE := (E - e*math.Sin(E) - M) / (1 - e*math.Cos(E))
+		if E -= dE; math.Abs(dE) < 1e-12 {
+			break
+		}
+	}
+	xp, yp := a * (math.Cos(E) - e), a * math.Sqrt(1 - e*e) * math.Sin(E)
+
+	cw, sw, cn, sn, ci, si := math.Cos(w), math.Sin(w), math.Cos(node*deg), math.Sin(node*deg), math.Cos(I), math.Sin(I)
+	return [3]float64{
+		(cw*cn - sw*sn*ci)*xp + (-sw*cn - cw*sn*ci)*yp,
+		(cw*sn + sw*cn*ci)*xp + (-sw*sn + cw*cn*ci)*yp,
+		(sw*si)*xp + (cw*si)*yp,
+	}
+}
+
+// precess moves J2000 equatorial coords (degrees) onto the equator &
+// equinox T centuries later (Meeus 21.3 & 21.4).
+func precess(ra, dec, T float64) (float64, float64) {
+	zeta := (2306.2181*T + 0.30188*T*T + 0.017998*T*T*T) / 3600.0 * deg
+	z := (2306.2181*T + 1.09468*T*T + 0.018203*T*T*T) / 3600.0 * deg
+	theta := (2004.3109*T - 0.42665*T*T - 0.041833*T*T*T) / 3600.0 * deg
+	a0, d0 := ra*deg, dec*deg
+	A := math.Cos(d0) * math.Sin(a0 + zeta)
+	B := math.Cos(theta)*math.Cos(d0)*math.Cos(a0 + zeta) - math.Sin(theta)*math.Sin(d0)
+	C := math.Sin(theta)*math.Cos(d0)*math.Cos(a0 + zeta) + math.Cos(theta)*math.Sin(d0)
+	return math.Mod((math.Atan2(A, B) + z) / deg + 360.0, 360.0), math.Asin(C) / deg
+}
@@ -0,0 +1,87 @@
+package eastro
+
+import(
+	"fmt"
+	"math"
+	"time"
+)
+
+// Contacts are the times (UTC) of an eclipse's contacts, as seen by an
+// observer: first contact (C1) when the moon first touches the sun, the
+// start (C2) & end (C3) of totality, and last contact (C4). C2 & C3 are
+// zero if the eclipse isn't total from there.
+type Contacts struct {
+	C1, C2, Max, C3, C4  time.Time
+}
+
+// separation is how far (arcsec) the moon's center is from the sun's,
+// and their semidiameters.
+func separation(t time.Time, deltaT float64, obs Observer) (sep, sdSun, sdMoon float64) {
+	sun, moon := Sun(t, deltaT, obs), Moon(t, deltaT, obs)
+	east, north := Offset(sun, moon)
+	return math.Hypot(east, north), sun.Semidiameter, moon.Semidiameter
+}
+
+// EclipseContacts predicts the contacts of the eclipse nearest to t
+// (within a few hours), for the observer. It is an error if the moon
+// doesn't cover any of the sun, from there.
+func EclipseContacts(near time.Time, deltaT float64, obs Observer) (Contacts, error) {
+	sep := func(t time.Time) float64 { s, _, _ := separation(t, deltaT, obs); return s }
+
+	// Greatest eclipse: the closest approach, within a minute, then
+	// narrowed down by golden section search
+	const window = 4 * time.Hour
+	best, bestSep := near, sep(near)
+	for t := near.Add(-window); !t.After(near.Add(window)); t = t.Add(time.Minute) {
+		if s := sep(t); s < bestSep {
+			best, bestSep = t, s
+		}
+	}
+	a, b := best.Add(-time.Minute), best.Add(time.Minute)
+	const phi = 0.6180339887498949
+	for b.Sub(a) > 10*time.Millisecond {
+		span := float64(b.Sub(a))
+		x1, x2 := b.Add(-time.Duration(phi * span)), a.Add(time.Duration(phi * span))
+		if sep(x1) < sep(x2) {
+			b = x2
+		} else {
+			a = x1
+		}
+	}
+	max := a.Add(b.Sub(a) / 2)
+
+	c := Contacts{Max: max}
+	s, sdSun, sdMoon := separation(max, deltaT, obs)
+	if s >= sdSun + sdMoon {
+		return c, fmt.Errorf("no eclipse from (%.4f, %.4f) near %s: the moon passes %.0f\" from the sun",
+			obs.Latitude, obs.Longitude, near.UTC().Format(time.RFC3339), s)
+	}
+
+	// Each contact is where the separation crosses the sum (or the
+	// difference) of the radii, found by bisection either side of max
+	crossing := func(from, to time.Time, total bool) time.Time {
+		f := func(t time.Time) float64 {
+			s, sdSun, sdMoon := separation(t, deltaT, obs)
+			if total {
+				return s - (sdMoon - sdSun)
+			}
+			return s - (sdMoon + sdSun)
+		}
+		outside := f(from) > 0.0
+		for to.Sub(from) > 10*time.Millisecond || from.Sub(to) > 10*time.Millisecond {
+			mid := from.Add(to.Sub(from) / 2)
+			if (f(mid) > 0.0) == outside {
+				from = mid
+			} else {
+				to = mid
+			}
+		}
+		return from.Add(to.Sub(from) / 2).Round(100*time.Millisecond)
+	}
+	c.C1, c.C4 = crossing(max.Add(-window), max, false), crossing(max.Add(window), max, false)
+	if s < sdMoon - sdSun {
+		c.C2, c.C3 = crossing(max.Add(-time.Hour), max, true), crossing(max.Add(time.Hour), max, true)
+	}
+	c.Max = max.Round(100*time.Millisecond)
+	return c, nil
+}
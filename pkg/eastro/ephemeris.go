@@ -0,0 +1,188 @@
+// Package eastro works out where the sun and moon are in the sky, as
+// seen from a place on the earth at a given time - enough to predict
+// how the moon moves across the sun during an eclipse. It follows the
+// shorter methods in Meeus (Astronomical Algorithms, 2nd ed.): the sun
+// from chapter 25, and the moon from chapter 47. Between them, the
+// moon's position relative to the sun is good to 10-20 arcseconds (say
+// half a minute of its motion), and - as the errors change slowly -
+// much better than that from one frame to the next.
+package eastro
+
+import(
+	"math"
+	"time"
+)
+
+const(
+	earthRadiusKm  = 6378.14
+	moonRadiusKm   = 1737.4
+	sunRadiusKm    = 696000.0
+	auKm           = 149597870.7
+	deg            = math.Pi / 180.0
+)
+
+// An Observer is where on the earth the photos were taken from.
+type Observer struct {
+	Latitude   float64  // Degrees, north positive
+	Longitude  float64  // Degrees, east positive
+	Elevation  float64  // Meters above sea level
+}
+
+// A Position is where a body appears in the sky, to an observer: its
+// apparent right ascension & declination (of date), its distance, and
+// the angular radius of its disk.
+type Position struct {
+	RA            float64  // Degrees
+	Dec           float64  // Degrees
+	Distance      float64  // Kilometers
+	Semidiameter  float64  // Arcseconds
+}
+
+// JulianDay is the Julian day number of t (on whatever time scale t
+// is on; see JulianEphemerisDay for TT).
+func JulianDay(t time.Time) float64 {
+	return 2440587.5 + float64(t.UTC().UnixNano()) / 86400e9
+}
+
+// JulianEphemerisDay is JulianDay for t in UTC, moved onto TT, which
+// is ahead of UTC by deltaT seconds (about 69 in the 2020s).
+func JulianEphemerisDay(t time.Time, deltaT float64) float64 {
+	return JulianDay(t) + deltaT / 86400.0
+}
+
+// Sun is where the sun appears, at time t (UTC), to the observer.
+func Sun(t time.Time, deltaT float64, obs Observer) Position {
+	T := centuries(JulianEphemerisDay(t, deltaT))
+	L0 := 280.46646 + 36000.76983*T + 0.0003032*T*T
+	M := 357.52911 + 35999.05029*T - 0.0001537*T*T
+	e := 0.016708634 - 0.000042037*T - 0.0000001267*T*T
+	C := (1.914602 - 0.004817*T - 0.000014*T*T) * math.Sin(M*deg) +
+		(0.019993 - 0.000101*T) * math.Sin(2*M*deg) +
+		0.000289 * math.Sin(3*M*deg)
+	nu := M + C
+	R := 1.000001018 * (1 - e*e) / (1 + e*math.Cos(nu*deg))
+
+	// Apparent longitude: nutation, and 20.5" of aberration
+	lambda := L0 + C + nutationInLongitude(T) - 0.00569
+	return topocentric(t, T, lambda, 0.0, R * auKm, sunRadiusKm, obs)
+}
+
+// Moon is where the moon appears, at time t (UTC), to the observer.
+// Parallax is nearly a degree, so the observer matters a lot.
+func Moon(t time.Time, deltaT float64, obs Observer) Position {
+	T := centuries(JulianEphemerisDay(t, deltaT))
+	lambda, beta, dist := moonEcliptic(T)
+	return topocentric(t, T, lambda + nutationInLongitude(T), beta, dist, moonRadiusKm, obs)
+}
+
+// moonEcliptic is the moon's geocentric ecliptic longitude & latitude
+// (degrees, without nutation) and distance (km), at T centuries of TT
+// from J2000 (Meeus example 47.a has a check).
+func moonEcliptic(T float64) (lambda, beta, dist float64) {
+	Lp := 218.3164477 + 481267.88123421*T - 0.0015786*T*T + T*T*T/538841 - T*T*T*T/65194000
+	D := 297.8501921 + 445267.1114034*T - 0.0018819*T*T + T*T*T/545868 - T*T*T*T/113065000
+	M := 357.5291092 + 35999.0502909*T - 0.0001536*T*T + T*T*T/24490000
+	Mp := 134.9633964 + 477198.8675055*T + 0.0087414*T*T + T*T*T/69699 - T*T*T*T/14712000
+	F := 93.2720950 + 483202.0175233*T - 0.0036539*T*T - T*T*T/3526000 + T*T*T*T/863310000
+	A1 := 119.75 + 131.849*T
+	A2 := 53.09 + 479264.290*T
+	A3 := 313.45 + 481266.484*T
+	E := 1.0 - 0.002516*T - 0.0000074*T*T
+
+	// Terms in M shrink as the earth's orbit gets more circular
+	eccentricity := func(m int) float64 {
+		switch m {
+		case 1, -1: return E
+		case 2, -2: return E * E
+		}
+		return 1.0
+	}
+
+	sumL, sumR := 0.0, 0.0
+	for _, term := range moonLR {
+		arg := (float64(term.d)*D + float64(term.m)*M + float64(term.mp)*Mp + float64(term.f)*F) * deg
+		sumL += term.l * eccentricity(term.m) * math.Sin(arg)
+		sumR += term.r * eccentricity(term.m) * math.Cos(arg)
+	}
+	sumB := 0.0
+	for _, term := range moonB {
+		arg := (float64(term.d)*D + float64(term.m)*M + float64(term.mp)*Mp + float64(term.f)*F) * deg
+		sumB += term.b * eccentricity(term.m) * math.Sin(arg)
+	}
+	sumL += 3958*math.Sin(A1*deg) + 1962*math.Sin((Lp-F)*deg) + 318*math.Sin(A2*deg)
+	sumB += -2235*math.Sin(Lp*deg) + 382*math.Sin(A3*deg) + 175*math.Sin((A1-F)*deg) + 175*math.Sin((A1+F)*deg) +
+		127*math.Sin((Lp-Mp)*deg) - 115*math.Sin((Lp+Mp)*deg)
+
+	return math.Mod(Lp + sumL/1e6, 360.0), sumB/1e6, 385000.56 + sumR/1000.0
+}
+
+// Offset is where `to` is, relative to `from`, on the sky: east and
+// north, in arcseconds (a gnomonic projection, centered on `from`).
+func Offset(from, to Position) (east, north float64) {
+	a0, d0 := from.RA*deg, from.Dec*deg
+	a, d := to.RA*deg, to.Dec*deg
+	cosc := math.Sin(d0)*math.Sin(d) + math.Cos(d0)*math.Cos(d)*math.Cos(a-a0)
+	east = math.Cos(d) * math.Sin(a-a0) / cosc
+	north = (math.Cos(d0)*math.Sin(d) - math.Sin(d0)*math.Cos(d)*math.Cos(a-a0)) / cosc
+	return east / deg * 3600.0, north / deg * 3600.0
+}
+
+func centuries(jde float64) float64 { return (jde - 2451545.0) / 36525.0 }
+
+// nutationInLongitude is Δψ (degrees), from just its biggest term;
+// the sun and moon get the same, so it drops out of their separation.
+func nutationInLongitude(T float64) float64 {
+	omega := 125.04452 - 1934.136261*T
+	return -0.00478 * math.Sin(omega*deg)
+}
+
+// obliquity is the true obliquity of the ecliptic (degrees).
+func obliquity(T float64) float64 {
+	omega := 125.04452 - 1934.136261*T
+	eps0 := 23.0 + 26.0/60.0 + 21.448/3600.0 - (46.8150*T + 0.00059*T*T - 0.001813*T*T*T) / 3600.0
+	return eps0 + 0.00256*math.Cos(omega*deg)
+}
+
+// siderealTime is the apparent sidereal time at Greenwich (degrees),
+// at time t (UTC).
+func siderealTime(t time.Time, T float64) float64 {
+	jd := JulianDay(t)
+	tu := (jd - 2451545.0) / 36525.0
+	gmst := 280.46061837 + 360.98564736629*(jd - 2451545.0) + 0.000387933*tu*tu - tu*tu*tu/38710000.0
+	return gmst + nutationInLongitude(T) * math.Cos(obliquity(T)*deg)
+}
+
+// topocentric turns a geocentric ecliptic position into an apparent
+// RA & Dec for the observer, by moving the origin from the earth's
+// center to where they are.
+func topocentric(t time.Time, T, lambda, beta, dist, radius float64, obs Observer) Position {
+	eps := obliquity(T) * deg
+	l, b := lambda*deg, beta*deg
+
+	// Geocentric equatorial (of date), in km
+	x := dist * math.Cos(b) * math.Cos(l)
+	y := dist * (math.Cos(b)*math.Sin(l)*math.Cos(eps) - math.Sin(b)*math.Sin(eps))
+	z := dist * (math.Cos(b)*math.Sin(l)*math.Sin(eps) + math.Sin(b)*math.Cos(eps))
+
+	// The observer, on the flattened earth (Meeus ch. 11)
+	phi := obs.Latitude * deg
+	u := math.Atan(0.99664719 * math.Tan(phi))
+	rhoSin := 0.99664719*math.Sin(u) + obs.Elevation/6378140.0*math.Sin(phi)
+	rhoCos := math.Cos(u) + obs.Elevation/6378140.0*math.Cos(phi)
+	theta := (siderealTime(t, T) + obs.Longitude) * deg
+	x -= earthRadiusKm * rhoCos * math.Cos(theta)
+	y -= earthRadiusKm * rhoCos * math.Sin(theta)
+	z -= earthRadiusKm * rhoSin
+
+	r := math.Sqrt(x*x + y*y + z*z)
+	ra := math.Atan2(y, x) / deg
+	if ra < 0.0 {
+		ra += 360.0
+	}
+	return Position{
+		RA:           ra,
+		Dec:          math.Asin(z / r) / deg,
+		Distance:     r,
+		Semidiameter: math.Asin(radius / r) / deg * 3600.0,
+	}
+}
@@ -0,0 +1,191 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"os"
+	"sort"
+)
+
+// AnimationConfig asks for a small, looping animation of the aligned
+// frames, for sharing: how well they line up, and how the prominences
+// move. They're rendered as for the timelapse (in capture order, with
+// one tone curve from the stack), but downscaled further.
+type AnimationConfig struct {
+	Enabled      bool
+	Format       string   // "gif" (the default), or "webp" (encoded by ffmpeg, as set in Timelapse.FFmpeg)
+	FPS          float64  // Frames per second; if zero, 5
+	Width        int      // In pixels (the height follows); if zero, 480
+	Range        float64  // As for the timelapse; if zero, 12
+	Interpolate  int      // As for the timelapse
+}
+
+func (ac AnimationConfig)withDefaults() AnimationConfig {
+	if ac.Format == ""  { ac.Format = "gif" }
+	if ac.FPS    == 0.0 { ac.FPS = 5.0 }
+	if ac.Width  == 0   { ac.Width = 480 }
+	if ac.Range  == 0.0 { ac.Range = 12.0 }
+	return ac
+}
+
+func (ac AnimationConfig)filename() string { return "animation." + ac.withDefaults().Format }
+
+// writeAnimation renders the aligned frames as `animation.gif` (or
+// .webp), if the config asks for it. Like the timelapse, it comes
+// after Fuse.
+func (fi *FusedImage)writeAnimation(ctx context.Context) error {
+	cfg := fi.Config.Animation.withDefaults()
+	if !cfg.Enabled {
+		return nil
+	}
+	defer fi.measureStage(ctx, "animation")()
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+	mw := cfg.Width
+	if mw > w {
+		mw = w
+	}
+	mh := int(math.Round(float64(h) * float64(mw) / float64(w)))
+	if cfg.Format == "webp" {
+		mw, mh = mw &^ 1, mh &^ 1
+	}
+	tr, err := fi.newTimelapseRenderer(mw, mh, cfg.Range)
+	if err != nil {
+		return fmt.Errorf("animation: %v", err)
+	}
+	filename := fi.Config.OutputPath(FinalOutput, cfg.filename())
+	fi.Config.infof("Rendering %d aligned frames as a %dx%d animation, to %s\n", len(tr.order), mw, mh, filename)
+
+	if cfg.Format == "webp" {
+		ffmpeg := fi.Config.Timelapse.withDefaults().FFmpeg
+		return fi.encodeWithFFmpeg(ctx, tr, cfg.Interpolate, ffmpeg, cfg.FPS, filename, "-c:v", "libwebp", "-loop", "0", "-quality", "80")
+	}
+
+	frames := [][]byte{}
+	err = tr.each(ctx, cfg.Interpolate, "Rendering the animation", func(frame []byte) error {
+		frames = append(frames, append([]byte{}, frame...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pal := gifPalette(frames)
+	anim := &gif.GIF{LoopCount: 0}
+	delay := int(math.Round(100.0 / cfg.FPS))
+	if delay < 2 {
+		delay = 2 // browsers treat anything faster as slow
+	}
+	for _, frame := range frames {
+		rgba := image.NewRGBA(image.Rect(0, 0, mw, mh))
+		for i := 0; i < mw*mh; i++ {
+			copy(rgba.Pix[i*4:], frame[i*3:i*3+3])
+			rgba.Pix[i*4+3] = 0xFF
+		}
+		img := image.NewPaletted(rgba.Bounds(), pal)
+		draw.FloydSteinberg.Draw(img, img.Bounds(), rgba, image.Point{})
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, delay)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("animation: open+w '%s': %v", filename, err)
+	}
+	defer f.Close()
+	if err := gif.EncodeAll(f, anim); err != nil {
+		return fmt.Errorf("animation '%s': %v", filename, err)
+	}
+	return f.Close()
+}
+
+// gifPalette picks one palette for all the frames, so the colors don't
+// shift from frame to frame, by median cut: the colors (at 5 bits per
+// channel, weighted by how many pixels have them) are split, along
+// whichever channel they spread furthest over, into 256 boxes, which
+// give the palette their averages. Dithering does the rest.
+func gifPalette(frames [][]byte) color.Palette {
+	type bin struct {
+		n        int
+		c   [3]int  // the sum, of each channel
+	}
+	bins := map[int]*bin{}
+	for _, frame := range frames {
+		for i:=0; i+2<len(frame); i+=3 {
+			key := int(frame[i]>>3)<<10 | int(frame[i+1]>>3)<<5 | int(frame[i+2]>>3)
+			if bins[key] == nil {
+				bins[key] = &bin{}
+			}
+			bn := bins[key]
+			bn.n++
+			for ch := 0; ch < 3; ch++ {
+				bn.c[ch] += int(frame[i+ch])
+			}
+		}
+	}
+	keys := []int{}
+	for k := range bins {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys) // so the palette comes out the same each time
+	all := []*bin{}
+	for _, k := range keys {
+		all = append(all, bins[k])
+	}
+	mean := func(bn *bin, ch int) int { return bn.c[ch] / bn.n }
+
+	// Keep splitting the box with the widest spread, at its median
+	boxes := [][]*bin{all}
+	for len(boxes) < 256 {
+		widest, widestCh, spread := -1, 0, 0
+		for i, box := range boxes {
+			for ch := 0; ch < 3; ch++ {
+				lo, hi := 255, 0
+				for _, bn := range box {
+					if v := mean(bn, ch); v < lo { lo = v }
+					if v := mean(bn, ch); v > hi { hi = v }
+				}
+				if hi - lo > spread {
+					widest, widestCh, spread = i, ch, hi - lo
+				}
+			}
+		}
+		if widest < 0 {
+			break // every box is a single color
+		}
+		box := boxes[widest]
+		sort.SliceStable(box, func(i, j int) bool { return mean(box[i], widestCh) < mean(box[j], widestCh) })
+		total, half := 0, 0
+		for _, bn := range box {
+			total += bn.n
+		}
+		split := 1
+		for i, bn := range box[:len(box)-1] {
+			if half += bn.n; half*2 >= total {
+				split = i + 1
+				break
+			}
+		}
+		boxes[widest] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	pal := color.Palette{}
+	for _, box := range boxes {
+		n, c := 0, [3]int{}
+		for _, bn := range box {
+			n += bn.n
+			for ch := 0; ch < 3; ch++ {
+				c[ch] += bn.c[ch]
+			}
+		}
+		if n > 0 {
+			pal = append(pal, color.RGBA{uint8(c[0] / n), uint8(c[1] / n), uint8(c[2] / n), 0xFF})
+		}
+	}
+	return pal
+}
@@ -0,0 +1,147 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/fogleman/gg"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eastro"
+)
+
+// AnnotationConfig controls an annotated copy of each tonemapped
+// output, with labels, a scale bar, and details of the observation.
+type AnnotationConfig struct {
+	Enabled      bool
+	Labels     []AnnotationLabel
+	NorthAngle   float64  // Direction of celestial north, degrees counterclockwise from image up
+	ScaleBar     float64  // Length of the scale bar, in solar radii; if zero, no scale bar
+	Timestamp    string   // e.g. "2024-04-08 18:17:30 UTC"
+	Location     string   // e.g. "Mazatlán, Mexico (23.2N, 106.4W)"
+	FontFile     string   // A TTF font; if empty, use a small built-in font
+	FontSize     float64  // In points, if using FontFile; if zero, 24
+}
+
+// An AnnotationLabel marks something in the sky - a star, a planet.
+// It's placed by the ephemeris, at the base photo's capture time (on
+// UTC as in Ephemeris): a planet or bright star by name (see
+// eastro.ListBodies), or a star by its J2000 coords. Or, it's placed by
+// hand (e.g. from a plate solve), relative to the sun: a position angle
+// (degrees from north, through east), and a distance in solar radii.
+type AnnotationLabel struct {
+	Text           string
+	Body           string   // e.g. "venus" or "regulus"; Text defaults to it
+	RA             float64  // Or a star's J2000 right ascension & declination, in degrees
+	Dec            float64
+	PositionAngle  float64  // Or by hand
+	Distance       float64
+}
+
+// placeLabels fills in the position angle & distance of the labels that
+// are placed by the ephemeris. The photos are centered on the moon,
+// which is within an arcminute of the sun in totality; the plate scale
+// is Photometry.ArcsecPerPixel, or from the moon's size.
+func (fi *FusedImage)placeLabels(labels []AnnotationLabel) []AnnotationLabel {
+	ec := fi.Config.Ephemeris.withDefaults()
+	out := []AnnotationLabel{}
+	for _, l := range labels {
+		if l.Body == "" && l.RA == 0.0 && l.Dec == 0.0 {
+			out = append(out, l)
+			continue
+		}
+		if len(fi.Layers) == 0 || fi.Layers[0].CaptureTime.IsZero() {
+			fi.Config.warnf("Annotation: the base photo has no capture time, can't place '%s%s' by the ephemeris\n", l.Text, l.Body)
+			continue
+		}
+		t := ec.cameraTimeToUTC(fi.Layers[0].CaptureTime)
+		body := eastro.Star(l.RA, l.Dec, t, ec.DeltaT)
+		if l.Body != "" {
+			var err error
+			if body, err = eastro.Body(l.Body, t, ec.DeltaT); err != nil {
+				fi.Config.warnf("Annotation: %v, skipping\n", err)
+				continue
+			}
+			if l.Text == "" {
+				l.Text = strings.ToUpper(l.Body[:1]) + strings.ToLower(l.Body[1:])
+			}
+		}
+		scale := fi.Config.Photometry.ArcsecPerPixel
+		if scale == 0.0 {
+			obs := eastro.Observer{Latitude: ec.Latitude, Longitude: ec.Longitude, Elevation: ec.Elevation}
+			scale = eastro.Moon(t, ec.DeltaT, obs).Semidiameter / float64(fi.Config.LunarRadius)
+		}
+		east, north := eastro.Offset(eastro.Sun(t, ec.DeltaT, eastro.Observer{}), body)
+		l.PositionAngle = math.Mod(math.Atan2(east, north) * 180.0 / math.Pi + 360.0, 360.0)
+		l.Distance = math.Hypot(east, north) / (scale * float64(fi.Config.LunarRadius))
+		fi.Config.debugf("Annotation: %s is at PA %.1f, %.2f solar radii\n", l.Text, l.PositionAngle, l.Distance)
+		out = append(out, l)
+	}
+	return out
+}
+
+// annotate writes a copy of the tonemapped `img`, with the annotations drawn over it.
+func (fi *FusedImage)annotate(img image.Image, basename string) {
+	cfg := fi.Config.Annotation
+	dc := gg.NewContextForImage(img)
+	w, h := float64(dc.Width()), float64(dc.Height())
+
+	fontHeight := 13.0
+	if cfg.FontFile != "" {
+		if cfg.FontSize == 0.0 { cfg.FontSize = 24 }
+		if err := dc.LoadFontFace(cfg.FontFile, cfg.FontSize); err != nil {
+			fi.Config.warnf("Annotation: %v, using built-in font\n", err)
+		} else {
+			fontHeight = cfg.FontSize
+		}
+	}
+	margin := fontHeight
+
+	dc.SetRGB(1, 1, 1)
+	dc.SetLineWidth(math.Max(1.0, fontHeight / 10.0))
+
+	radius := float64(fi.Config.LunarRadius)
+	cx, cy := float64(fi.Config.LunarCenter.X), float64(fi.Config.LunarCenter.Y)
+
+	if radius > 0 {
+		for _, l := range fi.placeLabels(cfg.Labels) {
+			// Position angle runs north through east, which is counterclockwise on the sky
+			theta := (cfg.NorthAngle + l.PositionAngle) * math.Pi / 180.0
+			x := cx - math.Sin(theta) * l.Distance * radius
+			y := cy - math.Cos(theta) * l.Distance * radius
+			dc.DrawCircle(x, y, fontHeight / 2.0)
+			dc.Stroke()
+			dc.DrawString(l.Text, x + fontHeight, y + fontHeight / 3.0)
+		}
+
+		if cfg.ScaleBar > 0 {
+			barLen := cfg.ScaleBar * radius
+			y := h - margin
+			dc.DrawLine(margin, y, margin + barLen, y)
+			dc.DrawLine(margin, y - fontHeight/2, margin, y)
+			dc.DrawLine(margin + barLen, y - fontHeight/2, margin + barLen, y)
+			dc.Stroke()
+			dc.DrawString(fmt.Sprintf("%g solar radii", cfg.ScaleBar), margin, y - fontHeight)
+		}
+
+	} else if len(cfg.Labels) > 0 || cfg.ScaleBar > 0 {
+		fi.Config.warnf("Annotation: no lunar limb found, can't place labels or scale bar\n")
+	}
+
+	lines := []string{}
+	if cfg.Timestamp != "" { lines = append(lines, cfg.Timestamp) }
+	if cfg.Location != "" { lines = append(lines, cfg.Location) }
+	for i, line := range lines {
+		y := h - margin - float64(len(lines)-1-i) * fontHeight * 1.5
+		dc.DrawStringAnchored(line, w - margin, y, 1.0, 0.0)
+	}
+
+	filename := fi.Config.OutputPath(FinalOutput, fmt.Sprintf("%s-annotated.png", basename))
+	fi.Config.outputs.write(func() error {
+		if err := dc.SavePNG(filename); err != nil {
+			fi.Config.warnf("Annotation: %s: %v\n", filename, err)
+		}
+		return nil
+	})
+}
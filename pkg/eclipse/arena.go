@@ -0,0 +1,65 @@
+package eclipse
+
+import(
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// A fuseArena is where Fuse gets its buffers from: every pixel's copy
+// of each layer's value, or (if they're streamed; see memoryPlan) each
+// worker's, to reuse from one pixel to the next. Rather than millions
+// of little slices, one per pixel, they are carved out of a single
+// slab; CameraNatives have no pointers in them, so the GC doesn't need
+// to scan it, or track anything per pixel, while the pixels fuse. With
+// disk buffers, the slab is on disk.
+type fuseArena struct {
+	layers   int
+	inputs   []ecolor.CameraNative  // Every pixel's inputs, in the order of fi.Pixels; nil if streamed
+	scratch  []ecolor.CameraNative  // Each worker's inputs, if streamed
+	onDisk   bool
+}
+
+// newFuseArena makes the arena for fusing the layers over the output
+// area, with that many workers.
+func (fi *FusedImage)newFuseArena(workers int) *fuseArena {
+	a := &fuseArena{layers: len(fi.Layers)}
+	if fi.memPlan.Streamed {
+		a.scratch = make([]ecolor.CameraNative, workers * a.layers)
+		return a
+	}
+	n := len(fi.Pixels) * a.layers
+	if fi.Config.buffers != nil {
+		var err error
+		if a.inputs, err = fi.Config.diskInputs(n); err != nil {
+			fi.Config.warnf("Fuse: %v, keeping the inputs in memory\n", err)
+		}
+		a.onDisk = a.inputs != nil
+	}
+	if a.inputs == nil {
+		a.inputs = make([]ecolor.CameraNative, n)
+	}
+	return a
+}
+
+// pixelInputs are where the pixel (at that index into fi.Pixels) keeps
+// its inputs.
+func (a *fuseArena)pixelInputs(i int) []ecolor.CameraNative {
+	i *= a.layers
+	return a.inputs[i : i+a.layers : i+a.layers]
+}
+
+// workerInputs are the worker's inputs for a streamed pixel, zeroed;
+// they get reused for the worker's next pixel.
+func (a *fuseArena)workerInputs(worker int) []ecolor.CameraNative {
+	i := worker * a.layers
+	in := a.scratch[i : i+a.layers : i+a.layers]
+	for j := range in {
+		in[j] = ecolor.CameraNative{}
+	}
+	return in
+}
+
+// release drops the workers' scratch inputs, at the end of the stage;
+// the pixels' own inputs stay with the pixels.
+func (a *fuseArena)release() {
+	a.scratch = nil
+}
@@ -0,0 +1,91 @@
+package eclipse
+
+import(
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// Intermediates that outlive a run (the stage cache's entries: lunar
+// limbs, alignment transforms, and fused stacks with their clipped
+// masks) are kept on disk as artifacts. An artifact is a magic string,
+// then a header saying what it is and which version of the format it
+// was written with, then the payload; both are gobs.
+//
+// Gob matches fields by name, skipping the ones the reader doesn't
+// know and leaving zero the ones the writer didn't send. So adding a
+// field to a payload needs no version bump: older readers ignore it,
+// newer readers get zero from older files, and the caches survive
+// upgrades (and downgrades). Only a change that an older reader would
+// get wrong (a field that changes meaning or units, say) needs
+// ArtifactVersion bumped, and artifactMinReader set to match, so that
+// older readers know to pass on the file instead of misreading it;
+// files older than artifactMinReader are likewise refused.
+const ArtifactVersion = 1
+
+// artifactMinReader is the oldest ArtifactVersion that can read the
+// artifacts that this code writes, and the oldest this code can read.
+const artifactMinReader = 1
+
+var artifactMagic = []byte("eclipse-hdr artifact\n")
+
+type artifactHeader struct {
+	Kind       string // "lunarlimb", "alignment", "stack"
+	Version    int    // The ArtifactVersion it was written with
+	MinReader  int    // The oldest ArtifactVersion that can read it
+	Writer     string // The Version of eclipse-hdr that wrote it
+}
+
+// An artifactVersionError is from reading an artifact in a format this
+// code doesn't understand; the cache treats it as a miss.
+type artifactVersionError struct {
+	hdr artifactHeader
+}
+
+func (e artifactVersionError)Error() string {
+	if e.hdr.MinReader > ArtifactVersion {
+		return fmt.Sprintf("%s artifact needs eclipse-hdr to read format v%d (it was written by %s, with v%d), but this is v%d",
+			e.hdr.Kind, e.hdr.MinReader, e.hdr.Writer, e.hdr.Version, ArtifactVersion)
+	}
+	return fmt.Sprintf("%s artifact is format v%d (written by %s), older than this eclipse-hdr reads (v%d)",
+		e.hdr.Kind, e.hdr.Version, e.hdr.Writer, artifactMinReader)
+}
+
+func writeArtifact(w io.Writer, kind string, v interface{}) error {
+	if _, err := w.Write(artifactMagic); err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(w)
+	hdr := artifactHeader{Kind: kind, Version: ArtifactVersion, MinReader: artifactMinReader, Writer: Version}
+	if err := enc.Encode(hdr); err != nil {
+		return fmt.Errorf("%s artifact: %v", kind, err)
+	}
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("%s artifact: %v", kind, err)
+	}
+	return nil
+}
+
+// readArtifact reads an artifact of that kind into v (a pointer to the
+// payload type that writeArtifact was given).
+func readArtifact(r io.Reader, kind string, v interface{}) error {
+	magic := make([]byte, len(artifactMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, artifactMagic) {
+		return fmt.Errorf("not an eclipse-hdr artifact")
+	}
+	dec := gob.NewDecoder(r)
+	hdr := artifactHeader{}
+	if err := dec.Decode(&hdr); err != nil {
+		return fmt.Errorf("artifact header: %v", err)
+	}
+	if hdr.Kind != kind {
+		return fmt.Errorf("artifact is a %s, not a %s", hdr.Kind, kind)
+	} else if hdr.MinReader > ArtifactVersion || hdr.Version < artifactMinReader {
+		return artifactVersionError{hdr}
+	}
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%s artifact: %v", kind, err)
+	}
+	return nil
+}
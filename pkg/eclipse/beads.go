@@ -0,0 +1,179 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// BeadsConfig is for the `beads` phase, which shows Baily's beads coming
+// and going around the lunar limb: the frames either side of second &
+// third contact are aligned on the moon (as for stacking), and combined
+// by taking the brightest value of each pixel over the frames, as each
+// was exposed. So every bead that showed in any frame is in the result.
+type BeadsConfig struct {
+	Window    float64  // Seconds either side of C2 & C3 to take frames from; if zero, 10
+	Brighten  float64  // Stops to brighten the composite by (the beads are usually shot short); if zero, none
+}
+
+func (bc BeadsConfig)withDefaults() BeadsConfig {
+	if bc.Window == 0.0 { bc.Window = 10.0 }
+	return bc
+}
+
+// beadsGroups picks the frames (by filename) around each contact, keyed
+// by the name of the composite they go into. The contacts are as predicted (see
+// predictedContacts); without a prediction, or capture times, all the
+// frames go into one composite.
+func (fi *FusedImage)beadsGroups() (map[string][]string, error) {
+	cfg := fi.Config.Beads.withDefaults()
+	ec := fi.Config.Ephemeris.withDefaults()
+	all := map[string][]string{"beads.png": {}}
+	for _, l := range fi.Layers {
+		all["beads.png"] = append(all["beads.png"], l.Filename())
+	}
+
+	times := []time.Time{}
+	for _, l := range fi.Layers {
+		if !l.CaptureTime.IsZero() {
+			times = append(times, ec.cameraTimeToUTC(l.CaptureTime))
+		}
+	}
+	if len(times) == 0 {
+		return all, nil
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	c2, c3, from, err := fi.predictedContacts(times[len(times)/2])
+	if err != nil {
+		return nil, err
+	} else if from == "" {
+		return all, nil
+	}
+
+	window := time.Duration(cfg.Window * float64(time.Second))
+	groups := map[string][]string{}
+	for _, l := range fi.Layers {
+		if l.CaptureTime.IsZero() {
+			continue
+		}
+		t := ec.cameraTimeToUTC(l.CaptureTime)
+		for _, c := range []struct{ name string; at time.Time }{{"beads-c2.png", c2}, {"beads-c3.png", c3}} {
+			if !c.at.IsZero() && t.After(c.at.Add(-window)) && t.Before(c.at.Add(window)) {
+				groups[c.name] = append(groups[c.name], l.Filename())
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("beads: none of the photos are within %gs of C2 (%s) or C3 (%s), as predicted by the %s",
+			cfg.Window, c2.Format("15:04:05"), c3.Format("15:04:05"), from)
+	}
+	fi.Config.debugf("Beads: C2 %s, C3 %s (from the %s); frames %v\n", c2.Format("15:04:05.0"), c3.Format("15:04:05.0"), from, groups)
+	return groups, nil
+}
+
+// writeBeads aligns the frames around the contacts, and writes a max
+// combined composite for each contact.
+func (fi *FusedImage)writeBeads(ctx context.Context) error {
+	groups, err := fi.beadsGroups()
+	if err != nil {
+		return err
+	}
+	return fi.writeBeadsGroups(ctx, groups)
+}
+
+// writeBeadsGroups writes a composite of each group of frames (named
+// as for beadsGroups). The frames that aren't in any group are dropped
+// before aligning.
+func (fi *FusedImage)writeBeadsGroups(ctx context.Context, groups map[string][]string) error {
+	keep := map[string]bool{}
+	for _, group := range groups {
+		for _, name := range group {
+			keep[name] = true
+		}
+	}
+	dropped := map[int]bool{}
+	for i, l := range fi.Layers {
+		if !keep[l.Filename()] {
+			dropped[i] = true
+			fi.Config.debugf("Beads: %s isn't near a contact, leaving it out\n", l.Filename())
+		}
+	}
+	if err := fi.dropLayers(dropped); err != nil {
+		return err
+	}
+	if err := fi.withHooks(ctx, "align", fi.Align); err != nil {
+		return err
+	}
+
+	// Aligning may have dropped more (with KeepGoing), so find the frames again by name
+	index := map[string]int{}
+	for i, l := range fi.Layers {
+		index[l.Filename()] = i
+	}
+	for _, name := range sortedNames(groups) {
+		frames := []int{}
+		for _, frame := range groups[name] {
+			if j, ok := index[frame]; ok {
+				frames = append(frames, j)
+			}
+		}
+		if len(frames) == 0 {
+			fi.Config.warnf("Beads: none of the frames for %s could be aligned\n", name)
+			continue
+		}
+		if err := fi.writeBeadsComposite(ctx, frames, fi.Config.OutputPath(FinalOutput, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBeadsComposite max combines the (aligned) frames, each developed
+// at its own exposure, so none of them outshines the rest, into a PNG.
+func (fi *FusedImage)writeBeadsComposite(ctx context.Context, frames []int, filename string) error {
+	defer fi.measureStage(ctx, "beads")()
+	cfg := fi.Config.Beads.withDefaults()
+	develop, err := fi.Config.pixelDeveloper()
+	if err != nil {
+		return err
+	}
+	gain := math.Pow(2.0, cfg.Brighten)
+	cs := fi.Config.ColorSpace
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+	out := image.NewRGBA64(image.Rect(0, 0, w, h))
+	progress := fi.Config.newProgress("Combining beads, for " + filepath.Base(filename), h)
+	err = eimage.ParallelFor(ctx, fi.workers("beads"), h, func(_, y int) {
+		for x:=0; x<w; x++ {
+			max := hdrcolor.RGB{}
+			for _, i := range frames {
+				fv := frameView{fi, i, 0.0, false} // at its own exposure; clipped pixels are as bright as they get
+				rgb, _ := fv.at(x, y)
+				p := Pixel{Fused: ecolor.CameraNative{RGB: rgb, IllumAtMax: fi.Layers[i].IlluminanceAtMaxExposure}}
+				develop(&p)
+				max.R, max.G, max.B = math.Max(max.R, p.DevelopedRGB.R), math.Max(max.G, p.DevelopedRGB.G), math.Max(max.B, p.DevelopedRGB.B)
+			}
+			to16 := func(v float64) uint16 { return uint16(math.Round(cs.Encode(math.Max(0.0, math.Min(1.0, v * gain))) * 0xFFFF)) }
+			out.SetRGBA64(x, y, color.RGBA64{to16(max.R), to16(max.G), to16(max.B), 0xFFFF})
+		}
+		progress.Add(1)
+	})
+	progress.Done()
+	if err != nil {
+		return err
+	}
+	if err := fi.Config.writePNG(out, filename); err != nil {
+		return fmt.Errorf("beads: %v", err)
+	}
+	fi.Config.infof("Combined %d frames around the contact into %s\n", len(frames), filename)
+	return nil
+}
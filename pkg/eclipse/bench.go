@@ -0,0 +1,113 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// A Benchmark times the main stages of the pipeline on some real
+// photos - decoding, lunar limb detection, alignment (which warps each
+// frame onto the base frame) and stacking - and reports how long each
+// took, and its throughput. Nothing is written out, and the stage cache
+// isn't used, so the numbers can be compared across machines, thread
+// counts and settings.
+type Benchmark struct {
+	Args      []string          // Photos (and conf.yaml files), as for a normal run
+	Base      Config            // Config to start from; any conf.yaml is loaded on top
+	Overrides []string          // `key=value` config settings, applied after any conf.yaml
+	Configure func(*Config)     // If set, called after loading; e.g. to apply command line flags
+}
+
+func NewBenchmark(base Config, args ...string) *Benchmark {
+	return &Benchmark{Args: args, Base: base}
+}
+
+type benchStage struct {
+	name     string
+	elapsed  time.Duration
+	frames   int
+	pixels   int  // How many pixels the stage worked through
+}
+
+// Run runs the stages, and returns the report (or ctx.Err(), if it is
+// cancelled).
+func (b *Benchmark)Run(ctx context.Context) (string, error) {
+	fi := NewFusedImage()
+	fi.Config = b.Base
+	fi.Overrides = b.Overrides
+	stages := []benchStage{}
+
+	start := time.Now()
+	if err := fi.LoadFilesAndDirs(ctx, b.Args...); err != nil {
+		return "", err
+	}
+	if b.Configure != nil {
+		b.Configure(&fi.Config)
+	}
+	if len(fi.Layers) == 0 {
+		return "", fmt.Errorf("bench: no photos were loaded")
+	}
+	inputPixels := 0
+	for _, l := range fi.Layers {
+		inputPixels += l.Dims.X * l.Dims.Y
+	}
+	stages = append(stages, benchStage{"decode", time.Since(start), len(fi.Layers), inputPixels})
+
+	// Make sure everything gets computed from scratch
+	fi.Config.CacheDir = ""
+	fi.Config.LunarLimbs = map[string]LunarLimb{}
+	fi.Config.Alignments = map[string]AlignmentTransform{}
+
+	if fi.Config.DoEclipseAlignment {
+		start = time.Now()
+		if err := fi.DetectLunarLimbs(ctx); err != nil {
+			return "", err
+		}
+		stages = append(stages, benchStage{"detect", time.Since(start), len(fi.Layers), inputPixels})
+	}
+
+	start = time.Now()
+	if err := fi.Align(ctx); err != nil { // reuses the limbs we just found
+		return "", err
+	}
+	stages = append(stages, benchStage{"align+warp", time.Since(start), len(fi.Layers)-1, inputPixels - fi.Layers[0].Dims.X * fi.Layers[0].Dims.Y})
+
+	start = time.Now()
+	if err := fi.Fuse(ctx); err != nil {
+		return "", err
+	}
+	stages = append(stages, benchStage{"stack", time.Since(start), len(fi.Layers), len(fi.Pixels) * len(fi.Layers)})
+
+	return b.report(fi, stages), nil
+}
+
+func (b *Benchmark)report(fi FusedImage, stages []benchStage) string {
+	si := softwareInfo()
+	lines := []string{
+		fmt.Sprintf("eclipse-hdr %s, %s, %s", si.Version, si.GoVersion, si.Platform),
+		fmt.Sprintf("%d CPUs, %d worker threads; GPU %s", runtime.NumCPU(), fi.Config.NumThreads(), fi.Config.gpu().Name()),
+		fmt.Sprintf("%d frames of %dx%d, output %dx%d; fuser %s, developer %s, finetune %v",
+			len(fi.Layers), fi.Layers[0].Dims.X, fi.Layers[0].Dims.Y, fi.OutputArea.Dx(), fi.OutputArea.Dy(),
+			fi.Config.Fuser, fi.Config.Developer, fi.Config.DoFineTunedAlignment),
+		"",
+		fmt.Sprintf("%-12s %10s %12s %12s", "stage", "time", "frames/s", "Mpixels/s"),
+	}
+
+	total := time.Duration(0)
+	for _, s := range stages {
+		secs := s.elapsed.Seconds()
+		if secs == 0 {
+			secs = 1e-9
+		}
+		lines = append(lines, fmt.Sprintf("%-12s %10s %12.2f %12.1f", s.name, s.elapsed.Round(time.Millisecond),
+			float64(s.frames) / secs, float64(s.pixels) / 1e6 / secs))
+		fi.Config.logEvent("bench", "stage", s.name, "seconds", s.elapsed.Seconds(), "frames", s.frames, "pixels", s.pixels)
+		total += s.elapsed
+	}
+	lines = append(lines, fmt.Sprintf("%-12s %10s", "total", total.Round(time.Millisecond)))
+
+	return strings.Join(lines, "\n") + "\n"
+}
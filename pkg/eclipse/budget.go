@@ -0,0 +1,144 @@
+package eclipse
+
+import(
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// A memoryPlan is how a run stays under Config.MaxMemory: fewer
+// workers for the stages that need a lot of scratch memory each, and
+// fusing without keeping every pixel's inputs around.
+type memoryPlan struct {
+	Workers   map[string]int  // Max workers for a stage, if the budget needs fewer than NumThreads
+	Streamed  bool            // Fuse drops each pixel's inputs once it's fused (except DebugPixels)
+}
+
+// planMemory works out, from estimateMemory, how to run a phase within
+// the memory budget. If it can't fit even with one worker, it says so
+// up front, rather than running out of memory halfway through.
+func (fi *FusedImage)planMemory(phase string) (memoryPlan, error) {
+	plan := memoryPlan{Workers: map[string]int{}, Streamed: fi.Config.Preview > 1} // a preview has no use for the inputs
+	if fi.Config.MaxMemory == "" {
+		return plan, nil
+	}
+	budget, err := parseBytes(fi.Config.MaxMemory)
+	if err != nil {
+		return plan, fmt.Errorf("maxmemory: %v", err)
+	}
+
+	fits := func(stage string, need, perWorker uint64) error {
+		if need + perWorker > budget {
+			return fmt.Errorf("%s: needs at least %s, over the maxmemory budget of %s", stage,
+				formatBytes(need + perWorker), formatBytes(budget))
+		}
+		if perWorker == 0 {
+			return nil
+		}
+		if w := int((budget - need) / perWorker); w < fi.Config.NumThreads() {
+			plan.Workers[stage] = w
+		}
+		return nil
+	}
+
+	if len(fi.Layers) == 0 {
+		return plan, fits(phase, fi.estimateMemory(phase), 0)
+	}
+
+	// Limb detection flood fills each frame; the seen map costs a few
+	// bytes for each pixel of the moon, so allow a few per pixel.
+	n := uint64(fi.Layers[0].Dims.X * fi.Layers[0].Dims.Y)
+	if phase == "partials" || phase == "montage" {
+		// Each fit has a gray copy of its photo, and a mask around the sun
+		return plan, fits("partials", fi.estimateMemory(phase), n*3)
+	} else if phase == "lightcurve" {
+		return plan, fits(phase, fi.estimateMemory(phase), 0) // just a sum per photo
+	} else if phase == "mosaic" {
+		// Each photo's half size copy (a float64 per pixel), as it's made
+		return plan, fits(phase, fi.estimateMemory(phase), n*2)
+	}
+	if err := fits("detect", fi.estimateMemory("detect"), n*4); err != nil {
+		return plan, err
+	}
+	if phase == "detect" {
+		return plan, nil
+	}
+
+	// Fine tuning scores each candidate by warping a whole frame (an
+	// eimage.Planar), and diffing it over the input area.
+	scratch := uint64(0)
+	if fi.Config.DoFineTunedAlignment {
+		area := n
+		if a := fi.Config.InputArea; !a.Empty() {
+			area = uint64(a.Dx() * a.Dy())
+		}
+		scratch = n*12 + area*8
+	}
+	if err := fits("align", fi.estimateMemory("align"), scratch); err != nil {
+		return plan, err
+	}
+	if phase == "align" || phase == "review" || phase == "beads" {
+		return plan, nil
+	}
+
+	need := fi.estimateMemory(phase)
+	if plan.Streamed || need > budget {
+		plan.Streamed = true
+		need -= fi.fusedInputsMemory()
+	}
+	return plan, fits("fuse", need, 0)
+}
+
+// lines describes the plan, one change per line, e.g. for the logs.
+func (plan memoryPlan)lines() []string {
+	lines := []string{}
+	for _, stage := range sortedNames(plan.Workers) {
+		lines = append(lines, fmt.Sprintf("Memory budget: %s with %d workers", stage, plan.Workers[stage]))
+	}
+	if plan.Streamed {
+		lines = append(lines, "Memory budget: fuse won't keep each pixel's inputs")
+	}
+	return lines
+}
+
+// fusedInputsMemory is the part of estimateMemory taken up by the
+// fused pixels' copies of every layer's value.
+func (fi *FusedImage)fusedInputsMemory() uint64 {
+	if len(fi.Layers) == 0 || fi.Config.Work.Buffers == "disk" {
+		return 0
+	}
+	out := fi.estimatedOutputArea()
+	return uint64(out.Dx() * out.Dy()) * uint64(len(fi.Layers)) * uint64(unsafe.Sizeof(ecolor.CameraNative{}))
+}
+
+// workers is how many worker goroutines a stage should use; NumThreads,
+// unless the memory plan says fewer.
+func (fi *FusedImage)workers(stage string) int {
+	if w, exists := fi.memPlan.Workers[stage]; exists && w < fi.Config.NumThreads() {
+		return w
+	}
+	return fi.Config.NumThreads()
+}
+
+// parseBytes parses a size like "512MB", "8GB" or "1.5G" (powers of
+// 1024, as formatBytes prints them); a plain number is bytes.
+func parseBytes(s string) (uint64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	mult := uint64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(str, unit + "B") || strings.HasSuffix(str, unit) {
+			str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), unit)
+			mult = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	str = strings.TrimSpace(strings.TrimSuffix(str, "B"))
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("'%s' is not a size, e.g. 8GB", s)
+	}
+	return uint64(f * float64(mult)), nil
+}
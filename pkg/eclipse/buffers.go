@@ -0,0 +1,87 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// startBuffers sets up the run's disk buffers, if `work.buffers: disk`;
+// they go in the scratch dir (see WorkConfig).
+func (fi *FusedImage)startBuffers() error {
+	if fi.Config.Work.Buffers != "disk" {
+		return nil
+	} else if !eimage.DiskBuffersSupported() {
+		return fmt.Errorf("work.buffers: disk isn't supported on %s", runtime.GOOS)
+	}
+	dir, err := fi.workDir()
+	if err != nil {
+		return err
+	}
+	fi.Config.buffers = &eimage.DiskBuffers{Dir: dir}
+	return nil
+}
+
+// releaseBuffers unmaps the disk buffers at the end of the run. The
+// aligned frames go back to being the loaded photos, and the pixels
+// lose their inputs, rather than being left pointing at nothing.
+func (fi *FusedImage)releaseBuffers() {
+	db := fi.Config.buffers
+	if db == nil {
+		return
+	}
+	fi.Config.debugf("Disk buffers: %s\n", formatBytes(db.Size()))
+	for i := range fi.Layers {
+		if p, ok := fi.Layers[i].Image.(*eimage.Planar); ok && p.OnDisk() {
+			p.Release()
+			fi.Layers[i].Image = fi.Layers[i].LoadedImage
+		}
+	}
+	if fi.inputsOnDisk {
+		for i := range fi.Pixels {
+			fi.Pixels[i].In = nil
+		}
+		fi.inputsOnDisk = false
+	}
+	if err := db.Close(); err != nil {
+		fi.Config.warnf("%v\n", err)
+	}
+	fi.Config.buffers = nil
+}
+
+// warpLayer makes the layer's aligned frame, on disk if the config has
+// disk buffers (and there's room); else in memory. The GPU warps it, if
+// there is one, except for previews.
+func (c Config)warpLayer(ctx context.Context, l *Layer) {
+	var dst *eimage.Planar
+	if c.buffers != nil {
+		var err error
+		if dst, err = c.buffers.NewPlanar(l.LoadedImage.Bounds()); err != nil {
+			c.warnf("%s: %v, keeping it in memory\n", l.Filename(), err)
+		}
+	}
+	if dst == nil {
+		dst = eimage.NewPlanar(l.LoadedImage.Bounds())
+	}
+	if c.Preview > 1 {
+		l.Image = l.AlignmentTransform.WarpWith(ctx, dst, l.LoadedImage, eimage.Bilinear, c.NumThreads())
+		return
+	} else if c.gpu().Warp(dst, l.LoadedImage, l.AlignmentTransform.ToMatrix()) {
+		l.Image = dst
+		return
+	}
+	l.Image = l.AlignmentTransform.WarpInto(ctx, dst, l.LoadedImage, c.NumThreads())
+}
+
+// diskInputs is room for n inputs, in the disk buffers.
+func (c Config)diskInputs(n int) ([]ecolor.CameraNative, error) {
+	b, err := c.buffers.Bytes(n * int(unsafe.Sizeof(ecolor.CameraNative{})))
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return unsafe.Slice((*ecolor.CameraNative)(unsafe.Pointer(unsafe.SliceData(b))), n), nil
+}
@@ -0,0 +1,298 @@
+package eclipse
+
+import(
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// The stage cache lets a run skip the stages whose inputs haven't
+// changed since an earlier run: lunar limb detection and alignment
+// (per photo), and fusion (for the whole stack). Each result is stored
+// under a hash of everything that went into it - the contents of the
+// photos, and the config values that the stage looks at - so it is
+// only reused when recomputing would give the same answer. Tuning the
+// later stages (enhance, tonemap) then starts from the cached stack.
+//
+// Entries are artifacts (see artifact.go), so a cache made by one
+// version of eclipse-hdr can be used by the next. The cache is only
+// used if Config.CacheDir is set.
+type stageCache struct {
+	dir         string
+	index       *photoIndex // Has the photos' hashes, so each is only hashed once
+	cfg         Config      // The run's, for its messages; see stageCache()
+}
+
+// stageCache returns the cache, or nil if caching is off.
+func (fi *FusedImage)stageCache() *stageCache {
+	if fi.Config.CacheDir == "" {
+		return nil
+	}
+	if fi.cache == nil || fi.cache.dir != fi.Config.CacheDir {
+		fi.cache = &stageCache{dir: fi.Config.CacheDir, index: fi.photoIndex()}
+	}
+	fi.cache.cfg = fi.Config // so its messages are tagged with the stage that is asking
+	return fi.cache
+}
+
+// fileHash is the sha256 of the file's contents.
+func (sc *stageCache)fileHash(filename string) (string, error) {
+	h, err := sc.index.hash(filename)
+	if err != nil {
+		return "", fmt.Errorf("cache: %v", err)
+	}
+	return h, nil
+}
+
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("hashing %s: %v", filename, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// key hashes the stage name and all the parts (via yaml, which sorts
+// map keys, so is stable).
+func (sc *stageCache)key(stage string, parts ...interface{}) (string, error) {
+	hasher := sha256.New()
+	hasher.Write([]byte(stage))
+	for _, part := range parts {
+		b, err := yaml.Marshal(part)
+		if err != nil {
+			return "", fmt.Errorf("cache key for %s: %v", stage, err)
+		}
+		hasher.Write(b)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (sc *stageCache)path(stage, key, ext string) string {
+	return filepath.Join(sc.dir, stage, key + ext)
+}
+
+// get loads a small cached result (limbs, alignments) into v.
+func (sc *stageCache)get(stage, key string, v interface{}) bool {
+	f, err := os.Open(sc.path(stage, key, ".art"))
+	if os.IsNotExist(err) {
+		return sc.getLegacy(stage, key, v)
+	} else if err != nil {
+		return false
+	}
+	defer f.Close()
+	return sc.decode(stage, key, readArtifact(f, stage, v))
+}
+
+// getLegacy reads the yaml entries that the cache had before it used
+// artifacts; new entries replace them.
+func (sc *stageCache)getLegacy(stage, key string, v interface{}) bool {
+	b, err := ioutil.ReadFile(sc.path(stage, key, ".yaml"))
+	if err != nil {
+		return false
+	}
+	if err := yaml.Unmarshal(b, v); err != nil {
+		sc.cfg.warnf("Cache: ignoring bad entry %s/%s: %v\n", stage, key, err)
+		return false
+	}
+	return true
+}
+
+// decode reports whether an entry was read; if it was in a format this
+// version can't read, it is redone (and replaced) without fuss.
+func (sc *stageCache)decode(stage, key string, err error) bool {
+	if _, isVersion := err.(artifactVersionError); isVersion {
+		sc.cfg.debugf("Cache: not using %s/%s: %v\n", stage, key, err)
+		return false
+	} else if err != nil {
+		sc.cfg.warnf("Cache: ignoring bad entry %s/%s: %v\n", stage, key, err)
+		return false
+	}
+	return true
+}
+
+func (sc *stageCache)put(stage, key string, v interface{}) {
+	err := sc.write(sc.path(stage, key, ".art"), func(w io.Writer) error { return writeArtifact(w, stage, v) })
+	if err != nil {
+		sc.cfg.warnf("Cache: %v\n", err)
+	}
+}
+
+// write writes the file via a temp file, so a crash can't leave a
+// half-written entry behind.
+func (sc *stageCache)write(filename string, fn func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// limbKey is the key for the lunar limb of a photo.
+func (sc *stageCache)limbKey(cfg Config, l *Layer) (string, error) {
+	h, err := sc.fileHash(l.LoadFilename)
+	if err != nil {
+		return "", err
+	}
+	return sc.key("lunarlimb", h, cfg.LimbDetector)
+}
+
+// alignKey is the key for aligning l2 onto l1. Without fine tuning,
+// AlignLayer takes any transform the config has for the pair, so that's
+// in the key too; editing it by hand then misses the cache.
+func (sc *stageCache)alignKey(cfg Config, l1, l2 *Layer) (string, error) {
+	h1, err := sc.fileHash(l1.LoadFilename)
+	if err != nil {
+		return "", err
+	}
+	h2, err := sc.fileHash(l2.LoadFilename)
+	if err != nil {
+		return "", err
+	}
+	var fromConfig *AlignmentTransform
+	if xf, exists := cfg.Alignments[alignmentName(l1, l2)]; exists && !cfg.DoFineTunedAlignment {
+		fromConfig = &xf
+	}
+	return sc.key("alignment", h1, h2, l1.LunarLimb, l2.LunarLimb, cfg.DoFineTunedAlignment, cfg.InputArea, fromConfig)
+}
+
+// stackInputs is everything that Fuse() looks at.
+type stackInputs struct {
+	Photos          []string
+	Alignments      []AlignmentTransform
+	LayerOverrides  []ImageOverride
+	InputArea       image.Rectangle
+	PhotoArea       image.Rectangle
+	OutputArea      image.Rectangle
+	LunarCenter     image.Point
+	LunarRadius     int
+
+	Monochrome      bool
+	Fuser           string
+	Developer       string
+	FuserLuminance  float64
+	ClipLevel       float64
+	BlackPoint      emath.Vec3
+	WhitePoint      emath.Vec3
+	ChannelMixer    ChannelMixerConfig
+	WhiteBalance    WhiteBalanceConfig
+	CameraWhite     emath.Vec3
+	CameraToPCS     emath.Mat3
+	OutputColorSpace string
+	ExactExposures  bool  `yaml:",omitempty"`
+}
+
+func (sc *stageCache)stackKey(fi *FusedImage) (string, error) {
+	c := fi.Config
+	in := stackInputs{
+		LayerOverrides: c.LayerOverrides, InputArea: c.InputArea, PhotoArea: c.PhotoArea, OutputArea: c.OutputArea,
+		LunarCenter: c.LunarCenter, LunarRadius: c.LunarRadius,
+		Monochrome: c.Monochrome, Fuser: c.Fuser, Developer: c.Developer, FuserLuminance: c.FuserLuminance,
+		ClipLevel: c.ClipLevel, BlackPoint: c.BlackPoint, WhitePoint: c.WhitePoint, ChannelMixer: c.ChannelMixer,
+		WhiteBalance: c.WhiteBalance, CameraWhite: c.CameraWhite, CameraToPCS: c.CameraToPCS,
+		OutputColorSpace: c.OutputColorSpace, ExactExposures: c.Radiance.ExactExposures,
+	}
+	for _, l := range fi.Layers {
+		h, err := sc.fileHash(l.LoadFilename)
+		if err != nil {
+			return "", err
+		}
+		in.Photos = append(in.Photos, h)
+		in.Alignments = append(in.Alignments, l.AlignmentTransform)
+	}
+	return sc.key("stack", in)
+}
+
+// cachedStack is the output of Fuse(): the developed pixels, and the
+// config values that it works out. Like the other payloads, fields can
+// be added to it freely, but changing what one means needs a new
+// artifact version (see artifact.go).
+type cachedStack struct {
+	Width, Height   int
+	RGB             []float64 // Developed RGB, three values per pixel, in Pixels order
+	Clipped         []bool
+
+	IllumAtMax      float64
+	CameraWhite     emath.Vec3
+	CameraToPCS     emath.Mat3
+}
+
+func (sc *stageCache)putStack(key string, fi *FusedImage) {
+	cs := cachedStack{
+		Width: fi.OutputArea.Dx(), Height: fi.OutputArea.Dy(),
+		RGB: make([]float64, 3*len(fi.Pixels)), Clipped: make([]bool, len(fi.Pixels)),
+		IllumAtMax: fi.Config.IllumAtMax, CameraWhite: fi.Config.CameraWhite, CameraToPCS: fi.Config.CameraToPCS,
+	}
+	for i, p := range fi.Pixels {
+		cs.RGB[3*i], cs.RGB[3*i+1], cs.RGB[3*i+2] = p.DevelopedRGB.R, p.DevelopedRGB.G, p.DevelopedRGB.B
+		cs.Clipped[i] = p.Clipped
+	}
+	err := sc.write(sc.path("stack", key, ".art"), func(w io.Writer) error { return writeArtifact(w, "stack", cs) })
+	if err != nil {
+		fi.Config.warnf("Cache: %v\n", err)
+	}
+}
+
+func (sc *stageCache)getStack(key string, fi *FusedImage) bool {
+	cs := cachedStack{}
+	if f, err := os.Open(sc.path("stack", key, ".art")); err == nil {
+		err = readArtifact(f, "stack", &cs)
+		f.Close()
+		if !sc.decode("stack", key, err) {
+			return false
+		}
+	} else if f, err := os.Open(sc.path("stack", key, ".gob")); err == nil {
+		// From before the cache used artifacts
+		err = gob.NewDecoder(f).Decode(&cs)
+		f.Close()
+		if !sc.decode("stack", key, err) {
+			return false
+		}
+	} else {
+		return false
+	}
+	if cs.Width != fi.OutputArea.Dx() || cs.Height != fi.OutputArea.Dy() || len(cs.Clipped) != cs.Width*cs.Height {
+		return false
+	}
+
+	fi.Pixels = make([]Pixel, len(cs.Clipped))
+	for x:=0; x<cs.Width; x++ {
+		for y:=0; y<cs.Height; y++ {
+			p := fi.PixRW(x, y)
+			i := x*cs.Height + y
+			p.OutputPos = image.Point{x, y}
+			p.DevelopedRGB = hdrcolor.RGB{R: cs.RGB[3*i], G: cs.RGB[3*i+1], B: cs.RGB[3*i+2]}
+			p.Clipped = cs.Clipped[i]
+		}
+	}
+	fi.Config.IllumAtMax = cs.IllumAtMax
+	fi.Config.CameraWhite = cs.CameraWhite
+	fi.Config.CameraToPCS = cs.CameraToPCS
+	return true
+}
@@ -0,0 +1,48 @@
+package eclipse
+
+import(
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// An alignment edited by hand in the config has to beat one that an
+// earlier run cached for the same pair of photos.
+func TestAlignKeyConfigTransform(t *testing.T) {
+	dir := t.TempDir()
+	l1, l2 := Layer{LoadFilename: filepath.Join(dir, "a.tif")}, Layer{LoadFilename: filepath.Join(dir, "b.tif")}
+	for _, l := range []Layer{l1, l2} {
+		if err := ioutil.WriteFile(l.LoadFilename, []byte(l.LoadFilename), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := &stageCache{dir: filepath.Join(dir, "cache"), index: newPhotoIndex()}
+	cfg := Config{Alignments: map[string]AlignmentTransform{}}
+	name := alignmentName(&l1, &l2)
+	cfg.Alignments[name] = AlignmentTransform{Name: name, TranslateByX: 1}
+
+	key, err := sc.alignKey(cfg, &l1, &l2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.put("alignment", key, cfg.Alignments[name])
+
+	cfg.Alignments[name] = AlignmentTransform{Name: name, TranslateByX: 2}
+	edited, err := sc.alignKey(cfg, &l1, &l2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xform AlignmentTransform
+	if sc.get("alignment", edited, &xform) {
+		t.Errorf("edited transform got the cached one, %s", xform)
+	}
+
+	// Fine tuning ignores the config, so editing it shouldn't matter
+	cfg.DoFineTunedAlignment = true
+	k1, _ := sc.alignKey(cfg, &l1, &l2)
+	cfg.Alignments[name] = AlignmentTransform{Name: name, TranslateByX: 3}
+	if k2, _ := sc.alignKey(cfg, &l1, &l2); k1 != k2 {
+		t.Errorf("fine tuned key changed with the config transform")
+	}
+}
@@ -0,0 +1,341 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// CamerasConfig merges the sequences from two or more cameras (or
+// telescopes, at different focal lengths) into one stack. The photos
+// are told apart by camera (see ImageOverride.Camera); the camera of
+// the base photo is the base camera, and the photos from each of the
+// others are resampled onto it, before they're aligned: scaled so the
+// moon is the same size, rotated so the corona lines up, and with their
+// exposures cross-calibrated, so the corona is as bright in both. A
+// mirrored camera (e.g. behind a star diagonal) isn't handled.
+type CamerasConfig struct {
+	Merge      bool
+	Solutions  map[string]CameraSolution `yaml:",omitempty"` // By camera; those given aren't solved for (e.g. from an earlier run's cameras.yaml)
+}
+
+// A CameraSolution maps the photos from one camera onto the base
+// camera's.
+type CameraSolution struct {
+	Scale      float64  // The base camera's lunar radius, over this one's
+	RotateDeg  float64  // As for AlignmentTransform.RotateByDeg
+	Gain       float64  // Multiplies the photos' IlluminanceAtMaxExposure, so the corona is as bright as in the base camera's
+	Pairs      int      `yaml:",omitempty"` // How many pairs of photos the gain came from; zero if it was given
+}
+
+// cameraOf is the camera the layer came from: as in its ImageOverride,
+// else its EXIF model.
+func (fi *FusedImage)cameraOf(l Layer) string {
+	if camera := fi.Config.Images[l.Filename()].Camera; camera != "" {
+		return camera
+	} else if l.CameraModel != "" {
+		return l.CameraModel
+	}
+	return "(unknown camera)"
+}
+
+// limbGroup is what a layer's lunar limb is compared against, in
+// checkLunarLimbs: the other photos from its camera, if they're being
+// merged (as the moon is a different size in each).
+func (fi *FusedImage)limbGroup(l Layer) string {
+	if !fi.Config.Cameras.Merge {
+		return ""
+	}
+	return fi.cameraOf(l)
+}
+
+// A cameraMap is how a merged layer was resampled; the lunar limb
+// detected in the photo is mapped by it, each time, as Config.LunarLimbs
+// keeps the limbs as found in the photos.
+type cameraMap struct {
+	m      emath.Aff3
+	scale  float64
+}
+
+func (cm cameraMap)limb(ll LunarLimb) LunarLimb {
+	c := ll.Center()
+	cx, cy := cm.m.Apply(float64(c.X), float64(c.Y))
+	hw, hh := float64(ll.Bounds.Dx()) * cm.scale / 2.0, float64(ll.Bounds.Dy()) * cm.scale / 2.0
+	ll.Bounds = image.Rect(int(math.Round(cx - hw)), int(math.Round(cy - hh)), int(math.Round(cx + hw)), int(math.Round(cy + hh)))
+	lx, ly := cm.m.Apply(float64(ll.LuminalCenter.X), float64(ll.LuminalCenter.Y))
+	ll.LuminalCenter = image.Point{int(math.Round(lx)), int(math.Round(ly))}
+	return ll
+}
+
+// mergeCameras resamples the photos from the other cameras onto the
+// base camera's, once their lunar limbs are known (see Align), and
+// writes the solutions to `cameras.yaml`, in the reports dir, which
+// can go into the config as they are. Photos merged by an earlier call
+// just have their limbs mapped again.
+func (fi *FusedImage)mergeCameras(ctx context.Context) error {
+	if !fi.Config.Cameras.Merge || len(fi.Layers) < 2 {
+		return nil
+	}
+	base := fi.cameraOf(fi.Layers[0])
+	byCamera, todo := map[string][]int{}, map[string]bool{}
+	for i := range fi.Layers {
+		l := &fi.Layers[i]
+		if l.cameraMap != nil {
+			l.LunarLimb = l.cameraMap.limb(l.LunarLimb)
+			continue
+		}
+		camera := fi.cameraOf(*l)
+		byCamera[camera] = append(byCamera[camera], i)
+		if camera != base {
+			todo[camera] = true
+		}
+	}
+	if len(todo) == 0 {
+		if len(byCamera) == 1 {
+			fi.Config.debugf("Cameras: all the photos are from %s, so there's nothing to merge\n", base)
+		}
+		return nil
+	}
+	defer fi.measureStage(ctx, "cameras")()
+
+	profiles := make([]coronaProfile, len(fi.Layers))
+	progress := fi.Config.newProgress("Profiling the corona, per camera", len(fi.Layers))
+	err := eimage.ParallelFor(ctx, fi.workers("cameras"), len(fi.Layers), func(_, i int) {
+		defer progress.Add(1)
+		if fi.Layers[i].cameraMap == nil {
+			profiles[i] = coronaProfileOf(fi.Layers[i])
+		}
+	})
+	progress.Done()
+	if err != nil {
+		return err
+	}
+
+	to, bounds := fi.Layers[0].LunarLimb.Center(), fi.Layers[0].LoadedImage.Bounds()
+	solutions := map[string]CameraSolution{}
+	for _, camera := range sortedNames(todo) {
+		sol, given := fi.Config.Cameras.Solutions[camera]
+		if !given {
+			if sol, err = fi.solveCamera(byCamera[base], byCamera[camera], profiles); err != nil {
+				return fmt.Errorf("cameras: %s: %v", camera, err)
+			}
+		}
+		fi.Config.infof("Cameras: merging %d photos from %s onto %s: scale %.4f, rotate %.2fdeg, gain %.3f\n",
+			len(byCamera[camera]), camera, base, sol.Scale, sol.RotateDeg, sol.Gain)
+		for _, i := range byCamera[camera] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			fi.mergeLayer(ctx, &fi.Layers[i], to, bounds, sol)
+		}
+		solutions[camera] = sol
+	}
+
+	b, err := yaml.Marshal(struct{ Cameras CamerasConfig }{CamerasConfig{Merge: true, Solutions: solutions}})
+	if err != nil {
+		return fmt.Errorf("cameras: %v", err)
+	}
+	filename := fi.Config.OutputPath(ReportOutput, "cameras.yaml")
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write cameras '%s': %v", filename, err)
+	}
+	return nil
+}
+
+// mergeLayer resamples the photo into bounds with its moon centered on
+// `to`, scaled and rotated about it, and scales its exposure by the gain.
+func (fi *FusedImage)mergeLayer(ctx context.Context, l *Layer, to image.Point, bounds image.Rectangle, sol CameraSolution) {
+	c := l.LunarLimb.Center()
+	m := emath.Identity().Translate(float64(to.X), float64(to.Y)).Rotate(sol.RotateDeg).Scale(sol.Scale).Translate(-float64(c.X), -float64(c.Y))
+	src := eimage.ToPlanar(l.LoadedImage)
+	dst := src.WarpWith(ctx, eimage.NewPlanar(bounds), m, eimage.CatmullRom, fi.Config.NumThreads())
+	if src != l.LoadedImage {
+		src.Release() // just a copy, for warping
+	}
+	l.LoadedImage, l.Image, l.Dims = dst, dst, bounds.Size()
+	l.IlluminanceAtMaxExposure *= sol.Gain
+	l.cameraMap = &cameraMap{m: m, scale: sol.Scale}
+	l.LunarLimb = l.cameraMap.limb(l.LunarLimb)
+	fi.Config.debugf("Cameras: resampled %s, lunar limb now %s\n", l.Filename(), l.LunarLimb.Bounds)
+}
+
+// solveCamera finds how the other camera's photos map onto the base
+// camera's. The scale is the ratio of the median lunar radii. The
+// rotation lines up the corona's profile (around the limb) in the pair
+// of photos, one from each camera, that have the most of it unclipped;
+// then the gain is the median difference between the profiles, over
+// every pair that has enough of it in common.
+func (fi *FusedImage)solveCamera(base, other []int, profiles []coronaProfile) (CameraSolution, error) {
+	radii := func(frames []int) float64 {
+		rs := []float64{}
+		for _, i := range frames {
+			rs = append(rs, float64(fi.Layers[i].LunarLimb.Radius()))
+		}
+		return medianOf(rs)
+	}
+	sol := CameraSolution{Scale: radii(base) / radii(other)}
+	if math.IsInf(sol.Scale, 0) || math.IsNaN(sol.Scale) || sol.Scale <= 0.0 {
+		return sol, fmt.Errorf("no lunar radius to scale by")
+	}
+
+	bestA, bestB, bestN, bestDt := -1, -1, 0, math.Inf(1)
+	for _, a := range base {
+		for _, b := range other {
+			n := sharedBins(profiles[a], profiles[b])
+			dt := math.Abs(fi.Layers[a].CaptureTime.Sub(fi.Layers[b].CaptureTime).Seconds())
+			if n > bestN || (n == bestN && dt < bestDt) {
+				bestA, bestB, bestN, bestDt = a, b, n, dt
+			}
+		}
+	}
+	if bestN < coronaMinBins {
+		return sol, fmt.Errorf("no pair of photos has enough unclipped corona in common to line up")
+	}
+	shift, deg := profiles[bestA].rotationTo(profiles[bestB])
+	sol.RotateDeg = deg
+	fi.Config.debugf("Cameras: rotation from %s & %s (%d degrees of corona): %.2fdeg\n",
+		fi.Layers[bestA].Filename(), fi.Layers[bestB].Filename(), bestN, deg)
+
+	gains := []float64{}
+	for _, a := range base {
+		for _, b := range other {
+			if g, n := profiles[a].gainTo(profiles[b], shift); n >= coronaMinBins {
+				gains = append(gains, g)
+			}
+		}
+	}
+	sol.Gain, sol.Pairs = medianOf(gains), len(gains)
+	return sol, nil
+}
+
+// A coronaProfile samples the corona's brightness (its log, in lux, as
+// for IlluminanceAtMaxExposure) by position angle, a degree at a time,
+// at coronaRadii steps from 1.15 to 1.8 lunar radii out; only where
+// it's neither clipped nor lost in the noise. Photos are compared
+// sample by sample, as the clipping leaves different radii in each.
+type coronaProfile struct {
+	logLux  [360][coronaRadii]float64
+	valid   [360][coronaRadii]bool
+}
+
+const(
+	coronaRadii   = 14  // 1.15, 1.2 ... 1.8
+	coronaMinBins = 60  // How many degrees of profile two photos must have in common to be compared
+)
+
+func coronaProfileOf(l Layer) coronaProfile {
+	cp := coronaProfile{}
+	c, r := l.LunarLimb.Center(), float64(l.LunarLimb.Radius())
+	b := l.LoadedImage.Bounds()
+	for deg := 0; deg < 360; deg++ {
+		a := float64(deg) * math.Pi / 180.0
+		for k := 0; k < coronaRadii; k++ {
+			d := (1.15 + 0.05*float64(k)) * r
+			p := image.Point{int(math.Round(float64(c.X) + d*math.Cos(a))), int(math.Round(float64(c.Y) + d*math.Sin(a)))}
+			if !p.In(b) {
+				continue
+			}
+			rr, gg, bb := eimage.PixelRGB(l.LoadedImage, p.X, p.Y)
+			if v := (rr + gg + bb) / 3.0; v > 0.02 && v < 0.9 {
+				cp.logLux[deg][k], cp.valid[deg][k] = math.Log(v * l.IlluminanceAtMaxExposure), true
+			}
+		}
+	}
+	return cp
+}
+
+// sharedBins is how many degrees of profile two photos could have in
+// common, whatever the rotation between them: the fewer of the two.
+func sharedBins(a, b coronaProfile) int {
+	na, nb := 0, 0
+	for j := 0; j < 360; j++ {
+		for k := 0; k < coronaRadii; k++ {
+			if a.valid[j][k] { na++; break }
+		}
+		for k := 0; k < coronaRadii; k++ {
+			if b.valid[j][k] { nb++; break }
+		}
+	}
+	if nb < na {
+		return nb
+	}
+	return na
+}
+
+// common is how a's and b's samples compare with b turned by the shift,
+// in whole degrees: for each angle where they have samples in common,
+// the mean of each one's, and all the differences between them.
+func (a coronaProfile)common(b coronaProfile, shift int) (xs, ys, diffs []float64) {
+	for j := 0; j < 360; j++ {
+		ja := (j + shift) % 360
+		x, y, n := 0.0, 0.0, 0
+		for k := 0; k < coronaRadii; k++ {
+			if a.valid[ja][k] && b.valid[j][k] {
+				x, y, n = x + a.logLux[ja][k], y + b.logLux[j][k], n + 1
+				diffs = append(diffs, a.logLux[ja][k] - b.logLux[j][k])
+			}
+		}
+		if n > 0 {
+			xs, ys = append(xs, x / float64(n)), append(ys, y / float64(n))
+		}
+	}
+	return xs, ys, diffs
+}
+
+// rotationTo finds the rotation that takes b's profile onto a's (so a
+// feature at angle x in b is at x+deg in a), by the best normalized
+// correlation over whole degrees, refined by fitting a parabola to
+// the peak.
+func (a coronaProfile)rotationTo(b coronaProfile) (int, float64) {
+	corr := make([]float64, 360)
+	for k := 0; k < 360; k++ {
+		corr[k] = math.Inf(-1)
+		xs, ys, _ := a.common(b, k)
+		if len(xs) < coronaMinBins {
+			continue
+		}
+		mx, my := 0.0, 0.0
+		for i := range xs {
+			mx, my = mx + xs[i], my + ys[i]
+		}
+		mx, my = mx / float64(len(xs)), my / float64(len(ys))
+		sxy, sxx, syy := 0.0, 0.0, 0.0
+		for i := range xs {
+			dx, dy := xs[i] - mx, ys[i] - my
+			sxy, sxx, syy = sxy + dx*dy, sxx + dx*dx, syy + dy*dy
+		}
+		if sxx > 0.0 && syy > 0.0 {
+			corr[k] = sxy / math.Sqrt(sxx * syy)
+		}
+	}
+	best := 0
+	for k := range corr {
+		if corr[k] > corr[best] {
+			best = k
+		}
+	}
+	deg := float64(best)
+	lo, hi := corr[(best + 359) % 360], corr[(best + 1) % 360]
+	if d := lo - 2.0*corr[best] + hi; !math.IsInf(lo, 0) && !math.IsInf(hi, 0) && d < 0.0 {
+		deg += 0.5 * (lo - hi) / d
+	}
+	if deg > 180.0 {
+		deg -= 360.0
+	}
+	return best, deg
+}
+
+// gainTo is how much brighter a's profile is than b's (with b turned by
+// the shift from rotationTo), by the median over the samples they have
+// in common; and over how many degrees of profile.
+func (a coronaProfile)gainTo(b coronaProfile, shift int) (float64, int) {
+	xs, _, diffs := a.common(b, shift)
+	return math.Exp(medianOf(diffs)), len(xs)
+}
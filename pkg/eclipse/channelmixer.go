@@ -0,0 +1,34 @@
+package eclipse
+
+import(
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eenhance"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// ChannelMixerConfig blends the RGB channels through a 3x3 matrix;
+// each output channel is a weighted sum of the input channels (row
+// major, so the first row gives the new red). In "camera" space it is
+// applied to the camera native inputs before fusion, which is where
+// you'd fix e.g. IR leaking into the red channel of a modified camera.
+// In "output" space it is an enhancement stage on the developed image.
+type ChannelMixerConfig struct {
+	Space   string      // "camera", or "output" (the default)
+	Matrix  emath.Mat3  // If all zeros, the mixer is off
+}
+
+func (cm ChannelMixerConfig)Enabled() bool { return cm.Matrix != (emath.Mat3{}) }
+
+func (cm ChannelMixerConfig)InCameraSpace() bool { return cm.Enabled() && cm.Space == "camera" }
+
+func (cm ChannelMixerConfig)mix(c hdrcolor.RGB) hdrcolor.RGB {
+	return eenhance.ChannelMixer(cm.Matrix).Adjust(c, 0)
+}
+
+// MixChannels runs the channel mixer over the developed image.
+func (fi *FusedImage)MixChannels() {
+	cm := fi.Config.ChannelMixer
+	fi.Config.infof("ChannelMixer: applying %s\n", cm.Matrix)
+	fi.adjustPixels(eenhance.ChannelMixer(cm.Matrix))
+}
@@ -0,0 +1,289 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// The classes of frame, for the `auto` phase.
+const(
+	ClassPartial     = "partial"
+	ClassDiamondRing = "diamondring"
+	ClassTotality    = "totality"
+)
+
+// ClassifyConfig tunes how the `auto` phase sorts the photos. A photo
+// is of a partial phase if it was taken through a filter, or if the
+// moon doesn't have light all the way round it (the edge of the moon
+// that's off the sun has dark sky beyond it); otherwise it's of
+// totality if it's within Threshold magnitudes of the faintest photo
+// that isn't clipped (by its brightness, as for the light curve), and
+// of the diamond ring (or Baily's beads) if it's brighter than that.
+type ClassifyConfig struct {
+	Threshold  float64  // In magnitudes; if zero, as for Contacts.Threshold (2.5)
+	Surround   float64  // How much of the lunar limb must have light beyond it, [0,1]; if zero, 0.8
+}
+
+func (cc ClassifyConfig)withDefaults(contacts ContactsConfig) ClassifyConfig {
+	if cc.Threshold == 0.0 { cc.Threshold = contacts.withDefaults().Threshold }
+	if cc.Surround  == 0.0 { cc.Surround = 0.8 }
+	return cc
+}
+
+// A FrameClass is how a photo was classified, and why. They go into
+// `classification.yaml`, in the reports dir.
+type FrameClass struct {
+	Filename     string
+	CaptureTime  time.Time  `yaml:",omitempty"`
+	Class        string
+	Magnitude    float64    // Above the faintest (unclipped) photo, so zero or more
+	Surround     float64    // How much of the lunar limb has light beyond it; zero if no limb was found
+	Reason       string
+}
+
+// ClassifyFrames sorts the photos into partial phases, diamond ring and
+// totality, from their integrated brightness (see LightCurve) and the
+// geometry around their lunar limb. They come back in time order.
+func (fi *FusedImage)ClassifyFrames(ctx context.Context) ([]FrameClass, error) {
+	cfg := fi.Config.Classify.withDefaults(fi.Config.Contacts)
+	points, err := fi.LightCurve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	surround, err := fi.limbSurrounds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The long exposures of totality are clipped, which makes them look
+	// fainter than they are; so the reference is the faintest of those
+	// that aren't, if there are any.
+	faintest, unclipped := math.Inf(1), math.Inf(1)
+	for _, p := range points {
+		if p.Brightness > 0.0 {
+			faintest = math.Min(faintest, p.Brightness)
+			if p.Clipped <= 0.01 {
+				unclipped = math.Min(unclipped, p.Brightness)
+			}
+		}
+	}
+	if !math.IsInf(unclipped, 1) {
+		faintest = unclipped
+	}
+	classes := []FrameClass{}
+	for _, p := range points {
+		fc := FrameClass{Filename: p.Filename, CaptureTime: p.CaptureTime, Surround: surround[p.Filename]}
+		if p.Brightness > 0.0 {
+			fc.Magnitude = math.Max(0.0, 2.5 * math.Log10(p.Brightness / faintest))
+		}
+		switch {
+		case p.Filter > 0.0:
+			fc.Class, fc.Reason = ClassPartial, fmt.Sprintf("taken through a filter (density %g)", p.Filter)
+		case fc.Surround < cfg.Surround:
+			fc.Class, fc.Reason = ClassPartial, fmt.Sprintf("light beyond only %.0f%% of the lunar limb", 100.0 * fc.Surround)
+		case fc.Magnitude < cfg.Threshold:
+			fc.Class, fc.Reason = ClassTotality, fmt.Sprintf("within %.1f mag of the faintest unclipped photo", cfg.Threshold)
+		default:
+			fc.Class, fc.Reason = ClassDiamondRing, fmt.Sprintf("%.1f mag brighter than the faintest unclipped photo", fc.Magnitude)
+		}
+		fi.Config.debugf("Frame %s: %s, %s\n", fc.Filename, fc.Class, fc.Reason)
+		classes = append(classes, fc)
+	}
+	return classes, nil
+}
+
+// limbSurrounds finds the lunar limb in each photo (or takes it from
+// the config), and how much of it has light just beyond it: the share
+// of the directions around it where the sky at 1.08 radii is several
+// times brighter than the middle of the moon's disk. In totality the
+// corona goes all the way round; in a partial phase, only the edge
+// that's over the sun is lit. Photos without a limb get zero.
+func (fi *FusedImage)limbSurrounds(ctx context.Context) (map[string]float64, error) {
+	defer fi.measureStage(ctx, "classify")()
+	detect, err := fi.Config.GetLimbDetector()
+	if err != nil {
+		return nil, err
+	}
+	cfg := fi.Config
+	cfg.Threads = 1
+	surround := make([]float64, len(fi.Layers))
+	progress := fi.Config.newProgress("Classifying photos", len(fi.Layers))
+	err = eimage.ParallelFor(ctx, fi.workers("classify"), len(fi.Layers), func(_, i int) {
+		defer progress.Add(1)
+		l := fi.Layers[i]
+		ll, exists := fi.Config.LunarLimbs[l.Filename()]
+		if !exists {
+			var err error
+			if ll, err = detect(ctx, cfg, l.LoadedImage); err != nil {
+				fi.Config.debugf("Classify: no lunar limb in %s: %v\n", l.Filename(), err)
+				return
+			}
+		}
+		surround[i] = limbSurround(l.LoadedImage, ll)
+	})
+	progress.Done()
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]float64{}
+	for i, l := range fi.Layers {
+		m[l.Filename()] = surround[i]
+	}
+	return m, nil
+}
+
+func limbSurround(img image.Image, ll LunarLimb) float64 {
+	c, r := ll.Center(), float64(ll.Radius())
+	b := img.Bounds()
+	gray := func(x, y float64) (float64, bool) {
+		px, py := int(math.Round(x)), int(math.Round(y))
+		if px < b.Min.X || py < b.Min.Y || px >= b.Max.X || py >= b.Max.Y {
+			return 0.0, false
+		}
+		rr, gg, bb := eimage.PixelRGB(img, px, py)
+		return (rr + gg + bb) / 3.0, true
+	}
+
+	// The middle of the disk: the median, over a grid within half a radius
+	inside := []float64{}
+	for dy := -0.5; dy <= 0.5; dy += 0.05 {
+		for dx := -0.5; dx <= 0.5; dx += 0.05 {
+			if v, ok := gray(float64(c.X) + dx*r, float64(c.Y) + dy*r); ok && dx*dx + dy*dy <= 0.25 {
+				inside = append(inside, v)
+			}
+		}
+	}
+	if len(inside) == 0 {
+		return 0.0
+	}
+	sort.Float64s(inside)
+	dark := math.Max(inside[len(inside)/2], 0.0005)
+
+	lit, seen := 0, 0
+	for deg := 0; deg < 360; deg++ {
+		a := float64(deg) * math.Pi / 180.0
+		v, ok := gray(float64(c.X) + 1.08*r*math.Cos(a), float64(c.Y) + 1.08*r*math.Sin(a))
+		if !ok {
+			continue // off the edge of the photo
+		}
+		seen++
+		if v > 4.0 * dark {
+			lit++
+		}
+	}
+	if seen == 0 {
+		return 0.0
+	}
+	return float64(lit) / float64(seen)
+}
+
+// runAuto classifies the photos, and sends each class through the
+// phase that's for it: the diamond ring frames to `beads` (split into
+// C2 & C3 by whether they came before or after totality), totality to
+// `all`, and the partial phases to `partials` (and to the montage, if
+// montage.totality is set).
+func (fi *FusedImage)runAuto(ctx context.Context) error {
+	classes, err := fi.ClassifyFrames(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(struct{ Frames []FrameClass }{classes})
+	if err != nil {
+		return fmt.Errorf("classify: %v", err)
+	}
+	filename := fi.Config.OutputPath(ReportOutput, "classification.yaml")
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write classification '%s': %v", filename, err)
+	}
+
+	byClass := map[string][]string{}
+	for _, fc := range classes {
+		byClass[fc.Class] = append(byClass[fc.Class], fc.Filename)
+	}
+	fi.Config.infof("Classified %d photos: %d partial, %d diamond ring, %d totality; wrote %s\n", len(classes),
+		len(byClass[ClassPartial]), len(byClass[ClassDiamondRing]), len(byClass[ClassTotality]), filename)
+
+	// Totality before the partials, so the montage can have this run's composite in the middle
+	if names := byClass[ClassDiamondRing]; len(names) > 0 {
+		groups := beadsAroundTotality(classes)
+		if err := fi.withLayers(names, func() error { return fi.writeBeadsGroups(ctx, groups) }); err != nil {
+			return err
+		}
+	}
+	if names := byClass[ClassTotality]; len(names) > 0 {
+		if err := fi.withLayers(names, func() error { return fi.runPhase(ctx, "all") }); err != nil {
+			return err
+		}
+	} else {
+		fi.Config.warnf("Classify: none of the photos are of totality, so there's nothing to stack\n")
+	}
+	if names := byClass[ClassPartial]; len(names) > 0 {
+		return fi.withLayers(names, func() error {
+			if err := fi.writePartials(ctx); err != nil {
+				return err
+			}
+			if fi.Config.Montage.Totality != "" {
+				return fi.writeMontage(ctx)
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// beadsAroundTotality splits the diamond ring frames (named, as for
+// beadsGroups) into those before totality (C2), and after (C3); if
+// there's no telling, they all go together.
+func beadsAroundTotality(classes []FrameClass) map[string][]string {
+	var first, last time.Time
+	for _, fc := range classes {
+		if fc.Class == ClassTotality && !fc.CaptureTime.IsZero() {
+			if first.IsZero() || fc.CaptureTime.Before(first) { first = fc.CaptureTime }
+			if last.IsZero() || fc.CaptureTime.After(last) { last = fc.CaptureTime }
+		}
+	}
+	groups := map[string][]string{}
+	for _, fc := range classes {
+		if fc.Class != ClassDiamondRing {
+			continue
+		}
+		name := "beads.png"
+		switch {
+		case first.IsZero() || fc.CaptureTime.IsZero():
+		case fc.CaptureTime.Before(first): name = "beads-c2.png"
+		case fc.CaptureTime.After(last):   name = "beads-c3.png"
+		}
+		groups[name] = append(groups[name], fc.Filename)
+	}
+	return groups
+}
+
+// withLayers runs fn with just the named layers, and then puts the rest
+// back (with their aligned copies released).
+func (fi *FusedImage)withLayers(names []string, fn func() error) error {
+	all, want := fi.Layers, map[string]bool{}
+	for _, name := range names {
+		want[name] = true
+	}
+	fi.Layers = nil
+	for _, l := range all {
+		if want[l.Filename()] {
+			fi.Layers = append(fi.Layers, l)
+		}
+	}
+	fi.setLayerOverrides()
+	err := fn()
+	fi.releaseLayers()
+	fi.Layers = all
+	fi.setLayerOverrides()
+	return err
+}
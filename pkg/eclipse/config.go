@@ -1,76 +1,296 @@
 package eclipse
 
 import(
+	"fmt"
 	"image"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"gopkg.in/yaml.v2"
 
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/elimb"
 	"github.com/abworrall/eclipse-hdr/pkg/emath"
+	"github.com/abworrall/eclipse-hdr/pkg/estack"
 )
 
 type Config struct {
+	ConfigVersion               int          // The format of the file; see CurrentConfigVersion
+	Include                   []string       `yaml:",omitempty"` // Config files that this one builds on, see loadConfig
 	Verbosity                   int
+	Threads                     int          // Max worker goroutines; if zero, GOMAXPROCS (normally one per CPU)
+	MaxMemory                   string       // Rough cap on memory use, e.g. "8GB"; stages use fewer workers (or less memory) to fit. If empty, no cap
+	Deterministic               bool         // Same inputs & config give bit-identical outputs; see README
+	Preview                     int          // If > 1, a quick look at the photos shrunk by this much, for trying settings out; see withPreview
+	GPU                         bool         // Warp, denoise & fine-tune on the GPU, if this build has one (see egpu) and there is one
+	KeepGoing                   bool         // If a frame fails (can't load, no lunar limb, bad alignment), drop it and carry on
+	LimbRadiusTolerance         float64      // A lunar limb radius this far (as a fraction) from the median is suspect, e.g. the flood fill leaked into a dim corona
+	AlignmentErrorTolerance     float64      // A fine-tuned alignment whose error is this many times the median is suspect
+	Monochrome                  bool         // Mono camera; skips all color handling
 	
 	ManualOverrideAsShotNeutral emath.Vec3   // A white/neutral color in camera native RGB space
 	ManualOverrideForwardMatrix emath.Mat3   // Maps white-balanced camera native RGB into XYZ(D50).
+	CameraModel                 string       // Look up this camera's color data, instead of using the EXIF `Model`
+	CameraProfiles              map[string]ecolor.CameraProfile // Extra cameras, for the color data lookup
+	WhiteBalance                WhiteBalanceConfig
+	OutputColorSpace            string       // What DevelopByDNG develops into; "" means sRGB, see ecolor.OutputColorSpaces
 
 	DoEclipseAlignment          bool
 	DoFineTunedAlignment        bool
 	OutputWidthInSolarDiameters float64
+	Framing                     FramingConfig
+	Renditions                []RenditionConfig  // Extra resized copies of the tonemapped outputs
+	Output                      OutputConfig // Where the output files go
+	CacheDir                    string       // Cache stage results here, to skip them next time if nothing changed; if empty, no cache
+	Work                        WorkConfig   // Where scratch files go, and when they are cleaned up
+	LUTFile                     string       // A `.cube` 3D LUT, applied to the tonemapped outputs as a final look
 
 	Fuser                       string
 	Developer                   string
+	LimbDetector                string
 	Tonemapper                  string
 	FuserLuminance              float64  // a var used by the fuser
+	ClipLevel                   float64  // a camera native channel value at/above this (0.0->1.0) is clipped
+	BlackPoint                  emath.Vec3  // Per-channel camera native black level (0.0->1.0), subtracted before fusing
+	WhitePoint                  emath.Vec3  // Per-channel camera native white level (0.0->1.0); zero means 1.0
+	ChannelMixer                ChannelMixerConfig
 
 	Alignments                  map[string]AlignmentTransform
+	LunarLimbs                  map[string]LunarLimb  // Keyed by filename; from `eclipse-hdr detect`, or earlier runs
+	Images                      map[string]ImageOverride  // Keyed by filename; per-photo tweaks
+	Select                    []string       // Only use photos that match all of these, e.g. `iso <= 800`; see select.go
+
+	// Optional post-fusion stages, see Enhance()
+	SkyGradient                 SkyGradientConfig
+	Inpaint                     InpaintConfig
+	CoronaWhiteBalance          CoronaWhiteBalanceConfig
+	Denoise                     DenoiseConfig
+	RadialSaturation            RadialProfile    // Saturation multiplier vs. distance from the sun
+	HSL                         []HSLAdjustment  // Hue/saturation/lightness tweaks, by hue range
+	SyntheticMoon               SyntheticMoonConfig
+	Isophotes                   IsophotesConfig
+	CoronaProfile               CoronaProfileConfig
+	Annotation                  AnnotationConfig
+	Stars                       StarsConfig
+	Photometry                  PhotometryConfig
+	Streamers                   StreamersConfig
+	Polarization                PolarizationConfig
+	Radiance                    RadianceConfig
+	Ephemeris                   EphemerisConfig
+	Scoring                     ScoringConfig
+	Earthshine                  EarthshineConfig
+	Contacts                    ContactsConfig
+	Cube                        CubeConfig
+	Cameras                     CamerasConfig    // Merging photos from more than one camera
+	AlignmentSmoothing          AlignmentSmoothingConfig
+	Timelapse                   TimelapseConfig
+	Animation                   AnimationConfig
+	Montage                     MontageConfig    // For the montage phase
+	Mosaic                      MosaicConfig     // For the mosaic phase
+	Beads                       BeadsConfig      // For the beads phase
+	Classify                    ClassifyConfig   // For the auto phase
+	Pipeline                  []PipelineStep   // If set, exactly which of the stages above run, and in what order
+	Hooks                     []Hook           // External commands to run before/after stages; see hooks.go
+	Extensions                  map[string]interface{} `yaml:",omitempty"` // Settings for registered stages etc, keyed by name; see registry.go
 
 	// Values we figure out elsewhere, and put here for access by rest of app
 	CameraWhite                 emath.Vec3       // From a DNG file Layer{}, or overrides
 	CameraToPCS                 emath.Mat3       // From a DNG file Layer{}, or overrides
+	ColorSpace                  ecolor.OutputColorSpace `yaml:"-"` // Looked up from OutputColorSpace
 	InputArea                   image.Rectangle
+	PhotoArea                   image.Rectangle  // The part of InputArea from the photos; the rest is framing padding, and stays black
 	OutputArea                  image.Rectangle
+	LunarCenter                 image.Point      // Center of the lunar limb in the base layer, in output coords
+	LunarRadius                 int              // Radius of the lunar limb in the base layer, in pixels
+	IllumAtMax                  float64          // Fuse() adjusts every pixel to this common illuminance
+	LayerOverrides            []ImageOverride  `yaml:"-"` // Images, in layer order
+
+	DebugSink                   DebugSink        `yaml:"-"` // Where debug images go; if nil, they aren't drawn
+	limbComposite              *elimb.Composite             // For the DebugSink, while DetectLunarLimbs runs
+	outputs                    *outputQueue                 // Writes the PNGs in the background, during a phase; see writingOutputs
+	buffers                    *eimage.DiskBuffers          // For the run in progress, with `work.buffers: disk`
+	DebugPixels               []image.Point    `yaml:"-"` // Output pixels to dump in detail, at trace level
+	Progress                    Progress         `yaml:"-"` // Hears how the slow stages are going; if nil, the terminal does (if there is one, and no Logger)
+	Metrics                     MetricsExporter  `yaml:"-"` // Gets each stage's timing & memory metrics, if set
+	Logger                     *slog.Logger      `yaml:"-"` // Gets the run's messages & events; if nil, see SetDefaultLogger
+	logAttrs                    logAttrs                     // The stage & frame that messages are about; see forStage
+}
+
+// newConfigFromYaml parses strictly, so that typos in key names (and
+// values of the wrong type) are errors, rather than silently ignored.
+// Anything not in the yaml keeps its value from `base`. It doesn't
+// Validate, as the yaml might only be one layer of the config (an
+// include, or an override); that waits until they're all applied.
+func newConfigFromYaml(b []byte, base Config) (Config, error) {
+	c := base
+
+	// Strict parsing complains if the yaml sets a map key that is
+	// already there, so parse into empty maps, and merge afterwards.
+	c.CameraProfiles, c.Alignments, c.LunarLimbs, c.Images, c.Extensions = nil, nil, nil, nil, nil
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return c, err
+	}
+
+	// An entry that was already there only gets the fields that the
+	// yaml sets, so e.g. `-set images."a.dng".threshold=0.5` keeps its
+	// `ev` from conf.yaml.
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return c, err
+	}
+	var err error
+	if c.CameraProfiles, err = mergeEntries(base.CameraProfiles, c.CameraProfiles, raw["cameraprofiles"]); err != nil {
+		return c, fmt.Errorf("cameraprofiles: %v", err)
+	}
+	if c.Alignments, err = mergeEntries(base.Alignments, c.Alignments, raw["alignments"]); err != nil {
+		return c, fmt.Errorf("alignments: %v", err)
+	}
+	if c.LunarLimbs, err = mergeEntries(base.LunarLimbs, c.LunarLimbs, raw["lunarlimbs"]); err != nil {
+		return c, fmt.Errorf("lunarlimbs: %v", err)
+	}
+	if c.Images, err = mergeEntries(base.Images, c.Images, raw["images"]); err != nil {
+		return c, fmt.Errorf("images: %v", err)
+	}
+	extensions := mergeMaps(base.Extensions, c.Extensions)
+	for name, v := range c.Extensions {
+		extensions[name] = mergeYamlValues(base.Extensions[name], v)
+	}
+	c.Extensions = extensions
+
+	return c, nil
 }
 
-func newConfigFromYaml(b []byte) (Config, error) {
-	c := NewConfig()
-	err := yaml.Unmarshal(b, &c)
-	return c, err
+// Clone returns a copy of the config that doesn't share any of the
+// maps that a run fills in, so it can be used by another run at the
+// same time.
+func (c Config)Clone() Config {
+	c.CameraProfiles = mergeMaps(c.CameraProfiles, nil)
+	c.Alignments     = mergeMaps(c.Alignments, nil)
+	c.LunarLimbs     = mergeMaps(c.LunarLimbs, nil)
+	c.Images         = mergeMaps(c.Images, nil)
+	c.Extensions     = mergeMaps(c.Extensions, nil)
+	return c
+}
+
+// mergeMaps returns a new map with everything in both; `over` wins.
+func mergeMaps[K comparable, V any](base, over map[K]V) map[K]V {
+	m := map[K]V{}
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range over {
+		m[k] = v
+	}
+	return m
+}
+
+// mergeEntries is mergeMaps, for a map that `raw` (the same yaml,
+// parsed generically) set entries in: an entry that's in base too gets
+// the fields from the yaml decoded onto a copy of base's, rather than
+// being replaced.
+func mergeEntries[V any](base, over map[string]V, raw interface{}) (map[string]V, error) {
+	m := mergeMaps(base, over)
+	entries, _ := raw.(map[interface{}]interface{})
+	for k, fields := range entries {
+		name := fmt.Sprint(k)
+		v, exists := base[name]
+		if !exists {
+			continue
+		}
+		b, err := yaml.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, &v); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		m[name] = v
+	}
+	return m, nil
+}
+
+// mergeYamlValues merges generically parsed yaml: maps key by key
+// (recursively), and anything else from `over`.
+func mergeYamlValues(base, over interface{}) interface{} {
+	bm, ok1 := base.(map[interface{}]interface{})
+	om, ok2 := over.(map[interface{}]interface{})
+	if !ok1 || !ok2 {
+		return over
+	}
+	m := map[interface{}]interface{}{}
+	for k, v := range bm {
+		m[k] = v
+	}
+	for k, v := range om {
+		m[k] = mergeYamlValues(bm[k], v)
+	}
+	return m
 }
 
 func (c Config)AsYaml() string {
 	b, err := yaml.Marshal(c)
 	if err != nil {
-		log.Fatal("Can't marshal config yaml: %v\n", err)
+		panic(fmt.Sprintf("can't marshal config yaml: %v", err)) // only a bug in Config could do this
 	}
 	return string(b)
 }
 
+// WriteYaml saves a snapshot of the config, so a later run (or phase)
+// can pick up where this one left off.
+func (c Config)WriteYaml(filename string) error {
+	if err := ioutil.WriteFile(filename, []byte(c.AsYaml()), 0644); err != nil {
+		return fmt.Errorf("write config '%s': %v", filename, err)
+	}
+	c.debugf("Wrote config snapshot to %s\n", filename)
+	return nil
+}
+
 func NewConfig() Config {
 	return Config{
+		ConfigVersion: CurrentConfigVersion,
 		Alignments: map[string]AlignmentTransform{},
+		LunarLimbs: map[string]LunarLimb{},
+		ClipLevel:  0.98,
+		LimbRadiusTolerance:     0.25,
+		AlignmentErrorTolerance: 4.0,
+		ColorSpace: ecolor.OutputColorSpaces["srgb"],
+
+		Fuser:          "mostexposed",
+		Developer:      "dng",
+		LimbDetector:   "floodfill",
+		Tonemapper:     "all",
+		FuserLuminance: 0.8,
+		DoEclipseAlignment:          true,
+		OutputWidthInSolarDiameters: 4.0,
+		Work:           WorkConfig{Cleanup: "always", Buffers: "memory"},
+		GPU:            true,
+	}
+}
+
+func (c Config)GetFuser() (PixelFunc, error) {
+	f, exists := fusers[c.Fuser]
+	if !exists {
+		return nil, fmt.Errorf("no Fuser strategy named '%s', wanted one of %q", c.Fuser, sortedNames(fusers))
 	}
+	return f, nil
 }
 
-func (c Config)GetFuser() PixelFunc {
-	switch c.Fuser {
-	case "mostexposed": return FuseByPickMostExposed
-	case "sector":      return FuseBySector
-	case "avg":         return FuseByAverage
-	default:
-		log.Fatalf("no Fuser strategy named '%s'", c.Fuser)
-		return nil
+func (c Config)GetDeveloper() (PixelFunc, error) {
+	if c.Monochrome {
+		return estack.DevelopByMono, nil
+	}
+
+	f, exists := developers[c.Developer]
+	if !exists {
+		return nil, fmt.Errorf("no Developer strategy named '%s', wanted one of %q", c.Developer, sortedNames(developers))
 	}
+	return f, nil
 }
 
-func (c Config)GetDeveloper() PixelFunc {
-	switch c.Developer {
-	case "layer": return DevelopByLayer
-	case "dng":   return DevelopByDNG
-	case "wb":    return DevelopByWhiteBalanceOnly
-	case "":      return DevelopByNone
-	default:
-		log.Fatalf("no Developer strategy named '%s'", c.Developer)
-		return nil
+func (c Config)GetLimbDetector() (LimbDetector, error) {
+	f, exists := limbDetectors[c.LimbDetector]
+	if !exists {
+		return nil, fmt.Errorf("no LimbDetector named '%s', wanted one of %q", c.LimbDetector, sortedNames(limbDetectors))
 	}
+	return f, nil
 }
@@ -0,0 +1,177 @@
+package eclipse
+
+import(
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eastro"
+)
+
+// ContactsConfig asks for the times of second & third contact to be
+// found from the light curve - the last photo with some photosphere in
+// it, and the first without, and then the other way round - and to be
+// compared with predictions. Capture times go onto UTC as for the
+// ephemeris (Ephemeris.UTCOffset & ClockCorrection).
+type ContactsConfig struct {
+	Enabled    bool
+	Threshold  float64    // How much brighter than totality a photo has to be to have the photosphere in it, in magnitudes; if zero, 2.5
+	C2         time.Time  // The predicted time of second contact (UTC), e.g. from a map that allows for the lunar limb profile; if zero, from the ephemeris
+	C3         time.Time  // Likewise, third contact
+}
+
+func (cc ContactsConfig)withDefaults() ContactsConfig {
+	if cc.Threshold == 0.0 { cc.Threshold = 2.5 }
+	return cc
+}
+
+// A ContactTime is one contact, as seen in the photos: somewhere between
+// the two photos either side of it (so, give or take half the gap).
+type ContactTime struct {
+	Observed     time.Time  `yaml:",omitempty"` // Halfway between the photos either side; zero if the sequence doesn't cover it
+	Uncertainty  float64    `yaml:",omitempty"` // Seconds either way
+	Before       string     `yaml:",omitempty"` // The last photo before the contact
+	After        string     `yaml:",omitempty"` // The first photo after
+	Predicted    time.Time  `yaml:",omitempty"`
+	Difference   float64    `yaml:",omitempty"` // Observed - predicted, in seconds
+}
+
+// A ContactReport is what goes into `contacts.yaml`, in the reports dir.
+type ContactReport struct {
+	PredictedFrom  string   `yaml:",omitempty"` // "config" or "ephemeris" (good to a minute or so)
+	TotalityLevel  float64  // The faintest photo's brightness, in lux at the sensor (as in the light curve)
+	C2             ContactTime
+	C3             ContactTime
+	Duration       float64  `yaml:",omitempty"` // Of totality, C3 - C2, in seconds
+	Predicted      float64  `yaml:",omitempty"` // The predicted duration
+}
+
+// Contacts finds second & third contact in the light curve. The photos
+// in totality are the run around the faintest one that are within
+// Threshold magnitudes of it; the photos either side of the run have
+// the photosphere in them (Baily's beads, or the diamond ring).
+func (fi *FusedImage)Contacts(points []LightCurvePoint) (*ContactReport, error) {
+	cfg := fi.Config.Contacts.withDefaults()
+	ec := fi.Config.Ephemeris.withDefaults()
+	timed := []LightCurvePoint{}
+	for _, p := range points {
+		if !p.CaptureTime.IsZero() && p.Brightness > 0.0 {
+			p.CaptureTime = ec.cameraTimeToUTC(p.CaptureTime)
+			timed = append(timed, p)
+		}
+	}
+	if len(timed) == 0 {
+		return nil, fmt.Errorf("contacts: none of the photos have a capture time")
+	}
+
+	faintest := 0
+	for i, p := range timed {
+		if p.Brightness < timed[faintest].Brightness {
+			faintest = i
+		}
+	}
+	rpt := &ContactReport{TotalityLevel: timed[faintest].Brightness}
+	limit := rpt.TotalityLevel * math.Pow(10.0, cfg.Threshold / 2.5)
+	start, end := faintest, faintest
+	for start > 0 && timed[start-1].Brightness < limit {
+		start--
+	}
+	for end < len(timed)-1 && timed[end+1].Brightness < limit {
+		end++
+	}
+	between := func(before, after LightCurvePoint) ContactTime {
+		gap := after.CaptureTime.Sub(before.CaptureTime)
+		return ContactTime{
+			Observed:    before.CaptureTime.Add(gap / 2),
+			Uncertainty: gap.Seconds() / 2.0,
+			Before:      before.Filename,
+			After:       after.Filename,
+		}
+	}
+	if start > 0 {
+		rpt.C2 = between(timed[start-1], timed[start])
+	} else {
+		fi.Config.warnf("Contacts: the sequence starts in totality (at %s), so there's no second contact\n", timed[0].Filename)
+	}
+	if end < len(timed)-1 {
+		rpt.C3 = between(timed[end], timed[end+1])
+	} else {
+		fi.Config.warnf("Contacts: the sequence ends in totality (at %s), so there's no third contact\n", timed[end].Filename)
+	}
+	if !rpt.C2.Observed.IsZero() && !rpt.C3.Observed.IsZero() {
+		rpt.Duration = rpt.C3.Observed.Sub(rpt.C2.Observed).Seconds()
+	}
+
+	// The predictions
+	var err error
+	if rpt.C2.Predicted, rpt.C3.Predicted, rpt.PredictedFrom, err = fi.predictedContacts(timed[faintest].CaptureTime); err != nil {
+		return nil, err
+	}
+	for _, ct := range []*ContactTime{&rpt.C2, &rpt.C3} {
+		if !ct.Observed.IsZero() && !ct.Predicted.IsZero() {
+			ct.Difference = ct.Observed.Sub(ct.Predicted).Seconds()
+		}
+	}
+	if !rpt.C2.Predicted.IsZero() && !rpt.C3.Predicted.IsZero() {
+		rpt.Predicted = rpt.C3.Predicted.Sub(rpt.C2.Predicted).Seconds()
+	}
+	return rpt, nil
+}
+
+// predictedContacts is when second & third contact should be (UTC), for
+// the eclipse around `near`: as set in the config (Contacts.C2 & C3),
+// or else from the ephemeris, if it knows where the photos were taken
+// from; and which of those it was ("" if neither).
+func (fi *FusedImage)predictedContacts(near time.Time) (time.Time, time.Time, string, error) {
+	cfg := fi.Config.Contacts
+	ec := fi.Config.Ephemeris.withDefaults()
+	if !cfg.C2.IsZero() || !cfg.C3.IsZero() {
+		return cfg.C2, cfg.C3, "config", nil
+	} else if ec.Latitude == 0.0 && ec.Longitude == 0.0 {
+		return time.Time{}, time.Time{}, "", nil
+	}
+	obs := eastro.Observer{Latitude: ec.Latitude, Longitude: ec.Longitude, Elevation: ec.Elevation}
+	c, err := eastro.EclipseContacts(near, ec.DeltaT, obs)
+	if err != nil {
+		return time.Time{}, time.Time{}, "", fmt.Errorf("contacts: %v", err)
+	}
+	if c.C2.IsZero() {
+		fi.Config.warnf("Contacts: the eclipse isn't total from (%.4f, %.4f), by the ephemeris\n", ec.Latitude, ec.Longitude)
+	}
+	return c.C2, c.C3, "ephemeris", nil
+}
+
+// writeContacts finds the contacts in the light curve, if the config
+// asks for it, and writes the report.
+func (fi *FusedImage)writeContacts(points []LightCurvePoint) error {
+	if !fi.Config.Contacts.Enabled {
+		return nil
+	}
+	rpt, err := fi.Contacts(points)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(rpt)
+	if err != nil {
+		return fmt.Errorf("contacts: %v", err)
+	}
+	filename := fi.Config.OutputPath(ReportOutput, "contacts.yaml")
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write contacts '%s': %v", filename, err)
+	}
+	for _, c := range []struct{ name string; ct ContactTime }{{"C2", rpt.C2}, {"C3", rpt.C3}} {
+		if c.ct.Observed.IsZero() {
+			continue
+		}
+		predicted := ""
+		if !c.ct.Predicted.IsZero() {
+			predicted = fmt.Sprintf(", %+.1fs from the prediction (%s)", c.ct.Difference, rpt.PredictedFrom)
+		}
+		fi.Config.infof("%s at %s ±%.1fs%s\n", c.name, c.ct.Observed.Format("15:04:05.0"), c.ct.Uncertainty, predicted)
+	}
+	fi.Config.infof("Wrote %s\n", filename)
+	return nil
+}
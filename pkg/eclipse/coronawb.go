@@ -0,0 +1,87 @@
+package eclipse
+
+import(
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// CoronaWhiteBalanceConfig controls a white balance correction based
+// on the corona itself. The K-corona is sunlight scattered off
+// electrons, so it has pretty much the solar spectrum, i.e. it should
+// come out white; any cast it has is down to the camera's white
+// balance (or the sky).
+type CoronaWhiteBalanceConfig struct {
+	Mode         string      // "" (off), "auto" (neutralize the mid-corona), or "manual"
+	InnerRadius  float64     // Inner edge of the sampled annulus, in solar radii; if zero, 1.5
+	OuterRadius  float64     // Outer edge of the sampled annulus, in solar radii; if zero, 2.5
+	Multipliers  emath.Vec3  // RGB multipliers; for "manual", or to override what "auto" would pick
+}
+
+// NeutralizeCorona scales the RGB channels of every developed pixel,
+// so that the average color of the mid-corona annulus is neutral.
+func (fi *FusedImage)NeutralizeCorona() {
+	cfg := fi.Config.CoronaWhiteBalance
+
+	mult := cfg.Multipliers
+	switch cfg.Mode {
+	case "manual":
+		if mult == (emath.Vec3{}) {
+			fi.Config.warnf("CoronaWhiteBalance: manual mode, but no multipliers in config, skipping\n")
+			return
+		}
+
+	case "auto":
+		if mult != (emath.Vec3{}) {
+			break // manual override of the multipliers
+		}
+		if !fi.needsLunarLimb("CoronaWhiteBalance") {
+			return
+		}
+		inner, outer := cfg.InnerRadius, cfg.OuterRadius
+		if inner == 0.0 { inner = 1.5 }
+		if outer == 0.0 { outer = 2.5 }
+
+		avg, n := fi.annulusAverage(inner, outer)
+		if n == 0 || avg[0] <= 0.0 || avg[2] <= 0.0 {
+			fi.Config.warnf("CoronaWhiteBalance: nothing to sample in annulus [%.1f,%.1f], skipping\n", inner, outer)
+			return
+		}
+		mult = emath.Vec3{avg[1] / avg[0], 1.0, avg[1] / avg[2]}
+		fi.Config.infof("CoronaWhiteBalance: annulus [%.1f,%.1f] (%d pix) averaged %s\n", inner, outer, n, avg)
+
+	default:
+		fi.Config.warnf("CoronaWhiteBalance: mode '%s' not recognized, wanted auto or manual\n", cfg.Mode)
+		return
+	}
+
+	fi.Config.infof("CoronaWhiteBalance: applying multipliers %s\n", mult)
+	fi.forEachPixel("", func(_, _ int, p *Pixel) {
+		p.DevelopedRGB.R *= mult[0]
+		p.DevelopedRGB.G *= mult[1]
+		p.DevelopedRGB.B *= mult[2]
+	})
+}
+
+// annulusAverage returns the average developed RGB of the pixels
+// that lie between `inner` and `outer` solar radii.
+func (fi *FusedImage)annulusAverage(inner, outer float64) (emath.Vec3, int) {
+	avg := emath.Vec3{}
+	n := 0
+	for x:=0; x<fi.OutputArea.Dx(); x++ {
+		for y:=0; y<fi.OutputArea.Dy(); y++ {
+			if r := fi.SolarRadii(x, y); r < inner || r > outer {
+				continue
+			}
+			rgb := fi.Pix(x, y).DevelopedRGB
+			avg[0] += rgb.R
+			avg[1] += rgb.G
+			avg[2] += rgb.B
+			n++
+		}
+	}
+	if n > 0 {
+		avg[0] /= float64(n)
+		avg[1] /= float64(n)
+		avg[2] /= float64(n)
+	}
+	return avg, n
+}
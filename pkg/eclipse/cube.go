@@ -0,0 +1,105 @@
+package eclipse
+
+import(
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// CubeConfig asks for every frame, aligned and scaled to the stack's
+// common exposure, to be written as a single FITS cube (x, y, frame),
+// for analyses over time (or exposure) that want the registered data
+// rather than the fused result. Each plane is one channel of the
+// frame's camera native linear pixels (see FusedImage.Masked), with
+// the pixels that couldn't be used (clipped, or beyond the edge of the
+// photo) as NaN; each plane's metadata goes in the header.
+type CubeConfig struct {
+	Enabled  bool
+	Channel  string  // "mean" (the default; of the three channels), "r", "g" or "b"
+}
+
+// cubeMaxFrames is as many planes as the per plane keys (e.g. ILLUMnnn)
+// have room to number.
+const cubeMaxFrames = 999
+
+// writeCube writes the aligned frames as a FITS cube, if the config asks
+// for it. It comes after Fuse, so the frames are on the stack's scale.
+func (fi *FusedImage)writeCube() error {
+	cfg := fi.Config.Cube
+	if !cfg.Enabled {
+		return nil
+	}
+	if len(fi.Layers) > cubeMaxFrames {
+		return fmt.Errorf("cube: %d frames is more than a FITS cube's header can describe (%d)", len(fi.Layers), cubeMaxFrames)
+	}
+	filename := fi.Config.OutputPath(FinalOutput, "cube.fits")
+	illum := fi.commonIllumAtMax()
+	k, _ := fi.saturation()
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+
+	names := []string{}
+	cards := []eio.FITSCard{
+		{Key: "CTYPE3", Value: eio.FITSString("FRAME"), Comment: "In order of EV, as in the run manifest"},
+		{Key: "CHANNEL", Value: eio.FITSString(cfg.channel()), Comment: "Of the camera native linear pixels"},
+		{Key: "ILLUMMAX", Value: fmt.Sprintf("%g", illum), Comment: "Lux that 1.0 is, in every plane"},
+		{Key: "CDM2", Value: fmt.Sprintf("%g", k * illum / 250.0), Comment: "Multiply by this for cd/m2 (roughly)"},
+	}
+	for i, l := range fi.Layers {
+		n := i + 1
+		names = append(names, l.Filename())
+		o := fi.Config.layerOverride(i)
+		cards = append(cards,
+			eio.FITSCard{Key: fmt.Sprintf("FILE%d", n), Value: eio.FITSString(l.Filename()), Comment: "Plane " + fmt.Sprint(n)},
+			eio.FITSCard{Key: fmt.Sprintf("EV%d", n), Value: fmt.Sprint(l.EV)},
+			eio.FITSCard{Key: fmt.Sprintf("ISO%d", n), Value: fmt.Sprint(l.ISO)},
+			eio.FITSCard{Key: fmt.Sprintf("FNUM%d", n), Value: fmt.Sprintf("%.1f", float64(l.ApertureX10) / 10.0), Comment: "f-number"},
+			eio.FITSCard{Key: fmt.Sprintf("EXPT%d", n), Value: fmt.Sprintf("%g", float64(l.ShutterSpeed[0]) / float64(l.ShutterSpeed[1])), Comment: "Exposure time (s)"},
+			eio.FITSCard{Key: fmt.Sprintf("ILLUM%d", n), Value: fmt.Sprintf("%g", l.IlluminanceAtMaxExposure), Comment: "The lux that saturated this frame"},
+		)
+		if o.Filter != 0.0 {
+			cards = append(cards, eio.FITSCard{Key: fmt.Sprintf("FILT%d", n), Value: fmt.Sprintf("%g", o.Filter), Comment: "Filter density"})
+		}
+		if !l.CaptureTime.IsZero() {
+			cards = append(cards, eio.FITSCard{Key: fmt.Sprintf("DATE%d", n), Value: eio.FITSString(l.CaptureTime.Format("2006-01-02T15:04:05.000")),
+				Comment: "Capture time, on the camera's clock"})
+		}
+	}
+	cards = append(cards, eio.FITSComment(fmt.Sprintf("Output area %v, lunar center %v, lunar radius %dpx", fi.OutputArea, fi.Config.LunarCenter, fi.Config.LunarRadius)))
+
+	nan := float32(math.NaN())
+	fi.Config.infof("Writing %d aligned frames as a cube, to %s\n", len(fi.Layers), filename)
+	start := time.Now()
+	err := eio.WriteFITSCube(filename, w, h, names, func(i int, pix []float32) error {
+		frame := frameView{fi, i, illum, true} // as Masked(i)
+		for y:=0; y<h; y++ {
+			for x:=0; x<w; x++ {
+				rgb, ok := frame.at(x, y)
+				if !ok {
+					pix[y*w + x] = nan
+					continue
+				}
+				switch cfg.Channel {
+				case "r": pix[y*w + x] = float32(rgb.R)
+				case "g": pix[y*w + x] = float32(rgb.G)
+				case "b": pix[y*w + x] = float32(rgb.B)
+				default:  pix[y*w + x] = float32((rgb.R + rgb.G + rgb.B) / 3.0)
+				}
+			}
+		}
+		return nil
+	}, cards...)
+	if err != nil {
+		return fmt.Errorf("cube: %v", err)
+	}
+	fi.Config.timeEvent("cube", start, "frames", len(fi.Layers))
+	return nil
+}
+
+func (cc CubeConfig)channel() string {
+	if cc.Channel == "" {
+		return "mean"
+	}
+	return cc.Channel
+}
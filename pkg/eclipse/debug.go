@@ -0,0 +1,55 @@
+package eclipse
+
+import(
+	"image"
+	"os"
+	"path/filepath"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// A DebugSink gets the debug images that the pipeline draws as it goes:
+// the lunar limb composite, and the difference images from fine tuning
+// the alignments. By default there is no sink, and they aren't drawn
+// at all; `-v` uses DebugFiles, which writes them into the debug dir.
+type DebugSink interface {
+	// DebugImage gets each image, along with the filename it would have
+	// in the debug output dir.
+	DebugImage(filename string, img image.Image)
+}
+
+// DebugFiles is a DebugSink that writes the images out as PNG files.
+type DebugFiles struct{
+	cfg   Config  // The run's, for `output.png` and its messages; see debugImage
+}
+
+func (df DebugFiles)DebugImage(filename string, img image.Image) {
+	write := eio.WritePNG
+	if df.cfg.Output.PNG == "fast" {
+		write = func(img image.Image, filename string) error { return eio.WritePNGFast(img, filename, 0) }
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		df.cfg.warnf("Debug dir: %v\n", err)
+	} else if err := write(img, filename); err != nil {
+		df.cfg.warnf("Debug image: %v\n", err)
+	}
+}
+
+// debugImage hands the image to the DebugSink, if there is one.
+func (c Config)debugImage(name string, img image.Image) {
+	sink := c.DebugSink
+	if df, ok := sink.(DebugFiles); ok {
+		df.cfg = c
+		df.cfg.DebugSink = nil
+		sink = df
+	}
+	if sink == nil {
+		return
+	}
+	filename := filepath.Join(c.Output.dir(DebugOutput), name)
+	if _, ok := sink.(DebugFiles); ok {
+		c.outputs.write(func() error { sink.DebugImage(filename, img); return nil })
+	} else {
+		sink.DebugImage(filename, img) // other sinks needn't be safe to call from another goroutine
+	}
+}
@@ -0,0 +1,106 @@
+package eclipse
+
+import(
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eenhance"
+)
+
+// DenoiseConfig controls an edge-preserving noise reduction stage. It
+// runs on the linear HDR pixels, before tonemapping stretches the
+// faint outer corona (and its noise) up into view.
+type DenoiseConfig struct {
+	Method       string         // "" (off), "bilateral", or "nlmeans"
+	Radius       int            // Radius of the filter window (bilateral), or search window (nlmeans); if zero, 2
+	RangeSigma   float64        // How different (relatively) a neighbour can be and still get averaged in; if zero, 0.1
+	Strength     RadialProfile  // Scales RangeSigma by distance from the sun; zero means no denoising at that radius
+	LightnessOnly bool          // Only denoise L* (in L*a*b*), leaving the chroma alone
+}
+
+// Denoise applies the configured filter to the developed HDR pixels.
+// Because the brightness of the corona falls off by orders of
+// magnitude, differences between pixels are compared relative to the
+// brightness of the pixel being filtered.
+func (fi *FusedImage)Denoise() {
+	cfg := fi.Config.Denoise
+	if cfg.Radius == 0 { cfg.Radius = 2 }
+	if cfg.RangeSigma == 0.0 { cfg.RangeSigma = 0.1 }
+	if len(cfg.Strength) > 0 && !fi.needsLunarLimb("Denoise") {
+		return
+	}
+
+	var filter func(src eenhance.Image, x, y int, sigma float64) hdrcolor.RGB
+	switch cfg.Method {
+	case "bilateral": filter = func(src eenhance.Image, x, y int, sigma float64) hdrcolor.RGB {
+		return eenhance.Bilateral(src, x, y, cfg.Radius, sigma)
+	}
+	case "nlmeans": filter = func(src eenhance.Image, x, y int, sigma float64) hdrcolor.RGB {
+		return eenhance.NLMeans(src, x, y, cfg.Radius, sigma)
+	}
+	default:
+		fi.Config.warnf("Denoise: method '%s' not recognized, wanted bilateral or nlmeans\n", cfg.Method)
+		return
+	}
+
+	fi.Config.infof("Denoising: %s, radius %d, sigma %.3f\n", cfg.Method, cfg.Radius, cfg.RangeSigma)
+
+	// Filter from a snapshot, so we don't read values we've already filtered
+	src := eenhance.Snapshot(developedImage{fi})
+
+	sigmaAt := func(x, y int) float64 {
+		sigma := cfg.RangeSigma
+		if len(cfg.Strength) > 0 {
+			sigma *= cfg.Strength.At(fi.SolarRadii(x, y))
+		}
+		return sigma
+	}
+	if cfg.Method == "bilateral" {
+		if gpuOut := fi.bilateralOnGPU(src, cfg.Radius, sigmaAt); gpuOut != nil {
+			filter = func(_ eenhance.Image, x, y int, sigma float64) hdrcolor.RGB {
+				i := 3 * (x * fi.OutputArea.Dy() + y)
+				return hdrcolor.RGB{R: float64(gpuOut[i]), G: float64(gpuOut[i+1]), B: float64(gpuOut[i+2])}
+			}
+		}
+	}
+
+	fi.forEachPixel("Denoising (tiles)", func(x, y int, p *Pixel) {
+		sigma := sigmaAt(x, y)
+		if sigma <= 0.0 {
+			return
+		}
+		filtered := filter(src, x, y, sigma)
+		if cfg.LightnessOnly {
+			cs := fi.Config.ColorSpace
+			orig, lab := cs.ToLab(p.DevelopedRGB), cs.ToLab(filtered)
+			filtered = ecolor.HDRRGBFloorAt(cs.FromLab(ecolor.Lab{L: lab.L, A: orig.A, B: orig.B}), 0.0)
+		}
+		p.DevelopedRGB = filtered
+	})
+}
+
+// bilateralOnGPU runs eenhance.Bilateral over every pixel on the GPU, and
+// returns the filtered RGB triples (in the same order as fi.Pixels), or
+// nil if there's no GPU to do it.
+func (fi *FusedImage)bilateralOnGPU(src *eenhance.Plane, radius int, sigmaAt func(x, y int) float64) []float32 {
+	dev := fi.Config.gpu()
+	if dev == nil {
+		return nil
+	}
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+	in, sigmas := make([]float32, 3*w*h), make([]float32, w*h)
+	for x:=0; x<w; x++ {
+		for y:=0; y<h; y++ {
+			i, c := x*h + y, src.RGB(x, y)
+			in[3*i], in[3*i+1], in[3*i+2] = float32(c.R), float32(c.G), float32(c.B)
+			sigmas[i] = float32(sigmaAt(x, y))
+		}
+	}
+
+	// The pixels are in columns, so to the GPU, x and y swap over
+	out := make([]float32, len(in))
+	if !dev.Bilateral(out, in, h, w, radius, sigmas) {
+		return nil
+	}
+	return out
+}
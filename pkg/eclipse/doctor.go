@@ -0,0 +1,180 @@
+package eclipse
+
+import(
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// Doctor checks the inputs (photos and config files) for things that
+// would spoil a long run, and returns a report that says what to do
+// about them. It returns false if there are problems that would stop
+// the run, rather than just things that look odd.
+func Doctor(args ...string) (string, bool) {
+	lines := []string{}
+	nErrors, nWarnings := 0, 0
+	report := func(level, subject, problem, fix string) {
+		switch level {
+		case "ERROR": nErrors++
+		case "WARN":  nWarnings++
+		}
+		lines = append(lines, fmt.Sprintf("%-5s %s: %s", level, subject, problem))
+		if fix != "" {
+			lines = append(lines, fmt.Sprintf("      -> %s", fix))
+		}
+	}
+	excludeFix := func(name string) string {
+		return fmt.Sprintf("exclude it: `-set 'images.\"%s\".exclude=true'`", name)
+	}
+
+	// Config files
+	cfg := NewConfig()
+	for _, filename := range findFiles(args, ".yaml") {
+		if c, err := loadConfig(filename, cfg); err != nil {
+			report("ERROR", filename, err.Error(), "fix the config file")
+		} else {
+			cfg = c
+			report("OK", filename, "config loads", "")
+		}
+	}
+	if err := cfg.Validate(); err != nil { // all the files together, as a run sees them
+		report("ERROR", "config", err.Error(), "fix the config files")
+	} else {
+		report("OK", "config", "config is valid", "")
+	}
+	if tc := cfg.Timelapse.withDefaults(); tc.Enabled || (cfg.Animation.Enabled && cfg.Animation.Format == "webp") {
+		if path, err := exec.LookPath(tc.FFmpeg); err != nil {
+			report("ERROR", "timelapse", fmt.Sprintf("can't find %s, to encode the movie", tc.FFmpeg), "install ffmpeg, or set `timelapse.ffmpeg` to where it is")
+		} else {
+			report("OK", "timelapse", "ffmpeg is " + path, "")
+		}
+	}
+
+	// Readable, with exposure data
+	photos := scanPhotos(args...)
+	good := []scannedPhoto{}
+	for _, p := range photos {
+		if cfg.Images[p.Filename()].Exclude {
+			continue
+		} else if p.Err != nil {
+			report("ERROR", p.Filename(), fmt.Sprintf("can't read metadata: %v", p.Err), excludeFix(p.Filename()))
+		} else {
+			good = append(good, p)
+		}
+	}
+	if len(photos) == 0 {
+		report("ERROR", "photos", "no .dng or .tif files found", "check the paths")
+	}
+	if len(good) == 0 {
+		return doctorSummary(lines, len(photos), nErrors, nWarnings), false
+	}
+
+	// Consistent resolution and camera
+	dims := map[string][]string{}
+	models := map[string][]string{}
+	for _, p := range good {
+		d := fmt.Sprintf("%dx%d", p.Dims.X, p.Dims.Y)
+		dims[d] = append(dims[d], p.Filename())
+		models[p.CameraModel] = append(models[p.CameraModel], p.Filename())
+	}
+	if len(dims) > 1 {
+		report("ERROR", "resolution", "photos are not all the same size: " + describeGroups(dims),
+			"exclude the odd ones out, or re-export them at the same size")
+	} else {
+		report("OK", "resolution", fmt.Sprintf("all %d photos are %s", len(good), describeGroups(dims)), "")
+	}
+	if len(models) > 1 {
+		report("WARN", "camera", "photos are from more than one camera: " + describeGroups(models),
+			"the color data comes from the first photo; process each camera separately")
+	}
+
+	// Color data
+	first := good[0]
+	if strings.ToLower(filepath.Ext(first.Path)) != ".dng" && !cfg.Monochrome && cfg.ManualOverrideForwardMatrix[0] == 0.0 {
+		model := first.CameraModel
+		if cfg.CameraModel != "" { model = cfg.CameraModel }
+		if _, exists := ecolor.LookupCameraProfile(model, cfg.CameraProfiles); !exists {
+			report("ERROR", "color", fmt.Sprintf("TIFFs from '%s', and no color data for that camera", model),
+				"add manualoverrideasshotneutral & manualoverrideforwardmatrix to conf.yaml, or use DNGs")
+		}
+	}
+
+	// Exposures
+	evs := map[int]bool{}
+	for _, p := range good {
+		evs[p.EV] = true
+	}
+	if len(evs) < 2 {
+		report("WARN", "exposures", fmt.Sprintf("only one exposure (EV %d); nothing to fuse", first.EV),
+			"check the camera's bracketing settings")
+	} else {
+		min, max := evRange(good)
+		report("OK", "exposures", fmt.Sprintf("%d different exposures, EV %d to %d", len(evs), min, max), "")
+	}
+
+	// Capture times
+	noTime := []string{}
+	for _, p := range good {
+		if p.CaptureTime.IsZero() {
+			noTime = append(noTime, p.Filename())
+		}
+	}
+	if len(noTime) > 0 {
+		report("WARN", "capture times", fmt.Sprintf("no EXIF capture time for %s", strings.Join(noTime, ", ")),
+			"can't check these for gaps")
+	} else if seqs := splitSequences(good); len(seqs) > 1 {
+		for i:=1; i<len(seqs); i++ {
+			prev, next := seqs[i-1][len(seqs[i-1])-1], seqs[i][0]
+			report("WARN", "capture times", fmt.Sprintf("gap of %s between %s and %s",
+				next.CaptureTime.Sub(prev.CaptureTime).Round(time.Second), prev.Filename(), next.Filename()),
+				"are these the same sequence ? `eclipse-hdr init` can exclude the stragglers")
+		}
+	} else {
+		report("OK", "capture times", fmt.Sprintf("one sequence, %s long",
+			good[len(good)-1].CaptureTime.Sub(good[0].CaptureTime).Round(time.Second)), "")
+	}
+
+	return doctorSummary(lines, len(photos), nErrors, nWarnings), nErrors == 0
+}
+
+func doctorSummary(lines []string, nPhotos, nErrors, nWarnings int) string {
+	lines = append(lines, "", fmt.Sprintf("Checked %d photos: %d errors, %d warnings", nPhotos, nErrors, nWarnings))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// describeGroups summarizes e.g. {"6016x4016": [a b c], "4000x3000": [d]}
+func describeGroups(groups map[string][]string) string {
+	keys := []string{}
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	strs := []string{}
+	for _, k := range keys {
+		strs = append(strs, fmt.Sprintf("%s (%s)", k, strings.Join(groups[k], ", ")))
+	}
+	return strings.Join(strs, "; ")
+}
+
+// findFiles walks the args, and returns the files with that extension.
+func findFiles(args []string, ext string) []string {
+	files := []string{}
+	for _, arg := range args {
+		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.ToLower(filepath.Ext(path)) == ext {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+	return files
+}
@@ -0,0 +1,446 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// LoadMetadata is like LoadFilesAndDirs, but only reads the config
+// files and the metadata of the photos (exposure, size etc.); no
+// pixel data gets loaded. It's for dry runs.
+func (fi *FusedImage)LoadMetadata(args ...string) error {
+	fi.metadataOnly = true
+	defer func() { fi.metadataOnly = false }()
+	if err := fi.loadThings(args...); err != nil {
+		return err
+	}
+	var err error
+	if fi.Config, err = fi.Config.WithOverrides(fi.Overrides...); err != nil {
+		return err
+	}
+	return fi.loadPhotos(context.Background()) // just metadata, so it is quick
+}
+
+// readMetadata gets a Layer with everything but the pixels.
+func readMetadata(filename string) (Layer, error) {
+	l := Layer{LoadFilename: filename}
+	m, err := eio.ReadMetadata(filename)
+	if err != nil {
+		return l, err
+	}
+	l.Dims = m.Dims
+	return l, l.setMetadata(m)
+}
+
+// Plan describes what running the phase would do, given what has been
+// loaded by LoadMetadata.
+func (fi *FusedImage)Plan(phase string) string {
+	cfg := fi.Config
+	lines := []string{fmt.Sprintf("Dry run of phase '%s'", phase)}
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	uses := func(phases ...string) bool {
+		for _, p := range phases {
+			if p == phase {
+				return true
+			}
+		}
+		return false
+	}
+
+	add("")
+	add("Inputs:")
+	for _, l := range fi.Layers {
+		add("  %-20s %s, %dx%d, %s", l.Filename(), l.ExposureValue, l.Dims.X, l.Dims.Y, l.CameraModel)
+	}
+	for _, f := range fi.hdrInputs {
+		add("  %-20s HDR pixels", f)
+	}
+	if len(fi.Layers) == 0 && len(fi.hdrInputs) == 0 {
+		add("  (nothing !)")
+	}
+
+	if uses("stack", "all") {
+		add("")
+		add("Color:")
+		switch {
+		case cfg.Monochrome:
+			add("  monochrome, no color correction")
+		case len(fi.Layers) > 0 && strings.HasSuffix(strings.ToLower(fi.Layers[0].LoadFilename), ".dng"):
+			add("  camera color data from the DNG %s", fi.Layers[0].Filename())
+		case cfg.ManualOverrideForwardMatrix[0] != 0.0:
+			add("  camera color data from the manual overrides")
+		default:
+			if _, model, exists := fi.lookupCameraProfile(); exists {
+				add("  camera color data from the profile for '%s'", model)
+			} else {
+				add("  NO camera color data (want DNGs, manual overrides, or a camera profile)")
+			}
+		}
+		wb := cfg.WhiteBalance.Mode
+		if wb == "" { wb = "asshot" }
+		cs := cfg.OutputColorSpace
+		if cs == "" { cs = "srgb" }
+		add("  white balance: %s; develop into %s, with developer '%s'", wb, cs, cfg.Developer)
+	}
+
+	add("")
+	add("Stages:")
+	if uses("detect", "align", "review", "stack", "all", "beads") || (phase == "enhance" && len(fi.Layers) > 0) {
+		if !cfg.DoEclipseAlignment {
+			add("  no alignment (-aligneclipse=false)")
+		} else {
+			known, unknown := []string{}, []string{}
+			for _, l := range fi.Layers {
+				if _, exists := cfg.LunarLimbs[l.Filename()]; exists {
+					known = append(known, l.Filename())
+				} else {
+					unknown = append(unknown, l.Filename())
+				}
+			}
+			add("  lunar limbs: %d from config %v, %d to detect %v", len(known), known, len(unknown), unknown)
+			if cfg.Cameras.Merge && len(fi.Layers) > 0 && uses("align", "review", "stack", "all", "beads") {
+				counts := map[string]int{}
+				for _, l := range fi.Layers {
+					counts[fi.cameraOf(l)]++
+				}
+				base := fi.cameraOf(fi.Layers[0])
+				for _, camera := range sortedNames(counts) {
+					_, given := cfg.Cameras.Solutions[camera]
+					switch {
+					case camera == base: add("  cameras: %s is the base (%d photos)", camera, counts[camera])
+					case given:          add("  cameras: merge %s (%d photos), by the solution from config", camera, counts[camera])
+					default:             add("  cameras: merge %s (%d photos), solving for scale, rotation & gain", camera, counts[camera])
+					}
+				}
+			}
+			if sc := cfg.Scoring; sc.Enabled {
+				add("  score frames: sharpness & transparency (min %.2f & %.2f; weighted: %v)", sc.MinSharpness, sc.MinTransparency, sc.Weight)
+			}
+			if es := cfg.Earthshine.withDefaults(); es.Enabled {
+				add("  earthshine: the disk within %.2f radii, against the corona at %.2f-%.2f", es.Disk, es.CoronaInner, es.CoronaOuter)
+			}
+		}
+	}
+	if uses("align", "review", "stack", "all", "beads") || (phase == "enhance" && len(fi.Layers) > 0) {
+		if cfg.DoEclipseAlignment && len(fi.Layers) > 1 {
+			for _, l := range fi.Layers[1:] {
+				name := alignmentName(&fi.Layers[0], &l)
+				_, exists := cfg.Alignments[name]
+				switch {
+				case cfg.DoFineTunedAlignment: add("  align %s: fine-tune search (slow)", name)
+				case exists:                   add("  align %s: transform from config", name)
+				default:                       add("  align %s: from the lunar limb centers", name)
+				}
+			}
+			if sm := cfg.AlignmentSmoothing.withDefaults(); sm.Enabled {
+				add("  smooth alignments: degree %d fit over time (replace %v, tolerance %gpx)", sm.Degree, sm.Replace, sm.Tolerance)
+			}
+		}
+	}
+	if uses("stack", "all") {
+		add("  fuse: %s (luminance %.2f), clip level %.2f", cfg.Fuser, cfg.FuserLuminance, cfg.ClipLevel)
+	}
+	if uses("enhance", "all") {
+		stages := fi.enhanceStages()
+		if len(stages) == 0 {
+			stages = []string{"(none configured)"}
+		}
+		add("  enhance: %s", strings.Join(stages, ", "))
+	}
+	if uses("render", "all") {
+		add("  tonemap: %s", strings.Join(fi.plannedTonemappers(), ", "))
+	}
+	if uses("partials") {
+		add("  fit the solar disk, with limb darkening, in %d partial phase photos", len(fi.Layers))
+	}
+	if uses("montage") {
+		mc := cfg.Montage.withDefaults()
+		totality := mc.Totality
+		if totality == "" {
+			totality = "(none)"
+		}
+		add("  montage: %d crescents, %dpx across (%s layout), around %s", len(fi.Layers), mc.Size, mc.Layout, totality)
+	}
+	if uses("mosaic") {
+		mc := cfg.Mosaic.withDefaults()
+		given := 0
+		for _, l := range fi.Layers {
+			if _, exists := mc.Tiles[l.Filename()]; exists {
+				given++
+			}
+		}
+		if len(fi.Layers) > 0 && given == len(fi.Layers) {
+			add("  mosaic: %d photos, placed as in the config", len(fi.Layers))
+		} else {
+			add("  mosaic: register %d pairs of photos (min overlap %.0f%%, fine-tune %v); exposures: %s", len(fi.Layers) * (len(fi.Layers) - 1) / 2,
+				100.0 * mc.MinOverlap, mc.FineTune, mc.Exposures)
+		}
+		add("  mosaic: blend, feathered over %.0f%% of each photo", 100.0 * mc.Feather)
+	}
+	if uses("auto") {
+		cc := cfg.Classify.withDefaults(cfg.Contacts)
+		add("  classify %d photos: partial (filtered, or light beyond less than %.0f%% of the limb), diamond ring, or totality (within %.1f mag of the faintest)",
+			len(fi.Layers), 100.0 * cc.Surround, cc.Threshold)
+		add("  then: diamond ring -> beads, totality -> all, partial -> partials")
+	}
+	if uses("beads") {
+		add("  beads: max combine the frames within %gs of C2 & C3, brightened by %g stops", cfg.Beads.withDefaults().Window, cfg.Beads.Brighten)
+	}
+	if uses("lightcurve") {
+		add("  measure the integrated brightness of %d photos, for the light curve", len(fi.Layers))
+		if cc := cfg.Contacts.withDefaults(); cc.Enabled {
+			add("  find second & third contact: photos more than %.1f mag brighter than totality have the photosphere in them", cc.Threshold)
+		}
+	}
+
+	add("")
+	add("Outputs:")
+	for _, f := range fi.plannedOutputs(phase) {
+		add("  %s", f)
+	}
+
+	add("")
+	add("Estimated peak memory: %s", formatBytes(fi.estimateMemory(phase)))
+	if fi.Config.Work.Buffers == "disk" {
+		add("  (not counting the aligned frames and fused pixels' inputs, which are on disk)")
+	}
+	if fi.Config.MaxMemory != "" {
+		if plan, err := fi.planMemory(phase); err != nil {
+			add("Memory budget: won't fit; %v", err)
+		} else {
+			lines = append(lines, plan.lines()...)
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// enhanceStages lists the post-fusion stages that are configured, in
+// the order Enhance() would run them.
+func (fi *FusedImage)enhanceStages() []string {
+	steps, err := fi.Config.pipelineSteps()
+	if err != nil {
+		return []string{fmt.Sprintf("(bad pipeline: %v)", err)}
+	}
+	stages := []string{}
+	for _, step := range steps {
+		if step.Name != step.enhanceStage.Name {
+			stages = append(stages, fmt.Sprintf("%s (%s)", step.Name, step.enhanceStage.Name))
+		} else {
+			stages = append(stages, step.Name)
+		}
+	}
+	return stages
+}
+
+func (fi *FusedImage)plannedTonemappers() []string {
+	if fi.Config.Tonemapper == "all" {
+		return Tonemappers
+	}
+	return []string{fi.Config.Tonemapper}
+}
+
+func (fi *FusedImage)plannedOutputs(phase string) []string {
+	oc := fi.Config.Output
+	if oc.PerRun && oc.runDir == "" {
+		oc.runDir = filepath.Join(oc.Dir, "run-YYYYMMDD-HHMMSS")
+	}
+	intermediate := func(names ...string) []string {
+		for i := range names {
+			names[i] = filepath.Join(oc.dir(IntermediateOutput), names[i])
+		}
+		return names
+	}
+	final := func(name string) string { return filepath.Join(oc.dir(FinalOutput), name) }
+	moonPositions := filepath.Join(oc.dir(ReportOutput), "moonpositions.yaml")
+	earthshine := filepath.Join(oc.dir(ReportOutput), "earthshine.yaml")
+	cameras := filepath.Join(oc.dir(ReportOutput), "cameras.yaml")
+
+	switch phase {
+	case "detect":
+		outputs := intermediate("detect.yaml")
+		if fi.Config.Ephemeris.Enabled {
+			outputs = append(outputs, moonPositions)
+		}
+		if fi.Config.Earthshine.Enabled {
+			outputs = append(outputs, earthshine)
+		}
+		return outputs
+	case "align":
+		outputs := intermediate("align.yaml")
+		if fi.Config.Cameras.Merge {
+			outputs = append(outputs, cameras)
+		}
+		return outputs
+	case "review":  return intermediate("review.yaml")
+	case "partials": return []string{filepath.Join(oc.dir(ReportOutput), "partials.yaml")}
+	case "montage":  return []string{final("montage.png")}
+	case "mosaic":   return []string{final("mosaic.png"), filepath.Join(oc.dir(ReportOutput), "mosaic.yaml")}
+	case "auto":
+		outputs := []string{filepath.Join(oc.dir(ReportOutput), "classification.yaml")}
+		outputs = append(outputs, final("beads-c2.png"), final("beads-c3.png"))
+		outputs = append(outputs, fi.plannedOutputs("all")...)
+		outputs = append(outputs, fi.plannedOutputs("partials")...)
+		if fi.Config.Montage.Totality != "" {
+			outputs = append(outputs, final("montage.png"))
+		}
+		return outputs
+	case "beads":
+		groups, _ := fi.beadsGroups()
+		outputs := []string{}
+		for _, name := range sortedNames(groups) {
+			outputs = append(outputs, final(name))
+		}
+		return outputs
+	case "lightcurve":
+		outputs := []string{filepath.Join(oc.dir(ReportOutput), "lightcurve.csv"), filepath.Join(oc.dir(ReportOutput), "lightcurve.png")}
+		if fi.Config.Contacts.Enabled {
+			outputs = append(outputs, filepath.Join(oc.dir(ReportOutput), "contacts.yaml"))
+		}
+		return outputs
+	case "stack":
+		outputs := intermediate("stacked.hdr", "stacked-clipped.png", "stack.yaml")
+		if fi.Config.Cameras.Merge {
+			outputs = append(outputs, cameras)
+		}
+		if fi.Config.CoronaProfile.Enabled {
+			outputs = append(outputs, final(fi.Config.CoronaProfile.filename()))
+		}
+		if fi.Config.Polarization.Enabled {
+			for _, name := range fi.Config.Polarization.filenames() {
+				outputs = append(outputs, final(name))
+			}
+		}
+		if fi.Config.Radiance.Enabled {
+			outputs = append(outputs, final(fi.Config.Radiance.filename()))
+		}
+		if fi.Config.Cube.Enabled {
+			outputs = append(outputs, final("cube.fits"))
+		}
+		if fi.Config.Timelapse.Enabled {
+			outputs = append(outputs, final("timelapse.mp4"))
+		}
+		if fi.Config.Animation.Enabled {
+			outputs = append(outputs, final(fi.Config.Animation.filename()))
+		}
+		return outputs
+	case "enhance": return append([]string{final("fused.hdr")}, intermediate("enhance.yaml")...)
+	}
+
+	outputs := []string{}
+	if phase == "all" {
+		outputs = append(outputs, final("fused.hdr"))
+		if fi.Config.Ephemeris.Enabled {
+			outputs = append(outputs, moonPositions)
+		}
+		if fi.Config.Earthshine.Enabled {
+			outputs = append(outputs, earthshine)
+		}
+		if fi.Config.Cameras.Merge {
+			outputs = append(outputs, cameras)
+		}
+		if fi.Config.CoronaProfile.Enabled {
+			outputs = append(outputs, final(fi.Config.CoronaProfile.filename()))
+		}
+		if fi.Config.Polarization.Enabled {
+			for _, name := range fi.Config.Polarization.filenames() {
+				outputs = append(outputs, final(name))
+			}
+		}
+		if fi.Config.Radiance.Enabled {
+			outputs = append(outputs, final(fi.Config.Radiance.filename()))
+		}
+		if fi.Config.Cube.Enabled {
+			outputs = append(outputs, final("cube.fits"))
+		}
+		if fi.Config.Timelapse.Enabled {
+			outputs = append(outputs, final("timelapse.mp4"))
+		}
+		if fi.Config.Animation.Enabled {
+			outputs = append(outputs, final(fi.Config.Animation.filename()))
+		}
+	}
+	if fi.Config.Isophotes.Enabled {
+		outputs = append(outputs, final("isophotes.png"))
+	}
+	for _, name := range fi.plannedTonemappers() {
+		base := "tmo-" + name
+		outputs = append(outputs, final(base + ".png"))
+		for _, r := range fi.Config.Renditions {
+			outputs = append(outputs, final(fmt.Sprintf("%s-%s.png", base, r.Name)))
+		}
+		if fi.Config.Isophotes.Enabled && fi.Config.Isophotes.Overlay {
+			outputs = append(outputs, final(base + "-isophotes.png"))
+		}
+		if fi.Config.Annotation.Enabled {
+			outputs = append(outputs, final(base + "-annotated.png"))
+		}
+	}
+	return outputs
+}
+
+// estimateMemory is a rough guess at the peak memory use: the photos,
+// their aligned copies, and the fused pixels (which hold a copy of
+// every layer's value). If we don't know where the limb is yet, we
+// assume the output is as big as the photos. With `work.buffers: disk`,
+// the aligned copies and the pixels' copies don't count.
+func (fi *FusedImage)estimateMemory(phase string) uint64 {
+	if len(fi.Layers) == 0 {
+		n := uint64(fi.OutputArea.Dx() * fi.OutputArea.Dy())
+		return n * uint64(unsafe.Sizeof(Pixel{}))
+	}
+
+	onDisk := fi.Config.Work.Buffers == "disk" // they are mapped files, that the OS can page out
+	photos := uint64(0)
+	for i, l := range fi.Layers {
+		n := uint64(l.Dims.X * l.Dims.Y)
+		photos += n * 8         // 16 bits per RGBA channel
+		if i > 0 && phase != "detect" && phase != "partials" && phase != "lightcurve" && phase != "montage" && phase != "mosaic" && !onDisk {
+			photos += n * 12      // the aligned copy is an eimage.Planar, float32 RGB
+		}
+	}
+	if phase == "detect" || phase == "align" || phase == "review" || phase == "beads" || phase == "partials" || phase == "lightcurve" || phase == "montage" {
+		return photos
+	} else if phase == "mosaic" {
+		// The shrunken copies (half size and down, a float64 a pixel), and
+		// a canvas at most as big as the photos laid side by side
+		return photos + photos / 8 * 3 + photos
+	}
+
+	out := fi.estimatedOutputArea()
+	perPixel := uint64(unsafe.Sizeof(Pixel{}))
+	if !onDisk {
+		perPixel += uint64(len(fi.Layers)) * uint64(unsafe.Sizeof(ecolor.CameraNative{})) // In
+	}
+	return photos + uint64(out.Dx() * out.Dy()) * perPixel
+}
+
+// estimatedOutputArea is where the output will be, once the photos are
+// aligned and framed; until the limb is found, all of the first photo.
+func (fi *FusedImage)estimatedOutputArea() image.Rectangle {
+	base := fi.Layers[0]
+	out := image.Rectangle{Max: base.Dims}
+	if ll, exists := fi.Config.LunarLimbs[base.Filename()]; exists && fi.Config.DoEclipseAlignment {
+		out = fi.Config.Framing.Area(ll.Center(), ll.Radius() + 3, fi.Config.OutputWidthInSolarDiameters)
+	}
+	return out
+}
+
+func formatBytes(b uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f, i := float64(b), 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
@@ -0,0 +1,193 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// EarthshineConfig asks for the moon's dark disk - lit only by sunlight
+// reflected off the earth - to be measured in the long exposures, where
+// it's bright enough to see, against the inner corona and the sky. The
+// earth's albedo is what sets it.
+type EarthshineConfig struct {
+	Enabled      bool
+	Disk         float64  // How much of the disk to measure, as a fraction of the lunar limb's radius (staying clear of the limb's glare); if zero, 0.8
+	CoronaInner  float64  // The annulus of inner corona to compare against, in lunar radii; if zero, 1.1
+	CoronaOuter  float64  // If zero, 1.3
+}
+
+func (ec EarthshineConfig)withDefaults() EarthshineConfig {
+	if ec.Disk == 0.0 { ec.Disk = 0.8 }
+	if ec.CoronaInner == 0.0 { ec.CoronaInner = 1.1 }
+	if ec.CoronaOuter == 0.0 { ec.CoronaOuter = 1.3 }
+	return ec
+}
+
+// An EarthshineFrame is one frame's measurement. Luminances are in
+// cd/m² (see RadianceConfig), from the median of the pixels in each
+// region, so stars and hot pixels don't count.
+type EarthshineFrame struct {
+	Filename           string
+	EV                 int
+	Filter             float64
+	Disk               float64  // The dark disk, as it came out
+	Sky                float64  // In the corners of the photo; zero if it's lost in the noise
+	Corona             float64  // The inner corona, less the sky; zero if it was clipped
+	Earthshine         float64  // The disk, less the sky that's scattered in front of it
+	SurfaceBrightness  float64  // Of the earthshine, in magnitudes per square arcsecond
+	ToCorona           float64  `yaml:",omitempty"` // Earthshine over corona
+	ToSky              float64  `yaml:",omitempty"` // Earthshine over sky
+}
+
+// An EarthshineReport is what goes into `earthshine.yaml`, in the
+// reports dir: the median over the frames it could be measured in, and
+// each of those frames.
+type EarthshineReport struct {
+	Earthshine         float64  // cd/m²
+	SurfaceBrightness  float64  // mag/arcsec²
+	ToCorona           float64
+	ToSky              float64
+	Scatter            float64  // The frames' median absolute deviation in earthshine, as a fraction of it
+	Skipped            []string `yaml:",omitempty"` // Frames where the disk was too dark to measure (or clipped)
+	Frames             []EarthshineFrame
+}
+
+// surfaceBrightness turns a luminance (cd/m²) into magnitudes per square
+// arcsecond (V band).
+func surfaceBrightness(cdm2 float64) float64 {
+	return 12.58 - 2.5 * math.Log10(cdm2)
+}
+
+// Earthshine measures the earthshine in each frame that it shows up in.
+// It needs the lunar limbs (DetectLunarLimbs, or Align).
+func (fi *FusedImage)Earthshine(ctx context.Context) (*EarthshineReport, error) {
+	defer fi.measureStage(ctx, "earthshine")()
+	cfg := fi.Config.Earthshine.withDefaults()
+	k, _ := fi.saturation()
+	clip := fi.Config.ClipLevel
+
+	frames := make([]*EarthshineFrame, len(fi.Layers))
+	progress := fi.Config.newProgress("Measuring earthshine", len(fi.Layers))
+	err := eimage.ParallelFor(ctx, fi.workers("earthshine"), len(fi.Layers), func(_, i int) {
+		defer progress.Add(1)
+		l := &fi.Layers[i]
+		r := limbRadius(l)
+		if r == 0.0 {
+			return
+		}
+		c := limbCenter(l)
+		disk, corona, coronaClipped := []float64{}, []float64{}, 0
+		bounds := l.LoadedImage.Bounds()
+		outer := cfg.CoronaOuter * r
+		for y:=int(c.Y - outer); y<=int(c.Y + outer); y++ {
+			for x:=int(c.X - outer); x<=int(c.X + outer); x++ {
+				if x < bounds.Min.X || y < bounds.Min.Y || x >= bounds.Max.X || y >= bounds.Max.Y {
+					continue
+				}
+				d := math.Hypot(float64(x) + 0.5 - c.X, float64(y) + 0.5 - c.Y) / r
+				if d > cfg.Disk && (d < cfg.CoronaInner || d > cfg.CoronaOuter) {
+					continue
+				}
+				red, g, b := eimage.PixelRGB(l.LoadedImage, x, y)
+				if d <= cfg.Disk {
+					if red >= clip || g >= clip || b >= clip {
+						return // The disk is clipped; far too long an exposure, or not the moon
+					}
+					disk = append(disk, (red + g + b) / 3.0)
+				} else {
+					if red >= clip || g >= clip || b >= clip {
+						coronaClipped++
+					}
+					corona = append(corona, (red + g + b) / 3.0)
+				}
+			}
+		}
+		sort.Float64s(disk)
+		if len(disk) == 0 || disk[len(disk)/2] < minBackground {
+			return // Too short an exposure for the earthshine to show
+		}
+
+		scale := k * l.IlluminanceAtMaxExposure * math.Pow(10.0, fi.Config.layerOverride(i).Filter) / 250.0
+		f := &EarthshineFrame{Filename: l.Filename(), EV: l.EV, Filter: fi.Config.layerOverride(i).Filter, Disk: disk[len(disk)/2] * scale}
+		if bg := cornerBackground(*l); bg >= minBackground {
+			f.Sky = bg * scale
+		}
+		f.Earthshine = f.Disk - f.Sky
+		if f.Earthshine <= 0.0 {
+			return // The disk is no brighter than the sky: it's all scatter
+		}
+		f.SurfaceBrightness = surfaceBrightness(f.Earthshine)
+		if len(corona) > 0 && coronaClipped * 2 < len(corona) {
+			f.Corona = medianOf(corona) * scale - f.Sky
+			if f.Corona > 0.0 {
+				f.ToCorona = f.Earthshine / f.Corona
+			}
+		}
+		if f.Sky > 0.0 {
+			f.ToSky = f.Earthshine / f.Sky
+		}
+		frames[i] = f
+	})
+	progress.Done()
+	if err != nil {
+		return nil, err
+	}
+
+	rpt := &EarthshineReport{}
+	earthshine, toCorona, toSky := []float64{}, []float64{}, []float64{}
+	for i, f := range frames {
+		if f == nil {
+			rpt.Skipped = append(rpt.Skipped, fi.Layers[i].Filename())
+			continue
+		}
+		fi.Config.debugf("Earthshine in %s: disk %.4g, sky %.4g, corona %.4g cd/m²; earthshine %.4g cd/m² (%.2f mag/arcsec²)\n",
+			f.Filename, f.Disk, f.Sky, f.Corona, f.Earthshine, f.SurfaceBrightness)
+		rpt.Frames = append(rpt.Frames, *f)
+		earthshine = append(earthshine, f.Earthshine)
+		if f.ToCorona > 0.0 { toCorona = append(toCorona, f.ToCorona) }
+		if f.ToSky > 0.0 { toSky = append(toSky, f.ToSky) }
+	}
+	if len(rpt.Frames) == 0 {
+		return nil, fmt.Errorf("earthshine: the moon's disk didn't show up in any of the photos; it needs long exposures")
+	}
+	sort.SliceStable(rpt.Frames, func(i, j int) bool { return rpt.Frames[i].EV < rpt.Frames[j].EV })
+
+	rpt.Earthshine, rpt.ToCorona, rpt.ToSky = medianOf(earthshine), medianOf(toCorona), medianOf(toSky)
+	rpt.SurfaceBrightness = surfaceBrightness(rpt.Earthshine)
+	deviations := []float64{}
+	for _, e := range earthshine {
+		deviations = append(deviations, math.Abs(e - rpt.Earthshine))
+	}
+	rpt.Scatter = medianOf(deviations) / rpt.Earthshine
+	return rpt, nil
+}
+
+// writeEarthshine measures the earthshine, if the config asks for it,
+// and writes the report.
+func (fi *FusedImage)writeEarthshine(ctx context.Context) error {
+	if !fi.Config.Earthshine.Enabled {
+		return nil
+	}
+	rpt, err := fi.Earthshine(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(rpt)
+	if err != nil {
+		return fmt.Errorf("earthshine: %v", err)
+	}
+	filename := fi.Config.OutputPath(ReportOutput, "earthshine.yaml")
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write earthshine '%s': %v", filename, err)
+	}
+	fi.Config.infof("Measured earthshine in %d frames: %.4g cd/m² (%.2f mag/arcsec², %.2g of the inner corona), scatter %.0f%%; wrote %s\n",
+		len(rpt.Frames), rpt.Earthshine, rpt.SurfaceBrightness, rpt.ToCorona, 100.0 * rpt.Scatter, filename)
+	return nil
+}
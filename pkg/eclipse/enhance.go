@@ -0,0 +1,123 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eenhance"
+)
+
+// An enhanceStage is one of the optional post-fusion stages.
+type enhanceStage struct {
+	Name     string
+	Enabled  func(c Config) bool
+	Run      StageFunc
+}
+
+// builtinStage is for the built-in stages, which don't fail (they warn
+// and skip, if they can't do their thing) and are quick enough not to
+// need to watch ctx.
+func builtinStage(run func(fi *FusedImage)) StageFunc {
+	return func(_ context.Context, fi *FusedImage) error { run(fi); return nil }
+}
+
+// The post-fusion stages, in the order they run (unless the config has
+// a Pipeline; see pipeline.go).
+var enhanceStages = []enhanceStage{
+	{"inpaint",            func(c Config) bool { return c.Inpaint.Enabled },             builtinStage((*FusedImage).InpaintClipped)},
+	{"skygradient",        func(c Config) bool { return c.SkyGradient.Order > 0 },       builtinStage((*FusedImage).RemoveSkyGradient)},
+	{"coronawhitebalance", func(c Config) bool { return c.CoronaWhiteBalance.Mode != "" }, builtinStage((*FusedImage).NeutralizeCorona)},
+	{"channelmixer",       func(c Config) bool { return c.ChannelMixer.Enabled() && !c.ChannelMixer.InCameraSpace() }, builtinStage((*FusedImage).MixChannels)},
+	{"denoise",            func(c Config) bool { return c.Denoise.Method != "" },        builtinStage((*FusedImage).Denoise)},
+	{"radialsaturation",   func(c Config) bool { return len(c.RadialSaturation) > 0 },   builtinStage((*FusedImage).AdjustRadialSaturation)},
+	{"hsl",                func(c Config) bool { return len(c.HSL) > 0 },                builtinStage((*FusedImage).AdjustHSL)},
+	{"syntheticmoon",      func(c Config) bool { return c.SyntheticMoon.Mode != "" },    builtinStage((*FusedImage).RenderSyntheticMoon)},
+	{"photometry",         func(c Config) bool { return len(c.Photometry.Stars) > 0 },   builtinStage((*FusedImage).CalibratePhotometry)},
+	{"stars",              func(c Config) bool { return c.Stars.Enabled },               builtinStage((*FusedImage).OverlayStars)},
+}
+
+// Enhance runs the optional post-fusion stages over the developed
+// HDR pixels. It happens after Fuse(), and before the HDR file is
+// written out and tonemapped, so all the stages work in linear HDR
+// space. Each stage is configured by its own block in the Config, and
+// is skipped if not configured. Each step of a Pipeline sees the config
+// with its own params on top. If a stage fails, or ctx is cancelled,
+// the remaining steps are skipped, and it returns the error (or
+// ctx.Err()).
+func (fi *FusedImage)Enhance(ctx context.Context) error {
+	steps, err := fi.Config.pipelineSteps()
+	if err != nil {
+		return fmt.Errorf("pipeline: %v", err)
+	}
+	progress := fi.Config.newProgress("Enhancing (stages)", len(steps))
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start := time.Now()
+		saved := fi.Config
+		fi.Config = step.cfg
+		err := fi.withHooks(ctx, step.Name, func(ctx context.Context) error {
+			if err := step.Run(ctx, fi); err != nil && ctx.Err() == nil {
+				return fmt.Errorf("stage %s: %v", step.Name, err)
+			} else if err != nil {
+				return ctx.Err()
+			}
+			return nil
+		})
+		fi.Config = saved
+		if err != nil {
+			return err
+		}
+		progress.Add(1)
+		fi.Config.timeEvent("enhance", start, "stage", step.enhanceStage.Name, "step", step.Name)
+	}
+	progress.Done()
+	return nil
+}
+
+// SolarRadii returns how far the output pixel at [x,y] is from the
+// center of the lunar limb, in units of the lunar radius (which during
+// totality is pretty much the solar radius). Returns -1 if we don't
+// know where the limb is (e.g. `-aligneclipse=false`).
+func (fi *FusedImage)SolarRadii(x, y int) float64 {
+	if fi.Config.LunarRadius == 0 {
+		return -1
+	}
+	dx := float64(x - fi.Config.LunarCenter.X)
+	dy := float64(y - fi.Config.LunarCenter.Y)
+	return math.Sqrt(dx*dx + dy*dy) / float64(fi.Config.LunarRadius)
+}
+
+// needsLunarLimb is a helper for the stages that only make sense if
+// we found the lunar limb.
+func (fi *FusedImage)needsLunarLimb(stage string) bool {
+	if fi.Config.LunarRadius == 0 {
+		fi.Config.warnf("%s: no lunar limb was found (is -aligneclipse off ?), skipping\n", stage)
+		return false
+	}
+	return true
+}
+
+// The filters themselves are in pkg/eenhance.
+type RadialProfile = eenhance.RadialProfile
+type RadialPoint   = eenhance.RadialPoint
+
+// adjustPixels runs the adjuster over each developed pixel.
+func (fi *FusedImage)adjustPixels(a eenhance.Adjuster) {
+	fi.forEachPixel("", func(x, y int, p *Pixel) {
+		p.DevelopedRGB = a.Adjust(p.DevelopedRGB, fi.SolarRadii(x, y))
+	})
+}
+
+// developedImage is the developed pixels, as an eenhance.Image.
+type developedImage struct {
+	fi  *FusedImage
+}
+
+func (di developedImage)Dims() (int, int)          { return di.fi.OutputArea.Dx(), di.fi.OutputArea.Dy() }
+func (di developedImage)RGB(x, y int) hdrcolor.RGB { return di.fi.Pix(x, y).DevelopedRGB }
@@ -2,6 +2,7 @@ package eclipse
 
 import (
 	"fmt"
+	"math"
 )
 
 type rat64 [2]int64
@@ -105,6 +106,22 @@ func (ev ExposureValue)String() string {
 	return s + fmt.Sprintf(", EV %2d (%6.0f lux)", ev.EV, ev.IlluminanceAtMaxExposure)
 }
 
+// ExactIlluminance is IlluminanceAtMaxExposure, from the ISO, aperture
+// & shutter speed to the nearest third of a stop, rather than rounded
+// off to whole stops (it's on the same scale, 2.5 lux x 2^EV). The
+// settings cameras report are nominal values for thirds of a stop
+// (1/60 is really 1/64, f/5.6 is really f/5.66), hence the rounding.
+// Without all three, it's IlluminanceAtMaxExposure.
+func (ev ExposureValue)ExactIlluminance() float64 {
+	if ev.ISO == 0 || ev.ApertureX10 == 0 || ev.ShutterSpeed[0] == 0 || ev.ShutterSpeed[1] == 0 {
+		return ev.IlluminanceAtMaxExposure
+	}
+	n := float64(ev.ApertureX10) / 10.0
+	t := float64(ev.ShutterSpeed[0]) / float64(ev.ShutterSpeed[1])
+	stops := math.Round(3.0 * math.Log2(n*n / t * 100.0 / float64(ev.ISO))) / 3.0
+	return 2.5 * math.Exp2(stops)
+}
+
 func (ev *ExposureValue)Validate() error {
 	// We know that f/2.8, at 1/4000, is EV=15; figure how we differ from this in stops.
 	apAdj := -1 * (closestApertureIndex(28) - closestApertureIndex(int(ev.ApertureX10)))
@@ -0,0 +1,23 @@
+package eclipse
+
+import(
+	"time"
+)
+
+// Structured events (stage timings, per-frame metrics) go to the run's
+// logger (see WithLogger), for tools wrapping eclipse-hdr to track
+// runs; see `-logformat=json`. Without one, they are dropped.
+
+// logEvent records a structured event; `args` are slog key/value pairs.
+func (c Config)logEvent(event string, args ...any) {
+	if l := c.logger(); l != nil {
+		l.Info(event, c.withLogAttrs(args)...)
+	}
+}
+
+// timeEvent is for deferring; it logs the event along with how long
+// it took, e.g. `defer fi.Config.timeEvent("fuse", time.Now())`.
+func (c Config)timeEvent(event string, start time.Time, args ...any) {
+	args = append(args, "seconds", time.Since(start).Seconds())
+	c.logEvent(event, args...)
+}
@@ -0,0 +1,169 @@
+package eclipse
+
+import(
+	"image"
+	"image/color"
+	"time"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// These accessors are the stable way for other code to get at the
+// frames (the layers) behind a FusedImage, at each step of the way:
+//
+//   Original(i)    the photo as loaded, in its own coords
+//   Warped(i)      the photo after alignment, in the shared input coords
+//   Linearized(i)  the warped photo as linear light, over the output
+//                  area, scaled to a common exposure
+//   Masked(i)      the same, with the pixels that can't be used (clipped,
+//                  or beyond the edge of the photo) left transparent
+//
+// and FrameInfo(i) has the metadata for it. Frames are in the same order
+// as Layers (ascending EV). The fused pixels themselves are the
+// FusedImage's own image.Image (and hdr.Image); see also ClippedMask.
+
+// FrameInfo is what we know about one frame, from its metadata and
+// from the pipeline so far.
+type FrameInfo struct {
+	Index              int
+	Filename           string       // The file it came from (the full path)
+	CameraModel        string
+	CaptureTime        time.Time    // Zero if the photo didn't say
+	Dims               image.Point
+	ExposureValue
+	LunarLimb                       // Zero until DetectLunarLimbs (or Align) has run
+	AlignmentTransform              // Zero until Align has run
+	Override           ImageOverride // From the config's `images:`, if there was one
+}
+
+func (fi *FusedImage)NumFrames() int { return len(fi.Layers) }
+
+// Frame returns the metadata for frame i.
+func (fi *FusedImage)Frame(i int) FrameInfo {
+	l := fi.Layers[i]
+	return FrameInfo{
+		Index:              i,
+		Filename:           l.LoadFilename,
+		CameraModel:        l.CameraModel,
+		CaptureTime:        l.CaptureTime,
+		Dims:               l.Dims,
+		ExposureValue:      l.ExposureValue,
+		LunarLimb:          l.LunarLimb,
+		AlignmentTransform: l.AlignmentTransform,
+		Override:           fi.Config.layerOverride(i),
+	}
+}
+
+// Frames returns the metadata for every frame.
+func (fi *FusedImage)Frames() []FrameInfo {
+	frames := []FrameInfo{}
+	for i := range fi.Layers {
+		frames = append(frames, fi.Frame(i))
+	}
+	return frames
+}
+
+// Original returns frame i as it was loaded (nil if only the metadata
+// was loaded).
+func (fi *FusedImage)Original(i int) image.Image { return fi.Layers[i].LoadedImage }
+
+// Warped returns frame i after alignment (nil before Align has run).
+func (fi *FusedImage)Warped(i int) image.Image { return fi.Layers[i].Image }
+
+// Linearized returns a view of frame i (after alignment) as camera
+// native linear light, over the output area. It is rescaled to the
+// fused image's common illuminance, so the frames can be compared
+// pixel for pixel; before Fuse has run, to that of the shortest
+// exposure. Black and white points aren't applied.
+func (fi *FusedImage)Linearized(i int) hdr.Image {
+	return frameView{fi, i, fi.commonIllumAtMax(), false}
+}
+
+// Masked is like Linearized, but the pixels that can't be used (those
+// clipped in any channel, or where framing padded beyond the photo)
+// are transparent; so its At() has alpha, and its HDRAt() is black.
+func (fi *FusedImage)Masked(i int) hdr.Image {
+	return frameView{fi, i, fi.commonIllumAtMax(), true}
+}
+
+// ClippedMask returns which output pixels were clipped in every frame,
+// as white on black (all black before Fuse has run).
+func (fi *FusedImage)ClippedMask() *image.Gray {
+	mask := image.NewGray(fi.OutputArea)
+	if len(fi.Pixels) == 0 {
+		return mask
+	}
+	for x:=0; x<fi.OutputArea.Dx(); x++ {
+		for y:=0; y<fi.OutputArea.Dy(); y++ {
+			if fi.Pix(x, y).Clipped {
+				mask.SetGray(x, y, color.Gray{0xFF})
+			}
+		}
+	}
+	return mask
+}
+
+func (fi *FusedImage)commonIllumAtMax() float64 {
+	if fi.IllumAtMax > 0 {
+		return fi.IllumAtMax
+	}
+	illum := 0.0
+	for _, l := range fi.Layers {
+		if l.IlluminanceAtMaxExposure > illum {
+			illum = l.IlluminanceAtMaxExposure
+		}
+	}
+	return illum
+}
+
+// A frameView reads one frame's warped pixels, lazily, as output pixels.
+type frameView struct {
+	fi         *FusedImage
+	layer      int
+	illumAtMax float64
+	masked     bool
+}
+
+func (fv frameView)ColorModel() color.Model { return hdrcolor.RGBModel }
+func (fv frameView)Bounds() image.Rectangle { return fv.fi.OutputArea }
+func (fv frameView)Size() int               { return fv.fi.Size() }
+
+func (fv frameView)HDRAt(x, y int) hdrcolor.Color {
+	rgb, ok := fv.at(x, y)
+	if !ok && fv.masked {
+		return hdrcolor.RGB{}
+	}
+	return rgb
+}
+
+func (fv frameView)At(x, y int) color.Color {
+	rgb, ok := fv.at(x, y)
+	if !ok && fv.masked {
+		return color.Transparent
+	}
+	return rgb
+}
+
+// at returns the linear pixel, and whether it is usable.
+func (fv frameView)at(x, y int) (hdrcolor.RGB, bool) {
+	l := fv.fi.Layers[fv.layer]
+	if l.Image == nil {
+		return hdrcolor.RGB{}, false
+	}
+	pt := image.Point{x + fv.fi.InputArea.Min.X, y + fv.fi.InputArea.Min.Y}
+	if !pt.In(l.Image.Bounds().Intersect(fv.fi.PhotoArea)) {
+		return hdrcolor.RGB{}, false
+	}
+	cn := ecolor.CameraNative{IllumAtMax: l.IlluminanceAtMaxExposure}
+	cn.R, cn.G, cn.B = eimage.PixelRGB(l.Image, pt.X, pt.Y)
+	clip := fv.fi.Config.ClipLevel
+	usable := cn.R < clip && cn.G < clip && cn.B < clip
+	if fv.illumAtMax > 0 {
+		cn.AdjustIllumAtMax(fv.illumAtMax)
+	}
+	return cn.RGB, usable
+}
@@ -0,0 +1,133 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// ScoringConfig scores each frame for how sharp it is, and how clear
+// the sky was, once the lunar limbs have been found. The scores go into
+// the run manifest; they can also drop the worst frames, or (with the
+// `avg` fuser) weight each frame by its score.
+type ScoringConfig struct {
+	Enabled          bool
+	MinSharpness     float64  // Drop frames less sharp than this (as a fraction of the median frame's); if zero, none are dropped
+	MinTransparency  float64  // Likewise, for frames with a brighter sky than the median's
+	Weight           bool     // With the `avg` fuser, multiply each frame's weight by its score
+}
+
+// A FrameScore is how one frame measured up. Sharpness and
+// transparency are relative to the median frame, so 1.0 is typical,
+// and lower is worse.
+type FrameScore struct {
+	EdgeWidth     float64  // Of the lunar limb, in pixels, from 10% to 90% of the way up from the moon to the corona
+	Background    float64  // The sky in the corners of the photo, scaled by exposure (lux, like IlluminanceAtMaxExposure); zero if it's lost in the noise
+	Sharpness     float64  // The median edge width, over this frame's
+	Transparency  float64  // The median background, over this frame's; zero if there's no background to measure
+	Score         float64  // Sharpness x transparency, each capped at 1.0
+}
+
+// minBackground is the faintest linear sky (of 1.0) that counts as a
+// measurement, rather than read noise.
+const minBackground = 0.002
+
+// ScoreFrames works out a FrameScore for each layer, and drops any that
+// fall below the config's minimums. It needs the lunar limbs.
+func (fi *FusedImage)ScoreFrames(ctx context.Context) error {
+	cfg := fi.Config.Scoring
+	if !cfg.Enabled {
+		return nil
+	}
+	defer fi.measureStage(ctx, "scoring")()
+	scores := make([]FrameScore, len(fi.Layers))
+	progress := fi.Config.newProgress("Scoring frames", len(fi.Layers))
+	err := eimage.ParallelFor(ctx, fi.workers("scoring"), len(fi.Layers), func(_, i int) {
+		l := fi.Layers[i]
+		scores[i] = FrameScore{EdgeWidth: l.LunarLimb.EdgeWidth(l.LoadedImage)}
+		if bg := cornerBackground(l); bg >= minBackground {
+			scores[i].Background = bg * l.IlluminanceAtMaxExposure
+		}
+		progress.Add(1)
+	})
+	progress.Done()
+	if err != nil {
+		return err
+	}
+
+	widths, backgrounds := []float64{}, []float64{}
+	for _, s := range scores {
+		if s.EdgeWidth > 0.0 { widths = append(widths, s.EdgeWidth) }
+		if s.Background > 0.0 { backgrounds = append(backgrounds, s.Background) }
+	}
+	medianWidth, medianBackground := medianOf(widths), medianOf(backgrounds)
+
+	if fi.Scores == nil {
+		fi.Scores = map[string]FrameScore{}
+	}
+	failed := map[int]bool{}
+	for i, s := range scores {
+		l := fi.Layers[i]
+		s.Sharpness = 1.0
+		if s.EdgeWidth > 0.0 {
+			s.Sharpness = medianWidth / s.EdgeWidth
+		}
+		if s.Background > 0.0 {
+			s.Transparency = medianBackground / s.Background
+		}
+		s.Score = capAt1(s.Sharpness)
+		if s.Transparency > 0.0 {
+			s.Score *= capAt1(s.Transparency)
+		}
+		fi.Scores[l.Filename()] = s
+		fi.Config.debugf("Frame score for %s: edge width %.2fpx, background %.4g, sharpness %.2f, transparency %.2f, score %.2f\n",
+			l.Filename(), s.EdgeWidth, s.Background, s.Sharpness, s.Transparency, s.Score)
+		fi.Config.logEvent("frame.score", "frame", l.Filename(), "edgewidth", s.EdgeWidth, "background", s.Background,
+			"sharpness", s.Sharpness, "transparency", s.Transparency, "score", s.Score)
+
+		if cfg.MinSharpness > 0.0 && s.Sharpness < cfg.MinSharpness {
+			fi.frameDropped(FrameFailure{Filename: l.Filename(), Stage: "scoring", Reason: fmt.Sprintf("sharpness %.2f is below %.2f (edge width %.2fpx, median %.2fpx)",
+				s.Sharpness, cfg.MinSharpness, s.EdgeWidth, medianWidth)})
+			failed[i] = true
+		} else if cfg.MinTransparency > 0.0 && s.Transparency > 0.0 && s.Transparency < cfg.MinTransparency {
+			fi.frameDropped(FrameFailure{Filename: l.Filename(), Stage: "scoring", Reason: fmt.Sprintf("transparency %.2f is below %.2f (background %.4g, median %.4g)",
+				s.Transparency, cfg.MinTransparency, s.Background, medianBackground)})
+			failed[i] = true
+		}
+	}
+	fi.setLayerOverrides() // for the weights
+	return fi.dropLayers(failed)
+}
+
+func capAt1(v float64) float64 {
+	if v > 1.0 {
+		return 1.0
+	}
+	return v
+}
+
+// cornerBackground is the median linear brightness (the mean of the
+// channels) in the four corners of the photo, as far from the sun as
+// it gets; each corner is a twentieth of the photo's width & height.
+func cornerBackground(l Layer) float64 {
+	bounds := l.LoadedImage.Bounds()
+	cw, ch := bounds.Dx() / 20, bounds.Dy() / 20
+	if cw == 0 || ch == 0 {
+		return 0.0
+	}
+	vals := []float64{}
+	for _, corner := range []struct{ x, y int }{
+		{bounds.Min.X, bounds.Min.Y}, {bounds.Max.X - cw, bounds.Min.Y}, {bounds.Min.X, bounds.Max.Y - ch}, {bounds.Max.X - cw, bounds.Max.Y - ch},
+	} {
+		for y:=corner.y; y<corner.y+ch; y++ {
+			for x:=corner.x; x<corner.x+cw; x++ {
+				r, g, b := eimage.PixelRGB(l.LoadedImage, x, y)
+				vals = append(vals, (r + g + b) / 3.0)
+			}
+		}
+	}
+	sort.Float64s(vals)
+	return vals[len(vals)/2]
+}
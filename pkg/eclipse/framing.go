@@ -0,0 +1,54 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+)
+
+// FramingConfig controls the shape and size of the output images, so
+// the final composites don't need cropping in some other tool. The
+// sun is always kept in the center.
+type FramingConfig struct {
+	SolarRadii   float64  // Height of the output, in solar radii; if zero, use OutputWidthInSolarDiameters
+	AspectRatio  string   // Width:height, e.g. "16:9" or "3:2"; if empty, square
+	Padding      int      // A black border (in pixels) to add around the output
+}
+
+// Area returns the rectangle (in input coords) that should be
+// processed and output, for a sun at `center` with the given radius:
+// the Crop, with the padding around it. The rectangle may extend
+// beyond the photo; if so, the excess will be black.
+func (fc FramingConfig)Area(center image.Point, radiusPix int, widthInSolarDiameters float64) image.Rectangle {
+	return fc.Crop(center, radiusPix, widthInSolarDiameters).Inset(-fc.Padding)
+}
+
+// Crop returns the part of the Area that comes from the photos; the
+// padding around it is black.
+func (fc FramingConfig)Crop(center image.Point, radiusPix int, widthInSolarDiameters float64) image.Rectangle {
+	// The default: a square `widthInSolarDiameters` across
+	halfH := int(float64(radiusPix) * widthInSolarDiameters)
+	if fc.SolarRadii > 0 {
+		halfH = int(float64(radiusPix) * fc.SolarRadii / 2.0)
+	}
+
+	halfW := halfH
+	if fc.AspectRatio != "" {
+		if aspect, err := parseAspectRatio(fc.AspectRatio); err == nil {
+			halfW = int(float64(halfH) * aspect)
+		} // else a square (see CalculateInputArea)
+	}
+
+	return image.Rectangle{
+		Min: image.Point{center.X - halfW, center.Y - halfH},
+		Max: image.Point{center.X + halfW, center.Y + halfH},
+	}
+}
+
+// parseAspectRatio turns "16:9" into 1.777
+func parseAspectRatio(s string) (float64, error) {
+	w, h := 0.0, 0.0
+	if n, err := fmt.Sscanf(s, "%g:%g", &w, &h); err != nil || n != 2 || w <= 0 || h <= 0 {
+		return 0, fmt.Errorf("aspect ratio '%s' not understood, wanted e.g. 16:9", s)
+	}
+	return w / h, nil
+}
@@ -1,28 +1,56 @@
 package eclipse
 
 import(
+	"context"
 	"image"
 	"image/color"
 	"fmt"
-	"log"
-	"os"
 	"sort"
+	"time"
 
-	"github.com/mdouchement/hdr/codec/rgbe"
 	"github.com/mdouchement/hdr/hdrcolor"
 
 	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+	"github.com/abworrall/eclipse-hdr/pkg/elimb"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
 )
 
 // FusedImage holds the image layers, and fuses them into a single
-// image. Implements the image.Image interface.
+// image. Implements the image.Image interface (and hdr.Image), over the
+// developed HDR pixels. To get at the frames behind it, use the
+// accessors in frames.go (Frame, Original, Warped, Linearized, Masked)
+// rather than the Layers.
 type FusedImage struct {
 	Config
 	Layers   []Layer // Ordered, ascending EV (descending "number of photons needed to fully expose")
 	Pixels   []Pixel
-}
 
-var DebugPixels = []image.Point{} // Things in here get dumped in detail
+	Stars    []Star    // Stars detected in the long exposures, if asked for
+	Photometry *PhotometricCalibration // From the reference stars, if there were any
+
+	Overrides []string // `key=value` config settings, applied after any conf.yaml; see Config.WithOverrides
+	Failures  []FrameFailure // Frames that were dropped, with KeepGoing (or by scoring)
+	Scores    map[string]FrameScore // Each frame's sharpness & transparency, by filename, if Scoring is enabled
+
+	isophotes *image.NRGBA // Contour overlay, if asked for
+	lut       *LUT3D       // Final look, if asked for
+
+	metadataOnly bool      // Don't load pixels; see LoadMetadata
+	hdrInputs []string     // HDR files from earlier phases that were loaded
+	photoFiles []string    // Photos found by loadThings, waiting for loadPhotos
+	inputFiles []string    // Everything loadFile loaded, for the manifest
+	scratchDir string      // The run's scratch dir, once there is one; see workDir
+	photoCache map[string]Layer // If set, photos already loaded (by a Watcher), by path
+	index     *photoIndex    // The input files' metadata & hashes; see photoIndex()
+	progress  *stageProgress // For whatever long-running thing is happening
+	cache     *stageCache  // See stageCache()
+	manifest  *Manifest    // For the run in progress, if there is one
+	memPlan   memoryPlan   // How the run in progress fits in MaxMemory; see planMemory
+	inputsOnDisk bool      // The pixels' inputs are in the disk buffers; see releaseBuffers
+	metrics []StageMetric  // For the manifest; see measureStage
+}
 
 // Implement image.Image
 func (fi FusedImage)ColorModel() color.Model       { return hdrcolor.RGBModel }
@@ -54,119 +82,431 @@ func (fi FusedImage)String() string {
 
 func (fi *FusedImage)AddLayer(l Layer) {
 	fi.Layers = append(fi.Layers, l)
-	sort.Slice(fi.Layers, func(i, j int) bool { return fi.Layers[i].EV < fi.Layers[j].EV })	
+	// Photos load in parallel, so they arrive in any order; break ties
+	// by filename, to get the same order every run.
+	sort.Slice(fi.Layers, func(i, j int) bool {
+		if fi.Layers[i].EV != fi.Layers[j].EV {
+			return fi.Layers[i].EV < fi.Layers[j].EV
+		}
+		return fi.Layers[i].LoadFilename < fi.Layers[j].LoadFilename
+	})
+}
+
+// releaseLayers hands back the aligned layers' planes to the pool (see
+// eimage.Planar.Release), once a run is done with them (e.g. between a
+// Watcher's stacks). A layer that was never warped (e.g. a preview's,
+// without alignment) has the loaded image as its image, which stays
+// in the photo cache for the next run, so it isn't released.
+func (fi *FusedImage)releaseLayers() {
+	for i := range fi.Layers {
+		if fi.Layers[i].Image == fi.Layers[i].LoadedImage {
+			continue
+		}
+		if p, ok := fi.Layers[i].Image.(*eimage.Planar); ok {
+			p.Release()
+			fi.Layers[i].Image = fi.Layers[i].LoadedImage
+		}
+	}
 }
 
 // Align does all the work to figure out how to align the various
 // layers, and generates the final transformed image for each layer.
-func (fi *FusedImage)Align() {
+// If ctx is cancelled, it gives up part way and returns ctx.Err().
+func (fi *FusedImage)Align(ctx context.Context) error {
 	if len(fi.Layers) == 0 {
-		return
+		return nil
 	}
 
-	log.Printf("Aligning image layers")
+	fi.Config.infof("Aligning image layers")
 
 	if fi.Config.DoEclipseAlignment {
-		for i:=0; i<len(fi.Layers); i++ {
-			fi.Layers[i].LunarLimb = FindLunarLimb(fi.Config, fi.Layers[i].LoadedImage)
+		if err := fi.DetectLunarLimbs(ctx); err != nil {
+			return err
 		}
-		fi.InputArea  = fi.CalculateInputArea()
+		if err := fi.mergeCameras(ctx); err != nil {
+			return err
+		}
+		if err := fi.ScoreFrames(ctx); err != nil {
+			return err
+		}
+		if fi.Config.Alignments == nil {
+			fi.Config.Alignments = map[string]AlignmentTransform{}
+		}
+		fi.InputArea, fi.PhotoArea = fi.CalculateInputArea()
 		fi.Config.InputArea = fi.InputArea // aligner needs this
+		fi.Config.LunarCenter = fi.Layers[0].LunarLimb.Center().Sub(fi.InputArea.Min)
+		fi.Config.LunarRadius = fi.Layers[0].LunarLimb.Radius()
+
+		// Anything we've aligned before (with the same photos & limbs)
+		// can come from the cache.
+		sc := fi.stageCache()
+		keys, cached := map[int]string{}, map[int]bool{}
+		for i:=1; sc != nil && i<len(fi.Layers); i++ {
+			l := &fi.Layers[i]
+			if key, err := sc.alignKey(fi.Config, &fi.Layers[0], l); err != nil {
+				fi.Config.warnf("%v\n", err)
+			} else if sc.get("alignment", key, &l.AlignmentTransform) {
+				fi.Config.debugf("Using cached alignment for %s\n", l.Filename())
+				fi.Config.warpLayer(ctx, l)
+				cached[i] = true
+			} else {
+				keys[i] = key
+			}
+		}
+
+		// Figure out the transforms to map points from the base/first
+		// image to the other images. Fine tuning has its own worker pool,
+		// so then we do one layer at a time; else the layers are done in
+		// parallel, and any spare threads go to warping each one.
+		threads := fi.Config.NumThreads()
+		cfg := fi.Config
+		if fi.Config.DoFineTunedAlignment {
+			threads = 1
+			cfg.Threads = fi.workers("align") // each of its workers warps a whole frame; see planMemory
+		} else if n := len(fi.Layers)-1; n > 0 {
+			cfg.Threads = threads / n
+			if cfg.Threads < 1 {
+				cfg.Threads = 1
+			}
+		}
+		progress := fi.Config.newProgress("Aligning", len(fi.Layers)-1)
+		err := eimage.ParallelFor(ctx, threads, len(fi.Layers)-1, func(_, i int) {
+			l := &fi.Layers[i+1]
+			if cached[i+1] {
+				progress.Add(1)
+				return
+			}
+			start := time.Now()
+			AlignLayer(ctx, cfg, &fi.Layers[0], l)
+			progress.Add(1)
+			if ctx.Err() != nil {
+				return // half-done; don't report it
+			}
+			xf := l.AlignmentTransform
+			fi.Config.timeEvent("alignment", start, "frame", l.Filename(), "translatex", xf.TranslateByX,
+				"translatey", xf.TranslateByY, "rotatedeg", xf.RotateByDeg, "error", xf.ErrorMetric)
+		})
+		progress.Done()
+		if err != nil {
+			return err
+		}
+
+		failed := map[int]bool{}
+		fi.checkAlignments(failed)
+		for i, l := range fi.Layers {
+			if i == 0 || failed[i] {
+				continue
+			}
+			fi.Config.Alignments[l.AlignmentTransform.Name] = l.AlignmentTransform // so later phases can reuse it
+			if key, exists := keys[i]; exists {
+				sc.put("alignment", key, l.AlignmentTransform)
+			}
+		}
 
-		// Figure out the transforms to map points from the base/first image to the other images
-		for i:=1; i<len(fi.Layers); i++ {
-			AlignLayer(fi.Config, &fi.Layers[0], &fi.Layers[i])
+		if err := fi.dropLayers(failed); err != nil {
+			return err
+		}
+		if err := fi.smoothAlignments(ctx); err != nil { // after the cache, which keeps the transforms as fitted
+			return err
 		}
 
 		if fi.Config.DoFineTunedAlignment {
-			log.Printf("Fine tune alignments:-\n\n%s\n", fi.Config.AsYaml())
+			fi.Config.infof("Fine tune alignments:-\n\n%s\n", fi.Config.AsYaml())
 		}
 		
 	} else {
 		fi.InputArea = fi.Layers[0].Image.Bounds() // default to whole image
+		fi.PhotoArea = fi.InputArea
 	}
 
 	// Figure out which area of the input we're going to process, in both input coords and output coords
 	fi.OutputArea = image.Rectangle{ Max:image.Point{fi.InputArea.Dx(), fi.InputArea.Dy()} } 
-	fi.Config.OutputArea = fi.OutputArea // Copy it into the config, so PixelFuncs can see it, sigh
+	fi.Config.OutputArea = fi.OutputArea // Copy it into the config, so the stack settings have it
+
+	fi.Config.debugf("Layers loaded and aligned: %s", fi)
+	return nil
+}
+
+// DetectLunarLimbs finds the lunar limb in each layer. Limbs found by
+// an earlier run (e.g. `eclipse-hdr detect`) are taken from the
+// config, and new ones are added to it. A frame whose limb can't be
+// found is an error, unless KeepGoing is set.
+func (fi *FusedImage)DetectLunarLimbs(ctx context.Context) error {
+	defer fi.measureStage(ctx, "detect")()
+	if fi.Config.LunarLimbs == nil {
+		fi.Config.LunarLimbs = map[string]LunarLimb{}
+	}
+	sc := fi.stageCache()
+	todo, keys := []int{}, map[int]string{}
+	for i:=0; i<len(fi.Layers); i++ {
+		name := fi.Layers[i].Filename()
+		if ll, exists := fi.Config.LunarLimbs[name]; exists {
+			fi.Config.debugf("Using lunar limb from config file for %s\n", name)
+			fi.Layers[i].LunarLimb = ll
+			continue
+		}
+		if sc != nil {
+			if key, err := sc.limbKey(fi.Config, &fi.Layers[i]); err != nil {
+				fi.Config.warnf("%v\n", err)
+			} else if sc.get("lunarlimb", key, &fi.Layers[i].LunarLimb) {
+				fi.Config.debugf("Using cached lunar limb for %s\n", name)
+				fi.Config.LunarLimbs[name] = fi.Layers[i].LunarLimb
+				continue
+			} else {
+				keys[i] = key
+			}
+		}
+		todo = append(todo, i)
+	}
+
+	cfg := fi.Config
+	if cfg.DebugSink != nil && len(todo) > 0 {
+		cfg.limbComposite = elimb.NewComposite()
+	}
+	// The photos are done in parallel; any spare threads go to each one's scan
+	cfg.Threads = 1
+	if len(todo) > 0 && fi.workers("detect") > len(todo) {
+		cfg.Threads = fi.workers("detect") / len(todo)
+	}
+
+	errs := make([]error, len(todo))
+	detect, err := cfg.GetLimbDetector()
+	if err != nil {
+		return err
+	}
+	progress := fi.Config.newProgress("Finding lunar limbs", len(todo))
+	err = eimage.ParallelFor(ctx, fi.workers("detect"), len(todo), func(_, j int) {
+		l := &fi.Layers[todo[j]]
+		start := time.Now()
+		l.LunarLimb, errs[j] = detect(ctx, cfg.forFrame(l.Filename()), l.LoadedImage)
+		progress.Add(1)
+		if errs[j] != nil {
+			return
+		}
+		ll := l.LunarLimb
+		fi.Config.timeEvent("lunarlimb", start, "frame", l.Filename(), "centerx", ll.Center().X, "centery", ll.Center().Y,
+			"radius", ll.Radius(), "brightness", ll.Brightness, "saturated", ll.Frame.SaturatedFraction())
+	})
+	progress.Done()
+	if err != nil {
+		return err // the limbs we did find aren't kept; the next run has to start over
+	}
+	if lc := cfg.limbComposite; lc != nil {
+		if img := lc.Image(); img != nil {
+			cfg.debugImage("010-lunarlimb-composite.png", img)
+		}
+	}
+
+	failed := map[int]bool{}
+	for j, i := range todo {
+		if errs[j] != nil {
+			if err := fi.frameFailed(fi.Layers[i].Filename(), "lunarlimb", errs[j].Error()); err != nil {
+				return err
+			}
+			failed[i] = true
+		}
+	}
+	fi.checkLunarLimbs(failed)
 
-	log.Printf("Layers loaded and aligned: %s", fi)
+	for _, i := range todo {
+		if failed[i] {
+			continue
+		}
+		fi.Config.LunarLimbs[fi.Layers[i].Filename()] = fi.Layers[i].LunarLimb
+		if key, exists := keys[i]; exists {
+			sc.put("lunarlimb", key, fi.Layers[i].LunarLimb)
+		}
+	}
+	return fi.dropLayers(failed)
 }
 
 // Fuse looks at the various layers for each pixel, and figures out a
 // final merged value for that pixel. There are a few algorithms to
 // pick from. Then it normalizes the brightness, so each pixel has the
-// same EV. Finally it does color development, white balance etc.
-func (fi *FusedImage)Fuse() {
-	log.Printf("Fusing image layers over %s", fi.OutputArea)
+// same EV. Finally it does color development, white balance etc. If
+// ctx is cancelled it stops part way (leaving the pixels half-done),
+// and returns ctx.Err().
+func (fi *FusedImage)Fuse(ctx context.Context) error {
+	cacheKey := ""
+	sc := fi.stageCache()
+	if sc != nil {
+		var err error
+		if cacheKey, err = sc.stackKey(fi); err != nil {
+			fi.Config.warnf("%v\n", err)
+		} else if sc.getStack(cacheKey, fi) {
+			fi.Config.infof("Using cached stack over %s\n", fi.OutputArea)
+			return nil
+		}
+	}
+	fuser, err := fi.Config.GetFuser()
+	if err != nil {
+		return err
+	}
+	developer, err := fi.Config.GetDeveloper()
+	if err != nil {
+		return err
+	}
+
+	fi.Config.infof("Fusing image layers over %s", fi.OutputArea)
+	defer fi.Config.timeEvent("fuse", time.Now(), "width", fi.OutputArea.Dx(), "height", fi.OutputArea.Dy())
 	fi.Pixels = make([]Pixel, fi.OutputArea.Dx() * fi.OutputArea.Dy())
+	settings := fi.Config.stackSettings()
 	
-	globalIllumAtMax := 0.0
-	for x:=0; x<fi.OutputArea.Dx(); x++ {
-		for y:=0; y<fi.OutputArea.Dy(); y++ {
+	// Each worker tracks its own max, to avoid locking
+	threads := fi.Config.NumThreads()
+	workerIllumAtMax := make([]float64, threads)
+	arena := fi.newFuseArena(threads) // If streamed, the inputs are reused, not kept; see memoryPlan
+	defer arena.release()
+	fi.inputsOnDisk = arena.onDisk
 
-			p := fi.PixRW(x, y) // Get a pointer to the Pixel, so we can mutate it
+	debugPixels := map[image.Point]bool{}
+	for _, pt := range fi.Config.DebugPixels {
+		debugPixels[pt] = true
+	}
 
-			p.OutputPos = image.Point{x, y}
-			p.RawInputs = make([]color.Color, len(fi.Layers))
-			p.In = make([]ecolor.CameraNative, len(fi.Layers))
+	err = fi.forEachTile(ctx, threads, "Fusing (tiles)", func(worker int, t image.Rectangle) {
+		for x:=t.Min.X; x<t.Max.X; x++ {
+			for y:=t.Min.Y; y<t.Max.Y; y++ {
 
-			// Gather the inputs from all the layers
-			for i:=0; i<len(fi.Layers); i++ {
-				p.RawInputs[i] = fi.Layers[i].Image.At(x + fi.InputArea.Min.X, y + fi.InputArea.Min.Y)
-				p.In[i] = ecolor.NewCameraNative(p.RawInputs[i], fi.Layers[i].ExposureValue.IlluminanceAtMaxExposure)
-			}
+				p := fi.PixRW(x, y) // Get a pointer to the Pixel, so we can mutate it
 
-			// Now run the fuser
-			fuser := fi.Config.GetFuser()
-			fuser(fi.Config, p)
+				p.OutputPos = image.Point{x, y}
+				streamed := fi.memPlan.Streamed && !debugPixels[p.OutputPos]
+				if streamed {
+					p.In = arena.workerInputs(worker)
+				} else if arena.inputs != nil {
+					p.In = arena.pixelInputs(x * fi.OutputArea.Dy() + y)
+				} else {
+					p.In = make([]ecolor.CameraNative, len(fi.Layers)) // a debug pixel, in a streamed fuse
+				}
+				if debugPixels[p.OutputPos] {
+					p.RawInputs = make([]color.Color, len(fi.Layers)) // Just for the dump; boxing them all is slow
+				}
 
-			if p.Fused.IllumAtMax > globalIllumAtMax {
-				globalIllumAtMax = p.Fused.IllumAtMax
+				// Gather the inputs from all the layers; framing may have padded beyond the photo (or
+				// added a border), which stays black
+				for i:=0; i<len(fi.Layers); i++ {
+					p.In[i].IllumAtMax = fi.Layers[i].ExposureValue.IlluminanceAtMaxExposure
+					pt := image.Point{x + fi.InputArea.Min.X, y + fi.InputArea.Min.Y}
+					if pt.In(fi.Layers[i].Image.Bounds().Intersect(fi.PhotoArea)) {
+						p.In[i].R, p.In[i].G, p.In[i].B = eimage.PixelRGB(fi.Layers[i].Image, pt.X, pt.Y)
+					}
+					if p.RawInputs != nil {
+						p.RawInputs[i] = p.In[i].RGB
+					}
+				}
+
+				// Even the shortest exposure is clipped; nothing good to fuse
+				r, g, b, _ := p.In[len(p.In)-1].HDRRGBA()
+				p.Clipped = r >= fi.Config.ClipLevel || g >= fi.Config.ClipLevel || b >= fi.Config.ClipLevel
+
+				if fi.Config.BlackPoint != (emath.Vec3{}) || fi.Config.WhitePoint != (emath.Vec3{}) {
+					for i := range p.In {
+						p.In[i].ApplyLevels(fi.Config.BlackPoint, fi.Config.WhitePoint)
+					}
+				}
+				if fi.Config.ChannelMixer.InCameraSpace() {
+					for i := range p.In {
+						p.In[i].RGB = fi.Config.ChannelMixer.mix(p.In[i].RGB)
+					}
+				}
+
+				// Now run the fuser
+				fuser(settings, p)
+				if streamed {
+					p.In = nil
+				}
+
+				if p.Fused.IllumAtMax > workerIllumAtMax[worker] {
+					workerIllumAtMax[worker] = p.Fused.IllumAtMax
+				}
 			}
 		}
+	})
+	if err != nil {
+		return err
+	}
+
+	globalIllumAtMax := 0.0
+	for _, illum := range workerIllumAtMax {
+		if illum > globalIllumAtMax {
+			globalIllumAtMax = illum
+		}
+	}
+	fi.IllumAtMax = globalIllumAtMax
+
+	if fi.Config.WhiteBalance.Mode == "solar" && !fi.Config.Monochrome {
+		if err := fi.CalibrateToSolarSpectrum(); err != nil {
+			fi.Config.warnf("WhiteBalance solar: %v, keeping as-shot white balance\n", err)
+		}
 	}
 
-	for x:=0; x<fi.OutputArea.Dx(); x++ {
-		for y:=0; y<fi.OutputArea.Dy(); y++ {
-			p := fi.PixRW(x, y)
+	settings = fi.Config.stackSettings() // with the white balance from the solar spectrum
+	err = fi.forEachTile(ctx, threads, "Developing (tiles)", func(_ int, t image.Rectangle) {
+		for x:=t.Min.X; x<t.Max.X; x++ {
+			for y:=t.Min.Y; y<t.Max.Y; y++ {
+				p := fi.PixRW(x, y)
 
-			p.Fused.AdjustIllumAtMax(globalIllumAtMax) 	 // Adjust all the pixels to the same max illuminance.
-			developer := fi.Config.GetDeveloper()
-			developer(fi.Config, p)                      // "Develop" the pixel (white balance etc.)
+				p.Fused.AdjustIllumAtMax(globalIllumAtMax) 	 // Adjust all the pixels to the same max illuminance.
+				developer(settings, p)                       // "Develop" the pixel (white balance etc.)
+			}
 		}
+	})
+	if err != nil {
+		return err
+	}
+	fi.logFuseStats()
+	if cacheKey != "" {
+		sc.putStack(cacheKey, fi)
 	}
 
-	for _, pt := range DebugPixels {
-		log.Printf("%s", fi.Pix(pt.X, pt.Y))
+	for _, pt := range fi.Config.DebugPixels {
+		fi.Config.tracef("%s", fi.Pix(pt.X, pt.Y))
+	}
+	return nil
+}
+
+// logFuseStats records how many pixels came from each layer, and how
+// many were clipped everywhere.
+func (fi *FusedImage)logFuseStats() {
+	if fi.Config.logger() == nil {
+		return
+	}
+	perLayer := make([]int, len(fi.Layers))
+	clipped := 0
+	for i := range fi.Pixels {
+		if n := fi.Pixels[i].LayerNumber; n >= 0 && n < len(perLayer) {
+			perLayer[n]++
+		}
+		if fi.Pixels[i].Clipped {
+			clipped++
+		}
+	}
+	for i, n := range perLayer {
+		fi.Config.logEvent("fuse.layer", "frame", fi.Layers[i].Filename(), "pixels", n)
 	}
+	fi.Config.logEvent("fuse.stats", "fuser", fi.Config.Fuser, "pixels", len(fi.Pixels), "clipped", clipped, "illumatmax", fi.IllumAtMax)
 }
 
 // WriteToHDR outputs a HDR image. You can load this into photoshop or other HDR tools.
 func (fi *FusedImage)WriteToHDR(filename string) error {
-	if writer, err := os.Create(filename); err != nil {
-		return fmt.Errorf("FusedImage.WriteToHDR, open+w '%s': %v", filename, err)
-	} else {
-		defer writer.Close()
-		err := rgbe.Encode(writer, fi)
-		if err != nil {
-			log.Printf("FusedImage.WriteToHDR, encoding RGBE file: %v\n", err)
-		}
-		return err
+	err := eio.WriteHDR(fi, filename)
+	if err != nil {
+		fi.Config.warnf("FusedImage.WriteToHDR: %v\n", err)
 	}
+	return err
 }
 
-func (fi *FusedImage)CalculateInputArea() image.Rectangle {
-	// Figure out which area of the input we're going to process, in both input coords and output coords
+// CalculateInputArea figures out which area of the input we're going
+// to process, and which part of that comes from the photos (the rest
+// is the framing's border). Outputs are centered on the eclipse, and
+// sized in terms of the lunar radius; see FramingConfig.
+func (fi *FusedImage)CalculateInputArea() (image.Rectangle, image.Rectangle) {
 	center    := fi.Layers[0].LunarLimb.Center()
 	radiusPix := fi.Layers[0].LunarLimb.Radius() + 3
-	width     := int( float64(radiusPix) * fi.Config.OutputWidthInSolarDiameters)
-	bounds    := image.Rectangle{
-		Min: image.Point{center.X - width, center.Y - width},
-		Max: image.Point{center.X + width, center.Y + width},
+	fc, width := fi.Config.Framing, fi.Config.OutputWidthInSolarDiameters
+	if _, err := parseAspectRatio(fc.AspectRatio); fc.AspectRatio != "" && err != nil {
+		fi.Config.warnf("Framing: %v, using a square\n", err)
 	}
-
-	// if !bounds.In(fi.Layers[0].LoadedImage.Bounds()) {}
-
-	return bounds
+	return fc.Area(center, radiusPix, width), fc.Crop(center, radiusPix, width)
 }
@@ -0,0 +1,34 @@
+package eclipse
+
+import(
+	"sync"
+
+	"github.com/abworrall/eclipse-hdr/pkg/egpu"
+)
+
+// The GPU is opened the first time a stage asks for it, and kept for
+// the life of the process (e.g. across -watch updates).
+var(
+	gpuOnce    sync.Once
+	gpuDevice *egpu.Device
+)
+
+// gpu is the GPU to run the warp, bilateral denoise and fine-tuning
+// kernels on, or nil (for the CPU) if there isn't one, or `gpu: false`.
+// It is off for deterministic runs too, as the GPU's float arithmetic
+// doesn't match the CPU's to the last bit.
+func (c Config)gpu() *egpu.Device {
+	if !c.GPU || c.Deterministic {
+		return nil
+	}
+	gpuOnce.Do(func() {
+		dev, err := egpu.Open()
+		if err != nil {
+			c.debugf("GPU: none (%v)\n", err)
+			return
+		}
+		c.infof("GPU: using %s\n", dev.Name())
+		gpuDevice = dev
+	})
+	return gpuDevice.WithWarnf(c.warnf) // so a failure goes to this run's log
+}
@@ -0,0 +1,169 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// A Hook runs an external command before or after a stage, so other
+// tools can be spliced into the pipeline. The command gets the run
+// manifest so far, and (once there are fused pixels) the current HDR
+// image; if it writes a replacement HDR image, that is loaded back in,
+// so e.g. a custom denoiser can stand in for the `denoise` stage.
+//
+// These placeholders in the command are filled in (and are also in
+// the environment, as EHDR_HOOK_STAGE etc):
+//
+//   {stage}     the stage, e.g. denoise
+//   {when}      pre or post
+//   {manifest}  a run manifest, as it stands (see Manifest)
+//   {hdr}       the current pixels, as an HDR file ("" before fusion)
+//   {hdrout}    where to write replacement pixels, if the hook wants to
+//   {outdir}    the dir for intermediate outputs
+//
+// The manifest and HDR files are scratch files, in the run's work dir
+// (see WorkConfig); a hook that wants to keep anything should write it
+// into {outdir}.
+type Hook struct {
+	Stage    string     // align, fuse, tonemap, or an enhancement step (by its pipeline name)
+	When     string     // pre or post
+	Command  []string   // The program and its args
+}
+
+// hookStages are the stages (as well as the enhancement steps) that
+// can have hooks.
+var hookStages = []string{"align", "fuse", "enhance", "tonemap"}
+
+// withHooks runs the stage, with any hooks around it. It returns
+// ctx.Err() if the stage was cut short. Its messages are tagged with
+// the stage.
+func (fi *FusedImage)withHooks(ctx context.Context, stage string, run func(context.Context) error) error {
+	saved := fi.Config.logAttrs
+	fi.Config = fi.Config.forStage(stage)
+	defer func() { fi.Config.logAttrs = saved }()
+
+	if err := fi.runHooks(ctx, stage, "pre"); err != nil {
+		return err
+	}
+	// The label lets a CPU profile be broken down by stage (it carries
+	// over to the goroutines the stage starts).
+	var err error
+	pprof.Do(ctx, pprof.Labels("stage", stage), func(ctx context.Context) {
+		defer fi.measureStage(ctx, stage)()
+		err = run(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fi.runHooks(ctx, stage, "post")
+}
+
+func (fi *FusedImage)runHooks(ctx context.Context, stage, when string) error {
+	for _, h := range fi.Config.Hooks {
+		if h.Stage == stage && h.When == when {
+			if err := fi.Config.outputs.wait(); err != nil { // the hook may want to look at them
+				return err
+			}
+			if err := fi.runHook(ctx, h); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("hook %s-%s %q: %v", when, stage, h.Command, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (fi *FusedImage)runHook(ctx context.Context, h Hook) error {
+	start := time.Now()
+	prefix := fmt.Sprintf("hook-%s-%s", h.When, h.Stage)
+	work, err := fi.workDir()
+	if err != nil {
+		return err
+	}
+	vars := map[string]string{
+		"stage":    h.Stage,
+		"when":     h.When,
+		"manifest": filepath.Join(work, prefix + "-manifest.yaml"),
+		"hdr":      "",
+		"hdrout":   filepath.Join(work, prefix + "-out.hdr"),
+		"outdir":   fi.Config.OutputDir(IntermediateOutput),
+	}
+
+	m := Manifest{Phase: "hook", Started: time.Now(), Software: softwareInfo()}
+	if fi.manifest != nil {
+		m = *fi.manifest
+	}
+	if err := fi.writeManifest(m, vars["manifest"]); err != nil {
+		return err
+	}
+	if len(fi.Pixels) > 0 {
+		vars["hdr"] = filepath.Join(work, prefix + ".hdr")
+		if err := fi.WriteToHDR(vars["hdr"]); err != nil {
+			return err
+		}
+	}
+	os.Remove(vars["hdrout"]) // so we can tell if the hook wrote one
+
+	args := []string{}
+	for _, arg := range h.Command {
+		for k, v := range vars {
+			arg = strings.ReplaceAll(arg, "{" + k + "}", v)
+		}
+		args = append(args, arg)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = os.Environ()
+	for k, v := range vars {
+		cmd.Env = append(cmd.Env, "EHDR_HOOK_" + strings.ToUpper(k) + "=" + v)
+	}
+	fi.Config.infof("Running hook %s: %s\n", prefix, strings.Join(args, " "))
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(vars["hdrout"]); err == nil {
+		if err := fi.replacePixels(vars["hdrout"]); err != nil {
+			return err
+		}
+		fi.Config.infof("Hook %s replaced the pixels\n", prefix)
+	}
+	fi.Config.timeEvent("hook", start, "stage", h.Stage, "when", h.When)
+	return nil
+}
+
+// replacePixels loads new developed pixels from an HDR file, which
+// has to be the same size. (Unlike loadHDR, the rest of each pixel is
+// kept.)
+func (fi *FusedImage)replacePixels(filename string) error {
+	img, err := eio.ReadHDR(filename)
+	if err != nil {
+		return err
+	}
+	b := img.Bounds()
+	if b.Dx() != fi.OutputArea.Dx() || b.Dy() != fi.OutputArea.Dy() {
+		return fmt.Errorf("'%s' is %dx%d, wanted %dx%d", filename, b.Dx(), b.Dy(), fi.OutputArea.Dx(), fi.OutputArea.Dy())
+	}
+	for x:=0; x<b.Dx(); x++ {
+		for y:=0; y<b.Dy(); y++ {
+			r, g, bl, _ := img.HDRAt(x + b.Min.X, y + b.Min.Y).HDRRGBA()
+			fi.PixRW(x, y).DevelopedRGB = hdrcolor.RGB{R: r, G: g, B: bl}
+		}
+	}
+	return nil
+}
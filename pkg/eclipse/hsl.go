@@ -0,0 +1,19 @@
+package eclipse
+
+import(
+	"github.com/abworrall/eclipse-hdr/pkg/eenhance"
+)
+
+// An HSLAdjustment tweaks the pixels whose hue falls in a range; see
+// eenhance.HSLAdjustment.
+type HSLAdjustment = eenhance.HSLAdjustment
+
+// AdjustHSL applies each of the `Config.HSL` adjustments in turn.
+func (fi *FusedImage)AdjustHSL() {
+	for _, adj := range fi.Config.HSL {
+		adj = adj.WithDefaults()
+		fi.Config.infof("HSL: hue %.0f±%.0f (feather %.0f): shift %.0f, saturation x%.2f, lightness x%.2f\n",
+			adj.Hue, adj.Width/2.0, adj.Feather, adj.HueShift, adj.Saturation, adj.Lightness)
+		fi.adjustPixels(adj)
+	}
+}
@@ -0,0 +1,62 @@
+package eclipse
+
+import(
+	"fmt"
+)
+
+// An ImageOverride changes how one input photo is handled, without
+// affecting the rest; e.g. to drop a frame with a cloud in it, or fix
+// up bad EXIF data. They live in Config.Images, keyed by filename.
+type ImageOverride struct {
+	Exclude    bool     // Don't load this photo at all
+	EV         int      // Use this exposure value, instead of the one from the EXIF data; zero means no override
+	Threshold  float64  // Layer is too exposed at a pixel above this (0.0->1.0); overrides FuserLuminance for this photo
+	Weight     float64  // How much this layer counts when the `avg` fuser averages layers; if zero, 1.0
+	Polarizer  float64  // The angle (degrees) of the polarizer it was taken through, for PolarizationConfig; zero means none, so use 180 for 0
+	Filter     float64  // The density of a filter it was taken through (e.g. 5.0 for a solar filter), for the light curve
+	Camera     string   // Which camera (or telescope) it came from, for CamerasConfig; if empty, its EXIF model
+}
+
+// applyImageOverride adjusts a freshly loaded layer. (Excluded photos
+// never get this far; see loadPhotos.)
+func (fi *FusedImage)applyImageOverride(l *Layer) error {
+	o := fi.Config.Images[l.Filename()]
+	if o.EV != 0 {
+		illum, exists := illuminanceLookup[o.EV]
+		if !exists {
+			return fmt.Errorf("%s: override EV %d is out of range", l.Filename(), o.EV)
+		}
+		fi.Config.debugf("Overriding EV for %s: %d -> %d\n", l.Filename(), l.ExposureValue.EV, o.EV)
+		l.ExposureValue.EV = o.EV
+		l.ExposureValue.IlluminanceAtMaxExposure = illum
+	} else if fi.Config.Radiance.ExactExposures {
+		illum := l.ExposureValue.ExactIlluminance()
+		fi.Config.debugf("Exact exposure for %s: %.0f lux (EV %d is %.0f)\n", l.Filename(), illum, l.EV, l.IlluminanceAtMaxExposure)
+		l.ExposureValue.IlluminanceAtMaxExposure = illum
+	}
+	return nil
+}
+
+// setLayerOverrides lines up the overrides with the (sorted) layers,
+// so that the PixelFuncs can find them by layer number. With
+// `scoring.weight`, each frame's score goes into its weight.
+func (fi *FusedImage)setLayerOverrides() {
+	fi.Config.LayerOverrides = make([]ImageOverride, len(fi.Layers))
+	for i, l := range fi.Layers {
+		o := fi.Config.Images[l.Filename()]
+		if s, exists := fi.Scores[l.Filename()]; exists && fi.Config.Scoring.Weight {
+			if o.Weight == 0.0 { o.Weight = 1.0 }
+			o.Weight *= s.Score
+		}
+		fi.Config.LayerOverrides[i] = o
+	}
+}
+
+// layerOverride is the override for the i'th layer; it is empty if
+// there isn't one.
+func (c Config)layerOverride(i int) ImageOverride {
+	if i < len(c.LayerOverrides) {
+		return c.LayerOverrides[i]
+	}
+	return ImageOverride{}
+}
@@ -1,11 +1,14 @@
 package eclipse
 
 import(
+	"context"
 	"fmt"
-	"image/color"
 	"math"
 
+	"github.com/mdouchement/hdr/hdrcolor"
+
 	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
 	"github.com/abworrall/eclipse-hdr/pkg/emath"
 )
 
@@ -23,20 +26,32 @@ func ImgDiff(cfg Config, l1, l2 *Layer, passName string, xform AlignmentTransfor
 	nErr     := 0
 	bounds   := cfg.InputArea
 
-	tooLow  := uint32(0x0200)
-	tooHigh := uint32(0x8000)
+	tooLow  := float64(0x0200) / 0xFFFF
+	tooHigh := float64(0x8000) / 0xFFFF
+
+	// This is the illuminance at max over the two images (that have diff exposures)
+	evMax := l1.ExposureValue
+	if l2.IlluminanceAtMaxExposure > evMax.IlluminanceAtMaxExposure {
+		evMax = l2.ExposureValue
+	}
+
+	// The GPU can't draw the debug image, but otherwise it can do the lot
+	if cfg.DebugSink == nil {
+		wa, wb := yWeights(cfg, l1.ExposureValue, evMax), yWeights(cfg, l2.ExposureValue, evMax)
+		if sum, n, ok := cfg.gpu().Diff(l1.Image, l2.LoadedImage, xform.ToMatrix(), bounds, wa, wb, tooLow, tooHigh); ok {
+			return sum * 10000000.0 / float64(n)
+		}
+	}
 
 	diff     := emath.NewFloatGrid(bounds.Dx(), bounds.Dy())
-	l2image  := xform.XFormImage(l2.LoadedImage)
+	l2image  := xform.Warp(context.Background(), l2.LoadedImage, 1) // the search runs many of these at once
 
 	nPix, nLow, nHigh := 0,0,0
 
 	for x:= bounds.Min.X; x<bounds.Max.X; x++ {
 		for y:= bounds.Min.Y; y<bounds.Max.Y; y++ {
-			c1 := l1.Image.At(x, y)
-			c2 := l2image.At(x, y)
-			r1, g1, b1,_ := c1.RGBA()
-			r2, g2, b2,_ := c2.RGBA()
+			r1, g1, b1 := eimage.PixelRGB(l1.Image, x, y)
+			r2, g2, b2 := eimage.PixelRGB(l2image, x, y)
 
 			nPix++
 			if r1 < tooLow || g1 < tooLow || b1 < tooLow || r2 < tooLow || g2 < tooLow || b2 < tooLow {
@@ -47,13 +62,8 @@ func ImgDiff(cfg Config, l1, l2 *Layer, passName string, xform AlignmentTransfor
 				continue
 			}
 
-			// This is the illuminance at max over the two images (that have diff exposures)
-			evMax := l1.ExposureValue
-			if l2.IlluminanceAtMaxExposure > evMax.IlluminanceAtMaxExposure {
-				evMax = l2.ExposureValue
-			}
-			Y1 := col2Y(cfg, c1, l1.ExposureValue, evMax)
-			Y2 := col2Y(cfg, c2, l2.ExposureValue, evMax)
+			Y1 := col2Y(cfg, hdrcolor.RGB{R: r1, G: g1, B: b1}, l1.ExposureValue, evMax)
+			Y2 := col2Y(cfg, hdrcolor.RGB{R: r2, G: g2, B: b2}, l2.ExposureValue, evMax)
 
 			pixErr := math.Abs(Y1 - Y2)
 
@@ -63,13 +73,15 @@ func ImgDiff(cfg Config, l1, l2 *Layer, passName string, xform AlignmentTransfor
 		}
 	}
 
+	l2image.Release()
+
 	// Scale to a number that tends to be in the range 10,000 - 100,000
 	errMetric := totErr * 10000000.0 / float64(nErr)
 
-	if cfg.Verbosity > 0 {
+	if cfg.DebugSink != nil {
 		title := fmt.Sprintf("%s: %.1f%% comparable; err=% 7.0f; %s",
 			passName, (100.0 * (float64(nErr) / float64(nPix))), errMetric, xform)
-		diff.ToImg(title, fmt.Sprintf("diff-%s-%s.png", xform.Name, passName))
+		cfg.debugImage(fmt.Sprintf("diff-%s-%s.png", xform.Name, passName), diff.Image(title))
 	}
 
 	return errMetric
@@ -77,10 +89,16 @@ func ImgDiff(cfg Config, l1, l2 *Layer, passName string, xform AlignmentTransfor
 
 // Does a full DNG development pass on the pixel, to get into XYZ_D50
 // color space; then returns the Y (luminance). Accounts for differing EVs.
-func col2Y(cfg Config, c color.Color, ev, evMax ExposureValue) float64 {
-	cn := ecolor.NewCameraNative(c, ev.IlluminanceAtMaxExposure)
+func col2Y(cfg Config, rgb hdrcolor.RGB, ev, evMax ExposureValue) float64 {
+	cn := ecolor.CameraNative{RGB: rgb, IllumAtMax: ev.IlluminanceAtMaxExposure}
 	cn.AdjustIllumAtMax(evMax.IlluminanceAtMaxExposure)
 	xyz := cn.ToPCS(cfg.CameraToPCS)
 
 	return xyz.Y
 }
+
+// yWeights is what col2Y multiplies each channel by, to get Y.
+func yWeights(cfg Config, ev, evMax ExposureValue) [3]float64 {
+	scale := ev.IlluminanceAtMaxExposure / evMax.IlluminanceAtMaxExposure
+	return [3]float64{cfg.CameraToPCS[3] * scale, cfg.CameraToPCS[4] * scale, cfg.CameraToPCS[5] * scale}
+}
@@ -0,0 +1,136 @@
+package eclipse
+
+import(
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// A photoIndex is what the stages know about the input files: each
+// photo's metadata (its EXIF data & dimensions, as from readMetadata),
+// and the sha256 of each file's contents (for the stage cache and the
+// manifest). It is filled in once, up front (see indexPhotos), so that
+// however many stages look, each file only gets opened & parsed once.
+// An entry is kept until its file changes size or modification time;
+// a Watcher keeps the index from one stack to the next.
+type photoIndex struct {
+	mu       sync.Mutex
+	entries  map[string]*indexEntry // By path
+}
+
+type indexEntry struct {
+	size      int64
+	modTime   time.Time
+
+	hasMeta   bool
+	meta      Layer   // No pixels; see readMetadata
+	metaErr   error
+	sha256    string  // "" until it's been hashed
+}
+
+func newPhotoIndex() *photoIndex {
+	return &photoIndex{entries: map[string]*indexEntry{}}
+}
+
+// photoIndex returns the index, making it if need be.
+func (fi *FusedImage)photoIndex() *photoIndex {
+	if fi.index == nil {
+		fi.index = newPhotoIndex()
+	}
+	return fi.index
+}
+
+// indexPhotos reads the metadata of all the photos that loadThings
+// found (bar any that the config excludes), in parallel, and hashes
+// them too unless it's only the metadata that's wanted.
+func (fi *FusedImage)indexPhotos(ctx context.Context) error {
+	pi := fi.photoIndex()
+	start := time.Now()
+	err := eimage.ParallelFor(ctx, fi.Config.NumThreads(), len(fi.photoFiles), func(_, i int) {
+		filename := fi.photoFiles[i]
+		if fi.Config.Images[filepath.Base(filename)].Exclude {
+			return
+		}
+		pi.metadata(filename) // errors are for whoever needs the metadata
+		if !fi.metadataOnly {
+			pi.hash(filename)
+		}
+	})
+	if err == nil && len(fi.photoFiles) > 0 {
+		fi.Config.debugf("Indexed %d photos in %s\n", len(fi.photoFiles), time.Since(start).Round(time.Millisecond))
+	}
+	return err
+}
+
+// entry returns the file's entry, a new one if the file has changed
+// since it was last looked at.
+func (pi *photoIndex)entry(filename string) (*indexEntry, error) {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	e, exists := pi.entries[filename]
+	if !exists || e.size != st.Size() || !e.modTime.Equal(st.ModTime()) {
+		e = &indexEntry{size: st.Size(), modTime: st.ModTime()}
+		pi.entries[filename] = e
+	}
+	return e, nil
+}
+
+// metadata returns the photo's metadata. As with readMetadata, the
+// Layer has whatever was read before any error.
+func (pi *photoIndex)metadata(filename string) (Layer, error) {
+	e, err := pi.entry(filename)
+	if err != nil {
+		return Layer{LoadFilename: filename}, err
+	}
+	pi.mu.Lock()
+	hasMeta, meta, metaErr := e.hasMeta, e.meta, e.metaErr
+	pi.mu.Unlock()
+	if hasMeta {
+		return meta, metaErr
+	}
+
+	meta, metaErr = readMetadata(filename) // not under the lock, so files get read in parallel
+	pi.mu.Lock()
+	e.hasMeta, e.meta, e.metaErr = true, meta, metaErr
+	pi.mu.Unlock()
+	return meta, metaErr
+}
+
+// hash returns the sha256 of the file's contents.
+func (pi *photoIndex)hash(filename string) (string, error) {
+	e, err := pi.entry(filename)
+	if err != nil {
+		return "", err
+	}
+	pi.mu.Lock()
+	h := e.sha256
+	pi.mu.Unlock()
+	if h != "" {
+		return h, nil
+	}
+
+	if h, err = sha256File(filename); err != nil {
+		return "", err
+	}
+	pi.mu.Lock()
+	e.sha256 = h
+	pi.mu.Unlock()
+	return h, nil
+}
+
+// size returns the size of the file, in bytes.
+func (pi *photoIndex)size(filename string) (int64, error) {
+	e, err := pi.entry(filename)
+	if err != nil {
+		return 0, err
+	}
+	return e.size, nil
+}
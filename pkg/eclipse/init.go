@@ -0,0 +1,208 @@
+package eclipse
+
+import(
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// SequenceGap is how long a pause between shots has to be before we
+// think the photos are from different sequences (e.g. some test shots,
+// and then the real bracketed sequence during totality).
+const SequenceGap = 2 * time.Minute
+
+// A scannedPhoto is what we could read from a photo's metadata.
+type scannedPhoto struct {
+	Path  string
+	Layer                // Everything but the pixels
+	Err   error          // If the metadata couldn't be read
+}
+
+// scanPhotos reads the metadata from all the photos in (or under) the
+// args, sorted by capture time (and then filename). Unreadable photos
+// are included, with their error.
+func scanPhotos(args ...string) []scannedPhoto {
+	photos := []scannedPhoto{}
+	for _, arg := range args {
+		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".tif", ".dng":
+				l, err := readMetadata(path)
+				photos = append(photos, scannedPhoto{Path: path, Layer: l, Err: err})
+			}
+			return nil
+		})
+	}
+	sort.SliceStable(photos, func(i, j int) bool {
+		if !photos[i].CaptureTime.Equal(photos[j].CaptureTime) {
+			return photos[i].CaptureTime.Before(photos[j].CaptureTime)
+		}
+		return photos[i].Path < photos[j].Path
+	})
+	return photos
+}
+
+// splitSequences groups the (readable, time sorted) photos into runs
+// of shots with no gap longer than SequenceGap.
+func splitSequences(photos []scannedPhoto) [][]scannedPhoto {
+	seqs := [][]scannedPhoto{}
+	for _, p := range photos {
+		if p.Err != nil {
+			continue
+		}
+		n := len(seqs)
+		if n == 0 || p.CaptureTime.Sub(seqs[n-1][len(seqs[n-1])-1].CaptureTime) > SequenceGap {
+			seqs = append(seqs, []scannedPhoto{})
+			n++
+		}
+		seqs[n-1] = append(seqs[n-1], p)
+	}
+	return seqs
+}
+
+func evRange(photos []scannedPhoto) (int, int) {
+	min, max := 100, -100
+	for _, p := range photos {
+		if p.EV < min { min = p.EV }
+		if p.EV > max { max = p.EV }
+	}
+	return min, max
+}
+
+// InitConfig scans the photos in dir, and writes a starter conf.yaml
+// into it, with settings guessed from what it found. It won't
+// overwrite an existing file. It returns the name of the new file.
+func InitConfig(dir string) (string, error) {
+	filename := filepath.Join(dir, "conf.yaml")
+	if _, err := os.Stat(filename); err == nil {
+		return "", fmt.Errorf("%s already exists, not overwriting it", filename)
+	}
+
+	photos := scanPhotos(dir)
+	seqs := splitSequences(photos)
+	if len(seqs) == 0 {
+		return "", fmt.Errorf("no readable photos (.dng or .tif) in %s", dir)
+	}
+
+	contents, err := starterConfig(dir, photos, seqs)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filename, contents, 0644); err != nil {
+		return "", fmt.Errorf("write '%s': %v", filename, err)
+	}
+	return filename, nil
+}
+
+// starterConfig writes out a commented yaml file. Only the settings
+// we have an opinion about go in; everything else is left at the
+// defaults, so the file stays short enough to edit.
+func starterConfig(dir string, photos []scannedPhoto, seqs [][]scannedPhoto) ([]byte, error) {
+	lines := []string{}
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, strings.TrimRight("# " + fmt.Sprintf(format, args...), " "))
+	}
+
+	// The longest sequence is most likely the eclipse.
+	main := 0
+	for i := range seqs {
+		if len(seqs[i]) > len(seqs[main]) {
+			main = i
+		}
+	}
+
+	add("Starter config, written by `eclipse-hdr init` from %d photos in %s.", len(photos), dir)
+	add("Edit as needed; see README.md for all the options.")
+	add("")
+
+	add("Sequences (split wherever there is a gap of more than %s):", SequenceGap)
+	for i, seq := range seqs {
+		min, max := evRange(seq)
+		note := ""
+		if len(seqs) > 1 {
+			note = "   <- excluded below"
+			if i == main { note = "   <- the main sequence" }
+		}
+		add("  %d: %s - %s, %d photos, EV %d to %d%s", i+1, seq[0].CaptureTime.Format("15:04:05"),
+			seq[len(seq)-1].CaptureTime.Format("15:04:05"), len(seq), min, max, note)
+	}
+	add("")
+
+	byEV := map[int][]string{}
+	for _, p := range seqs[main] {
+		byEV[p.EV] = append(byEV[p.EV], p.Filename())
+	}
+	evs := []int{}
+	for ev := range byEV {
+		evs = append(evs, ev)
+	}
+	sort.Ints(evs)
+	add("Exposures in the main sequence:")
+	for _, ev := range evs {
+		add("  EV %2d: %s", ev, strings.Join(byEV[ev], ", "))
+	}
+	if len(evs) == 1 {
+		add("  (only one exposure; there won't be much dynamic range to fuse)")
+	}
+	add("")
+
+	// Color data: DNGs carry their own, else we need a camera profile.
+	first := seqs[main][0]
+	if strings.ToLower(filepath.Ext(first.Path)) == ".dng" {
+		add("Camera: %s; color data from the DNG files", first.CameraModel)
+	} else if _, exists := ecolor.LookupCameraProfile(first.CameraModel, nil); exists {
+		add("Camera: %s; color data from the built-in camera profile", first.CameraModel)
+	} else {
+		add("Camera: %s; NO color data, so fill these in (see `Using TIFFs instead` in README.md):", first.CameraModel)
+		add("manualoverrideasshotneutral: [r, g, b]")
+		add("manualoverrideforwardmatrix: [9 values, row by row]")
+	}
+	add("")
+
+	setting := func(key string, val interface{}) yaml.MapItem { return yaml.MapItem{Key: key, Value: val} }
+	exclude := yaml.MapSlice{setting("exclude", true)}
+
+	settings := yaml.MapSlice{
+		setting("configversion", CurrentConfigVersion),
+		setting("fuser", "mostexposed"),
+		setting("developer", "dng"),
+		setting("tonemapper", "all"),
+		setting("outputwidthinsolardiameters", 4),
+	}
+
+	images := yaml.MapSlice{}
+	for _, p := range photos {
+		if p.Err != nil {
+			add("Can't read %s (%v); excluded below", p.Filename(), p.Err)
+			images = append(images, setting(p.Filename(), exclude))
+		}
+	}
+	for i, seq := range seqs {
+		if i == main {
+			continue
+		}
+		for _, p := range seq {
+			images = append(images, setting(p.Filename(), exclude))
+		}
+	}
+	if len(images) > 0 {
+		settings = append(settings, setting("images", images))
+	}
+
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("marshal starter config: %v", err)
+	}
+	return append([]byte(strings.Join(lines, "\n") + "\n"), b...), nil
+}
@@ -0,0 +1,91 @@
+package eclipse
+
+import(
+	"math"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// InpaintConfig controls the filling-in of pixels that were clipped in
+// every exposure. Right off the limb, the inner corona (and any
+// prominences) can be too bright even for the shortest bracket, which
+// leaves a hard white ring.
+type InpaintConfig struct {
+	Enabled    bool
+	MaxRadius  float64  // Don't look any further out than this for valid pixels, in solar radii; if zero, 2.0
+	FitWidth   int      // Distance (pixels) between the two samples used to fit the radial falloff; if zero, 4
+}
+
+// InpaintClipped replaces each clipped pixel by extrapolating inwards
+// from the nearest valid pixels further out along the same radial
+// line. The corona brightness falls off roughly as a power of radius,
+// so we fit a power law to two samples on the valid side, and follow
+// it back in.
+func (fi *FusedImage)InpaintClipped() {
+	if !fi.needsLunarLimb("Inpaint") {
+		return
+	}
+	cfg := fi.Config.Inpaint
+	if cfg.MaxRadius == 0.0 { cfg.MaxRadius = 2.0 }
+	if cfg.FitWidth == 0 { cfg.FitWidth = 4 }
+
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+	center := fi.Config.LunarCenter
+	maxR := cfg.MaxRadius * float64(fi.Config.LunarRadius)
+
+	// sampleOutwards walks out from radius r along the angle theta,
+	// until it finds a pixel that wasn't clipped.
+	sampleOutwards := func(theta, r float64) (hdrcolor.RGB, float64, bool) {
+		for ; r < maxR; r += 1.0 {
+			x := center.X + int(math.Round(r * math.Cos(theta)))
+			y := center.Y + int(math.Round(r * math.Sin(theta)))
+			if x < 0 || y < 0 || x >= w || y >= h {
+				return hdrcolor.RGB{}, 0, false
+			}
+			if p := fi.Pix(x, y); !p.Clipped {
+				return p.DevelopedRGB, r, true
+			}
+		}
+		return hdrcolor.RGB{}, 0, false
+	}
+
+	nClipped, nFilled := 0, 0
+	for x:=0; x<w; x++ {
+		for y:=0; y<h; y++ {
+			p := fi.PixRW(x, y)
+			if !p.Clipped {
+				continue
+			}
+			nClipped++
+
+			dx, dy := float64(x - center.X), float64(y - center.Y)
+			r := math.Sqrt(dx*dx + dy*dy)
+			theta := math.Atan2(dy, dx)
+
+			c1, r1, ok := sampleOutwards(theta, r)
+			if !ok {
+				continue
+			}
+			c2, r2, ok := sampleOutwards(theta, r1 + float64(cfg.FitWidth))
+			if !ok || r2 <= r1 {
+				continue
+			}
+
+			// Fit lum = k * r^-n, then scale c1 (keeping its color)
+			l1, l2 := ecolor.LinearSRGBLuminance(c1), ecolor.LinearSRGBLuminance(c2)
+			n := 0.0
+			if l1 > 0 && l2 > 0 {
+				n = math.Log(l1/l2) / math.Log(r2/r1)
+			}
+			n = math.Max(0.0, math.Min(n, 20.0)) // we only expect it to get brighter towards the sun
+			scale := math.Pow(r1/math.Max(r, 1.0), n)
+
+			p.DevelopedRGB = hdrcolor.RGB{R: c1.R*scale, G: c1.G*scale, B: c1.B*scale}
+			nFilled++
+		}
+	}
+
+	fi.Config.infof("Inpaint: %d pixels clipped in every layer, %d filled in\n", nClipped, nFilled)
+}
@@ -0,0 +1,88 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// IsophotesConfig controls the generation of corona isophotes -
+// contours of equal brightness - which are handy for comparing the
+// shape of the corona with model predictions.
+type IsophotesConfig struct {
+	Enabled    bool
+	StepStops  float64  // Brightness step between contours, in stops (factors of two); if zero, 0.5
+	MinRadius  float64  // Don't draw contours closer to the sun than this, in solar radii; if zero, 1.0
+	Overlay    bool     // Also write a copy of each tonemapped output with the contours drawn over it
+}
+
+// Isophotes returns an image with the contours drawn in white, and
+// everything else transparent, so it can be layered over an output.
+func (fi *FusedImage)Isophotes() *image.NRGBA {
+	cfg := fi.Config.Isophotes
+	if cfg.StepStops == 0.0 { cfg.StepStops = 0.5 }
+	if cfg.MinRadius == 0.0 { cfg.MinRadius = 1.0 }
+
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+
+	// Which brightness band each pixel falls into
+	band := make([]int, w*h)
+	for x:=0; x<w; x++ {
+		for y:=0; y<h; y++ {
+			lum := ecolor.LinearSRGBLuminance(fi.Pix(x, y).DevelopedRGB)
+			if lum <= 0.0 || fi.SolarRadii(x, y) < cfg.MinRadius {
+				band[y*w+x] = math.MinInt32
+				continue
+			}
+			band[y*w+x] = int(math.Floor(math.Log2(lum) / cfg.StepStops))
+		}
+	}
+
+	// A contour lies where the band changes between neighbours
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x:=0; x<w-1; x++ {
+		for y:=0; y<h-1; y++ {
+			b := band[y*w+x]
+			if b == math.MinInt32 {
+				continue
+			}
+			if right, down := band[y*w+x+1], band[(y+1)*w+x]; (right != b && right != math.MinInt32) || (down != b && down != math.MinInt32) {
+				img.SetNRGBA(x, y, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+			}
+		}
+	}
+
+	return img
+}
+
+// writeIsophotes writes out the contour layer, and keeps hold of it
+// for overlaying onto the tonemapped outputs.
+func (fi *FusedImage)writeIsophotes() {
+	fi.Config.infof("Generating isophotes (step %.2f stops)\n", fi.Config.Isophotes.StepStops)
+	fi.isophotes = fi.Isophotes()
+	cfg, iso, filename := fi.Config, fi.isophotes, fi.Config.OutputPath(FinalOutput, "isophotes.png")
+	cfg.outputs.write(func() error {
+		if err := cfg.writePNG(iso, filename); err != nil {
+			fi.Config.warnf("Isophotes: %v\n", err)
+		}
+		return nil
+	})
+}
+
+// overlayIsophotes draws the contours over a tonemapped image.
+func (fi *FusedImage)overlayIsophotes(img image.Image, basename string) {
+	cfg, iso, filename := fi.Config, fi.isophotes, fi.Config.OutputPath(FinalOutput, fmt.Sprintf("%s-isophotes.png", basename))
+	cfg.outputs.write(func() error {
+		dst := image.NewRGBA64(img.Bounds())
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+		draw.Draw(dst, dst.Bounds(), iso, image.Point{}, draw.Over)
+		if err := cfg.writePNG(dst, filename); err != nil {
+			fi.Config.warnf("Isophotes: %v\n", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package eclipse
+
+import(
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A FrameFailure records why a frame was dropped from the run.
+type FrameFailure struct {
+	Filename  string
+	Stage     string  // load, lunarlimb, alignment
+	Reason    string
+}
+
+func (ff FrameFailure)String() string { return fmt.Sprintf("%s: %s: %s", ff.Filename, ff.Stage, ff.Reason) }
+
+// frameFailed deals with a frame that couldn't be processed. With
+// KeepGoing, it is recorded (for the manifest) and the caller drops the
+// frame and carries on; otherwise it returns the error that stops the
+// run.
+func (fi *FusedImage)frameFailed(filename, stage, reason string) error {
+	ff := FrameFailure{Filename: filename, Stage: stage, Reason: reason}
+	if !fi.Config.KeepGoing {
+		return fmt.Errorf("%s (use -keepgoing to drop the frame and carry on)", ff)
+	}
+	fi.frameDropped(ff)
+	return nil
+}
+
+// frameSuspect is for a frame that looks wrong, but might not be. With
+// KeepGoing it gets dropped, like a failure; otherwise we just warn.
+func (fi *FusedImage)frameSuspect(filename, stage, reason string) bool {
+	ff := FrameFailure{Filename: filename, Stage: stage, Reason: reason}
+	if !fi.Config.KeepGoing {
+		fi.Config.warnf("Suspect frame %s\n", ff)
+		return false
+	}
+	fi.frameDropped(ff)
+	return true
+}
+
+func (fi *FusedImage)frameDropped(ff FrameFailure) {
+	fi.Config.warnf("Dropping frame %s\n", ff)
+	fi.Config.logEvent("frame.dropped", "frame", ff.Filename, "stage", ff.Stage, "reason", ff.Reason)
+	fi.Failures = append(fi.Failures, ff)
+}
+
+// dropLayers removes the failed layers (by index), and lines the
+// overrides back up with what is left. It's an error if that leaves
+// nothing.
+func (fi *FusedImage)dropLayers(failed map[int]bool) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	layers := []Layer{}
+	for i, l := range fi.Layers {
+		if !failed[i] {
+			layers = append(layers, l)
+		}
+	}
+	fi.Layers = layers
+	fi.setLayerOverrides()
+	if len(fi.Layers) == 0 {
+		return fmt.Errorf("all frames failed, nothing left to work with")
+	}
+	return nil
+}
+
+// checkLunarLimbs flags the layers whose limbs don't look like the
+// others. (Outliers are only dropped with KeepGoing.)
+func (fi *FusedImage)checkLunarLimbs(failed map[int]bool) {
+	radii := map[string][]float64{}
+	for i, l := range fi.Layers {
+		if !failed[i] {
+			radii[fi.limbGroup(l)] = append(radii[fi.limbGroup(l)], float64(l.LunarLimb.Radius()))
+		}
+	}
+	for i, l := range fi.Layers {
+		r, group := float64(l.LunarLimb.Radius()), radii[fi.limbGroup(l)]
+		median := medianOf(group)
+		if !failed[i] && len(group) >= 3 && math.Abs(r - median) > fi.Config.LimbRadiusTolerance * median {
+			failed[i] = fi.frameSuspect(l.Filename(), "lunarlimb", fmt.Sprintf("limb radius %.0f, but the median is %.0f", r, median))
+		}
+	}
+}
+
+// checkAlignments flags the layers whose fine-tuned alignments fit
+// much worse than the others. (Coarse alignments don't have an error
+// metric.)
+func (fi *FusedImage)checkAlignments(failed map[int]bool) {
+	if !fi.Config.DoFineTunedAlignment {
+		return
+	}
+	errs := []float64{}
+	for _, l := range fi.Layers[1:] {
+		errs = append(errs, l.AlignmentTransform.ErrorMetric)
+	}
+	median := medianOf(errs)
+	for i, l := range fi.Layers {
+		e := l.AlignmentTransform.ErrorMetric
+		if i > 0 && len(errs) >= 3 && median > 0 && e > fi.Config.AlignmentErrorTolerance * median {
+			failed[i] = fi.frameSuspect(l.Filename(), "alignment", fmt.Sprintf("alignment error %.4g, but the median is %.4g", e, median))
+		}
+	}
+}
+
+func medianOf(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, vals...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n % 2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"image"
 	"path/filepath"
+	"time"
 
 	"github.com/abworrall/eclipse-hdr/pkg/emath"
 )
@@ -14,6 +15,9 @@ type Layer struct {
 	LoadedImage        image.Image  // The original photo image
 
 	// Data we exctract from image metadata
+	CameraModel        string       // The EXIF `Model`, e.g. "NIKON Df"
+	CaptureTime        time.Time    // The EXIF `DateTimeOriginal`; zero if there wasn't one
+	Dims               image.Point  // Width & height of the photo
 	ExposureValue                   // The exposure value for the photo
 	CameraWhite        emath.Vec3   // A white/neutral color for the photo, given the color temp / white balance
 	CameraToPCS        emath.Mat3   // Maps camera native color to PCS (CIEXYZ(D50?), incl. white balancing
@@ -21,6 +25,7 @@ type Layer struct {
 	// Data we compute
 	LunarLimb                       // Our guess at where the moon is in the photo
 	AlignmentTransform              // How to map a point from the base image into this image
+	cameraMap          *cameraMap   // If LoadedImage was resampled from another camera's photo; see mergeCameras
 
 	// _This_ image is aligned across layers, so a pixel at [x,y] relates to the same bit of sky on every layer
 	image.Image
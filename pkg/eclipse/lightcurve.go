@@ -0,0 +1,216 @@
+package eclipse
+
+import(
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fogleman/gg"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// A LightCurvePoint is the whole of one photo's light, scaled by its
+// exposure (and any filter it was taken through), so that photos
+// across the sequence can be compared.
+type LightCurvePoint struct {
+	Filename     string
+	CaptureTime  time.Time  // Zero if the photo didn't say
+	EV           int
+	Filter       float64    // The density of the filter it was taken through
+	Brightness   float64    // The mean linear brightness, in lux at the sensor (on the same scale as IlluminanceAtMaxExposure)
+	Magnitude    float64    // Relative to the brightest photo, so zero or more
+	Clipped      float64    // The fraction of the pixels that were clipped; if it's much above zero, Brightness is too low
+}
+
+// LightCurve measures each photo's integrated brightness: the mean of
+// its linear pixels (over the camera native channels), scaled by its
+// exposure and filter. Over a whole sequence, from the partial phases
+// through totality, it shows how much the light drops at second contact
+// and comes back at third. The points are in time order; photos without
+// a capture time go at the end.
+func (fi *FusedImage)LightCurve(ctx context.Context) ([]LightCurvePoint, error) {
+	defer fi.measureStage(ctx, "lightcurve")()
+	points := make([]LightCurvePoint, len(fi.Layers))
+	progress := fi.Config.newProgress("Measuring the light curve", len(fi.Layers))
+	err := eimage.ParallelFor(ctx, fi.workers("lightcurve"), len(fi.Layers), func(_, i int) {
+		l := fi.Layers[i]
+		filter := fi.Config.layerOverride(i).Filter
+		bounds := l.LoadedImage.Bounds()
+		sum, clipped := 0.0, 0
+		for y:=bounds.Min.Y; y<bounds.Max.Y; y++ {
+			for x:=bounds.Min.X; x<bounds.Max.X; x++ {
+				r, g, b := eimage.PixelRGB(l.LoadedImage, x, y)
+				if clip := fi.Config.ClipLevel; r >= clip || g >= clip || b >= clip {
+					clipped++
+				}
+				sum += (r + g + b) / 3.0
+			}
+		}
+		n := float64(bounds.Dx() * bounds.Dy())
+		points[i] = LightCurvePoint{
+			Filename:    l.Filename(),
+			CaptureTime: l.CaptureTime,
+			EV:          l.EV,
+			Filter:      filter,
+			Brightness:  sum / n * l.IlluminanceAtMaxExposure * math.Pow(10.0, filter),
+			Clipped:     float64(clipped) / n,
+		}
+		progress.Add(1)
+	})
+	progress.Done()
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("lightcurve: no photos")
+	}
+
+	max := 0.0
+	for _, p := range points {
+		max = math.Max(max, p.Brightness)
+	}
+	for i := range points {
+		points[i].Magnitude = math.Inf(1)
+		if points[i].Brightness > 0.0 {
+			points[i].Magnitude = 2.5 * math.Log10(max / points[i].Brightness)
+		}
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		ti, tj := points[i].CaptureTime, points[j].CaptureTime
+		if ti.IsZero() || tj.IsZero() {
+			return !ti.IsZero() && tj.IsZero()
+		}
+		return ti.Before(tj)
+	})
+	return points, nil
+}
+
+// writeLightCurve measures the light curve, and writes it to the
+// reports dir, as `lightcurve.csv` and a plot of it, `lightcurve.png`;
+// and then the contact times, if the config asks for them.
+func (fi *FusedImage)writeLightCurve(ctx context.Context) error {
+	points, err := fi.LightCurve(ctx)
+	if err != nil {
+		return err
+	}
+
+	filename := fi.Config.OutputPath(ReportOutput, "lightcurve.csv")
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("lightcurve: %v", err)
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"time", "seconds", "filename", "ev", "filter", "brightness", "magnitude", "clipped"})
+	num := func(v float64) string { return strconv.FormatFloat(v, 'g', 8, 64) }
+	start := points[0].CaptureTime
+	for _, p := range points {
+		when, secs := "", ""
+		if !p.CaptureTime.IsZero() {
+			when, secs = p.CaptureTime.Format(time.RFC3339), num(p.CaptureTime.Sub(start).Seconds())
+		}
+		w.Write([]string{when, secs, p.Filename, strconv.Itoa(p.EV), num(p.Filter), num(p.Brightness), num(p.Magnitude), num(p.Clipped)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("lightcurve %s: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("lightcurve %s: %v", filename, err)
+	}
+
+	plotname := fi.Config.OutputPath(ReportOutput, "lightcurve.png")
+	if err := fi.Config.plotLightCurve(points, plotname); err != nil {
+		return err
+	}
+	fi.Config.infof("Measured the light curve over %d photos, wrote %s and %s\n", len(points), filename, plotname)
+	return fi.writeContacts(points)
+}
+
+// plotLightCurve plots the brightness (on a log scale, as it drops by
+// a million or so at totality) against the time since the first photo.
+// Photos that were more than 1% clipped are drawn hollow, as their
+// brightness is only a lower bound. Photos without a capture time can't
+// be placed, so are left off.
+func (c Config)plotLightCurve(points []LightCurvePoint, filename string) error {
+	timed := []LightCurvePoint{}
+	for _, p := range points {
+		if !p.CaptureTime.IsZero() && p.Brightness > 0.0 {
+			timed = append(timed, p)
+		}
+	}
+	if len(timed) == 0 {
+		c.warnf("Light curve: none of the photos had a capture time, so no plot\n")
+		return nil
+	}
+
+	const w, h, margin = 960, 540, 60.0
+	start := timed[0].CaptureTime
+	span := math.Max(1.0, timed[len(timed)-1].CaptureTime.Sub(start).Seconds())
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, p := range timed {
+		lo, hi = math.Min(lo, math.Log10(p.Brightness)), math.Max(hi, math.Log10(p.Brightness))
+	}
+	lo, hi = math.Floor(lo), math.Ceil(hi)
+	if hi == lo {
+		hi++
+	}
+	px := func(secs float64) float64 { return margin + secs / span * (w - 2*margin) }
+	py := func(b float64) float64 { return h - margin - (math.Log10(b) - lo) / (hi - lo) * (h - 2*margin) }
+
+	dc := gg.NewContext(w, h)
+	dc.SetRGB(1, 1, 1)
+	dc.Clear()
+
+	// Axes, with a gridline for each power of ten
+	dc.SetRGB(0.85, 0.85, 0.85)
+	dc.SetLineWidth(1)
+	for e := lo; e <= hi; e++ {
+		y := py(math.Pow(10.0, e))
+		dc.DrawLine(margin, y, w - margin, y)
+		dc.Stroke()
+	}
+	dc.SetRGB(0, 0, 0)
+	dc.DrawRectangle(margin, margin, w - 2*margin, h - 2*margin)
+	dc.Stroke()
+	for e := lo; e <= hi; e++ {
+		dc.DrawStringAnchored(fmt.Sprintf("1e%.0f", e), margin - 6, py(math.Pow(10.0, e)), 1, 0.5)
+	}
+	dc.DrawStringAnchored(start.Format("15:04:05"), margin, h - margin + 16, 0, 0.5)
+	dc.DrawStringAnchored(fmt.Sprintf("+%s", time.Duration(span * float64(time.Second)).Round(time.Second)), w - margin, h - margin + 16, 1, 0.5)
+	dc.DrawStringAnchored("time", w / 2, h - margin + 16, 0.5, 0.5)
+	dc.DrawStringAnchored("Light curve: mean brightness (lux at the sensor), scaled by exposure", w / 2, margin / 2, 0.5, 0.5)
+
+	// The curve, and the points on it
+	dc.SetRGB(0.2, 0.3, 0.7)
+	dc.SetLineWidth(1.5)
+	for i, p := range timed {
+		x, y := px(p.CaptureTime.Sub(start).Seconds()), py(p.Brightness)
+		if i == 0 {
+			dc.MoveTo(x, y)
+		} else {
+			dc.LineTo(x, y)
+		}
+	}
+	dc.Stroke()
+	for _, p := range timed {
+		dc.DrawCircle(px(p.CaptureTime.Sub(start).Seconds()), py(p.Brightness), 3.5)
+		if p.Clipped > 0.01 {
+			dc.Stroke()
+		} else {
+			dc.Fill()
+		}
+	}
+
+	if err := dc.SavePNG(filename); err != nil {
+		return fmt.Errorf("lightcurve plot '%s': %v", filename, err)
+	}
+	return nil
+}
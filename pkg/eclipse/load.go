@@ -1,46 +1,127 @@
 package eclipse
 
 import (
+	"context"
 	"fmt"
+	"image"
 	"io/ioutil"
-	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
-	"github.com/rwcarlsen/goexif/exif"
-	"golang.org/x/image/tiff"
-
-	"github.com/abworrall/go-dng/pkg/dng"
+	"gopkg.in/yaml.v2"
 
 	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
 	"github.com/abworrall/eclipse-hdr/pkg/emath"
 )
 
 
 
-func (fi *FusedImage)LoadFilesAndDirs(args ...string) (error) {
-	if err := fi.loadThings(args...); err != nil {
+func (fi *FusedImage)LoadFilesAndDirs(ctx context.Context, args ...string) (error) {
+	defer fi.measureStage(ctx, "load")()
+	fi.progress = fi.Config.newProgress("Loading (photos)", countPhotos(args...))
+	err := fi.loadThings(args...)
+	if err == nil {
+		fi.Config, err = fi.Config.WithOverrides(fi.Overrides...)
+		fi.Config = fi.Config.withPreview()
+	}
+	if err == nil {
+		err = fi.loadPhotos(ctx) // now we've seen any config, and know how many threads to use
+	}
+	fi.progress.Done()
+	fi.progress = nil
+	if err != nil {
 		return err
 	}
+	return fi.setupColor()
+}
 
-	// Now everything is loaded, tidy up config
-	if len(fi.Layers) > 0 && fi.Layers[0].CameraToPCS[1] != 0.0 {
-		log.Printf("Taking CameraWhite/CameraToPCS from DNG data in %s\n", fi.Layers[0].Filename())
+// setupColor tidies up the config, now that everything is loaded:
+// it works out the camera color data, and applies the white balance.
+func (fi *FusedImage)setupColor() error {
+	if fi.Config.Monochrome {
+		fi.Config.infof("Monochrome camera, skipping all color correction\n")
+		fi.Config.CameraWhite = emath.Vec3{1, 1, 1}
+		fi.Config.CameraToPCS = emath.Vec3{1, 1, 1}.Diag()
+		return nil
+
+	} else if len(fi.Layers) > 0 && fi.Layers[0].CameraToPCS != (emath.Mat3{}) {
+		fi.Config.infof("Taking CameraWhite/CameraToPCS from DNG data (or the Photo) for %s\n", fi.Layers[0].Filename())
 		fi.Config.CameraWhite = fi.Layers[0].CameraWhite
 		fi.Config.CameraToPCS = fi.Layers[0].CameraToPCS
 
 	} else if fi.Config.ManualOverrideForwardMatrix[0] != 0.0 {
-		log.Printf("Taking CameraWhite/CameraToPCS from manual overrides in config.yaml\n")
+		fi.Config.infof("Taking CameraWhite/CameraToPCS from manual overrides in config.yaml\n")
 		fi.Config.CameraWhite = fi.Config.ManualOverrideAsShotNeutral
 		fi.Config.CameraToPCS = ecolor.MakeCameraToPCS(fi.Config.ManualOverrideAsShotNeutral,
 			fi.Config.ManualOverrideForwardMatrix)
 
+	} else if cp, model, exists := fi.lookupCameraProfile(); exists {
+		fi.Config.infof("Taking CameraWhite/CameraToPCS from camera profile for '%s'\n", model)
+		fi.Config.CameraWhite = cp.AsShotNeutral
+		fi.Config.CameraToPCS = cp.CameraToPCS()
+
+	} else if len(fi.Layers) == 0 && fi.Config.CameraToPCS != (emath.Mat3{}) {
+		// Later phases (e.g. `eclipse-hdr render`) only need a config
+		// snapshot, with the white balance already applied.
+		fi.Config.infof("Taking CameraWhite/CameraToPCS from config snapshot\n")
+		if cs, err := ecolor.LookupOutputColorSpace(fi.Config.OutputColorSpace); err != nil {
+			return err
+		} else {
+			fi.Config.ColorSpace = cs
+		}
+		return nil
+
 	} else {
-		return fmt.Errorf("No color correction info; need DNGs, or ManualOverride{AsShotNeutral,ForwardMatrix} in conf.yaml")
+		return fmt.Errorf("No color correction info; need DNGs, or ManualOverride{AsShotNeutral,ForwardMatrix} in conf.yaml, or a known camera model")
 	}
 
-	return nil
+	if cs, err := ecolor.LookupOutputColorSpace(fi.Config.OutputColorSpace); err != nil {
+		return err
+	} else {
+		fi.Config.ColorSpace = cs
+	}
+
+	return fi.ApplyWhiteBalance()
+}
+
+// lookupCameraProfile finds color data for the camera, either as named
+// in the config, or as recorded in the EXIF data of the first layer.
+func (fi *FusedImage)lookupCameraProfile() (ecolor.CameraProfile, string, bool) {
+	model := fi.Config.CameraModel
+	if model == "" && len(fi.Layers) > 0 {
+		model = fi.Layers[0].CameraModel
+	}
+	cp, exists := ecolor.LookupCameraProfile(model, fi.Config.CameraProfiles)
+	return cp, model, exists
+}
+
+func (c Config)logLayerEvent(l Layer) {
+	c.logEvent("layer.loaded", "frame", l.Filename(), "camera", l.CameraModel, "ev", l.EV,
+		"iso", l.ISO, "aperture", float64(l.ApertureX10) / 10.0,
+		"exposure", float64(l.ShutterSpeed[0]) / float64(l.ShutterSpeed[1]),
+		"width", l.Dims.X, "height", l.Dims.Y)
+}
+
+// countPhotos walks the args the same way loadThings does, counting
+// the photo files (for progress reporting).
+func countPhotos(args ...string) int {
+	n := 0
+	for _, arg := range args {
+		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				switch strings.ToLower(filepath.Ext(path)) {
+				case ".tif", ".dng": n++
+				}
+			}
+			return nil
+		})
+	}
+	return n
 }
 
 func (fi *FusedImage)loadThings(args ...string) (error) {
@@ -74,193 +155,260 @@ func (fi *FusedImage)loadThings(args ...string) (error) {
 	return nil
 }
 
-	
+// loadPhotos loads all the photos that loadThings found, in
+// parallel. Photos excluded by the config aren't loaded.
+func (fi *FusedImage)loadPhotos(ctx context.Context) error {
+	if err := fi.indexPhotos(ctx); err != nil {
+		return err
+	}
+	index := fi.photoIndex()
+	var mu sync.Mutex
+	errs := make([]error, len(fi.photoFiles))
+
+	err := eimage.ParallelFor(ctx, fi.Config.NumThreads(), len(fi.photoFiles), func(_, i int) {
+		filename := fi.photoFiles[i]
+		if fi.Config.Images[filepath.Base(filename)].Exclude {
+			fi.Config.infof("Excluding %s, as per config\n", filepath.Base(filename))
+			fi.progress.Add(1)
+			return
+		}
+
+		if len(fi.Config.Select) > 0 {
+			meta, err := index.metadata(filename)
+			if err == nil {
+				err = fi.applyImageOverride(&meta)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("Reading metadata from %s failed: %v", filename, err)
+				return
+			}
+			if failed := fi.Config.selectPhoto(meta); failed != "" {
+				fi.Config.infof("Skipping %s, not selected (%s)\n", filepath.Base(filename), failed)
+				fi.progress.Add(1)
+				return
+			}
+		}
+
+		var layer Layer
+		var err error
+		mu.Lock()
+		cached, isCached := fi.photoCache[filename]
+		mu.Unlock()
+
+		switch {
+		case isCached:
+			layer = cached
+		case fi.metadataOnly:
+			if layer, err = index.metadata(filename); err != nil {
+				errs[i] = fmt.Errorf("Reading metadata from %s failed: %v", filename, err)
+				return
+			}
+		case strings.ToLower(filepath.Ext(filename)) == ".tif":
+			if layer, err = index.metadata(filename); err != nil {
+				errs[i] = fmt.Errorf("Loading %s as TIFF failed: %v", filename, err)
+				return
+			} else if layer, err = loadTIFF(layer); err != nil {
+				errs[i] = fmt.Errorf("Loading %s as TIFF failed: %v", filename, err)
+				return
+			}
+		default:
+			meta, _ := index.metadata(filename) // the DNG SDK reads the exposure; we just want the camera model
+			if layer, err = loadDNG(filename, meta.CameraModel); err != nil {
+				errs[i] = fmt.Errorf("Loading %s as DNG failed: %v", filename, err)
+				return
+			}
+		}
+
+		if !isCached {
+			fi.Config.previewLayer(ctx, &layer)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if fi.photoCache != nil && !isCached {
+			fi.photoCache[filename] = layer
+		}
+		if err := fi.applyImageOverride(&layer); err != nil {
+			errs[i] = err
+			return
+		}
+		fi.AddLayer(layer)
+		fi.progress.Add(1)
+		if !fi.metadataOnly && !isCached {
+			fi.Config.logLayerEvent(layer)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, err := range errs {
+		if err != nil && fi.Config.KeepGoing {
+			fi.frameDropped(FrameFailure{Filename: filepath.Base(fi.photoFiles[i]), Stage: "load", Reason: err.Error()})
+		} else if err != nil {
+			return err
+		}
+	}
+	fi.photoFiles = nil
+	fi.setLayerOverrides()
+	return nil
+}
+
 func (fi *FusedImage)loadFile(filename string) error {
 	ext := filepath.Ext(filename)
 
+	switch strings.ToLower(ext) {
+	case ".tif", ".dng", ".hdr", ".yaml":
+		fi.inputFiles = append(fi.inputFiles, filename)
+	}
+
 	switch strings.ToLower(ext) {
 
-	case ".tif":
-		layer, err := loadTIFF(filename)
+	case ".hdr":
+		if !fi.metadataOnly {
+			break
+		}
+		dims, err := eio.ReadHDRDims(filename)
 		if err != nil {
-			return fmt.Errorf("Loading %s as TIFF failed: %v", filename, err)
+			return fmt.Errorf("Reading metadata from %s failed: %v", filename, err)
 		}
-		fi.AddLayer(layer)
+		fi.OutputArea = image.Rectangle{Max: dims}
+		fi.hdrInputs = append(fi.hdrInputs, filepath.Base(filename))
+		return nil
+	}
 
-	case ".dng":
-		layer, err := loadDNG(filename)
-		if err != nil {
-			return fmt.Errorf("Loading %s as DNG failed: %v", filename, err)
+	switch strings.ToLower(ext) {
+
+	case ".tif", ".dng":
+		fi.photoFiles = append(fi.photoFiles, filename) // loaded later, by loadPhotos
+
+	case ".hdr":
+		if err := fi.loadHDR(filename); err != nil {
+			return fmt.Errorf("Loading %s as HDR failed: %v", filename, err)
 		}
-		fi.AddLayer(layer)
+		fi.hdrInputs = append(fi.hdrInputs, filepath.Base(filename))
+		fi.Config.infof("Loaded HDR pixels from %s\n", filename)
 
 	case ".yaml":
-		cfg, err := loadConfig(filename)
+		cfg, err := loadConfig(filename, fi.Config)
 		if err != nil {
 			return fmt.Errorf("Loading %s as config YAML failed: %v", filename, err)
 		}
 		fi.Config = cfg
-		log.Printf("Loaded base configuration from %s\n", filename)
+		fi.Config.infof("Loaded configuration from %s\n", filename)
 	}
 
 	return nil
 }
 
-func loadConfig(filename string) (Config, error) {
+// loadConfig overlays the config file onto base. If the file has an
+// `include` list, those files (relative to this one) are loaded first,
+// in order, so this file only needs to say what is different - e.g. a
+// shared camera.yaml, with a small file per eclipse that includes it.
+func loadConfig(filename string, base Config) (Config, error) {
+	return loadConfigIncluding(filename, base, nil)
+}
+
+func loadConfigIncluding(filename string, base Config, chain []string) (Config, error) {
+	abs, _ := filepath.Abs(filename)
+	for _, prev := range chain {
+		if prev == abs {
+			return Config{}, fmt.Errorf("config %s: include loop: %s -> %s", filename, strings.Join(chain, " -> "), abs)
+		}
+	}
+	chain = append(chain, abs)
+
 	contents, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return Config{}, fmt.Errorf("config read %s: %v", filename, err)
 	}
-
-	return newConfigFromYaml(contents)
-}
-
-func loadDNG(filename string) (Layer, error) {
-	l := Layer{LoadFilename: filename}
-
-	img := dng.Image{ImageKind:dng.ImageStage3}
-	if err := img.Load(filename); err != nil {
-		return Layer{}, err
+	migrated, notes, err := migrateConfig(contents)
+	if err != nil {
+		return Config{}, fmt.Errorf("config %s: %v", filename, err)
 	}
-
-	fnum := img.ExifFNumber()
-	exposure := img.ExifExposureTime()
-
-	l.ExposureValue.ISO = img.ExifISO()
-	l.ApertureX10 = fNumberToX10(int(fnum[0]), int(fnum[1]))
-	l.ShutterSpeed = rat64{int64(exposure[0]), int64(exposure[1])}
-
-	l.CameraWhite = emath.Vec3(img.CameraWhite())
-	l.CameraToPCS = emath.Mat3(img.CameraToPCS())
-	
-	if err := l.ExposureValue.Validate(); err != nil {
-		return l, fmt.Errorf("image '%s' Invalid EV: %v", filename, err)
+	for _, note := range notes {
+		base.infof("Config %s is from an older version: %s (`eclipse-hdr migrate %s` updates the file)\n", filename, note, filename)
+	}
+	if len(notes) > 0 {
+		contents = migrated // else keep the original, so error messages have the right line numbers
 	}
 
-	l.LoadedImage = img
-	l.Image = l.LoadedImage // Default to no alignment (needed for first image ?) - FIXME, this is messy
-
-	return l, nil
-}
-
-func loadTIFF(filename string) (Layer, error) {
-	l := Layer{LoadFilename: filename}
-
-	// First, try to load the EXIF metadata.
-	if reader, err := os.Open(filename); err != nil {
-		return l, fmt.Errorf("open+r exif '%s': %v", filename, err)
-
-	} else if ex, err := exif.Decode(reader); err != nil {
-		return l, fmt.Errorf("exif parsing '%s': %v", filename, err)
-
-	} else {
-		if tag, err := ex.Get(exif.ISOSpeedRatings); err != nil {
-			return l, fmt.Errorf("exif ISO '%s': %v", filename, err)
-		} else if val, err := tag.Int64(0); err != nil {
-			return l, fmt.Errorf("exif ISO '%s': %v", filename, err)
-		} else {
-			l.ExposureValue.ISO = int(val)
+	// Any errors in here will get reported by the strict parse below
+	includes := struct{ Include []string }{}
+	yaml.Unmarshal(contents, &includes)
+	for _, inc := range includes.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(filename), inc)
 		}
-
-		if tag, err := ex.Get(exif.FNumber); err != nil {
-			return l, fmt.Errorf("exif FNumber '%s': %v", filename, err)
-		} else if num, denom, err := tag.Rat2(0); err != nil {
-			return l, fmt.Errorf("exif FNumber '%s': %v", filename, err)
-		} else {
-			l.ApertureX10 = fNumberToX10(int(num), int(denom))
+		if base, err = loadConfigIncluding(inc, base, chain); err != nil {
+			return base, err
 		}
+		base.debugf("Config %s includes %s\n", filename, inc)
+	}
 
-		if tag, err := ex.Get(exif.ExposureTime); err != nil {
-			return l, fmt.Errorf("exif ExposureTime '%s': %v", filename, err)
-		} else if num, denom, err := tag.Rat2(0); err != nil {
-			return l, fmt.Errorf("exif ExposureTime '%s': %v", filename, err)
-		} else {
-			l.ShutterSpeed = rat64{num,denom}
+	cfg, err := newConfigFromYaml(contents, base)
+	cfg.Include = nil // all loaded now; don't let snapshots load them again
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// Each of these is like "line 3: field exposre not found in type eclipse.Config"
+		lines := []string{}
+		for _, e := range typeErr.Errors {
+			lines = append(lines, filename + ":" + strings.TrimPrefix(e, "line "))
 		}
+		return cfg, fmt.Errorf("config errors:\n  %s", strings.Join(lines, "\n  "))
+	}
+	return cfg, err
+}
 
-		// Note: we ignore Exposure Compensation, as it is informational. The
-		// Fstop/Speed/ISO triple fully defines how much light would expose a pixel.
-		
-		if err := l.ExposureValue.Validate(); err != nil {
-			return l, fmt.Errorf("image '%s' EV: %v", filename, err)
-		}
+// loadTIFF loads the image data for a photo, whose metadata (from the
+// photo index) is already in `l`.
+func loadTIFF(l Layer) (Layer, error) {
+	img, err := eio.ReadTIFF(l.LoadFilename)
+	if err != nil {
+		return l, err
 	}
+	l.LoadedImage = img
+	l.Image = l.LoadedImage // Default to no alignment (needed for first image ?)
+	l.Dims = img.Bounds().Size()
+	return l, nil
+}
 
-	// Re-open the file, now for the image data
-	if reader, err := os.Open(filename); err != nil {
-		return l, fmt.Errorf("open+r img '%s': %v", filename, err)
-	} else if img, err := tiff.Decode(reader); err != nil {
-		return l, fmt.Errorf("tiff loading '%s': %v", filename, err)
-	} else {
-		l.LoadedImage = img
-		l.Image = l.LoadedImage // Default to no alignment (needed for first image ?)
+// loadDNG loads a DNG photo (see eio.ReadDNG); the camera model comes
+// from its EXIF data (see photoIndex).
+func loadDNG(filename, model string) (Layer, error) {
+	d, err := eio.ReadDNG(filename)
+	if err != nil {
+		return Layer{}, err
+	}
+	l := Layer{LoadFilename: filename, CameraWhite: d.CameraWhite, CameraToPCS: d.CameraToPCS}
+	d.CameraModel = model
+	if err := l.setMetadata(d.Metadata); err != nil {
+		return l, err
 	}
-	
+	l.LoadedImage = d.Image
+	l.Image = l.LoadedImage // Default to no alignment (needed for first image ?) - FIXME, this is messy
+	l.Dims = d.Dims
 	return l, nil
 }
 
-func fNumberToX10(num, denom int) int {
-	switch denom {
-	case 10: return num
-	case  5: return num * 2
-	case  1: return num * 10
-	default:
-		panic(fmt.Sprintf("exif FNumber denom unhandled '%d/%d'", num, denom))
+// setMetadata fills in the layer's camera model and exposure from
+// what its file says (see eio.ReadExif).
+func (l *Layer)setMetadata(m eio.Metadata) error {
+	l.CameraModel = m.CameraModel
+	l.CaptureTime = m.CaptureTime
+	l.ExposureValue.ISO = m.ISO
+	l.ApertureX10 = fNumberToX10(int(m.FNumber[0]), int(m.FNumber[1]))
+	l.ShutterSpeed = rat64(m.ExposureTime)
+	if err := l.ExposureValue.Validate(); err != nil {
+		return fmt.Errorf("image '%s' EV: %v", l.LoadFilename, err)
 	}
-	return -1
+	return nil
 }
 
-/* Example EXIF dump from a 16-bit TIFF exported by lightroom from a DNG imported from a Nikon Df.
-
-ApertureValue: "4970854/1000000"
-SceneType: ""
-SceneCaptureType: 0
-Flash: 0
-ColorSpace: 65535
-FocalLengthIn35mmFilm: 480
-MeteringMode: 5
-LensModel: "200.0-500.0 mm f/5.6"
-SamplesPerPixel: 3
-PlanarConfiguration: 1
-FNumber: "56/10"
-DateTimeDigitized: "2017:08:21 11:34:53"
-FocalPlaneYResolution: "44855751/32768"
-FileSource: ""
-DigitalZoomRatio: "1/1"
-GainControl: 1
-Compression: 1
-XResolution: "72/1"
-ExifIFDPointer: 15320
-ShutterSpeedValue: "10965784/1000000"
-ImageWidth: 4928
-ResolutionUnit: 2
-ExposureMode: 1
-Saturation: 0
-MaxApertureValue: "50/10"
-FocalPlaneResolutionUnit: 3
-SensingMethod: 2
-Contrast: 0
-ImageLength: 3280
-DateTime: "2019:06:29 15:38:50"
-ExposureProgram: 1
-ExposureBiasValue: "-12/6"
-SubjectDistanceRange: 0
-ISOSpeedRatings: 800
-DateTimeOriginal: "2017:08:21 11:34:53"
-FocalLength: "4800/10"
-SubSecTimeOriginal: "4"
-PhotometricInterpretation: 2
-Model: "NIKON Df"
-YResolution: "72/1"
-ExposureTime: "1/2000"
-SubSecTimeDigitized: "40"
-CFAPattern: ""
-WhiteBalance: 0
-FocalPlaneXResolution: "44855751/32768"
-CustomRendered: 0
-BitsPerSample: [16,16,16]
-Make: "NIKON CORPORATION"
-ExifVersion: "0231"
-LightSource: 0
-
- */
+// fNumberToX10 turns an EXIF rational FNumber (e.g. 56/10) into f/N*10
+// (e.g. 56); a zero denominator (unknown) gives 0.
+func fNumberToX10(num, denom int) int {
+	if denom == 0 {
+		return 0
+	}
+	return int(math.Round(float64(num) * 10 / float64(denom)))
+}
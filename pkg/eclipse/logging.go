@@ -0,0 +1,119 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+const(
+	LevelTrace = slog.LevelDebug - 4 // per-pixel detail
+)
+
+var(
+	// logLevel is how much the standard log package gets; see
+	// SetVerbosity. (A LevelVar is safe to set while runs are logging.)
+	logLevel = new(slog.LevelVar)
+
+	// defaultLogger is for runs without a Config.Logger; see
+	// SetDefaultLogger.
+	defaultLogger atomic.Pointer[slog.Logger]
+)
+
+// SetVerbosity maps the command line flags onto log levels: -q (-1)
+// only shows warnings, 0 is the normal progress messages, -v (1) adds
+// per-frame detail, and -vv (2) adds per-pixel detail.
+func SetVerbosity(v int) {
+	switch {
+	case v < 0:  logLevel.Set(slog.LevelWarn)
+	case v == 0: logLevel.Set(slog.LevelInfo)
+	case v == 1: logLevel.Set(slog.LevelDebug)
+	default:     logLevel.Set(LevelTrace)
+	}
+}
+
+// LogLevel is the level that SetVerbosity set, for the handler of a
+// logger (see WithLogger) to filter by.
+func LogLevel() slog.Leveler {
+	return logLevel
+}
+
+// SetDefaultLogger sends the messages and events of runs that don't
+// have their own logger (see WithLogger) to l; nil puts them back to
+// the standard log package (events are then dropped). It is safe to
+// call at any time.
+func SetDefaultLogger(l *slog.Logger) {
+	defaultLogger.Store(l)
+}
+
+// logAttrs say which stage, and which frame, a message is about; they
+// are added to each message (and event) as `stage` and `frame` attrs.
+type logAttrs struct {
+	stage  string
+	frame  string
+}
+
+// logger is where the run's messages & events go; nil is the
+// standard log package.
+func (c Config)logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return defaultLogger.Load()
+}
+
+// forStage and forFrame are the config, with its messages tagged.
+func (c Config)forStage(stage string) Config {
+	c.logAttrs.stage = stage
+	return c
+}
+
+func (c Config)forFrame(frame string) Config {
+	c.logAttrs.frame = frame
+	return c
+}
+
+// withLogAttrs adds the stage & frame to args (slog key/value pairs),
+// unless args already has them.
+func (c Config)withLogAttrs(args []any) []any {
+	has := map[string]bool{}
+	for i:=0; i<len(args); i+=2 {
+		if key, ok := args[i].(string); ok {
+			has[key] = true
+		}
+	}
+	out := append([]any{}, args...)
+	if c.logAttrs.stage != "" && !has["stage"] {
+		out = append(out, "stage", c.logAttrs.stage)
+	}
+	if c.logAttrs.frame != "" && !has["frame"] {
+		out = append(out, "frame", c.logAttrs.frame)
+	}
+	return out
+}
+
+func (c Config)logAt(level slog.Level, format string, args ...interface{}) {
+	if l := c.logger(); l != nil {
+		if ctx := context.Background(); l.Enabled(ctx, level) {
+			l.Log(ctx, level, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), c.withLogAttrs(nil)...)
+		}
+		return
+	}
+	if level < logLevel.Level() {
+		return
+	}
+	if level >= slog.LevelError {
+		format = "ERROR: " + format
+	} else if level >= slog.LevelWarn {
+		format = "WARNING: " + format
+	}
+	log.Printf(format, args...)
+}
+
+func (c Config)tracef(format string, args ...interface{}) { c.logAt(LevelTrace, format, args...) }
+func (c Config)debugf(format string, args ...interface{}) { c.logAt(slog.LevelDebug, format, args...) }
+func (c Config)infof(format string, args ...interface{})  { c.logAt(slog.LevelInfo, format, args...) }
+func (c Config)warnf(format string, args ...interface{})  { c.logAt(slog.LevelWarn, format, args...) }
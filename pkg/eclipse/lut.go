@@ -0,0 +1,161 @@
+package eclipse
+
+import(
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A LUT3D is a 3D color lookup table, as read from an Adobe/Resolve
+// `.cube` file. It maps display-encoded RGB in [0,1] to display-encoded
+// RGB, so it gets applied to the tonemapped images, as the final look.
+type LUT3D struct {
+	Title     string
+	Size      int
+	DomainMin [3]float64
+	DomainMax [3]float64
+	Table     [][3]float64 // Size^3 entries; red varies fastest, then green, then blue
+}
+
+// LoadCubeLUT parses a `.cube` file. Only 3D LUTs are supported.
+func LoadCubeLUT(filename string) (*LUT3D, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open+r LUT '%s': %v", filename, err)
+	}
+	defer reader.Close()
+
+	lut := LUT3D{DomainMax: [3]float64{1.0, 1.0, 1.0}}
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+
+		switch fields[0] {
+		case "TITLE":
+			lut.Title = strings.Trim(strings.TrimPrefix(line, "TITLE"), " \"")
+		case "LUT_1D_SIZE":
+			return nil, fmt.Errorf("LUT '%s': 1D LUTs not supported", filename)
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("LUT '%s' line %d: bad LUT_3D_SIZE", filename, lineNum)
+			}
+			if lut.Size, err = strconv.Atoi(fields[1]); err != nil || lut.Size < 2 {
+				return nil, fmt.Errorf("LUT '%s' line %d: bad LUT_3D_SIZE '%s'", filename, lineNum, fields[1])
+			}
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			v, err := parseFloats(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("LUT '%s' line %d: %v", filename, lineNum, err)
+			}
+			if fields[0] == "DOMAIN_MIN" {
+				lut.DomainMin = v
+			} else {
+				lut.DomainMax = v
+			}
+		default:
+			v, err := parseFloats(fields)
+			if err != nil {
+				return nil, fmt.Errorf("LUT '%s' line %d: %v", filename, lineNum, err)
+			}
+			lut.Table = append(lut.Table, v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading LUT '%s': %v", filename, err)
+	}
+
+	if lut.Size == 0 {
+		return nil, fmt.Errorf("LUT '%s': no LUT_3D_SIZE", filename)
+	} else if len(lut.Table) != lut.Size*lut.Size*lut.Size {
+		return nil, fmt.Errorf("LUT '%s': expected %d entries, got %d", filename, lut.Size*lut.Size*lut.Size, len(lut.Table))
+	}
+	return &lut, nil
+}
+
+func parseFloats(fields []string) ([3]float64, error) {
+	v := [3]float64{}
+	if len(fields) != 3 {
+		return v, fmt.Errorf("expected 3 values, got %d", len(fields))
+	}
+	for i, f := range fields {
+		var err error
+		if v[i], err = strconv.ParseFloat(f, 64); err != nil {
+			return v, fmt.Errorf("bad value '%s': %v", f, err)
+		}
+	}
+	return v, nil
+}
+
+func (lut *LUT3D)at(r, g, b int) [3]float64 {
+	return lut.Table[r + lut.Size * (g + lut.Size * b)]
+}
+
+// Lookup maps an RGB triple through the LUT, using trilinear
+// interpolation.
+func (lut *LUT3D)Lookup(rgb [3]float64) [3]float64 {
+	idx, frac := [3]int{}, [3]float64{}
+	for i := range rgb {
+		v := (rgb[i] - lut.DomainMin[i]) / (lut.DomainMax[i] - lut.DomainMin[i])
+		if v < 0.0 { v = 0.0 }
+		if v > 1.0 { v = 1.0 }
+		v *= float64(lut.Size - 1)
+		idx[i] = int(v)
+		if idx[i] == lut.Size-1 {
+			idx[i]--
+		}
+		frac[i] = v - float64(idx[i])
+	}
+
+	out := [3]float64{}
+	for corner:=0; corner<8; corner++ {
+		w := 1.0
+		pos := [3]int{}
+		for i:=0; i<3; i++ {
+			if corner & (1<<i) != 0 {
+				pos[i] = idx[i] + 1
+				w *= frac[i]
+			} else {
+				pos[i] = idx[i]
+				w *= 1.0 - frac[i]
+			}
+		}
+		c := lut.at(pos[0], pos[1], pos[2])
+		for i:=0; i<3; i++ {
+			out[i] += w * c[i]
+		}
+	}
+	return out
+}
+
+// Apply returns a copy of the (LDR) image, mapped through the LUT.
+func (lut *LUT3D)Apply(img image.Image) *image.RGBA64 {
+	b := img.Bounds()
+	out := image.NewRGBA64(b)
+	for x:=b.Min.X; x<b.Max.X; x++ {
+		for y:=b.Min.Y; y<b.Max.Y; y++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			v := lut.Lookup([3]float64{float64(r)/0xFFFF, float64(g)/0xFFFF, float64(bl)/0xFFFF})
+			out.SetRGBA64(x, y, color.RGBA64{toU16(v[0]), toU16(v[1]), toU16(v[2]), uint16(a)})
+		}
+	}
+	return out
+}
+
+func toU16(f float64) uint16 {
+	if f <= 0.0 {
+		return 0
+	} else if f >= 1.0 {
+		return 0xFFFF
+	}
+	return uint16(f * 0xFFFF + 0.5)
+}
@@ -0,0 +1,195 @@
+package eclipse
+
+import(
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Version is the release of eclipse-hdr; set it at build time with
+// `-ldflags "-X github.com/abworrall/eclipse-hdr/pkg/eclipse.Version=v1.2.0"`.
+// The VCS revision is picked up from the build info anyway.
+var Version = "dev"
+
+// A Manifest records everything about a run that went into its
+// outputs: the software, the exact input files, what was detected and
+// worked out for each frame, and the effective config. Rerun the same
+// software on the same inputs with that config, and you get the same
+// outputs (whose hashes are recorded too, so you can check).
+type Manifest struct {
+	Phase      string
+	Started    time.Time
+	Finished   time.Time
+	Software   SoftwareInfo
+	Inputs   []ManifestFile
+	Frames   []ManifestFrame
+	Dropped  []FrameFailure `yaml:",omitempty"` // Frames that failed, with KeepGoing
+	Outputs  []ManifestFile
+	Stages   []StageMetric  `yaml:",omitempty"` // How long each stage took, and the memory it used
+	Photometry *PhotometricCalibration `yaml:",omitempty"` // If there were reference stars
+	Config     yaml.MapSlice // The config as the phase started, after all the files, overrides and flags
+}
+
+type SoftwareInfo struct {
+	Version       string
+	Revision      string   `yaml:",omitempty"`
+	Modified      bool     `yaml:",omitempty"` // Built from a tree with uncommitted changes
+	GoVersion     string
+	Platform      string
+	Dependencies  []string // module@version
+}
+
+type ManifestFile struct {
+	Path    string
+	SHA256  string
+	Size    int64
+}
+
+type ManifestFrame struct {
+	Filename    string
+	EV          int
+	LunarLimb   LunarLimb
+	Alignment   AlignmentTransform
+	Override    ImageOverride `yaml:",omitempty"`
+	Score      *FrameScore    `yaml:",omitempty"` // With `scoring`
+}
+
+func softwareInfo() SoftwareInfo {
+	si := SoftwareInfo{Version: Version, GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision": si.Revision = s.Value
+			case "vcs.modified": si.Modified = s.Value == "true"
+			}
+		}
+		for _, dep := range bi.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			si.Dependencies = append(si.Dependencies, dep.Path + "@" + dep.Version)
+		}
+	}
+	return si
+}
+
+// startManifest snapshots the config, before the phase changes it.
+func (fi *FusedImage)startManifest(phase string) *Manifest {
+	m := &Manifest{Phase: phase, Started: time.Now(), Software: softwareInfo()}
+	if err := yaml.Unmarshal([]byte(fi.Config.AsYaml()), &m.Config); err != nil {
+		fi.Config.warnf("Manifest: %v\n", err)
+	}
+	return m
+}
+
+// finishManifest fills in the rest, and writes it into the reports
+// dir as `manifest-<phase>.yaml`.
+func (fi *FusedImage)finishManifest(m *Manifest) error {
+	m.Finished = time.Now()
+	filename := fi.Config.OutputPath(ReportOutput, "manifest-" + m.Phase + ".yaml")
+	if err := fi.writeManifest(*m, filename); err != nil {
+		return err
+	}
+	fi.Config.infof("Wrote run manifest to %s\n", filename)
+	return nil
+}
+
+// writeManifest fills in the manifest with how things are now, and
+// writes it out.
+func (fi *FusedImage)writeManifest(m Manifest, filename string) error {
+	inputs := append([]string{}, fi.inputFiles...)
+	for _, f := range []string{fi.Config.LUTFile, fi.Config.Annotation.FontFile, fi.Config.SyntheticMoon.TextureFile} {
+		if f != "" {
+			inputs = append(inputs, f)
+		}
+	}
+	for _, filename := range inputs {
+		mf, err := fi.manifestFile(filename)
+		if err != nil {
+			return fmt.Errorf("manifest: %v", err)
+		}
+		m.Inputs = append(m.Inputs, mf)
+	}
+
+	for i, l := range fi.Layers {
+		mf := ManifestFrame{Filename: l.Filename(), EV: l.EV, LunarLimb: l.LunarLimb,
+			Alignment: l.AlignmentTransform, Override: fi.Config.layerOverride(i)}
+		if s, exists := fi.Scores[l.Filename()]; exists {
+			mf.Score = &s
+		}
+		m.Frames = append(m.Frames, mf)
+	}
+
+	m.Dropped = fi.Failures
+	m.Stages = fi.metrics
+	m.Photometry = fi.Photometry
+
+	outputs, err := fi.Config.outputsSince(m.Started.Truncate(time.Second)) // some filesystems have coarse mtimes
+	if err != nil {
+		return fmt.Errorf("manifest: %v", err)
+	}
+	for _, output := range outputs {
+		if output == filename {
+			continue
+		}
+		mf, err := fi.manifestFile(output)
+		if err != nil {
+			return fmt.Errorf("manifest: %v", err)
+		}
+		m.Outputs = append(m.Outputs, mf)
+	}
+
+	if fi.Config.Deterministic {
+		m.Started, m.Finished, m.Stages = time.Time{}, time.Time{}, nil // so the manifest is reproducible too
+	}
+
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write manifest '%s': %v", filename, err)
+	}
+	return nil
+}
+
+func (fi *FusedImage)manifestFile(filename string) (ManifestFile, error) {
+	size, err := fi.photoIndex().size(filename)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	h, err := fi.photoIndex().hash(filename) // the photos were hashed when they were indexed
+	return ManifestFile{Path: filename, SHA256: h, Size: size}, err
+}
+
+// outputsSince lists the files in the output dirs that were written
+// since the time.
+func (c Config)outputsSince(t time.Time) ([]string, error) {
+	dirs := map[string]bool{}
+	for _, kind := range []OutputKind{FinalOutput, IntermediateOutput, DebugOutput, ReportOutput} {
+		dirs[c.Output.dir(kind)] = true
+	}
+	files := []string{}
+	for dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && !e.ModTime().Before(t) {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
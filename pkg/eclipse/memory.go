@@ -0,0 +1,181 @@
+package eclipse
+
+import(
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"time"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A Photo is a photo that has already been decoded, along with what
+// the pipeline needs to know about how it was taken; the way to run
+// the pipeline in memory, without files (see WithPhotos). The pixels
+// should be linear camera RGB, as for DNG stage 3 (see
+// pkg/ecolor/README.md).
+type Photo struct {
+	Name          string        // Stands in for the filename, e.g. in the config's `images:`, logs, and alignment names
+	Image         image.Image
+	CameraModel   string        // As in EXIF, e.g. "NIKON Df"; used to find a camera profile, if there is no CameraToPCS
+	CaptureTime   time.Time     // Optional
+	ISO           int
+	FNumber       float64       // e.g. 5.6
+	ExposureTime  [2]int64      // Seconds, as a fraction, e.g. {1, 500}
+
+	// The color data from a DNG (AsShotNeutral, and the matrix it gives
+	// to get to the PCS), if there is any; else it comes from the config,
+	// or a camera profile.
+	CameraWhite   emath.Vec3
+	CameraToPCS   emath.Mat3
+}
+
+// layer turns the photo into a Layer, as loadDNG would.
+func (p Photo)layer() (Layer, error) {
+	l := Layer{
+		LoadFilename: p.Name,
+		LoadedImage:  p.Image,
+		Image:        p.Image,
+		CameraModel:  p.CameraModel,
+		CaptureTime:  p.CaptureTime,
+		CameraWhite:  p.CameraWhite,
+		CameraToPCS:  p.CameraToPCS,
+	}
+	if p.Name == "" {
+		return l, fmt.Errorf("photo has no name")
+	} else if p.Image == nil {
+		return l, fmt.Errorf("photo %s has no image", p.Name)
+	}
+	l.Dims = p.Image.Bounds().Size()
+	l.ExposureValue.ISO = p.ISO
+	l.ApertureX10 = int(math.Round(p.FNumber * 10))
+	l.ShutterSpeed = rat64(p.ExposureTime)
+	if err := l.ExposureValue.Validate(); err != nil {
+		return l, fmt.Errorf("photo %s: Invalid EV: %v", p.Name, err)
+	}
+	return l, nil
+}
+
+// DecodePhoto decodes a photo that's in memory rather than in a file
+// (e.g. one handed over by a browser); it has to be a TIFF, with EXIF,
+// as for loading TIFFs from files (see the README).
+func DecodePhoto(name string, data []byte) (Photo, error) {
+	l := Layer{LoadFilename: name}
+	if m, err := eio.ReadExif(bytes.NewReader(data)); err != nil {
+		return Photo{}, fmt.Errorf("'%s': %v", name, err)
+	} else if err := l.setMetadata(m); err != nil {
+		return Photo{}, err
+	}
+	img, err := eio.DecodeTIFF(bytes.NewReader(data))
+	if err != nil {
+		return Photo{}, fmt.Errorf("'%s': %v", name, err)
+	}
+	return Photo{
+		Name:         name,
+		Image:        img,
+		CameraModel:  l.CameraModel,
+		CaptureTime:  l.CaptureTime,
+		ISO:          l.ExposureValue.ISO,
+		FNumber:      float64(l.ApertureX10) / 10,
+		ExposureTime: [2]int64(l.ShutterSpeed),
+	}, nil
+}
+
+// LoadPhotos is LoadFilesAndDirs for photos that are already decoded:
+// it applies the overrides, picks out the photos that the config
+// selects, and sets up the color data, all without touching the
+// filesystem.
+func (fi *FusedImage)LoadPhotos(ctx context.Context, photos ...Photo) error {
+	defer fi.measureStage(ctx, "load")()
+	var err error
+	if fi.Config, err = fi.Config.WithOverrides(fi.Overrides...); err != nil {
+		return err
+	}
+	fi.Config = fi.Config.withPreview()
+	if fi.Config.CacheDir != "" {
+		fi.Config.warnf("Not caching: the stage cache works on files, and these photos are in memory\n")
+		fi.Config.CacheDir = ""
+	}
+
+	for _, p := range photos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fi.Config.Images[p.Name].Exclude {
+			fi.Config.infof("Excluding %s, as per config\n", p.Name)
+			continue
+		}
+		l, err := p.layer()
+		if err == nil {
+			fi.Config.previewLayer(ctx, &l)
+			err = fi.applyImageOverride(&l)
+		}
+		if err != nil && fi.Config.KeepGoing {
+			fi.frameDropped(FrameFailure{Filename: p.Name, Stage: "load", Reason: err.Error()})
+			continue
+		} else if err != nil {
+			return err
+		}
+		if failed := fi.Config.selectPhoto(l); failed != "" {
+			fi.Config.infof("Skipping %s, not selected (%s)\n", p.Name, failed)
+			continue
+		}
+		fi.AddLayer(l)
+		fi.Config.logLayerEvent(l)
+	}
+	fi.setLayerOverrides()
+	return fi.setupColor()
+}
+
+// RunInMemory runs the stages of a phase, as RunPhase does, but writes
+// nothing out (no snapshots, HDR files, manifest or hooks), so that it
+// can work on photos from LoadPhotos; the results are left in fi. A
+// phase that has to end in files (`review`, `render`) can't run this
+// way; instead of rendering, call Render on the result.
+func (fi *FusedImage)RunInMemory(ctx context.Context, phase string) error {
+	defer fi.Config.timeEvent("phase", time.Now(), "phase", phase)
+	if len(fi.Config.Hooks) > 0 {
+		return fmt.Errorf("%s: hooks work on files, so can't run in memory", phase)
+	} else if err := fi.needLayers(phase); err != nil {
+		return err
+	}
+	var err error
+	if fi.memPlan, err = fi.planMemory(phase); err != nil {
+		return err
+	}
+	for _, line := range fi.memPlan.lines() {
+		fi.Config.infof("%s\n", line)
+	}
+	defer fi.cleanupWork(nil) // there are only the disk buffers' files, if any
+	if err := fi.startBuffers(); err != nil {
+		return err
+	}
+	defer fi.releaseBuffers()
+
+	stages := map[string][]string{
+		"detect":  {"detect"},
+		"align":   {"align"},
+		"stack":   {"align", "fuse"},
+		"enhance": {"align", "fuse", "enhance"},
+		"all":     {"align", "fuse", "enhance"},
+	}[phase]
+	if stages == nil {
+		return fmt.Errorf("phase '%s' can't run in memory, wanted one of [detect align stack enhance all]", phase)
+	}
+	run := map[string]func(context.Context) error{"align": fi.Align, "fuse": fi.Fuse, "enhance": fi.Enhance}
+	return fi.writingOutputs(func() error { // debug images, if the sink is DebugFiles
+		for _, stage := range stages {
+			if stage == "detect" {
+				if err := fi.DetectLunarLimbs(ctx); err != nil { // which measures itself
+					return err
+				}
+			} else if err := fi.withHooks(ctx, stage, run[stage]); err != nil { // no hooks; but the stage is measured & labelled
+				return err
+			}
+		}
+		return nil
+	})
+}
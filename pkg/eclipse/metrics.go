@@ -0,0 +1,74 @@
+package eclipse
+
+import(
+	"context"
+	"expvar"
+	"runtime"
+	"runtime/trace"
+	"sync"
+	"time"
+)
+
+// A StageMetric is how long a stage of a run took, and how much memory
+// it used. They are listed in the run manifest (under `stages`), and
+// passed on to the Config's MetricsExporter, if there is one.
+type StageMetric struct {
+	Stage       string
+	Seconds     float64
+	AllocBytes  uint64    // Allocated during the stage, whether or not it was freed again
+	HeapBytes   uint64    // In use on the heap when it finished
+	Frames      int       // How many frames the run had
+}
+
+// A MetricsExporter gets the metrics for each stage as it finishes, e.g.
+// to pass on to OpenTelemetry or Prometheus. The calls can come from
+// several runs at once.
+type MetricsExporter interface {
+	StageDone(m StageMetric)
+}
+
+// measureStage is for deferring, around a stage:
+// `defer fi.measureStage(ctx, "fuse")()`. The stage is also a region in
+// the execution trace, if one is being taken (see `-trace`).
+func (fi *FusedImage)measureStage(ctx context.Context, stage string) func() {
+	region := trace.StartRegion(ctx, stage)
+	start := time.Now()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	return func() {
+		region.End()
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		m := StageMetric{
+			Stage:      stage,
+			Seconds:    time.Since(start).Seconds(),
+			AllocBytes: after.TotalAlloc - before.TotalAlloc,
+			HeapBytes:  after.HeapAlloc,
+			Frames:     len(fi.Layers),
+		}
+		fi.metrics = append(fi.metrics, m)
+		if fi.Config.Metrics != nil {
+			fi.Config.Metrics.StageDone(m)
+		}
+		fi.Config.logEvent("stage.metrics", "stage", stage, "seconds", m.Seconds, "allocbytes", m.AllocBytes, "heapbytes", m.HeapBytes)
+	}
+}
+
+// ExpvarMetrics is a MetricsExporter that keeps totals for each stage,
+// across all the runs, in the expvar `eclipsehdr` (so a program that
+// serves /debug/vars shows them): `<stage>.runs`, `<stage>.seconds`
+// and `<stage>.allocbytes`, plus the latest `heapbytes`.
+type ExpvarMetrics struct{}
+
+var expvarStages = sync.OnceValue(func() *expvar.Map { return expvar.NewMap("eclipsehdr") })
+
+func (ExpvarMetrics)StageDone(m StageMetric) {
+	vars := expvarStages()
+	vars.Add(m.Stage + ".runs", 1)
+	vars.AddFloat(m.Stage + ".seconds", m.Seconds)
+	vars.Add(m.Stage + ".allocbytes", int64(m.AllocBytes))
+	heap := new(expvar.Int)
+	heap.Set(int64(m.HeapBytes))
+	vars.Set("heapbytes", heap)
+}
@@ -0,0 +1,109 @@
+package eclipse
+
+import(
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CurrentConfigVersion is the version of the config file format that
+// this code reads and writes. Files from older versions are migrated
+// as they are loaded (see migrateConfig); `eclipse-hdr migrate` does
+// it for good. When a change to Config would break older files (a key
+// is renamed or moved, or a value means something different), bump
+// this, and add a function to configMigrations that turns the old
+// layout into the new one.
+const CurrentConfigVersion = 1
+
+// configMigrations[n] turns a version n file into a version n+1 file.
+// Each one returns notes on what it changed.
+var configMigrations = []func(yaml.MapSlice) (yaml.MapSlice, []string){
+	migrateConfigV0,
+}
+
+// migrateConfigV0 handles files from before there were versions; the
+// format didn't change, they just didn't say which version they were.
+func migrateConfigV0(doc yaml.MapSlice) (yaml.MapSlice, []string) {
+	return doc, nil
+}
+
+var configVersionLine = regexp.MustCompile(`(?m)^configversion:.*$`)
+
+// configVersion peeks at the version of a config file.
+func configVersion(contents []byte) int {
+	v := struct{ ConfigVersion int }{}
+	yaml.Unmarshal(contents, &v) // if this fails, so will the real parse
+	return v.ConfigVersion
+}
+
+// migrateConfig brings the contents of a config file up to the current
+// version. It returns them unchanged if they are current already.
+func migrateConfig(contents []byte) ([]byte, []string, error) {
+	version := configVersion(contents)
+	if version > CurrentConfigVersion {
+		return nil, nil, fmt.Errorf("config version %d is newer than this eclipse-hdr understands (%d); upgrade eclipse-hdr", version, CurrentConfigVersion)
+	} else if version == CurrentConfigVersion {
+		return contents, nil, nil
+	}
+
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		return nil, nil, err
+	}
+	notes := []string{}
+	for v:=version; v<CurrentConfigVersion; v++ {
+		var n []string
+		doc, n = configMigrations[v](doc)
+		notes = append(notes, n...)
+	}
+
+	// If nothing changed but the version, keep the file as it was (with
+	// its comments), with the new version in place of the old one; or
+	// at the top, if it didn't say (which is version 0, as is saying 0).
+	if len(notes) == 0 {
+		stamp := fmt.Sprintf("configversion: %d", CurrentConfigVersion)
+		if configVersionLine.Match(contents) {
+			return configVersionLine.ReplaceAll(contents, []byte(stamp)), nil, nil
+		}
+		return append([]byte(stamp + "\n"), contents...), nil, nil
+	}
+
+	// Stamp the new version, at the top
+	stamped := yaml.MapSlice{{Key: "configversion", Value: CurrentConfigVersion}}
+	for _, item := range doc {
+		if item.Key != "configversion" {
+			stamped = append(stamped, item)
+		}
+	}
+	b, err := yaml.Marshal(stamped)
+	return b, notes, err
+}
+
+// MigrateConfigFile rewrites a config file in the current format,
+// keeping the original as `<filename>.bak`. If a migration had to
+// change the layout, comments are not kept.
+func MigrateConfigFile(filename string) ([]string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("config read %s: %v", filename, err)
+	}
+	migrated, notes, err := migrateConfig(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	} else if string(migrated) == string(contents) {
+		return nil, nil
+	}
+	if _, err := newConfigFromYaml(migrated, NewConfig()); err != nil {
+		return nil, fmt.Errorf("%s: still not valid after migrating: %v", filename, err)
+	}
+
+	if err := ioutil.WriteFile(filename + ".bak", contents, 0644); err != nil {
+		return nil, fmt.Errorf("write backup: %v", err)
+	}
+	if err := ioutil.WriteFile(filename, migrated, 0644); err != nil {
+		return nil, fmt.Errorf("write '%s': %v", filename, err)
+	}
+	return append(notes, fmt.Sprintf("updated to config version %d (original in %s.bak)", CurrentConfigVersion, filename)), nil
+}
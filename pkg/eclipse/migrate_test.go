@@ -0,0 +1,38 @@
+package eclipse
+
+import(
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	current := fmt.Sprintf("configversion: %d", CurrentConfigVersion)
+	tests := []struct {
+		name, in, want  string
+		wantErr         bool
+	}{
+		{"absent", "# my eclipse\nfuser: avg\n", current + "\n# my eclipse\nfuser: avg\n", false},
+		{"zero", "# my eclipse\nconfigversion: 0\nfuser: avg\n", "# my eclipse\n" + current + "\nfuser: avg\n", false},
+		{"current", current + "\nfuser: avg\n", current + "\nfuser: avg\n", false},
+		{"future", fmt.Sprintf("configversion: %d\nfuser: avg\n", CurrentConfigVersion+1), "", true},
+	}
+	for _, test := range tests {
+		got, _, err := migrateConfig([]byte(test.in))
+		if test.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "newer than") {
+				t.Errorf("%s: wanted a version error, got %v", test.name, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, wanted %q", test.name, got, test.want)
+		}
+		if _, err := newConfigFromYaml(got, NewConfig()); err != nil {
+			t.Errorf("%s: migrated config doesn't parse: %v", test.name, err)
+		}
+	}
+}
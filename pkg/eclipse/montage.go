@@ -0,0 +1,261 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// MontageConfig lays out the classic eclipse montage, for the `montage`
+// phase: the crescents of the partial phases, in the order they were
+// taken, around a totality composite. Each crescent is cut out around
+// the solar disk fitted to it (as for `partials`), and scaled to the
+// same size, so the moon is seen to move across the sun.
+type MontageConfig struct {
+	Totality       string   // The totality composite for the middle (e.g. a tmo-*.png from render); if empty, the middle is left empty
+	Layout         string   // "arc" (the default), or "grid"
+	Size           int      // The sun's diameter, in each crescent, in pixels; if zero, 240
+	Spacing        float64  // The gap between crescents, as a fraction of Size; if zero, 0.25
+	Arc            float64  // For "arc": the degrees the crescents spread over, centered on the top; if zero, 270
+	TotalityScale  float64  // How big the moon is in the composite, as a multiple of Size; if zero, 1.5
+	Columns        int      // For "grid"; if zero, as square as fits
+}
+
+func (mc MontageConfig)withDefaults() MontageConfig {
+	if mc.Layout        == ""  { mc.Layout = "arc" }
+	if mc.Size          == 0   { mc.Size = 240 }
+	if mc.Spacing       == 0.0 { mc.Spacing = 0.25 }
+	if mc.Arc           == 0.0 { mc.Arc = 270.0 }
+	if mc.TotalityScale == 0.0 { mc.TotalityScale = 1.5 }
+	return mc
+}
+
+// montageMargin is how far around the solar disk each crescent is cut
+// out, as a fraction of the radius; enough to keep the limb's glow.
+const montageMargin = 0.08
+
+// writeMontage fits the solar disk in each photo (which should be of
+// the partial phases), and draws the montage into `montage.png`.
+func (fi *FusedImage)writeMontage(ctx context.Context) error {
+	cfg := fi.Config.Montage.withDefaults()
+	frames, err := fi.FitPartials(ctx)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(frames, func(i, j int) bool { // undated photos go last
+		ti, tj := frames[i].CaptureTime, frames[j].CaptureTime
+		if ti.IsZero() || tj.IsZero() {
+			return !ti.IsZero() && tj.IsZero()
+		}
+		return ti.Before(tj)
+	})
+
+	var totality image.Image
+	if cfg.Totality != "" {
+		img, err := eio.ReadImage(cfg.Totality)
+		if err != nil {
+			return fmt.Errorf("montage: %v", err)
+		}
+		totality = fi.scaleTotality(img, cfg)
+	}
+
+	defer fi.measureStage(ctx, "montage")()
+	tile := int(math.Round(float64(cfg.Size) * (1.0 + montageMargin)))
+	var centers []image.Point
+	var middle image.Point
+	switch cfg.Layout {
+	case "grid": centers, middle = montageGrid(len(frames), tile, cfg, totality)
+	default:     centers, middle = montageArc(frames, tile, cfg, totality)
+	}
+
+	// The canvas covers it all, with a gap around the edge
+	bounds := image.Rectangle{}
+	if totality != nil {
+		bounds = totality.Bounds().Add(middle.Sub(totality.Bounds().Size().Div(2)))
+	}
+	for _, c := range centers {
+		bounds = bounds.Union(image.Rect(c.X - tile/2, c.Y - tile/2, c.X - tile/2 + tile, c.Y - tile/2 + tile))
+	}
+	gap := int(math.Round(float64(cfg.Size) * cfg.Spacing))
+	bounds = bounds.Inset(-gap)
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	if totality != nil {
+		at := middle.Sub(totality.Bounds().Size().Div(2)).Sub(bounds.Min)
+		draw.Draw(canvas, totality.Bounds().Sub(totality.Bounds().Min).Add(at), totality, totality.Bounds().Min, draw.Src)
+	}
+
+	layers := map[string]*Layer{}
+	for i := range fi.Layers {
+		layers[fi.Layers[i].Filename()] = &fi.Layers[i]
+	}
+	progress := fi.Config.newProgress("Drawing the montage", len(frames))
+	for i, f := range frames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		crescent := fi.renderCrescent(layers[f.Filename].LoadedImage, f, tile)
+		at := centers[i].Sub(image.Point{tile/2, tile/2}).Sub(bounds.Min)
+		draw.DrawMask(canvas, image.Rect(0, 0, tile, tile).Add(at), crescent, image.Point{}, circleMask(tile), image.Point{}, draw.Over)
+		progress.Add(1)
+	}
+	progress.Done()
+
+	filename := fi.Config.OutputPath(FinalOutput, "montage.png")
+	if err := fi.Config.writePNG(canvas, filename); err != nil {
+		return fmt.Errorf("montage: %v", err)
+	}
+	fi.Config.infof("Wrote %d crescents (%s layout) to %s, %dx%d\n", len(frames), cfg.Layout, filename, canvas.Bounds().Dx(), canvas.Bounds().Dy())
+	return nil
+}
+
+// scaleTotality shrinks the totality composite so its moon is
+// TotalityScale times the crescents' sun. The lunar radius comes from
+// the config (e.g. the enhance.yaml that made the composite); without
+// it, the composite is taken to be OutputWidthInSolarDiameters wide.
+func (fi *FusedImage)scaleTotality(img image.Image, cfg MontageConfig) image.Image {
+	b := img.Bounds()
+	moonDiameter := 2.0 * float64(fi.Config.LunarRadius)
+	if fi.Config.LunarRadius == 0 || fi.Config.OutputArea.Dx() != b.Dx() {
+		moonDiameter = float64(b.Dx()) / fi.Config.OutputWidthInSolarDiameters
+		fi.Config.debugf("Montage: no lunar radius for %dx%d %s, taking the moon to be %.0fpx across\n", b.Dx(), b.Dy(), cfg.Totality, moonDiameter)
+	}
+	scale := cfg.TotalityScale * float64(cfg.Size) / moonDiameter
+	w, h := int(math.Round(float64(b.Dx()) * scale)), int(math.Round(float64(b.Dy()) * scale))
+	return ResizeLanczos(img, w, h, fi.Config.ColorSpace)
+}
+
+// montageArc puts the crescents along an arc around the middle, from the
+// lower left, over the top, to the lower right; each is as far along it
+// as its capture time is through the sequence (but never closer to the
+// next than half the average). The arc's radius keeps them Spacing
+// apart, and clear of the totality composite.
+func montageArc(frames []PartialFrame, tile int, cfg MontageConfig, totality image.Image) ([]image.Point, image.Point) {
+	n := len(frames)
+	span := cfg.Arc * math.Pi / 180.0
+	pos := []float64{0.5} // in [0,1], along the arc; a single crescent goes at the top
+	if n > 1 {
+		pos = make([]float64, n)
+		start, end := frames[0].CaptureTime, frames[n-1].CaptureTime
+		dated := !start.IsZero() && !end.IsZero() && end.After(start)
+		for i := range frames {
+			if t := frames[i].CaptureTime; !dated || t.IsZero() {
+				pos[i] = float64(i) / float64(n-1)
+			} else {
+				pos[i] = t.Sub(start).Seconds() / end.Sub(start).Seconds()
+			}
+		}
+		minStep := 0.5 / float64(n-1)
+		for i := 1; i < n; i++ {
+			pos[i] = math.Max(pos[i], pos[i-1] + minStep)
+		}
+		for i := range pos {
+			pos[i] /= pos[n-1]
+		}
+	}
+
+	step := float64(tile) * (1.0 + cfg.Spacing)
+	radius := 0.0
+	for i := 1; i < n; i++ {
+		if d := (pos[i] - pos[i-1]) * span; d > 0.0 {
+			radius = math.Max(radius, step / (2.0 * math.Sin(math.Min(d, math.Pi) / 2.0)))
+		}
+	}
+	if totality != nil {
+		b := totality.Bounds()
+		inner := math.Hypot(float64(b.Dx()), float64(b.Dy())) / 2.0 * 0.8 // the corners are dark sky, so can sit under a crescent
+		radius = math.Max(radius, inner + step / 2.0)
+	}
+	radius = math.Max(radius, step)
+
+	centers := make([]image.Point, n)
+	for i := range frames {
+		theta := -span / 2.0 + pos[i] * span // clockwise, from straight up
+		centers[i] = image.Point{int(math.Round(radius * math.Sin(theta))), int(math.Round(-radius * math.Cos(theta)))}
+	}
+	return centers, image.Point{}
+}
+
+// montageGrid puts the crescents in rows, in order: the first half
+// above the totality composite, and the rest below it (or all of them
+// in one block, without a composite). Short rows are centered.
+func montageGrid(n, tile int, cfg MontageConfig, totality image.Image) ([]image.Point, image.Point) {
+	cell := int(math.Round(float64(tile) * (1.0 + cfg.Spacing)))
+	pad := cell - tile
+	cols := cfg.Columns
+	if cols == 0 {
+		cols = int(math.Ceil(math.Sqrt(float64(n))))
+		if totality != nil && cols < totality.Bounds().Dx() / cell {
+			cols = totality.Bounds().Dx() / cell // as wide as the composite
+		}
+	}
+	width := cols * cell
+
+	centers := []image.Point{}
+	rows := func(y, from, to int) int {
+		for i := from; i < to; i += cols {
+			count := cols
+			if to - i < count {
+				count = to - i
+			}
+			for c := 0; c < count; c++ {
+				centers = append(centers, image.Point{(width - count*cell) / 2 + c*cell + cell/2, y + cell/2})
+			}
+			y += cell
+		}
+		return y
+	}
+	if totality == nil {
+		rows(0, 0, n)
+		return centers, image.Point{}
+	}
+	above, h := (n + 1) / 2, totality.Bounds().Dy()
+	y := rows(0, 0, above)
+	middle := image.Point{width / 2, y + pad/2 + h/2}
+	rows(y + pad + h, above, n)
+	return centers, middle
+}
+
+// renderCrescent cuts the solar disk out of the photo, scaled so the sun
+// is Size across within a tile x tile square, and brightened so the
+// disk's center is nearly white. It's gray, as the camera's colors
+// through a solar filter aren't anything in particular.
+func (fi *FusedImage)renderCrescent(img image.Image, f PartialFrame, tile int) image.Image {
+	r := f.Radius * (1.0 + montageMargin)
+	crop := image.Rect(int(math.Floor(f.X - r)), int(math.Floor(f.Y - r)), int(math.Ceil(f.X + r)), int(math.Ceil(f.Y + r)))
+	gain := 0.9 / math.Max(f.Brightness, 1e-6)
+	cs := fi.Config.ColorSpace
+	cut := image.NewGray16(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	for y:=crop.Min.Y; y<crop.Max.Y; y++ {
+		for x:=crop.Min.X; x<crop.Max.X; x++ {
+			if !(image.Point{x, y}).In(img.Bounds()) {
+				continue
+			}
+			r, g, b := eimage.PixelRGB(img, x, y)
+			v := math.Max(0.0, math.Min(1.0, (r + g + b) / 3.0 * gain))
+			cut.SetGray16(x - crop.Min.X, y - crop.Min.Y, color.Gray16{uint16(math.Round(cs.Encode(v) * 0xFFFF))})
+		}
+	}
+	return ResizeLanczos(cut, tile, tile, cs)
+}
+
+// circleMask is opaque within the circle that fills a size x size square,
+// with a pixel of antialiasing at the edge.
+func circleMask(size int) image.Image {
+	mask := image.NewAlpha(image.Rect(0, 0, size, size))
+	c := float64(size) / 2.0
+	for y:=0; y<size; y++ {
+		for x:=0; x<size; x++ {
+			d := math.Hypot(float64(x) + 0.5 - c, float64(y) + 0.5 - c)
+			mask.SetAlpha(x, y, color.Alpha{uint8(math.Round(255.0 * math.Max(0.0, math.Min(1.0, c - d))))})
+		}
+	}
+	return mask
+}
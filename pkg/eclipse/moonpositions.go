@@ -0,0 +1,259 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eastro"
+)
+
+// EphemerisConfig asks for the lunar limbs found in each photo to be
+// checked against where the moon should have been, from an ephemeris,
+// given the time of each photo and where it was taken from. The
+// residuals show up a camera clock that's off (the moon is consistently
+// ahead or behind along its track), a mount that drifts (residuals that
+// grow with time), and biases in the limb detection (residuals, or
+// radii, that depend on the exposure). Image orientation is from
+// Annotation.NorthAngle, and the plate scale from Photometry.ArcsecPerPixel,
+// or else from the moon's size.
+type EphemerisConfig struct {
+	Enabled          bool
+	Latitude         float64      // Of the observer, in degrees (north positive)
+	Longitude        float64      // In degrees, east positive (so the Americas are negative)
+	Elevation        float64      // Meters above sea level
+	UTCOffset        float64      // Hours the camera's clock was set ahead of UTC, e.g. -5 for CDT (EXIF times don't say)
+	ClockCorrection  float64      // Seconds to add to the camera's times, if its clock is known to be off
+	DeltaT           float64      // TT - UT1, in seconds; if zero, 69.2 (as it was in the 2020s)
+	SunCenter        image.Point  // Where the sun's center is in the photos (e.g. from the partials phase, without moving the camera); if zero, it's fitted
+}
+
+func (ec EphemerisConfig)withDefaults() EphemerisConfig {
+	if ec.DeltaT == 0.0 { ec.DeltaT = 69.2 }
+	return ec
+}
+
+// A PixelPos is a position on a photo, to a fraction of a pixel.
+type PixelPos struct {
+	X, Y  float64
+}
+
+// A MoonPosition is one frame's limb center, against the ephemeris.
+type MoonPosition struct {
+	Filename      string
+	Time          time.Time  // The capture time, as UTC (with UTCOffset & ClockCorrection)
+	EV            int
+	Detected      PixelPos   `yaml:",flow"` // The lunar limb's center, in the photo's own coords
+	Predicted     PixelPos   `yaml:",flow"`
+	Residual      PixelPos   `yaml:",flow"` // Detected - Predicted, in pixels
+	AlongTrack    float64    // The residual along the moon's motion (pixels; positive is ahead of where it should be)
+	CrossTrack    float64    // And across it, 90° counterclockwise from the motion
+	Radius        float64    // Of the detected limb, in pixels
+	RadiusError   float64    // Detected - predicted (from the moon's semidiameter & the plate scale), in pixels
+}
+
+// A MoonPositionReport is what goes into `moonpositions.yaml`, in the
+// reports dir.
+type MoonPositionReport struct {
+	ArcsecPerPixel  float64
+	NorthAngle      float64
+	SunCenter       PixelPos  `yaml:",flow"`
+	SunCenterFitted bool      // If so, the residuals average to zero, and a clock offset can't be seen
+	Motion          float64   // How fast the moon moved across the sun, in pixels per second
+	RMS             float64   // Of the residuals, in pixels
+	ClockOffset     float64   `yaml:",omitempty"` // The camera clock's error, in seconds, from the along track residuals (only with a SunCenter); add it to clockcorrection
+	Drift           PixelPos  `yaml:",flow"`      // The residuals' trend over time, pixels per minute: the mount's drift (or a clock running at the wrong rate)
+	ByEV          []EVResidual                     // Limb detection biases
+	Frames        []MoonPosition
+}
+
+// An EVResidual is the average residual of the frames at one EV.
+type EVResidual struct {
+	EV           int
+	Frames       int
+	Residual     PixelPos  `yaml:",flow"`
+	RadiusError  float64
+}
+
+// cameraTimeToUTC is the capture time on the UTC timescale: the EXIF
+// time is wall clock time, on whatever the camera was set to.
+func (ec EphemerisConfig)cameraTimeToUTC(t time.Time) time.Time {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return wall.Add(time.Duration((-ec.UTCOffset * 3600.0 + ec.ClockCorrection) * float64(time.Second)))
+}
+
+// MoonPositions compares each frame's lunar limb with the ephemeris.
+// Frames without a capture time, or a limb, are left out. It needs the
+// lunar limbs (DetectLunarLimbs, or Align).
+func (fi *FusedImage)MoonPositions() (*MoonPositionReport, error) {
+	cfg := fi.Config.Ephemeris.withDefaults()
+	obs := eastro.Observer{Latitude: cfg.Latitude, Longitude: cfg.Longitude, Elevation: cfg.Elevation}
+	theta := fi.Config.Annotation.NorthAngle * math.Pi / 180.0
+
+	// The moon's offset from the sun, as seen on the photo: east & north
+	// (arcsec) turned into pixel directions, as for annotation labels
+	toPixels := func(east, north, scale float64) PixelPos {
+		return PixelPos{
+			X: (-east*math.Cos(theta) - north*math.Sin(theta)) / scale,
+			Y: (east*math.Sin(theta) - north*math.Cos(theta)) / scale,
+		}
+	}
+	type sample struct {
+		l           *Layer
+		t           time.Time
+		east, north float64  // The moon, relative to the sun, now
+		de, dn      float64  // And its motion, arcsec per second
+		sd          float64  // The moon's semidiameter
+	}
+	samples := []sample{}
+	for i := range fi.Layers {
+		l := &fi.Layers[i]
+		if l.CaptureTime.IsZero() || l.LunarLimb.Radius() == 0 {
+			fi.Config.debugf("Moon positions: skipping %s, it has no capture time or lunar limb\n", l.Filename())
+			continue
+		}
+		t := cfg.cameraTimeToUTC(l.CaptureTime)
+		offset := func(t time.Time) (float64, float64) {
+			return eastro.Offset(eastro.Sun(t, cfg.DeltaT, obs), eastro.Moon(t, cfg.DeltaT, obs))
+		}
+		e, n := offset(t)
+		e1, n1 := offset(t.Add(time.Second))
+		samples = append(samples, sample{l, t, e, n, e1 - e, n1 - n, eastro.Moon(t, cfg.DeltaT, obs).Semidiameter})
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("ephemeris: none of the photos have both a capture time and a lunar limb")
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].t.Before(samples[j].t) })
+
+	// Plate scale, as configured, or from the moon's size
+	scale := fi.Config.Photometry.ArcsecPerPixel
+	if scale == 0.0 {
+		scales := []float64{}
+		for _, s := range samples {
+			scales = append(scales, s.sd / limbRadius(s.l))
+		}
+		sort.Float64s(scales)
+		scale = scales[len(scales)/2]
+	}
+
+	rpt := &MoonPositionReport{ArcsecPerPixel: scale, NorthAngle: fi.Config.Annotation.NorthAngle}
+	offsets := make([]PixelPos, len(samples))
+	for i, s := range samples {
+		offsets[i] = toPixels(s.east, s.north, scale)
+	}
+	if cfg.SunCenter == (image.Point{}) {
+		rpt.SunCenterFitted = true
+		for i, s := range samples {
+			c := limbCenter(s.l)
+			rpt.SunCenter.X += (c.X - offsets[i].X) / float64(len(samples))
+			rpt.SunCenter.Y += (c.Y - offsets[i].Y) / float64(len(samples))
+		}
+	} else {
+		rpt.SunCenter = PixelPos{float64(cfg.SunCenter.X), float64(cfg.SunCenter.Y)}
+	}
+
+	// Residuals, and the clock offset: how far along its track the moon
+	// is, over how fast it's moving
+	along, speed2, ss := 0.0, 0.0, 0.0
+	for i, s := range samples {
+		c := limbCenter(s.l)
+		v := toPixels(s.de, s.dn, scale)
+		speed := math.Hypot(v.X, v.Y)
+		ux, uy := v.X / speed, v.Y / speed
+		mp := MoonPosition{
+			Filename:    s.l.Filename(),
+			Time:        s.t,
+			EV:          s.l.EV,
+			Detected:    c,
+			Predicted:   PixelPos{rpt.SunCenter.X + offsets[i].X, rpt.SunCenter.Y + offsets[i].Y},
+			Radius:      limbRadius(s.l),
+			RadiusError: limbRadius(s.l) - s.sd / scale,
+		}
+		mp.Residual = PixelPos{c.X - mp.Predicted.X, c.Y - mp.Predicted.Y}
+		mp.AlongTrack = mp.Residual.X*ux + mp.Residual.Y*uy
+		mp.CrossTrack = mp.Residual.X*uy - mp.Residual.Y*ux // image y is down, so this is counterclockwise
+		rpt.Frames = append(rpt.Frames, mp)
+
+		rpt.Motion += speed / float64(len(samples))
+		along += mp.Residual.X*v.X + mp.Residual.Y*v.Y
+		speed2 += speed * speed
+		ss += mp.Residual.X*mp.Residual.X + mp.Residual.Y*mp.Residual.Y
+	}
+	rpt.RMS = math.Sqrt(ss / float64(len(samples)))
+	if !rpt.SunCenterFitted && speed2 > 0.0 {
+		rpt.ClockOffset = along / speed2 // ahead of the ephemeris means the photo was later than the clock said
+	}
+
+	// Drift: a straight line through the residuals, against time
+	if len(samples) > 1 {
+		st, sx, sy, stt, stx, sty := 0.0, 0.0, 0.0, 0.0, 0.0, 0.0
+		for _, mp := range rpt.Frames {
+			t := mp.Time.Sub(rpt.Frames[0].Time).Minutes()
+			st, sx, sy = st + t, sx + mp.Residual.X, sy + mp.Residual.Y
+			stt, stx, sty = stt + t*t, stx + t*mp.Residual.X, sty + t*mp.Residual.Y
+		}
+		n := float64(len(rpt.Frames))
+		if d := n*stt - st*st; d > 0.0 {
+			rpt.Drift = PixelPos{(n*stx - st*sx) / d, (n*sty - st*sy) / d}
+		}
+	}
+
+	byEV := map[int]*EVResidual{}
+	for _, mp := range rpt.Frames {
+		if byEV[mp.EV] == nil {
+			byEV[mp.EV] = &EVResidual{EV: mp.EV}
+		}
+		r := byEV[mp.EV]
+		r.Frames++
+		r.Residual.X, r.Residual.Y, r.RadiusError = r.Residual.X + mp.Residual.X, r.Residual.Y + mp.Residual.Y, r.RadiusError + mp.RadiusError
+	}
+	for _, r := range byEV {
+		n := float64(r.Frames)
+		r.Residual.X, r.Residual.Y, r.RadiusError = r.Residual.X / n, r.Residual.Y / n, r.RadiusError / n
+		rpt.ByEV = append(rpt.ByEV, *r)
+	}
+	sort.Slice(rpt.ByEV, func(i, j int) bool { return rpt.ByEV[i].EV < rpt.ByEV[j].EV })
+
+	return rpt, nil
+}
+
+// limbCenter & limbRadius are the lunar limb's, to half a pixel.
+func limbCenter(l *Layer) PixelPos {
+	b := l.LunarLimb.Bounds
+	return PixelPos{float64(b.Min.X + b.Max.X) / 2.0, float64(b.Min.Y + b.Max.Y) / 2.0}
+}
+func limbRadius(l *Layer) float64 {
+	return float64(l.LunarLimb.Bounds.Dx() + l.LunarLimb.Bounds.Dy()) / 4.0
+}
+
+// writeMoonPositions checks the lunar limbs against the ephemeris, if
+// the config asks for it, and writes the report.
+func (fi *FusedImage)writeMoonPositions() error {
+	if !fi.Config.Ephemeris.Enabled {
+		return nil
+	}
+	rpt, err := fi.MoonPositions()
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(rpt)
+	if err != nil {
+		return fmt.Errorf("ephemeris: %v", err)
+	}
+	filename := fi.Config.OutputPath(ReportOutput, "moonpositions.yaml")
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write moon positions '%s': %v", filename, err)
+	}
+	clock := ""
+	if !rpt.SunCenterFitted {
+		clock = fmt.Sprintf(", clock offset %+.1fs", rpt.ClockOffset)
+	}
+	fi.Config.infof("Checked %d lunar limbs against the ephemeris: RMS residual %.2fpx, drift (%.2f, %.2f)px/min%s; wrote %s\n",
+		len(rpt.Frames), rpt.RMS, rpt.Drift.X, rpt.Drift.Y, clock, filename)
+	return nil
+}
@@ -0,0 +1,547 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ealign"
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// MosaicConfig is for the `mosaic` phase, which stitches overlapping
+// wide-field photos (the horizon, the landscape lit by the eclipse, the
+// corona in context) into one big canvas. Each pair of photos is
+// registered by where they overlap (the sun and moon needn't be in both,
+// or either), and the photos are chained together, each onto the one it
+// overlaps best with, starting from the base photo. Where they overlap,
+// they're blended, each fading out towards its edges.
+type MosaicConfig struct {
+	Tiles       map[string]MosaicTile `yaml:",omitempty"` // By filename; if every photo has one (e.g. from an earlier run's mosaic.yaml), nothing is searched for
+	MinOverlap  float64  // The least overlap, as a fraction of the smaller photo, to register a pair by; if zero, 0.1
+	Feather     float64  // How far in from its edges each photo fades in, as a fraction of its size; if zero, 0.15
+	Exposures   string   // "match" (the default): scale each photo so the overlaps agree; or "exif": leave them as exposed
+	FineTune    bool     // Refine each pair's registration, rotation included, with the fine-tune search (see AlignLayerFine)
+}
+
+func (mc MosaicConfig)withDefaults() MosaicConfig {
+	if mc.MinOverlap == 0.0 { mc.MinOverlap = 0.1 }
+	if mc.Feather    == 0.0 { mc.Feather = 0.15 }
+	if mc.Exposures  == ""  { mc.Exposures = "match" }
+	return mc
+}
+
+// A MosaicTile is where a photo goes in the mosaic: Transform maps it
+// onto the base photo (as an AlignmentTransform maps a layer onto the
+// base layer), and Gain scales its exposure.
+type MosaicTile struct {
+	Transform  AlignmentTransform
+	Gain       float64
+}
+
+const(
+	mosaicCoarseSize = 96   // The longest side of the photos, in the first, brute force search
+	mosaicMinMatch   = 0.5  // The least correlation for a pair's overlap to count as a match
+	mosaicSamples    = 20000 // About how many pixels of the overlap are compared, for each candidate
+	mosaicPeaks      = 8    // How many of the best matches in the first search are refined
+)
+
+// writeMosaic places the photos (or takes their places from the config),
+// and draws them into `mosaic.png`; the places go into `mosaic.yaml`, in
+// the reports dir.
+func (fi *FusedImage)writeMosaic(ctx context.Context) error {
+	defer fi.measureStage(ctx, "mosaic")()
+	cfg := fi.Config.Mosaic.withDefaults()
+	tiles := map[string]MosaicTile{}
+	for _, l := range fi.Layers {
+		if t, exists := cfg.Tiles[l.Filename()]; exists {
+			tiles[l.Filename()] = t
+		}
+	}
+	if len(tiles) < len(fi.Layers) {
+		if len(tiles) > 0 {
+			fi.Config.warnf("Mosaic: only %d of the %d photos have a place in the config, so placing them all\n", len(tiles), len(fi.Layers))
+		}
+		var err error
+		if tiles, err = fi.placeMosaicTiles(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
+	b, err := yaml.Marshal(struct{ Mosaic MosaicConfig }{MosaicConfig{Tiles: tiles}})
+	if err != nil {
+		return fmt.Errorf("mosaic: %v", err)
+	}
+	report := fi.Config.OutputPath(ReportOutput, "mosaic.yaml")
+	if err := ioutil.WriteFile(report, b, 0644); err != nil {
+		return fmt.Errorf("write mosaic '%s': %v", report, err)
+	}
+	return fi.renderMosaic(ctx, cfg, tiles, fi.Config.OutputPath(FinalOutput, "mosaic.png"))
+}
+
+// A mosaicMatch is how photo j maps onto photo i (their layer numbers),
+// and how well.
+type mosaicMatch struct {
+	i, j   int
+	xform  AlignmentTransform
+	gain   float64  // How much brighter i is than j, over the overlap
+	score  float64  // The correlation over the overlap
+}
+
+// placeMosaicTiles registers every pair of photos, and then grows a
+// tree out from the base photo: each photo joins the photo already
+// placed that it matches best, until none are left that match. The
+// rest are dropped (with KeepGoing).
+func (fi *FusedImage)placeMosaicTiles(ctx context.Context, cfg MosaicConfig) (map[string]MosaicTile, error) {
+	n := len(fi.Layers)
+	pyramids := make([][]lumGrid, n)
+	progress := fi.Config.newProgress("Mosaic: shrinking photos", n)
+	err := eimage.ParallelFor(ctx, fi.workers("mosaic"), n, func(_, i int) {
+		pyramids[i] = lumPyramid(fi.Layers[i], fi.Config.ClipLevel)
+		progress.Add(1)
+	})
+	progress.Done()
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := [][2]int{}
+	for i := 0; i < n; i++ {
+		for j := i+1; j < n; j++ {
+			pairs = append(pairs, [2]int{i, j})
+		}
+	}
+	matches := make([]*mosaicMatch, len(pairs))
+	progress = fi.Config.newProgress("Mosaic: registering pairs", len(pairs))
+	for k, p := range pairs { // each search is parallel inside
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		matches[k] = fi.registerMosaicPair(ctx, cfg, p[0], p[1], pyramids[p[0]], pyramids[p[1]])
+		if m := matches[k]; m != nil {
+			fi.Config.debugf("Mosaic: %s onto %s: %s, gain %.3f, correlation %.3f\n", fi.Layers[m.j].Filename(), fi.Layers[m.i].Filename(), m.xform, m.gain, m.score)
+		}
+		progress.Add(1)
+	}
+	progress.Done()
+
+	// Each photo's map onto the base photo, and gain, as it's placed
+	places := map[int]emath.Aff3{0: emath.Identity()}
+	gains := map[int]float64{0: 1.0}
+	for len(places) < n {
+		var best *mosaicMatch
+		var bestM emath.Aff3
+		bestTo, bestGain := -1, 0.0
+		for _, m := range matches {
+			if m == nil || m.score < mosaicMinMatch || (best != nil && m.score <= best.score) {
+				continue
+			}
+			_, iPlaced := places[m.i]
+			_, jPlaced := places[m.j]
+			switch {
+			case iPlaced && !jPlaced: best, bestTo, bestM, bestGain = m, m.j, places[m.i].Mult(m.xform.ToMatrix()), gains[m.i] * m.gain
+			case jPlaced && !iPlaced: best, bestTo, bestM, bestGain = m, m.i, places[m.j].Mult(m.xform.ToMatrix().Invert()), gains[m.j] / m.gain
+			}
+		}
+		if best == nil {
+			break
+		}
+		places[bestTo], gains[bestTo] = bestM, bestGain
+	}
+
+	tiles := map[string]MosaicTile{}
+	dropped := map[int]bool{}
+	for i, l := range fi.Layers {
+		m, placed := places[i]
+		if !placed {
+			if err := fi.frameFailed(l.Filename(), "mosaic", "doesn't overlap any of the placed photos well enough"); err != nil {
+				return nil, err
+			}
+			dropped[i] = true
+			continue
+		}
+		t := MosaicTile{Transform: transformFromMatrix(m), Gain: 1.0}
+		if cfg.Exposures == "match" {
+			t.Gain = gains[i]
+		}
+		t.Transform.Name = l.Filename()
+		tiles[l.Filename()] = t
+	}
+	fi.Config.infof("Mosaic: placed %d of %d photos\n", len(tiles), n)
+	return tiles, fi.dropLayers(dropped)
+}
+
+// transformFromMatrix is the AlignmentTransform (rotating about the
+// origin) for a rigid map.
+func transformFromMatrix(m emath.Aff3) AlignmentTransform {
+	theta := math.Atan2(m[3], m[0])
+	c, s := math.Cos(theta), math.Sin(theta)
+	return AlignmentTransform{ // ToMatrix rotates after translating, so the translation is rotated back
+		TranslateByX: c*m[2] + s*m[5],
+		TranslateByY: -s*m[2] + c*m[5],
+		RotateByDeg:  theta * 180.0 / math.Pi,
+	}
+}
+
+// registerMosaicPair finds where photo j goes on photo i: a brute force
+// search for the translation that best correlates their (log)
+// brightness, on small copies of them; refined on larger copies, a
+// level at a time; and then on the photos themselves, to the pixel (or,
+// with FineTune, by the fine-tune search). It's nil if they don't
+// overlap enough anywhere.
+func (fi *FusedImage)registerMosaicPair(ctx context.Context, cfg MosaicConfig, i, j int, pi, pj []lumGrid) *mosaicMatch {
+	top := len(pi) - 1
+	if len(pj) - 1 < top {
+		top = len(pj) - 1
+	}
+	a, b := pi[top], pj[top]
+	minArea := cfg.MinOverlap * math.Min(float64(a.w * a.h), float64(b.w * b.h))
+
+	// Every translation, at the top level. The copies are small enough
+	// that the right one can fall between their pixels, and score worse
+	// than a wrong one, so the best few peaks all go down the levels.
+	cols, rows := a.w + b.w - 1, a.h + b.h - 1
+	scores := make([]float64, cols * rows)
+	eimage.ParallelFor(ctx, fi.workers("mosaic"), rows, func(_, r int) {
+		for c := 0; c < cols; c++ {
+			dx, dy := c - (b.w - 1), r - (b.h - 1)
+			scores[r*cols + c] = math.Inf(-1)
+			if overlapArea(a, b, dx, dy) >= minArea {
+				scores[r*cols + c], _ = a.correlate(b, float64(dx), float64(dy))
+			}
+		}
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	type candidate struct{ dx, dy, score float64 }
+	peaks := []candidate{}
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			v, peak := scores[r*cols + c], true
+			for k := 0; k < 9 && peak && !math.IsInf(v, -1); k++ {
+				nc, nr := c + k%3 - 1, r + k/3 - 1
+				if k != 4 && nc >= 0 && nr >= 0 && nc < cols && nr < rows && scores[nr*cols + nc] > v {
+					peak = false
+				}
+			}
+			if peak && !math.IsInf(v, -1) {
+				peaks = append(peaks, candidate{float64(c - (b.w - 1)), float64(r - (b.h - 1)), v})
+			}
+		}
+	}
+	if len(peaks) == 0 {
+		return nil
+	}
+	sort.SliceStable(peaks, func(x, y int) bool { return peaks[x].score > peaks[y].score })
+	if len(peaks) > mosaicPeaks {
+		peaks = peaks[:mosaicPeaks]
+	}
+
+	// Down the levels, within a couple of pixels each time
+	best := candidate{score: math.Inf(-1)}
+	for _, p := range peaks {
+		for level := top-1; level >= 0; level-- {
+			la, lb := pi[level], pj[level]
+			cx, cy := p.dx * 2.0, p.dy * 2.0
+			p.score = math.Inf(-1)
+			for ox := -2.0; ox <= 2.0; ox++ {
+				for oy := -2.0; oy <= 2.0; oy++ {
+					if s, _ := la.correlate(lb, cx + ox, cy + oy); s > p.score {
+						p = candidate{cx + ox, cy + oy, s}
+					}
+				}
+			}
+		}
+		if p.score > best.score {
+			best = p
+		}
+	}
+	dx, dy := best.dx, best.dy
+	full := float64(pi[0].scale)
+	a, b = pi[0], pj[0]
+	score, gain := a.correlate(b, dx, dy)
+	xform := AlignmentTransform{
+		Name:            fmt.Sprintf("%s-%s", fi.Layers[i].Filename(), fi.Layers[j].Filename()),
+		TranslateByX:    dx * full,
+		TranslateByY:    dy * full,
+	}
+	// Rotate about the middle of the overlap
+	ov := image.Rect(0, 0, a.w, a.h).Intersect(image.Rect(0, 0, b.w, b.h).Add(image.Point{int(dx), int(dy)}))
+	xform.RotationCenterX, xform.RotationCenterY = float64(ov.Min.X + ov.Max.X) / 2.0 * full, float64(ov.Min.Y + ov.Max.Y) / 2.0 * full
+
+	// The smallest copies are half size; the last pixel or two comes
+	// from the photos themselves
+	li, lj := fi.Layers[i], fi.Layers[j]
+	diff := func(xf AlignmentTransform, _ string) float64 { return mosaicDiff(li, lj, xf, ov, full, fi.Config.ClipLevel) }
+	if cfg.FineTune {
+		search := ealign.Search{Score: diff, Workers: fi.workers("mosaic"), Debugf: fi.Config.debugf}
+		xform = search.FineTune(ctx, xform, full)
+	} else {
+		best, bestDiff := xform, math.MaxFloat64
+		for ox := -full; ox <= full; ox++ {
+			for oy := -full; oy <= full; oy++ {
+				xf := xform
+				xf.TranslateByX, xf.TranslateByY = xform.TranslateByX + ox, xform.TranslateByY + oy
+				if d := diff(xf, ""); d < bestDiff {
+					best, bestDiff = xf, d
+				}
+			}
+		}
+		xform = best
+	}
+	return &mosaicMatch{i: i, j: j, xform: xform, gain: gain, score: score}
+}
+
+// mosaicDiff is the fine-tune search's error metric for where photo lj
+// goes on li: the mean squared difference of their log brightness, with
+// lj's made to match li's on average, over a sparse grid of the overlap
+// (in li's coords, at the given scale).
+func mosaicDiff(li, lj Layer, xf AlignmentTransform, ov image.Rectangle, scale, clip float64) float64 {
+	j2i := xf.ToMatrix().Invert()
+	r := image.Rect(int(float64(ov.Min.X) * scale), int(float64(ov.Min.Y) * scale), int(float64(ov.Max.X) * scale), int(float64(ov.Max.Y) * scale))
+	step := int(math.Max(1.0, math.Sqrt(float64(r.Dx() * r.Dy()) / mosaicSamples)))
+	diffs := []float64{}
+	for y := r.Min.Y; y < r.Max.Y; y += step {
+		for x := r.Min.X; x < r.Max.X; x += step {
+			vi, ok := logLux(li, float64(x) + 0.5, float64(y) + 0.5, clip)
+			if !ok {
+				continue
+			}
+			jx, jy := j2i.Apply(float64(x) + 0.5, float64(y) + 0.5)
+			if vj, ok := logLux(lj, jx, jy, clip); ok {
+				diffs = append(diffs, vi - vj)
+			}
+		}
+	}
+	if len(diffs) < 100 {
+		return math.MaxFloat64
+	}
+	mean := 0.0
+	for _, d := range diffs {
+		mean += d
+	}
+	mean /= float64(len(diffs))
+	sum := 0.0
+	for _, d := range diffs {
+		sum += (d - mean) * (d - mean)
+	}
+	return sum / float64(len(diffs))
+}
+
+// logLux samples the photo (bilinearly) at (x,y), as log brightness in
+// lux; it isn't usable if it's off the photo, clipped, or black.
+func logLux(l Layer, x, y, clip float64) (float64, bool) {
+	rgb, ok := sampleRGB(l.LoadedImage, x, y, clip)
+	if v := (rgb[0] + rgb[1] + rgb[2]) / 3.0; ok && v > 1e-4 {
+		return math.Log(v * l.IlluminanceAtMaxExposure), true
+	}
+	return 0.0, false
+}
+
+// sampleRGB samples the image bilinearly at (x,y), pixel centers being
+// on the halves; it isn't usable if it's off the image, or any of the
+// pixels it comes from are at or above clip.
+func sampleRGB(img image.Image, x, y, clip float64) ([3]float64, bool) {
+	b := img.Bounds()
+	px, py := x - 0.5, y - 0.5
+	ix, iy := int(math.Floor(px)), int(math.Floor(py))
+	fx, fy := px - float64(ix), py - float64(iy)
+	if ix < b.Min.X || iy < b.Min.Y || ix+1 >= b.Max.X || iy+1 >= b.Max.Y {
+		return [3]float64{}, false
+	}
+	out, ok := [3]float64{}, true
+	for k, w := range [4]float64{(1-fx)*(1-fy), fx*(1-fy), (1-fx)*fy, fx*fy} {
+		r, g, bl := eimage.PixelRGB(img, ix + k%2, iy + k/2)
+		if r >= clip || g >= clip || bl >= clip {
+			ok = false
+		}
+		out[0], out[1], out[2] = out[0] + w*r, out[1] + w*g, out[2] + w*bl
+	}
+	return out, ok
+}
+
+// A lumGrid is a shrunken copy of a photo's log brightness (in lux, so
+// photos at different exposures compare), by box averaging `scale`
+// pixels each way; NaN where it's clipped or black.
+type lumGrid struct {
+	w, h   int
+	scale  int
+	v      []float64
+}
+
+// lumPyramid is the photo at half size, then a quarter, and so on, down
+// to mosaicCoarseSize across.
+func lumPyramid(l Layer, clip float64) []lumGrid {
+	b := l.LoadedImage.Bounds()
+	g := lumGrid{w: b.Dx() / 2, h: b.Dy() / 2, scale: 2}
+	g.v = make([]float64, g.w * g.h)
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			sum, ok := 0.0, true
+			for k := 0; k < 4; k++ {
+				r, gg, bl := eimage.PixelRGB(l.LoadedImage, b.Min.X + 2*x + k%2, b.Min.Y + 2*y + k/2)
+				if r >= clip || gg >= clip || bl >= clip {
+					ok = false
+				}
+				sum += (r + gg + bl) / 3.0
+			}
+			if v := sum / 4.0; ok && v > 1e-4 {
+				g.v[y*g.w + x] = math.Log(v * l.IlluminanceAtMaxExposure)
+			} else {
+				g.v[y*g.w + x] = math.NaN()
+			}
+		}
+	}
+	levels := []lumGrid{g}
+	for g.w > mosaicCoarseSize || g.h > mosaicCoarseSize {
+		h := lumGrid{w: g.w / 2, h: g.h / 2, scale: g.scale * 2}
+		h.v = make([]float64, h.w * h.h)
+		for y := 0; y < h.h; y++ {
+			for x := 0; x < h.w; x++ {
+				sum, n := 0.0, 0
+				for k := 0; k < 4; k++ {
+					if v := g.v[(2*y + k/2)*g.w + 2*x + k%2]; !math.IsNaN(v) {
+						sum, n = sum + v, n + 1
+					}
+				}
+				h.v[y*h.w + x] = math.NaN()
+				if n == 4 {
+					h.v[y*h.w + x] = sum / 4.0
+				}
+			}
+		}
+		levels, g = append(levels, h), h
+	}
+	return levels
+}
+
+func overlapArea(a, b lumGrid, dx, dy int) float64 {
+	ov := image.Rect(0, 0, a.w, a.h).Intersect(image.Rect(dx, dy, dx + b.w, dy + b.h))
+	return float64(ov.Dx() * ov.Dy())
+}
+
+// correlate compares b, moved by (dx,dy) (whole pixels; any fraction
+// is dropped), with a, over where they overlap: the normalized
+// correlation of their values, and how much brighter a is than b (the
+// exp of the median difference). A sparse grid of the overlap is
+// enough.
+func (a lumGrid)correlate(b lumGrid, dx, dy float64) (float64, float64) {
+	ix, iy := int(math.Round(dx)), int(math.Round(dy))
+	ov := image.Rect(0, 0, a.w, a.h).Intersect(image.Rect(ix, iy, ix + b.w, iy + b.h))
+	if ov.Empty() {
+		return math.Inf(-1), 1.0
+	}
+	step := int(math.Max(1.0, math.Sqrt(float64(ov.Dx() * ov.Dy()) / mosaicSamples)))
+	n, sa, sb, saa, sbb, sab := 0.0, 0.0, 0.0, 0.0, 0.0, 0.0
+	diffs := []float64{}
+	for y := ov.Min.Y; y < ov.Max.Y; y += step {
+		for x := ov.Min.X; x < ov.Max.X; x += step {
+			va, vb := a.v[y*a.w + x], b.v[(y - iy)*b.w + x - ix]
+			if math.IsNaN(va) || math.IsNaN(vb) {
+				continue
+			}
+			n, sa, sb, saa, sbb, sab = n + 1, sa + va, sb + vb, saa + va*va, sbb + vb*vb, sab + va*vb
+			diffs = append(diffs, va - vb)
+		}
+	}
+	if n < 16 {
+		return math.Inf(-1), 1.0
+	}
+	cov := sab/n - sa/n*sb/n
+	varA, varB := saa/n - sa/n*sa/n, sbb/n - sb/n*sb/n
+	if varA <= 0.0 || varB <= 0.0 {
+		return math.Inf(-1), 1.0
+	}
+	sort.Float64s(diffs)
+	return cov / math.Sqrt(varA * varB), math.Exp(diffs[len(diffs)/2])
+}
+
+// renderMosaic draws the photos onto a canvas that fits them all, each
+// at the base photo's exposure (times its gain), developed as for the
+// stack. Where they overlap, each is weighted by how far it is from its
+// own edges (out to Feather), and barely at all if it's clipped.
+func (fi *FusedImage)renderMosaic(ctx context.Context, cfg MosaicConfig, tiles map[string]MosaicTile, filename string) error {
+	develop, err := fi.Config.pixelDeveloper()
+	if err != nil {
+		return err
+	}
+	type placed struct {
+		l      Layer
+		c2t    emath.Aff3  // canvas (base photo) coords to the photo's
+		gain   float64
+		feather float64
+	}
+	all := []placed{}
+	bounds := image.Rectangle{}
+	for _, l := range fi.Layers {
+		t, exists := tiles[l.Filename()]
+		if !exists {
+			continue
+		}
+		m, b := t.Transform.ToMatrix(), l.LoadedImage.Bounds()
+		for _, p := range []image.Point{b.Min, {b.Max.X, b.Min.Y}, {b.Min.X, b.Max.Y}, b.Max} {
+			x, y := m.Apply(float64(p.X), float64(p.Y))
+			bounds = bounds.Union(image.Rect(int(math.Floor(x)), int(math.Floor(y)), int(math.Ceil(x)) + 1, int(math.Ceil(y)) + 1))
+		}
+		all = append(all, placed{l, m.Invert(), t.Gain, cfg.Feather * float64(min(b.Dx(), b.Dy()))})
+	}
+	if len(all) == 0 {
+		return fmt.Errorf("mosaic: no photos to draw")
+	}
+	illum := fi.Layers[0].IlluminanceAtMaxExposure
+	clip := fi.Config.ClipLevel
+	cs := fi.Config.ColorSpace
+
+	w, h := bounds.Dx(), bounds.Dy()
+	fi.Config.infof("Drawing %d photos into a %dx%d mosaic\n", len(all), w, h)
+	out := image.NewRGBA64(image.Rect(0, 0, w, h))
+	progress := fi.Config.newProgress("Drawing the mosaic", h)
+	err = eimage.ParallelFor(ctx, fi.workers("mosaic"), h, func(_, y int) {
+		defer progress.Add(1)
+		for x := 0; x < w; x++ {
+			cx, cy := float64(bounds.Min.X + x) + 0.5, float64(bounds.Min.Y + y) + 0.5
+			sum, wsum := [3]float64{}, 0.0
+			for _, p := range all {
+				tx, ty := p.c2t.Apply(cx, cy)
+				rgb, usable := sampleRGB(p.l.LoadedImage, tx, ty, clip)
+				tb := p.l.LoadedImage.Bounds()
+				edge := math.Min(math.Min(tx - float64(tb.Min.X), float64(tb.Max.X) - tx), math.Min(ty - float64(tb.Min.Y), float64(tb.Max.Y) - ty))
+				if edge <= 0.5 {
+					continue // off this photo
+				}
+				weight := math.Min(1.0, edge / math.Max(p.feather, 1.0))
+				if !usable {
+					weight *= 0.001 // so the photos that aren't clipped win
+				}
+				k := weight * p.gain * p.l.IlluminanceAtMaxExposure / illum
+				sum[0], sum[1], sum[2], wsum = sum[0] + k*rgb[0], sum[1] + k*rgb[1], sum[2] + k*rgb[2], wsum + weight
+			}
+			if wsum == 0.0 {
+				continue // transparent
+			}
+			px := Pixel{Fused: ecolor.CameraNative{IllumAtMax: illum}}
+			px.Fused.R, px.Fused.G, px.Fused.B = sum[0] / wsum, sum[1] / wsum, sum[2] / wsum
+			develop(&px)
+			to16 := func(v float64) uint16 { return uint16(math.Round(cs.Encode(math.Max(0.0, math.Min(1.0, v))) * 0xFFFF)) }
+			out.SetRGBA64(x, y, color.RGBA64{to16(px.DevelopedRGB.R), to16(px.DevelopedRGB.G), to16(px.DevelopedRGB.B), 0xFFFF})
+		}
+	})
+	progress.Done()
+	if err != nil {
+		return err
+	}
+	if err := fi.Config.writePNG(out, filename); err != nil {
+		return fmt.Errorf("mosaic: %v", err)
+	}
+	fi.Config.infof("Wrote the mosaic to %s\n", filename)
+	return nil
+}
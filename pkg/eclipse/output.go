@@ -0,0 +1,127 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// OutputConfig says where the output files go. The dirs for each kind
+// of output are relative to the run dir, which is Dir (or a timestamped
+// subdir of it, if PerRun is set).
+type OutputConfig struct {
+	Dir              string  // Where everything goes; if empty, the current dir
+	PerRun           bool    // Give each run its own subdir of Dir, e.g. `run-20240408-181502`
+	FinalDir         string  // Tonemapped images, renditions, annotations, isophotes, fused.hdr
+	IntermediateDir  string  // Files for the next phase: stacked.hdr, clipped masks, config snapshots
+	DebugDir         string  // Lunar limb composite, alignment diffs, fattal02 grids
+	ReportDir        string  // Reports about the run
+	PNG              string  // How PNGs are written: "" or "std" (image/png), or "fast" (in parallel; see eio.EncodePNG)
+
+	runDir           string
+	preview          bool    // Everything goes in a `preview` subdir, so it doesn't overwrite the real thing
+}
+
+var(
+	runDirsMu sync.Mutex
+	runDirs   = map[string]bool{} // Taken by runs in this process, so runs started in the same second don't share one
+)
+
+type OutputKind int
+
+const(
+	FinalOutput OutputKind = iota
+	IntermediateOutput
+	DebugOutput
+	ReportOutput
+)
+
+// StartRun picks the run dir. It only does anything the first time
+// it is called, so all the phases of a run end up in the same place;
+// it says if it made up a new (per-run) dir.
+func (oc *OutputConfig)StartRun() bool {
+	if oc.runDir != "" {
+		return false
+	}
+	oc.runDir = oc.Dir
+	if oc.PerRun {
+		name := "run-" + time.Now().Format("20060102-150405")
+		runDirsMu.Lock()
+		oc.runDir = filepath.Join(oc.Dir, name)
+		for i:=2; runDirs[oc.runDir]; i++ {
+			oc.runDir = filepath.Join(oc.Dir, fmt.Sprintf("%s-%d", name, i))
+		}
+		runDirs[oc.runDir] = true
+		runDirsMu.Unlock()
+		return true
+	}
+	return false
+}
+
+// startRun is Output.StartRun, saying where the outputs are going.
+func (c *Config)startRun() {
+	if c.Output.StartRun() {
+		c.infof("Writing outputs into %s\n", c.Output.runDir)
+	}
+}
+
+// dir is where outputs of that kind go; it doesn't create it.
+func (oc OutputConfig)dir(kind OutputKind) string {
+	run := oc.runDir
+	if run == "" {
+		run = oc.Dir
+	}
+	if oc.preview {
+		run = filepath.Join(run, "preview")
+	}
+	sub := ""
+	switch kind {
+	case FinalOutput:        sub = oc.FinalDir
+	case IntermediateOutput: sub = oc.IntermediateDir
+	case DebugOutput:        sub = oc.DebugDir
+	case ReportOutput:       sub = oc.ReportDir
+	}
+	if dir := filepath.Join(run, sub); dir != "" {
+		return dir
+	}
+	return "."
+}
+
+// OutputDir is where outputs of that kind go, creating it if needed.
+func (c Config)OutputDir(kind OutputKind) string {
+	dir := c.Output.dir(kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.warnf("Output dir %s: %v\n", dir, err)
+	}
+	return dir
+}
+
+// writePNG writes a PNG output, with the encoder that `output.png`
+// says, tagged with the output color space.
+func (c Config)writePNG(img image.Image, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("open+w '%s': %v", filename, err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if cs := c.ColorSpace; cs.Name != "" {
+		w = eio.TagPNG(f, eio.PNGColorTag{SRGB: cs.Name == "srgb", Gamma: cs.Gamma, Chromaticities: cs.Chromaticities})
+	}
+	if c.Output.PNG == "fast" {
+		return eio.EncodePNG(w, img, c.NumThreads())
+	}
+	return png.Encode(w, img)
+}
+
+// OutputPath is where to write the named output file.
+func (c Config)OutputPath(kind OutputKind, filename string) string {
+	return filepath.Join(c.OutputDir(kind), filename)
+}
@@ -0,0 +1,75 @@
+package eclipse
+
+import(
+	"sync"
+)
+
+// maxPendingOutputs is how many output files can be being written at
+// once, in the background; more than that, and whoever wants to write
+// another waits. Each one holds on to its image until it's written, so
+// this is what bounds the memory they take.
+const maxPendingOutputs = 2
+
+// An outputQueue writes the PNG outputs (tonemapped images, their
+// renditions & overlays, the clipped mask, debug images) in the
+// background, so encoding them overlaps with the rest of the
+// pipeline, rather than holding it up. The images handed to it mustn't
+// change afterwards.
+type outputQueue struct {
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	err    error  // The first write that failed
+}
+
+func newOutputQueue() *outputQueue {
+	return &outputQueue{slots: make(chan struct{}, maxPendingOutputs)}
+}
+
+// write runs fn (which writes a file) in the background, and any error
+// comes back from wait. With no queue (e.g. when a stage is called
+// directly, not from RunPhase), it just runs fn, and returns its error.
+func (q *outputQueue)write(fn func() error) error {
+	if q == nil {
+		return fn()
+	}
+	q.slots <- struct{}{}
+	q.wg.Add(1)
+	go func() {
+		defer func() { <-q.slots; q.wg.Done() }()
+		if err := fn(); err != nil {
+			q.mu.Lock()
+			if q.err == nil {
+				q.err = err
+			}
+			q.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// wait waits for everything written so far, and returns the first
+// error.
+func (q *outputQueue)wait() error {
+	if q == nil {
+		return nil
+	}
+	q.wg.Wait()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// writingOutputs runs fn (e.g. a phase) with the outputs written in the
+// background, and waits for them to be done.
+func (fi *FusedImage)writingOutputs(fn func() error) error {
+	q := newOutputQueue()
+	fi.Config.outputs = q
+	defer func() { fi.Config.outputs = nil }()
+	err := fn()
+	if werr := q.wait(); err == nil {
+		err = werr
+	}
+	return err
+}
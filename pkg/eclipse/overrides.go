@@ -0,0 +1,84 @@
+package eclipse
+
+import(
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix marks environment variables that override config values;
+// e.g. ECLIPSEHDR_WHITEBALANCE_MODE=solar is the same as
+// `-set whitebalance.mode=solar`.
+const EnvPrefix = "ECLIPSEHDR_"
+
+// WithOverrides returns a copy of the config with the settings
+// applied. Each setting looks like `whitebalance.mode=solar`; the key
+// is the path through the yaml (quote any part that has dots in it,
+// e.g. `images."DSC_5670.dng".exclude=true`), and the value is parsed
+// as yaml, so `blackpoint=[0.01,0.01,0.02]` works too. The result is
+// validated once they have all been applied, so the order of settings
+// that depend on each other doesn't matter; as this is the last layer
+// of the config, that covers the config files too.
+func (c Config)WithOverrides(settings ...string) (Config, error) {
+	for _, setting := range settings {
+		b, err := overrideAsYaml(setting)
+		if err != nil {
+			return c, err
+		}
+		if c, err = newConfigFromYaml(b, c); err != nil {
+			return c, fmt.Errorf("override '%s': %v", setting, err)
+		}
+		c.debugf("Config override: %s\n", setting)
+	}
+	return c, c.Validate()
+}
+
+// overrideAsYaml turns `a.b.c=val` into the yaml doc `{a: {b: {c: val}}}`.
+func overrideAsYaml(setting string) ([]byte, error) {
+	key, val, found := strings.Cut(setting, "=")
+	if !found || key == "" {
+		return nil, fmt.Errorf("override '%s': wanted key=value", setting)
+	}
+
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(val), &v); err != nil {
+		return nil, fmt.Errorf("override '%s': bad value: %v", setting, err)
+	}
+	path := splitKeyPath(key)
+	for i:=len(path)-1; i>=0; i-- {
+		v = map[string]interface{}{path[i]: v}
+	}
+	return yaml.Marshal(v)
+}
+
+// splitKeyPath splits the key on dots, except for dots inside quotes.
+func splitKeyPath(key string) []string {
+	path, part, quoted := []string{}, "", false
+	for _, r := range key {
+		switch {
+		case r == '"':          quoted = !quoted
+		case r == '.' && !quoted: path, part = append(path, part), ""
+		default:                part += string(r)
+		}
+	}
+	return append(path, part)
+}
+
+// EnvOverrides picks out the config settings from the environment
+// (as from os.Environ()), sorted so that they apply in a fixed order.
+// Underscores in the name become dots in the key, so map keys that
+// contain underscores (e.g. filenames under `images`) need `-set`.
+func EnvOverrides(environ []string) []string {
+	settings := []string{}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		key, val, _ := strings.Cut(strings.TrimPrefix(kv, EnvPrefix), "=")
+		settings = append(settings, strings.ToLower(strings.ReplaceAll(key, "_", ".")) + "=" + val)
+	}
+	sort.Strings(settings)
+	return settings
+}
@@ -0,0 +1,114 @@
+package eclipse
+
+import(
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Settings that depend on each other have to work in either order, as
+// EnvOverrides sorts them; the config is only validated once they're
+// all applied.
+func TestWithOverridesOrder(t *testing.T) {
+	for _, settings := range [][]string{
+		{"syntheticmoon.mode=textured", "syntheticmoon.texturefile=x.png"},
+		{"syntheticmoon.texturefile=x.png", "syntheticmoon.mode=textured"},
+	} {
+		c, err := NewConfig().WithOverrides(settings...)
+		if err != nil {
+			t.Errorf("%q: %v", settings, err)
+		} else if c.SyntheticMoon.Mode != "textured" || c.SyntheticMoon.TextureFile != "x.png" {
+			t.Errorf("%q: got %+v", settings, c.SyntheticMoon)
+		}
+	}
+
+	if _, err := NewConfig().WithOverrides("syntheticmoon.mode=textured"); err == nil {
+		t.Errorf("textured without a texturefile was valid")
+	}
+}
+
+// Likewise for an include that the file including it completes.
+func TestLoadConfigIncludeValidation(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"common.yaml": "syntheticmoon: {mode: textured}\n",
+		"conf.yaml":   "include: [common.yaml]\nsyntheticmoon: {texturefile: x.png}\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := loadConfig(filepath.Join(dir, "conf.yaml"), NewConfig())
+	if err == nil {
+		_, err = c.WithOverrides()
+	}
+	if err != nil {
+		t.Errorf("conf.yaml: %v", err)
+	}
+
+	// ... but the config as a whole still gets checked
+	c, err = loadConfig(filepath.Join(dir, "common.yaml"), NewConfig())
+	if err == nil {
+		_, err = c.WithOverrides()
+	}
+	if err == nil || !strings.Contains(err.Error(), "syntheticmoon.texturefile") {
+		t.Errorf("common.yaml on its own: got %v", err)
+	}
+}
+
+func TestSplitKeyPath(t *testing.T) {
+	tests := []struct {
+		key   string
+		want  []string
+	}{
+		{"fuser", []string{"fuser"}},
+		{"syntheticmoon.mode", []string{"syntheticmoon", "mode"}},
+		{`images."IMG_0001.tif".ev`, []string{"images", "IMG_0001.tif", "ev"}},
+		{`images."a.b.c"`, []string{"images", "a.b.c"}},
+		{`"a.b".c."d"`, []string{"a.b", "c", "d"}},
+		{"a..b", []string{"a", "", "b"}},
+		{"", []string{""}},
+	}
+	for _, test := range tests {
+		if got := splitKeyPath(test.key); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("'%s': got %q, wanted %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestOverrideAsYaml(t *testing.T) {
+	tests := []struct {
+		setting, want  string
+		wantErr        bool
+	}{
+		{"fuser=avg", "fuser: avg\n", false},
+		{"threads=4", "threads: 4\n", false},
+		{"syntheticmoon.mode=textured", "syntheticmoon:\n  mode: textured\n", false},
+		{`images."IMG_0001.tif".ev=3`, "images:\n  IMG_0001.tif:\n    ev: 3\n", false},
+		{"select=[iso >= 800, ev < 3]", "select:\n- iso >= 800\n- ev < 3\n", false},
+		{"output.dir=a=b", "output:\n  dir: a=b\n", false}, // only the first = splits
+		{"fuser=", "fuser: null\n", false},
+		{"fuser", "", true},
+		{"=avg", "", true},
+		{"select=[iso", "", true},
+	}
+	for _, test := range tests {
+		got, err := overrideAsYaml(test.setting)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': wanted an error, got %q", test.setting, got)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("'%s': %v", test.setting, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("'%s': got %q, wanted %q", test.setting, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package eclipse
+
+import(
+	"context"
+	"image"
+	"runtime"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// NumThreads is how many worker goroutines to use; `Config.Threads`,
+// or GOMAXPROCS (normally one per CPU) if that isn't set.
+func (c Config)NumThreads() int {
+	if c.Threads > 0 {
+		return c.Threads
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// forEachTile is how the per-pixel stages spread their work: it splits
+// the output area into tiles (in output coords; see eimage.ForTiles),
+// and runs fn over them with `threads` workers. If label isn't empty,
+// it reports progress, a tile at a time.
+func (fi *FusedImage)forEachTile(ctx context.Context, threads int, label string, fn func(worker int, tile image.Rectangle)) error {
+	r := image.Rectangle{Max: fi.OutputArea.Size()}
+	var progress *stageProgress
+	if label != "" {
+		progress = fi.Config.newProgress(label, eimage.NumTiles(r))
+		defer progress.Done()
+	}
+	return eimage.ForTiles(ctx, threads, r, func(worker int, tile image.Rectangle) {
+		fn(worker, tile)
+		progress.Add(1)
+	})
+}
+
+// forEachPixel runs fn over every fused pixel, a tile at a time, with
+// all the threads; for the enhance stages, which can't be cancelled
+// midway.
+func (fi *FusedImage)forEachPixel(label string, fn func(x, y int, p *Pixel)) {
+	fi.forEachTile(context.Background(), fi.Config.NumThreads(), label, func(_ int, t image.Rectangle) {
+		for x:=t.Min.X; x<t.Max.X; x++ {
+			for y:=t.Min.Y; y<t.Max.Y; y++ {
+				fn(x, y, fi.PixRW(x, y))
+			}
+		}
+	})
+}
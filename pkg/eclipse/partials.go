@@ -0,0 +1,109 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/elimb"
+)
+
+// A PartialFrame is a photo of one of the partial phases, with the sun
+// fitted to it (see elimb.FitSolarDisk). They go into `partials.yaml`,
+// in the reports dir.
+type PartialFrame struct {
+	Filename           string
+	CaptureTime        time.Time  `yaml:",omitempty"`
+	EV                 int
+	elimb.SolarDisk               `yaml:",inline"`
+	CenterIlluminance  float64    // The disk center's brightness, scaled by the exposure, so frames can be compared
+	Normalization      float64    // Multiply the frame's (exposure scaled) brightness by this, to match the median frame
+}
+
+// FitPartials fits the solar disk, with its limb darkening, to each of
+// the photos, which should be of the partial phases (through a solar
+// filter). The center brightnesses, scaled by each photo's exposure,
+// give a normalization for the sequence: the sun's disk doesn't change,
+// so any difference between frames is the sky (haze, thin cloud) or
+// the exposure data. A photo that can't be fitted is an error, unless
+// KeepGoing is set.
+func (fi *FusedImage)FitPartials(ctx context.Context) ([]PartialFrame, error) {
+	defer fi.measureStage(ctx, "partials")()
+	frames := make([]PartialFrame, len(fi.Layers))
+	errs := make([]error, len(fi.Layers))
+	progress := fi.Config.newProgress("Fitting solar disks", len(fi.Layers))
+	err := eimage.ParallelFor(ctx, fi.workers("partials"), len(fi.Layers), func(_, i int) {
+		l := fi.Layers[i]
+		start := time.Now()
+		sd, err := elimb.FitSolarDisk(l.LoadedImage)
+		progress.Add(1)
+		if errs[i] = err; err != nil {
+			return
+		}
+		frames[i] = PartialFrame{
+			Filename:          l.Filename(),
+			CaptureTime:       l.CaptureTime,
+			EV:                l.EV,
+			SolarDisk:         sd,
+			CenterIlluminance: sd.Brightness * l.IlluminanceAtMaxExposure,
+		}
+		fi.Config.timeEvent("solardisk", start, "frame", l.Filename(), "centerx", sd.X, "centery", sd.Y, "radius", sd.Radius,
+			"limbdarkening", sd.LimbDarkening, "visible", sd.Visible)
+		fi.Config.debugf("Solar disk in %s: %s\n", l.Filename(), sd)
+	})
+	progress.Done()
+	if err != nil {
+		return nil, err
+	}
+
+	fitted := []PartialFrame{}
+	for i := range frames {
+		if errs[i] != nil {
+			if err := fi.frameFailed(fi.Layers[i].Filename(), "solardisk", errs[i].Error()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fitted = append(fitted, frames[i])
+	}
+	if len(fitted) == 0 {
+		return nil, fmt.Errorf("partials: the solar disk couldn't be fitted in any of the photos")
+	}
+
+	illums := []float64{}
+	for _, f := range fitted {
+		illums = append(illums, f.CenterIlluminance)
+	}
+	sort.Float64s(illums)
+	median := illums[len(illums)/2]
+	for i := range fitted {
+		fitted[i].Normalization = median / fitted[i].CenterIlluminance
+	}
+
+	// In time order, as a sequence
+	sort.SliceStable(fitted, func(i, j int) bool { return fitted[i].CaptureTime.Before(fitted[j].CaptureTime) })
+	return fitted, nil
+}
+
+// writePartials fits the partial phase photos, and writes the report.
+func (fi *FusedImage)writePartials(ctx context.Context) error {
+	frames, err := fi.FitPartials(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(struct{ Frames []PartialFrame }{frames})
+	if err != nil {
+		return fmt.Errorf("partials: %v", err)
+	}
+	filename := fi.Config.OutputPath(ReportOutput, "partials.yaml")
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write partials '%s': %v", filename, err)
+	}
+	fi.Config.infof("Fitted the solar disk in %d partial phase photos, wrote %s\n", len(frames), filename)
+	return nil
+}
@@ -0,0 +1,349 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// The pipeline can be run one phase at a time, so that you can keep
+// iterating on the later phases without re-running the earlier ones.
+// Each phase writes out a snapshot of the config (which carries the
+// lunar limbs, alignments etc. along to the next phase), and maybe an
+// image; pass those to the next phase, along with the photos if it
+// needs them.
+//
+//   detect:  photos              -> detect.yaml
+//   align:   photos, detect.yaml -> align.yaml
+//   review:  photos, align.yaml  -> review.yaml (interactive; accept/reject/flag each frame)
+//   stack:   photos, align.yaml  -> stack.yaml, stacked.hdr, stacked-clipped.png
+//   enhance: stack.yaml, stacked.hdr (photos, for `stars`) -> enhance.yaml, fused.hdr
+//   render:  enhance.yaml, fused.hdr -> tmo-*.png
+//   all:     photos -> everything (fused.hdr, tmo-*.png)
+//
+// and, off to one side, for photos of the partial phases:
+//
+//   partials:   photos -> partials.yaml (in the reports dir)
+//   lightcurve: photos -> lightcurve.csv, lightcurve.png, contacts.yaml (in the reports dir; the whole sequence)
+//   montage:    photos (and a totality composite, e.g. tmo-*.png) -> montage.png
+//   beads:      photos (around C2 & C3) -> beads-c2.png, beads-c3.png
+//
+// and for wide-field photos, that overlap:
+//
+//   mosaic:     photos -> mosaic.png, mosaic.yaml (in the reports dir)
+//
+// or, for a whole sequence in one go:
+//
+//   auto:    photos -> classification.yaml, and then each photo through
+//            partials, beads or all, by what it's of
+var(
+	Phases = []string{"detect", "align", "review", "stack", "enhance", "render", "all", "partials", "lightcurve", "montage", "beads", "auto", "mosaic"}
+)
+
+func ListPhases() string {
+	return fmt.Sprintf("%v", Phases)
+}
+
+func IsPhase(s string) bool {
+	for _, p := range Phases {
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
+
+// RunPhase runs one phase of the pipeline, on whatever has been loaded,
+// and then writes a manifest of the run into the reports dir; scratch
+// files are cleaned up as Config.Work says. If the phase won't fit in
+// Config.MaxMemory, it fails before starting. If ctx
+// is cancelled, the stages stop as soon as they can, and it returns
+// ctx.Err() (with nothing more written out).
+func (fi *FusedImage)RunPhase(ctx context.Context, phase string) (err error) {
+	defer fi.Config.timeEvent("phase", time.Now(), "phase", phase)
+	defer func() { fi.cleanupWork(err) }()
+	if fi.memPlan, err = fi.planMemory(phase); err != nil {
+		return err
+	}
+	for _, line := range fi.memPlan.lines() {
+		fi.Config.infof("%s\n", line)
+	}
+	if err := fi.startBuffers(); err != nil {
+		return err
+	}
+	defer fi.releaseBuffers()
+	fi.Config.startRun()
+	fi.manifest = fi.startManifest(phase)
+	if err := fi.writingOutputs(func() error { return fi.runPhase(ctx, phase) }); err != nil {
+		return err
+	}
+	return fi.finishManifest(fi.manifest)
+}
+
+func (fi *FusedImage)runPhase(ctx context.Context, phase string) error {
+	intermediate := func(name string) string { return fi.Config.OutputPath(IntermediateOutput, name) }
+
+	switch phase {
+	case "detect":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		if err := fi.DetectLunarLimbs(ctx); err != nil {
+			return err
+		}
+		if err := fi.ScoreFrames(ctx); err != nil {
+			return err
+		}
+		if err := fi.writeMoonPositions(); err != nil {
+			return err
+		}
+		if err := fi.writeEarthshine(ctx); err != nil {
+			return err
+		}
+		return fi.Config.WriteYaml(intermediate("detect.yaml"))
+
+	case "align":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		if err := fi.withHooks(ctx, "align", fi.Align); err != nil {
+			return err
+		}
+		return fi.Config.WriteYaml(intermediate("align.yaml"))
+
+	case "review":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		if err := fi.withHooks(ctx, "align", fi.Align); err != nil {
+			return err
+		}
+		b, err := fi.Review(os.Stdin, os.Stdout)
+		if err != nil {
+			return err
+		}
+		filename := intermediate("review.yaml")
+		if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+			return fmt.Errorf("write review '%s': %v", filename, err)
+		}
+		fi.Config.infof("Wrote %s; pass it on to `eclipse-hdr stack`\n", filename)
+		return nil
+
+	case "stack":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		if err := fi.withHooks(ctx, "align", fi.Align); err != nil {
+			return err
+		} else if err := fi.withHooks(ctx, "fuse", fi.Fuse); err != nil {
+			return err
+		}
+		if err := fi.WriteToHDR(intermediate("stacked.hdr")); err != nil {
+			return err
+		}
+		if err := fi.writeClippedMask(intermediate("stacked-clipped.png")); err != nil {
+			return err
+		}
+		if err := fi.writeCoronaProfile(); err != nil {
+			return err
+		}
+		if err := fi.writePolarization(ctx); err != nil {
+			return err
+		}
+		if err := fi.writeRadiance(); err != nil {
+			return err
+		}
+		if err := fi.writeCube(); err != nil {
+			return err
+		}
+		if err := fi.writeTimelapse(ctx); err != nil {
+			return err
+		}
+		if err := fi.writeAnimation(ctx); err != nil {
+			return err
+		}
+		return fi.Config.WriteYaml(intermediate("stack.yaml"))
+
+	case "enhance":
+		if err := fi.needPixels(phase); err != nil {
+			return err
+		}
+		if len(fi.Layers) > 0 {
+			// Only some stages need the photos (e.g. stars); the alignments come from the config
+			if err := fi.Align(ctx); err != nil {
+				return err
+			}
+		}
+		if err := fi.withHooks(ctx, "enhance", fi.Enhance); err != nil {
+			return err
+		}
+		if err := fi.writeStreamerReport(); err != nil {
+			return err
+		}
+		if err := fi.WriteToHDR(fi.Config.OutputPath(FinalOutput, "fused.hdr")); err != nil {
+			return err
+		}
+		return fi.Config.WriteYaml(intermediate("enhance.yaml"))
+
+	case "render":
+		if err := fi.needPixels(phase); err != nil {
+			return err
+		}
+		return fi.withHooks(ctx, "tonemap", fi.Tonemap)
+
+	case "partials":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		return fi.writePartials(ctx)
+
+	case "lightcurve":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		return fi.writeLightCurve(ctx)
+
+	case "montage":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		return fi.writeMontage(ctx)
+
+	case "beads":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		return fi.writeBeads(ctx)
+
+	case "auto":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		return fi.runAuto(ctx)
+
+	case "mosaic":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		return fi.writeMosaic(ctx)
+
+	case "all":
+		if err := fi.needLayers(phase); err != nil {
+			return err
+		}
+		for _, stage := range []struct{ name string; run func(context.Context) error }{
+			{"align", fi.Align}, {"fuse", fi.Fuse}, {"enhance", fi.Enhance},
+		} {
+			if err := fi.withHooks(ctx, stage.name, stage.run); err != nil {
+				return err
+			}
+			if stage.name == "align" {
+				if err := fi.writeMoonPositions(); err != nil {
+					return err
+				}
+				if err := fi.writeEarthshine(ctx); err != nil {
+					return err
+				}
+			}
+			if stage.name == "fuse" {
+				if err := fi.writeCoronaProfile(); err != nil { // while the pixels are still linear
+					return err
+				}
+				if err := fi.writePolarization(ctx); err != nil {
+					return err
+				}
+				if err := fi.writeRadiance(); err != nil {
+					return err
+				}
+				if err := fi.writeCube(); err != nil {
+					return err
+				}
+				if err := fi.writeTimelapse(ctx); err != nil {
+					return err
+				}
+				if err := fi.writeAnimation(ctx); err != nil {
+					return err
+				}
+			}
+		}
+		if err := fi.writeStreamerReport(); err != nil {
+			return err
+		}
+		if err := fi.WriteToHDR(fi.Config.OutputPath(FinalOutput, "fused.hdr")); err != nil {
+			return err
+		}
+		return fi.withHooks(ctx, "tonemap", fi.Tonemap)
+	}
+
+	return fmt.Errorf("phase '%s' not recognized, wanted %s", phase, ListPhases())
+}
+
+func (fi *FusedImage)needLayers(phase string) error {
+	if len(fi.Layers) == 0 {
+		return fmt.Errorf("%s: no photos were loaded", phase)
+	}
+	return nil
+}
+
+func (fi *FusedImage)needPixels(phase string) error {
+	if len(fi.Pixels) == 0 {
+		return fmt.Errorf("%s: needs an HDR file from an earlier phase (e.g. stacked.hdr)", phase)
+	}
+	return nil
+}
+
+// loadHDR fills in the developed pixels from an HDR file written by
+// an earlier phase. If there is a matching `-clipped.png` mask next
+// to it, that is used to restore which pixels were clipped.
+func (fi *FusedImage)loadHDR(filename string) error {
+	img, err := eio.ReadHDR(filename)
+	if err != nil {
+		return err
+	}
+
+	var mask image.Image
+	maskFilename := strings.TrimSuffix(filename, ".hdr") + "-clipped.png"
+	if _, err := os.Stat(maskFilename); err == nil {
+		if mask, err = loadTexture(maskFilename); err != nil {
+			return err
+		}
+	}
+
+	b := img.Bounds()
+	fi.OutputArea = image.Rectangle{Max: image.Point{b.Dx(), b.Dy()}}
+	fi.Config.OutputArea = fi.OutputArea
+	fi.Pixels = make([]Pixel, b.Dx() * b.Dy())
+	for x:=0; x<b.Dx(); x++ {
+		for y:=0; y<b.Dy(); y++ {
+			p := fi.PixRW(x, y)
+			p.OutputPos = image.Point{x, y}
+			r, g, bl, _ := img.HDRAt(x + b.Min.X, y + b.Min.Y).HDRRGBA()
+			p.DevelopedRGB = hdrcolor.RGB{R: r, G: g, B: bl}
+			if mask != nil {
+				p.Clipped = eimage.GrayU16At(mask, x, y) > 0
+			}
+		}
+	}
+	return nil
+}
+
+// writeClippedMask writes out a black & white image of which pixels
+// were clipped in every layer.
+func (fi *FusedImage)writeClippedMask(filename string) error {
+	cfg, mask := fi.Config, fi.ClippedMask()
+	return cfg.outputs.write(func() error {
+		if err := cfg.writePNG(mask, filename); err != nil {
+			return fmt.Errorf("writing clipped mask: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,191 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// PhotometryConfig puts the fused image on an absolute scale, using
+// stars of known magnitude in the long exposures (found as for
+// StarsConfig). Each reference star's light is summed up, and compared
+// with its magnitude, to get the zero point; with the plate scale,
+// that turns any pixel value into a surface brightness, in magnitudes
+// per square arcsecond.
+type PhotometryConfig struct {
+	Stars              []ReferenceStar
+	MatchRadius          int      // How close (pixels) a detected star must be to where a reference star should be; if zero, 5
+	Aperture             int      // Radius (pixels) to sum each star's light over; if zero, 4
+	SolarRadiusArcsec    float64  // The apparent radius of the lunar limb, for the plate scale; if zero, 960
+	ArcsecPerPixel       float64  // The plate scale; if zero, it comes from the lunar radius & SolarRadiusArcsec
+}
+
+// A ReferenceStar is a star of known magnitude, such as Regulus.
+type ReferenceStar struct {
+	Name       string
+	Pos        image.Point  // Where it is, in output coords (e.g. from a plate solve of tmo-linear.png)
+	Magnitude  float64      // In the band nearest the camera's luminance (e.g. Johnson V)
+}
+
+func (pc PhotometryConfig)withDefaults() PhotometryConfig {
+	if pc.MatchRadius       == 0   { pc.MatchRadius = 5 }
+	if pc.Aperture          == 0   { pc.Aperture = 4 }
+	if pc.SolarRadiusArcsec == 0.0 { pc.SolarRadiusArcsec = 960.0 }
+	return pc
+}
+
+// A PhotometricCalibration says what the fused pixel values mean in
+// absolute terms. It goes into the run manifest, and `photometry.yaml`
+// in the reports dir.
+type PhotometricCalibration struct {
+	ZeroPoint       float64  // The magnitude of a star whose light sums to 1.0 (in developed luminance)
+	Scatter         float64  // The standard deviation of the stars' zero points, in magnitudes
+	ArcsecPerPixel  float64
+	Stars         []CalibrationStar
+}
+
+// A CalibrationStar is a reference star, as it was measured.
+type CalibrationStar struct {
+	Name       string
+	Pos        image.Point  // Where it was found
+	Magnitude  float64
+	Flux       float64      // Its luminance, summed over the aperture, less the sky
+	ZeroPoint  float64
+}
+
+// SurfaceBrightness is the brightness of a pixel with that (linear)
+// luminance, in magnitudes per square arcsecond; +Inf if it's black.
+func (pc PhotometricCalibration)SurfaceBrightness(lum float64) float64 {
+	if lum <= 0.0 {
+		return math.Inf(1)
+	}
+	return pc.ZeroPoint - 2.5 * math.Log10(lum) + 5.0 * math.Log10(pc.ArcsecPerPixel)
+}
+
+// CalibratePhotometry finds the reference stars, measures them, and
+// works out the zero point. If none of them can be found, there is no
+// calibration, and it says so.
+func (fi *FusedImage)CalibratePhotometry() {
+	if !fi.needsLunarLimb("Photometry") {
+		return
+	}
+	cfg := fi.Config.Photometry.withDefaults()
+	pc := PhotometricCalibration{ArcsecPerPixel: cfg.ArcsecPerPixel}
+	if pc.ArcsecPerPixel == 0.0 {
+		pc.ArcsecPerPixel = cfg.SolarRadiusArcsec / float64(fi.Config.LunarRadius)
+	}
+
+	detected := fi.DetectStars(fi.Config.Stars.withDefaults())
+	for _, ref := range cfg.Stars {
+		star, found := nearestStar(detected, ref.Pos, cfg.MatchRadius)
+		if !found {
+			fi.Config.warnf("Photometry: no star found within %dpx of %s at %v, skipping it\n", cfg.MatchRadius, ref.Name, ref.Pos)
+			continue
+		}
+		flux, err := fi.starFlux(star, cfg.Aperture)
+		if err != nil {
+			fi.Config.warnf("Photometry: %s: %v, skipping it\n", ref.Name, err)
+			continue
+		}
+		zp := ref.Magnitude + 2.5 * math.Log10(flux)
+		fi.Config.debugf("Photometry: %s (mag %.2f) at %v, flux %.4g, zero point %.3f\n", ref.Name, ref.Magnitude, star.Pos, flux, zp)
+		pc.Stars = append(pc.Stars, CalibrationStar{Name: ref.Name, Pos: star.Pos, Magnitude: ref.Magnitude, Flux: flux, ZeroPoint: zp})
+	}
+	if len(pc.Stars) == 0 {
+		fi.Config.warnf("Photometry: none of the %d reference stars could be measured, no calibration\n", len(cfg.Stars))
+		return
+	}
+
+	zps := []float64{}
+	for _, s := range pc.Stars {
+		zps = append(zps, s.ZeroPoint)
+	}
+	sort.Float64s(zps)
+	pc.ZeroPoint = zps[len(zps)/2]
+	if len(zps)%2 == 0 {
+		pc.ZeroPoint = (zps[len(zps)/2-1] + zps[len(zps)/2]) / 2.0
+	}
+	if len(zps) > 1 {
+		mean, ss := 0.0, 0.0
+		for _, zp := range zps {
+			mean += zp / float64(len(zps))
+		}
+		for _, zp := range zps {
+			ss += (zp - mean) * (zp - mean)
+		}
+		pc.Scatter = math.Sqrt(ss / float64(len(zps)-1))
+	}
+	fi.Photometry = &pc
+	fi.Config.infof("Photometry: zero point %.2f ± %.2f mag from %d stars, at %.2f\"/px; a pixel value of 1.0 is %.2f mag/arcsec²\n",
+		pc.ZeroPoint, pc.Scatter, len(pc.Stars), pc.ArcsecPerPixel, pc.SurfaceBrightness(1.0))
+
+	if err := fi.writePhotometry(); err != nil {
+		fi.Config.warnf("Photometry: %v\n", err)
+	}
+}
+
+// nearestStar is the detected star closest to pos, if any are within
+// `radius` pixels.
+func nearestStar(stars []Star, pos image.Point, radius int) (Star, bool) {
+	best, bestD2 := Star{}, radius*radius + 1
+	for _, s := range stars {
+		if d := s.Pos.Sub(pos); d.X*d.X + d.Y*d.Y < bestD2 {
+			best, bestD2 = s, d.X*d.X + d.Y*d.Y
+		}
+	}
+	return best, bestD2 <= radius*radius
+}
+
+// starFlux sums the star's luminance over a circular aperture, in the
+// layer it was found in (developed onto the fused scale, as for
+// injectStar), less the sky, from the ring just outside the aperture.
+func (fi *FusedImage)starFlux(star Star, aperture int) (float64, error) {
+	sky := aperture + 3
+	if r := image.Rect(star.Pos.X-sky, star.Pos.Y-sky, star.Pos.X+sky+1, star.Pos.Y+sky+1); !r.In(image.Rectangle{Max: fi.OutputArea.Size()}) {
+		return 0, fmt.Errorf("too near the edge")
+	}
+	develop, err := fi.layerDeveloper(star.Layer)
+	if err != nil {
+		return 0, err
+	}
+
+	sum, n, skySum, skyN := 0.0, 0, 0.0, 0
+	for i:=-sky; i<=sky; i++ {
+		for j:=-sky; j<=sky; j++ {
+			d2 := i*i + j*j
+			if d2 > sky*sky {
+				continue
+			}
+			lum := ecolor.LinearSRGBLuminance(develop(star.Pos.X+i, star.Pos.Y+j))
+			if d2 <= aperture*aperture {
+				sum, n = sum + lum, n+1
+			} else if d2 > (aperture+1)*(aperture+1) {
+				skySum, skyN = skySum + lum, skyN+1
+			}
+		}
+	}
+	flux := sum - float64(n) * skySum / float64(skyN)
+	if flux <= 0.0 {
+		return 0, fmt.Errorf("no brighter than the sky")
+	}
+	return flux, nil
+}
+
+// writePhotometry writes the calibration into the reports dir.
+func (fi *FusedImage)writePhotometry() error {
+	b, err := yaml.Marshal(fi.Photometry)
+	if err != nil {
+		return err
+	}
+	filename := fi.Config.OutputPath(ReportOutput, "photometry.yaml")
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write '%s': %v", filename, err)
+	}
+	return nil
+}
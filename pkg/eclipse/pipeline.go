@@ -0,0 +1,164 @@
+package eclipse
+
+import(
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A PipelineStep is one run of a post-fusion stage, as listed in
+// Config.Pipeline. If there is no pipeline in the config, the stages
+// that are configured run in the usual order (see enhanceStages); if
+// there is one, it says exactly which stages run, and in what order,
+// so stages can be reordered, left out, or run more than once with
+// different settings.
+type PipelineStep struct {
+	Name    string        // Unique name for the step; if empty, the stage
+	Stage   string        // Which stage to run, e.g. `denoise`; if empty, the name
+	After   []string      // Steps that have to run before this one; otherwise steps run in the order listed
+	Params  interface{}   // Settings for this step only, in the same shape as the stage's own block (e.g. `denoise:`), on top of it
+}
+
+func (ps PipelineStep)stage() string {
+	if ps.Stage != "" {
+		return ps.Stage
+	}
+	return ps.Name
+}
+
+func (ps PipelineStep)name() string {
+	if ps.Name != "" {
+		return ps.Name
+	}
+	return ps.Stage
+}
+
+// A plannedStep is a stage that will run, with the config it will see.
+type plannedStep struct {
+	Name    string
+	enhanceStage
+	cfg     Config
+}
+
+// pipelineSteps works out which stages to run, in order.
+func (c Config)pipelineSteps() ([]plannedStep, error) {
+	steps := []plannedStep{}
+	if len(c.Pipeline) == 0 {
+		for _, stage := range enhanceStages {
+			if stage.Enabled(c) {
+				steps = append(steps, plannedStep{stage.Name, stage, c})
+			}
+		}
+		return steps, nil
+	}
+
+	order, err := orderPipeline(c.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	base := c
+	base.Pipeline = nil // the step configs don't need it (and validating them shouldn't recurse)
+	for _, i := range order {
+		ps := c.Pipeline[i]
+		stage, exists := lookupEnhanceStage(ps.stage())
+		if !exists {
+			return nil, fmt.Errorf("step '%s': stage '%s' not recognized, wanted one of %q", ps.name(), ps.stage(), enhanceStageNames())
+		}
+		cfg := base
+		if ps.Params != nil {
+			params := map[string]interface{}{stage.Name: ps.Params}
+			if registeredStages[stage.Name] {
+				params = map[string]interface{}{"extensions": params}
+			}
+			b, err := yaml.Marshal(params)
+			if err == nil {
+				cfg, err = newConfigFromYaml(b, base)
+			}
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("step '%s': params: %v", ps.name(), err)
+			}
+		}
+		if !stage.Enabled(cfg) {
+			key := stage.Name
+			if registeredStages[stage.Name] {
+				key = "extensions." + key
+			}
+			return nil, fmt.Errorf("step '%s': stage '%s' isn't switched on; give the step params, or configure `%s:`",
+				ps.name(), stage.Name, key)
+		}
+		steps = append(steps, plannedStep{ps.name(), stage, cfg})
+	}
+	return steps, nil
+}
+
+// orderPipeline sorts the steps so each one comes after the steps in
+// its `after` list (and otherwise keeps the order they were listed in).
+func orderPipeline(pipeline []PipelineStep) ([]int, error) {
+	index := map[string]int{}
+	for i, ps := range pipeline {
+		if ps.name() == "" {
+			return nil, fmt.Errorf("step %d: needs a name or a stage", i)
+		} else if _, exists := index[ps.name()]; exists {
+			return nil, fmt.Errorf("step '%s': name used more than once; give the steps their own names", ps.name())
+		}
+		index[ps.name()] = i
+	}
+	for _, ps := range pipeline {
+		for _, after := range ps.After {
+			if _, exists := index[after]; !exists {
+				return nil, fmt.Errorf("step '%s': runs after '%s', but there is no such step", ps.name(), after)
+			}
+		}
+	}
+
+	order, done := []int{}, map[int]bool{}
+	for len(order) < len(pipeline) {
+		next := -1
+		for i, ps := range pipeline {
+			if done[i] {
+				continue
+			}
+			ready := true
+			for _, after := range ps.After {
+				ready = ready && done[index[after]]
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			stuck := []string{}
+			for i, ps := range pipeline {
+				if !done[i] {
+					stuck = append(stuck, ps.name())
+				}
+			}
+			return nil, fmt.Errorf("steps %s have a loop in their `after` lists", strings.Join(stuck, ", "))
+		}
+		order = append(order, next)
+		done[next] = true
+	}
+	return order, nil
+}
+
+func lookupEnhanceStage(name string) (enhanceStage, bool) {
+	for _, stage := range enhanceStages {
+		if stage.Name == name {
+			return stage, true
+		}
+	}
+	return enhanceStage{}, false
+}
+
+func enhanceStageNames() []string {
+	names := []string{}
+	for _, stage := range enhanceStages {
+		names = append(names, stage.Name)
+	}
+	return names
+}
@@ -0,0 +1,53 @@
+package eclipse
+
+import(
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOrderPipeline(t *testing.T) {
+	tests := []struct {
+		name      string
+		pipeline  []PipelineStep
+		want      []int
+		wantErr   string // a bit of the error, if there should be one
+	}{
+		{"listed order", []PipelineStep{{Name: "denoise"}, {Name: "hsl"}, {Name: "vignette"}}, []int{0, 1, 2}, ""},
+		{"empty", []PipelineStep{}, []int{}, ""},
+		{"after moves a step later",
+			[]PipelineStep{{Name: "hsl", After: []string{"vignette"}}, {Name: "denoise"}, {Name: "vignette"}},
+			[]int{1, 2, 0}, ""},
+		{"after an earlier step changes nothing",
+			[]PipelineStep{{Name: "denoise"}, {Name: "hsl", After: []string{"denoise"}}},
+			[]int{0, 1}, ""},
+		{"chain",
+			[]PipelineStep{{Name: "c", Stage: "hsl", After: []string{"b"}}, {Name: "b", Stage: "hsl", After: []string{"a"}}, {Name: "a", Stage: "hsl"}},
+			[]int{2, 1, 0}, ""},
+		{"stage as the name",
+			[]PipelineStep{{Stage: "hsl", After: []string{"denoise"}}, {Stage: "denoise"}},
+			[]int{1, 0}, ""},
+		{"no name or stage", []PipelineStep{{Name: "hsl"}, {After: []string{"hsl"}}}, nil, "step 1: needs a name or a stage"},
+		{"duplicate names", []PipelineStep{{Name: "hsl"}, {Stage: "hsl"}}, nil, "step 'hsl': name used more than once"},
+		{"missing after", []PipelineStep{{Name: "hsl", After: []string{"denoise"}}}, nil, "runs after 'denoise', but there is no such step"},
+		{"loop",
+			[]PipelineStep{{Name: "denoise"}, {Name: "a", Stage: "hsl", After: []string{"b"}}, {Name: "b", Stage: "hsl", After: []string{"a"}}},
+			nil, "steps a, b have a loop"},
+		{"self loop", []PipelineStep{{Name: "hsl", After: []string{"hsl"}}}, nil, "steps hsl have a loop"},
+	}
+	for _, test := range tests {
+		got, err := orderPipeline(test.pipeline)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: wanted an error with '%s', got %v", test.name, test.wantErr, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, wanted %v", test.name, got, test.want)
+		}
+	}
+}
@@ -1,54 +1,40 @@
 package eclipse
 
 import(
-	"fmt"
-	"image"
-	"image/color"
-
-	"github.com/mdouchement/hdr/hdrcolor"
-
-	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/estack"
 )
 
-type Pixel struct {
-	OutputPos     image.Point                        // In output coords
-	RawInputs   []color.Color
-	In          []ecolor.CameraNative
-
-	Fused         ecolor.CameraNative                // The single CameraNative pixel fused from the source images
-	DevelopedRGB  hdrcolor.RGB                       // The white balanced, color-corrected HDR RGB value
-	TonemappedRGB color.Color                        // The final LDR output, after HDR->LDR tonemapping
-
-	LayerNumber   int                                // which layer used; or how many layers used
-}
-
-func (p Pixel)String() string {
-	str := fmt.Sprintf("----- Pixel @(%d,%d)-----\n", p.OutputPos.X, p.OutputPos.Y)
-
-	str += fmt.Sprintf("Raw Inputs:-\n")
-	for i:=0; i<len(p.RawInputs); i++ {
-		r, g, b, _ := p.RawInputs[i].RGBA()
-		str += fmt.Sprintf("-- layer %d         : [      0x%04X,       0x%04X,       0x%04X]\n", i, r, g, b)
+// A Pixel is one output pixel of the stack; see pkg/estack, which has
+// the fusers and developers too.
+type Pixel = estack.Pixel
+
+// A PixelFunc fuses or develops a pixel; see estack.PixelFunc.
+type PixelFunc = estack.PixelFunc
+
+// stackSettings are the parts of the config that the fusers and
+// developers see. The white balance has to be settled first (see
+// CalibrateToSolarSpectrum), for the developers.
+func (c Config)stackSettings() estack.Settings {
+	s := estack.Settings{
+		FuserLuminance: c.FuserLuminance,
+		OutputArea:     c.OutputArea,
+		CameraWhite:    c.CameraWhite,
+		CameraToPCS:    c.CameraToPCS,
+		ColorSpace:     c.ColorSpace,
 	}
-
-	str += fmt.Sprintf("CameraNative  Inputs:-\n")
-	for i:=0; i<len(p.In); i++ {
-		str += fmt.Sprintf("-- layer %d         : %s\n", i, p.In[i])
+	for _, o := range c.LayerOverrides {
+		s.Layers = append(s.Layers, estack.LayerSettings{Threshold: o.Threshold, Weight: o.Weight})
 	}
-	str += fmt.Sprintf("\n")
-
-	str += fmt.Sprintf("Fused              : %s (layer# %d)\n", p.Fused, p.LayerNumber)
-	str += fmt.Sprintf("DevelopedRGB       : [%12.10f, %12.10f, %12.10f]\n",
-		p.DevelopedRGB.R, p.DevelopedRGB.G, p.DevelopedRGB.B)
+	return s
+}
 
-	if p.TonemappedRGB != nil {
-		r, g, b, _ := p.TonemappedRGB.RGBA()
-		str += fmt.Sprintf("Output(RGB64)      : [      0x%04X,       0x%04X,       0x%04X]\n", r, g, b)
-		r, g, b = r>>8, g>>8, b>>8
-		str += fmt.Sprintf("Output(RGB32)      : [%12d, %12d, %12d]\n", r, g, b)
+// pixelDeveloper is the config's developer, with the stack settings
+// it needs.
+func (c Config)pixelDeveloper() (func(*Pixel), error) {
+	developer, err := c.GetDeveloper()
+	if err != nil {
+		return nil, err
 	}
-	str += fmt.Sprintf("\n")
-
-	return str
+	settings := c.stackSettings()
+	return func(p *Pixel) { developer(settings, p) }, nil
 }
-
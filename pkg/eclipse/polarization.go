@@ -0,0 +1,240 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// PolarizationConfig asks for maps of how the corona's light is
+// polarized, from photos taken through a polarizer at three or more
+// angles (set per photo, as `images.<file>.polarizer`). At each pixel,
+// the linear brightness of each of those photos is fitted to the Stokes
+// parameters I, Q & U, which give the degree and the angle of the
+// polarization. The maps are written alongside the fused stack, from
+// the aligned photos, in the `stack` and `all` phases.
+type PolarizationConfig struct {
+	Enabled    bool
+	Format     string   // "fits" (the default; one cube of I, Q, U, degree & angle) or "tiff" (a 16 bit TIFF of each)
+	MinSignal  float64  // Where I is below this (as a fraction of the brightest), degree & angle are left at zero; if zero, 0.001
+}
+
+func (pc PolarizationConfig)withDefaults() PolarizationConfig {
+	if pc.Format    == ""  { pc.Format = "fits" }
+	if pc.MinSignal == 0.0 { pc.MinSignal = 0.001 }
+	return pc
+}
+
+// filenames are the files the maps get written to.
+func (pc PolarizationConfig)filenames() []string {
+	if pc.withDefaults().Format == "tiff" {
+		names := []string{}
+		for _, m := range polarizationMapNames {
+			names = append(names, "polarization-" + m + ".tif")
+		}
+		return names
+	}
+	return []string{"polarization.fits"}
+}
+
+var polarizationMapNames = []string{"intensity", "q", "u", "degree", "angle"}
+
+// PolarizationMaps are the results, over the output area, row by row
+// (as for image.Image). Angles are in degrees, in [0, 180), measured
+// the same way as the polarizer angles; pixels that couldn't be
+// measured (too few of the photos were usable there) are all zero.
+type PolarizationMaps struct {
+	Width, Height  int
+	Intensity    []float32  // Stokes I, linear, on the fused image's scale
+	Q, U         []float32
+	Degree       []float32  // sqrt(Q²+U²)/I; noise can take it over 1.0
+	Angle        []float32
+}
+
+// polarizedLayers are the layers that were taken through a polarizer,
+// and the angle of each, in [0, 180).
+func (fi *FusedImage)polarizedLayers() (layers []int, angles []float64) {
+	for i := range fi.Layers {
+		if p := fi.Config.layerOverride(i).Polarizer; p != 0.0 {
+			layers, angles = append(layers, i), append(angles, math.Mod(p, 180.0))
+		}
+	}
+	return layers, angles
+}
+
+// PolarizationMaps fits I, Q & U at every output pixel, by least
+// squares, to the brightness seen through the polarizer at each angle:
+//
+//   v(θ) = ½ (I + Q cos 2θ + U sin 2θ)
+//
+// Clipped pixels (and those beyond the edge of a photo) are left out;
+// a pixel needs three different angles left, for there to be an answer.
+// Brightness is the mean of the camera native channels, so it doesn't
+// depend on the color setup. It needs the photos to be aligned.
+func (fi *FusedImage)PolarizationMaps(ctx context.Context) (*PolarizationMaps, error) {
+	layers, angles := fi.polarizedLayers()
+
+	// Each distinct angle gets a bit, so it's cheap to count how many a
+	// pixel has. A polarizer at θ and θ+180° is the same filter, so they
+	// count as one angle (else 0°, 90° & 180° would look like three, and
+	// give a singular fit).
+	distinct := map[float64]uint64{}
+	bit := make([]uint64, len(angles))
+	for k, a := range angles {
+		key := math.Mod(math.Mod(a, 180.0) + 180.0, 180.0)
+		if _, exists := distinct[key]; !exists && len(distinct) < 64 {
+			distinct[key] = 1 << len(distinct)
+		}
+		bit[k] = distinct[key]
+	}
+	if len(distinct) < 3 {
+		return nil, fmt.Errorf("polarization: needs photos at 3 or more polarizer angles, found %d (set them as `images.<file>.polarizer`)", len(distinct))
+	}
+	cos2, sin2 := make([]float64, len(angles)), make([]float64, len(angles))
+	for k, a := range angles {
+		cos2[k], sin2[k] = math.Cos(2.0 * a * math.Pi / 180.0), math.Sin(2.0 * a * math.Pi / 180.0)
+	}
+	fi.Config.debugf("Polarization: %d photos, at angles %v\n", len(layers), angles)
+
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+	pm := &PolarizationMaps{Width: w, Height: h}
+	pm.Intensity, pm.Q, pm.U = make([]float32, w*h), make([]float32, w*h), make([]float32, w*h)
+	pm.Degree, pm.Angle = make([]float32, w*h), make([]float32, w*h)
+	views := make([]frameView, len(layers))
+	for k, i := range layers {
+		views[k] = frameView{fi, i, fi.commonIllumAtMax(), true}
+	}
+
+	err := eimage.ParallelFor(ctx, fi.Config.NumThreads(), w, func(_, x int) {
+		for y:=0; y<h; y++ {
+			// The normal equations, for [I Q U]; the ½ is taken out at the end
+			var AtA  [9]float64
+			var Atb  [3]float64
+			seen := uint64(0)
+			for k, fv := range views {
+				rgb, usable := fv.at(x, y)
+				if !usable {
+					continue
+				}
+				v := (rgb.R + rgb.G + rgb.B) / 3.0
+				row := [3]float64{1.0, cos2[k], sin2[k]}
+				for i:=0; i<3; i++ {
+					Atb[i] += row[i] * v
+					for j:=0; j<3; j++ {
+						AtA[3*i+j] += row[i] * row[j]
+					}
+				}
+				seen |= bit[k]
+			}
+			if bits.OnesCount64(seen) < 3 {
+				continue
+			}
+			m := emath.Mat3(AtA).Invert()
+			I := 2.0 * (m[0]*Atb[0] + m[1]*Atb[1] + m[2]*Atb[2])
+			Q := 2.0 * (m[3]*Atb[0] + m[4]*Atb[1] + m[5]*Atb[2])
+			U := 2.0 * (m[6]*Atb[0] + m[7]*Atb[1] + m[8]*Atb[2])
+			n := y*w + x
+			pm.Intensity[n], pm.Q[n], pm.U[n] = float32(I), float32(Q), float32(U)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Degree & angle, where there's enough light for them to mean something
+	minI := float64(pm.maxIntensity()) * fi.Config.Polarization.withDefaults().MinSignal
+	for n := range pm.Intensity {
+		I, Q, U := float64(pm.Intensity[n]), float64(pm.Q[n]), float64(pm.U[n])
+		if I <= minI || I <= 0.0 {
+			continue
+		}
+		pm.Degree[n] = float32(math.Sqrt(Q*Q + U*U) / I)
+		angle := 0.5 * math.Atan2(U, Q) * 180.0 / math.Pi
+		if angle < 0.0 {
+			angle += 180.0
+		}
+		if angle >= 180.0 { // -0.0000001 + 180
+			angle = 0.0
+		}
+		pm.Angle[n] = float32(angle)
+	}
+	return pm, nil
+}
+
+func (pm *PolarizationMaps)maxIntensity() float32 {
+	max := float32(0.0)
+	for _, v := range pm.Intensity {
+		if v > max { max = v }
+	}
+	return max
+}
+
+// writePolarization works out the maps, if the config asks for them,
+// and writes them out.
+func (fi *FusedImage)writePolarization(ctx context.Context) error {
+	cfg := fi.Config.Polarization.withDefaults()
+	if !cfg.Enabled {
+		return nil
+	}
+	pm, err := fi.PolarizationMaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	planes := []eio.FITSPlane{
+		{Name: "INTENSITY", Pix: pm.Intensity}, {Name: "Q", Pix: pm.Q}, {Name: "U", Pix: pm.U}, {Name: "DEGREE", Pix: pm.Degree}, {Name: "ANGLE", Pix: pm.Angle},
+	}
+	filenames := cfg.filenames()
+	if cfg.Format == "fits" {
+		filename := fi.Config.OutputPath(FinalOutput, filenames[0])
+		fi.Config.infof("Writing the polarization maps to %s\n", filename)
+		return eio.WriteFITS(filename, pm.Width, pm.Height, planes,
+			eio.FITSComment("Stokes I, Q & U (linear, on the fused image's scale), degree of polarization, angle (degrees)"),
+			eio.FITSComment(fmt.Sprintf("Output area %v, lunar center %v, lunar radius %dpx", fi.OutputArea, fi.Config.LunarCenter, fi.Config.LunarRadius)))
+	}
+
+	// 16 bit TIFFs can't go negative, or over 1.0, so each map is scaled
+	// to fit: I by its max, Q & U over I from [-1,1], degree from [0,1],
+	// angle from [0,180)
+	maxI := pm.maxIntensity()
+	scale := []func(n int) float64{
+		func(n int) float64 { return float64(pm.Intensity[n] / maxI) },
+		func(n int) float64 { return fraction(pm.Q[n], pm.Intensity[n]) },
+		func(n int) float64 { return fraction(pm.U[n], pm.Intensity[n]) },
+		func(n int) float64 { return float64(pm.Degree[n]) },
+		func(n int) float64 { return float64(pm.Angle[n]) / 180.0 },
+	}
+	for p, filename := range filenames {
+		filename = fi.Config.OutputPath(FinalOutput, filename)
+		img := image.NewGray16(image.Rect(0, 0, pm.Width, pm.Height))
+		for n := range pm.Intensity {
+			img.Pix[2*n], img.Pix[2*n+1] = to16Bits(scale[p](n))
+		}
+		fi.Config.debugf("Writing %s\n", filename)
+		if err := eio.WriteTIFF(img, filename); err != nil {
+			return err
+		}
+	}
+	fi.Config.infof("Wrote the polarization maps to %s\n", fi.Config.OutputPath(FinalOutput, "polarization-*.tif"))
+	return nil
+}
+
+// fraction maps q/i from [-1,1] into [0,1].
+func fraction(q, i float32) float64 {
+	if i <= 0.0 {
+		return 0.5
+	}
+	return (float64(q/i) + 1.0) / 2.0
+}
+
+// to16Bits is a [0,1] value (clamped) as big endian 16 bits.
+func to16Bits(v float64) (byte, byte) {
+	u := uint16(math.Round(math.Max(0.0, math.Min(1.0, v)) * 0xFFFF))
+	return byte(u >> 8), byte(u)
+}
@@ -0,0 +1,81 @@
+package eclipse
+
+import(
+	"fmt"
+	"sort"
+)
+
+// Presets are named starting points for the config. A preset is
+// applied on top of NewConfig(), before any conf.yaml or flags, so
+// anything it sets can still be overridden.
+var Presets = map[string]func(*Config){
+	// Small and fast; just to see if the alignment & exposures look OK
+	"quick-preview": func(c *Config) {
+		c.OutputWidthInSolarDiameters = 2.5
+		c.DoFineTunedAlignment = false
+		c.Tonemapper = "reinhard05"
+	},
+
+	// A natural looking HDR composite, with the usual cleanups
+	"classic-hdr": func(c *Config) {
+		c.Fuser = "mostexposed"
+		c.Developer = "dng"
+		c.Tonemapper = "fattal02"
+		c.SkyGradient = SkyGradientConfig{Order: 1}
+		c.Inpaint = InpaintConfig{Enabled: true}
+		c.Denoise = DenoiseConfig{
+			Method: "bilateral",
+			LightnessOnly: true,
+			Strength: RadialProfile{{Radius: 1.2, Value: 0.0}, {Radius: 2.0, Value: 1.0}, {Radius: 4.0, Value: 2.0}},
+		}
+		c.RadialSaturation = RadialProfile{{Radius: 1.0, Value: 1.3}, {Radius: 1.5, Value: 1.0}, {Radius: 3.0, Value: 0.5}}
+	},
+
+	// Bring out the fine coronal streamers, at the expense of a natural
+	// look: strong local contrast, neutral corona, heavy denoising and
+	// not much color away from the prominences.
+	"druckmuller-style": func(c *Config) {
+		c.Fuser = "mostexposed"
+		c.Developer = "dng"
+		c.Tonemapper = "fattal02"
+		c.SkyGradient = SkyGradientConfig{Order: 2}
+		c.Inpaint = InpaintConfig{Enabled: true}
+		c.CoronaWhiteBalance = CoronaWhiteBalanceConfig{Mode: "auto"}
+		c.Denoise = DenoiseConfig{
+			Method: "nlmeans",
+			Strength: RadialProfile{{Radius: 1.1, Value: 0.0}, {Radius: 1.5, Value: 1.0}, {Radius: 4.0, Value: 3.0}},
+		}
+		c.RadialSaturation = RadialProfile{{Radius: 1.0, Value: 1.2}, {Radius: 1.3, Value: 0.6}, {Radius: 2.0, Value: 0.2}}
+		c.Stars = StarsConfig{Enabled: true}
+	},
+
+	// Radiometrically honest output: averaged exposures, calibrated to
+	// the solar spectrum, no enhancement, linear tonemapping into a
+	// linear color space.
+	"scientific-linear": func(c *Config) {
+		c.Fuser = "avg"
+		c.Developer = "dng"
+		c.Tonemapper = "linear"
+		c.WhiteBalance = WhiteBalanceConfig{Mode: "solar"}
+		c.OutputColorSpace = "rec2020-linear"
+	},
+}
+
+func ListPresets() string {
+	names := []string{}
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%v", names)
+}
+
+// ApplyPreset updates the config with the named preset.
+func (c *Config)ApplyPreset(name string) error {
+	preset, exists := Presets[name]
+	if !exists {
+		return fmt.Errorf("preset '%s' not recognized, wanted one of %s", name, ListPresets())
+	}
+	preset(c)
+	return nil
+}
@@ -0,0 +1,50 @@
+package eclipse
+
+import(
+	"context"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// PreviewScale is what `-preview` shrinks the photos by: a quarter of
+// the width and height, so a sixteenth of the pixels.
+const PreviewScale = 4
+
+// withPreview sets up a preview run, with `preview` > 1: the whole
+// pipeline runs, on shrunk copies of the photos (see previewLayer),
+// with bilinear warping (see warpLayer), no fine tuning, and fusion
+// that doesn't keep each pixel's inputs (see planMemory); it takes
+// seconds rather than minutes, so settings can be tried out before the
+// real run. Nothing it does is cached, and its outputs go in a
+// `preview` subdir. The lunar limbs and alignments in the config are
+// for the full size photos, so it finds its own.
+//
+// Settings in pixels (e.g. denoise.radius) aren't scaled, so they do
+// proportionally more in a preview.
+func (c Config)withPreview() Config {
+	if c.Preview <= 1 {
+		return c
+	}
+	c.infof("Preview: at 1/%d size\n", c.Preview)
+	if n := len(c.LunarLimbs) + len(c.Alignments); n > 0 {
+		c.debugf("Preview: not using the %d lunar limbs & alignments from the config\n", n)
+	}
+	c.LunarLimbs = map[string]LunarLimb{}
+	c.Alignments = map[string]AlignmentTransform{}
+	c.DoFineTunedAlignment = false
+	c.CacheDir = ""
+	c.Output.preview = true
+	return c
+}
+
+// previewLayer shrinks a freshly loaded photo, for a preview.
+func (c Config)previewLayer(ctx context.Context, l *Layer) {
+	if c.Preview <= 1 {
+		return
+	}
+	if l.LoadedImage != nil { // i.e. not just the metadata
+		l.LoadedImage = eimage.Shrink(ctx, l.LoadedImage, c.Preview, 1) // the photos load in parallel
+		l.Image = l.LoadedImage
+	}
+	l.Dims = l.Dims.Div(c.Preview)
+}
@@ -0,0 +1,130 @@
+package eclipse
+
+import(
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// CoronaProfileConfig asks for the corona's radial brightness profile:
+// its average brightness in rings around the sun's center, against the
+// distance out in solar radii. It's taken from the linear stack, as it
+// comes out of fusion (before any enhancements or tonemapping), so
+// the falloff can be plotted against coronal models.
+type CoronaProfileConfig struct {
+	Enabled    bool
+	Step       float64  // Width of each ring, in solar radii; if zero, 0.05
+	MaxRadius  float64  // How far out to go, in solar radii; if zero, as far as the image goes
+	Format     string   // "csv" (the default) or "json"
+}
+
+func (cfg CoronaProfileConfig)filename() string {
+	if cfg.Format == "json" {
+		return "corona-profile.json"
+	}
+	return "corona-profile.csv"
+}
+
+// A ProfileRing is the average of the pixels in one ring around the
+// sun. Clipped pixels aren't in the averages.
+type ProfileRing struct {
+	Radius     float64  `json:"radius"`     // The middle of the ring, in solar radii
+	R          float64  `json:"r"`          // Linear RGB, in the output color space
+	G          float64  `json:"g"`
+	B          float64  `json:"b"`
+	Luminance  float64  `json:"luminance"`
+	StdDev     float64  `json:"stddev"`     // Of the luminance
+	Pixels     int      `json:"pixels"`
+	Clipped    int      `json:"clipped"`
+}
+
+// CoronaProfile bins the fused pixels by their distance from the
+// sun's center (from the solar radius out), and averages each ring.
+// It needs the lunar limb.
+func (fi *FusedImage)CoronaProfile() []ProfileRing {
+	cfg := fi.Config.CoronaProfile
+	if cfg.Step == 0.0 { cfg.Step = 0.05 }
+
+	type sums struct{ r, g, b, lum, lum2 float64; n, clipped int }
+	rings := []sums{}
+	for x:=0; x<fi.OutputArea.Dx(); x++ {
+		for y:=0; y<fi.OutputArea.Dy(); y++ {
+			r := fi.SolarRadii(x, y)
+			if r < 1.0 || (cfg.MaxRadius > 0.0 && r >= cfg.MaxRadius) {
+				continue
+			}
+			i := int((r - 1.0) / cfg.Step)
+			for len(rings) <= i {
+				rings = append(rings, sums{})
+			}
+			p := fi.Pix(x, y)
+			if p.Clipped {
+				rings[i].clipped++
+				continue
+			}
+			lum := ecolor.LinearSRGBLuminance(p.DevelopedRGB)
+			s := &rings[i]
+			s.r, s.g, s.b = s.r + p.DevelopedRGB.R, s.g + p.DevelopedRGB.G, s.b + p.DevelopedRGB.B
+			s.lum, s.lum2 = s.lum + lum, s.lum2 + lum*lum
+			s.n++
+		}
+	}
+
+	profile := make([]ProfileRing, len(rings))
+	for i, s := range rings {
+		ring := ProfileRing{Radius: 1.0 + (float64(i) + 0.5) * cfg.Step, Pixels: s.n, Clipped: s.clipped}
+		if s.n > 0 {
+			n := float64(s.n)
+			ring.R, ring.G, ring.B, ring.Luminance = s.r/n, s.g/n, s.b/n, s.lum/n
+			ring.StdDev = math.Sqrt(math.Max(0.0, s.lum2/n - ring.Luminance*ring.Luminance))
+		}
+		profile[i] = ring
+	}
+	return profile
+}
+
+// writeCoronaProfile writes out the profile, if the config asks for it.
+func (fi *FusedImage)writeCoronaProfile() error {
+	cfg := fi.Config.CoronaProfile
+	if !cfg.Enabled || !fi.needsLunarLimb("coronaprofile") {
+		return nil
+	}
+	profile := fi.CoronaProfile()
+	filename := fi.Config.OutputPath(FinalOutput, cfg.filename())
+	fi.Config.infof("Writing the corona's radial profile (%d rings) to %s\n", len(profile), filename)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("corona profile: %v", err)
+	}
+	defer f.Close()
+
+	if cfg.Format == "json" {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			LunarRadius  int            `json:"lunar_radius_px"` // How many pixels a solar radius is
+			IllumAtMax   float64        `json:"illum_at_max"`    // Lux for a value of 1.0
+			Rings        []ProfileRing  `json:"rings"`
+		}{fi.Config.LunarRadius, fi.IllumAtMax, profile})
+	} else {
+		w := csv.NewWriter(f)
+		w.Write([]string{"radius", "r", "g", "b", "luminance", "stddev", "pixels", "clipped"})
+		num := func(v float64) string { return strconv.FormatFloat(v, 'g', 8, 64) }
+		for _, ring := range profile {
+			w.Write([]string{num(ring.Radius), num(ring.R), num(ring.G), num(ring.B), num(ring.Luminance), num(ring.StdDev),
+				strconv.Itoa(ring.Pixels), strconv.Itoa(ring.Clipped)})
+		}
+		w.Flush()
+		err = w.Error()
+	}
+	if err != nil {
+		return fmt.Errorf("corona profile %s: %v", filename, err)
+	}
+	return f.Close()
+}
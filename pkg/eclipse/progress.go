@@ -0,0 +1,145 @@
+package eclipse
+
+import(
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The progress lines only go to stderr if it is a terminal (so they
+// don't clutter up log files); this is set once, as the program starts.
+var stderrIsTerminal = isTerminal(os.Stderr)
+
+// A Progress hears about the slow stages (loading, limb finding,
+// alignment, fusion, denoising, etc) as they run, so e.g. a GUI can
+// show how far along things are. A stage counts off its units of work
+// (photos, columns, etc); StageProgress is called at most a few times
+// a second per stage, and again when the last unit is done. Stages can
+// run inside others (e.g. each layer's fine tuning, inside "Aligning"),
+// and calls can come from many goroutines.
+type Progress interface {
+	StageStarted(stage string, total int)
+	StageProgress(stage string, done, total int)
+	StageFinished(stage string, elapsed time.Duration)
+}
+
+// A stageProgress counts off the work for one stage, and passes it on
+// to the Progress. It is safe to call Add from many goroutines, and for
+// a nil stageProgress.
+type stageProgress struct {
+	Stage     string
+	Total     int
+
+	sink      Progress
+	mu        sync.Mutex
+	done      int
+	start     time.Time
+	lastSent  time.Time
+}
+
+// newProgress starts a stage, reporting to the config's Progress; if
+// there isn't one, to the terminal, unless the messages are going to a
+// logger (whose output the progress lines would get mixed into).
+func (c Config)newProgress(stage string, total int) *stageProgress {
+	p := &stageProgress{Stage: stage, Total: total, sink: c.Progress, start: time.Now()}
+	if p.sink == nil && stderrIsTerminal && c.logger() == nil {
+		p.sink = terminal
+	}
+	if p.sink != nil {
+		p.sink.StageStarted(stage, total)
+	}
+	return p
+}
+
+// Add records that `n` more units of work are done.
+func (p *stageProgress)Add(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	if p.sink == nil || (time.Since(p.lastSent) < 250 * time.Millisecond && p.done < p.Total) {
+		return
+	}
+	p.lastSent = time.Now()
+	p.sink.StageProgress(p.Stage, p.done, p.Total)
+}
+
+// Done finishes off the stage.
+func (p *stageProgress)Done() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = p.Total
+	if p.sink != nil {
+		p.sink.StageFinished(p.Stage, time.Since(p.start))
+	}
+}
+
+// TerminalProgress is the Progress that the command uses: a single
+// self-overwriting line on stderr, with an ETA.
+type TerminalProgress struct {
+	mu        sync.Mutex
+	stages    map[string]terminalStage
+}
+
+type terminalStage struct {
+	start     time.Time
+	total     int
+}
+
+var terminal = &TerminalProgress{}
+
+func (t *TerminalProgress)StageStarted(stage string, total int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stages == nil {
+		t.stages = map[string]terminalStage{}
+	}
+	t.stages[stage] = terminalStage{time.Now(), total}
+	t.print(progressLine(stage, 0, total, 0))
+}
+
+func (t *TerminalProgress)StageProgress(stage string, done, total int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.print(progressLine(stage, done, total, time.Since(t.stages[stage].start)))
+}
+
+func (t *TerminalProgress)StageFinished(stage string, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := t.stages[stage].total
+	delete(t.stages, stage)
+	t.print(progressLine(stage, total, total, elapsed))
+	fmt.Fprintf(os.Stderr, "\n")
+}
+
+func (t *TerminalProgress)print(line string) {
+	fmt.Fprintf(os.Stderr, "\r%-70s", line)
+}
+
+func progressLine(stage string, done, total int, elapsed time.Duration) string {
+	if total <= 0 {
+		return fmt.Sprintf("%s: %d done, %s", stage, done, elapsed.Round(time.Second))
+	}
+
+	frac := float64(done) / float64(total)
+	str := fmt.Sprintf("%s: %d/%d (%5.1f%%)", stage, done, total, 100.0 * frac)
+	if done >= total {
+		return str + fmt.Sprintf(", took %s", elapsed.Round(time.Second))
+	} else if done > 0 {
+		eta := time.Duration(float64(elapsed) / frac) - elapsed
+		return str + fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return str
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode() & os.ModeCharDevice != 0
+}
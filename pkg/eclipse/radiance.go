@@ -0,0 +1,111 @@
+package eclipse
+
+import(
+	"fmt"
+	"image/color"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// isoSaturation is K in the ISO 12232 saturation based speed, Lsat = K
+// N²/(S t): the luminance (cd/m²) that just saturates a sensor of ISO
+// speed S, at f/N for t seconds.
+const isoSaturation = 78.0
+
+// RadianceConfig asks for the stack in physical units: luminance, in
+// cd/m², from the photos' exposures and the camera's sensitivity. It's
+// written straight after fusion, before any enhancements, so ratios of
+// brightness between parts of the corona mean something.
+type RadianceConfig struct {
+	Enabled         bool
+	Format          string   // "fits" (the default; R, G, B & luminance planes) or "hdr" (Radiance RGBE)
+	Saturation      float64  // K in Lsat = K N²/(S t), for this camera; if zero, from its camera profile, or else 78 (as in ISO 12232)
+	ExactExposures  bool     // Scale each photo by its exact ISO, aperture & shutter speed when fusing, rather than its EV in whole stops
+}
+
+func (rc RadianceConfig)filename() string {
+	if rc.Format == "hdr" {
+		return "radiance.hdr"
+	}
+	return "radiance.fits"
+}
+
+// saturation is the K to use, and where it came from.
+func (fi *FusedImage)saturation() (float64, string) {
+	if k := fi.Config.Radiance.Saturation; k > 0.0 {
+		return k, "radiance.saturation"
+	} else if cp, model, exists := fi.lookupCameraProfile(); exists && cp.Saturation > 0.0 {
+		return cp.Saturation, "the camera profile for " + model
+	}
+	return isoSaturation, "ISO 12232"
+}
+
+// RadianceScale is what to multiply the fused pixels by, to get them in
+// cd/m². A value of 1.0 saturates the sensor at fi.IllumAtMax (which is
+// 2.5 lux x N²/t x 100/S; see ExposureValue.ExactIlluminance), so
+// the luminance for it is K N²/(S t) = K x IllumAtMax / 250.
+func (fi *FusedImage)RadianceScale() float64 {
+	k, _ := fi.saturation()
+	return k * fi.IllumAtMax / 250.0
+}
+
+// writeRadiance writes the fused pixels, scaled to cd/m², if the config
+// asks for it. It has to come before any enhancements.
+func (fi *FusedImage)writeRadiance() error {
+	cfg := fi.Config.Radiance
+	if !cfg.Enabled {
+		return nil
+	}
+	scale := fi.RadianceScale()
+	k, from := fi.saturation()
+	filename := fi.Config.OutputPath(FinalOutput, cfg.filename())
+	fi.Config.infof("Writing the radiance map to %s; 1.0 is %.4g cd/m² (saturation constant %g, from %s)\n", filename, scale, k, from)
+	if !cfg.ExactExposures {
+		for _, l := range fi.Layers {
+			if l.ExactIlluminance() != l.IlluminanceAtMaxExposure {
+				fi.Config.infof("Radiance: the photos' exposures are in whole stops (e.g. %s is really %.0f lux), see radiance.exactexposures\n",
+					l.Filename(), l.ExactIlluminance())
+				break
+			}
+		}
+	}
+
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+	if cfg.Format == "hdr" {
+		if err := eio.WriteHDR(&radianceImage{fi, scale}, filename); err != nil {
+			return fmt.Errorf("radiance: %v", err)
+		}
+		return nil
+	}
+
+	r, g, b, lum := make([]float32, w*h), make([]float32, w*h), make([]float32, w*h), make([]float32, w*h)
+	for x:=0; x<w; x++ {
+		for y:=0; y<h; y++ {
+			p := fi.Pix(x, y).DevelopedRGB
+			n := y*w + x
+			r[n], g[n], b[n] = float32(p.R * scale), float32(p.G * scale), float32(p.B * scale)
+			lum[n] = float32(ecolor.LinearSRGBLuminance(p) * scale)
+		}
+	}
+	planes := []eio.FITSPlane{{Name: "R", Pix: r}, {Name: "G", Pix: g}, {Name: "B", Pix: b}, {Name: "LUMINANCE", Pix: lum}}
+	return eio.WriteFITS(filename, w, h, planes,
+		eio.FITSCard{Key: "BUNIT", Value: "'cd/m2'", Comment: "Luminance"},
+		eio.FITSCard{Key: "SATCONST", Value: fmt.Sprintf("%g", k), Comment: "K in Lsat = K N^2/(S t)"},
+		eio.FITSCard{Key: "ILLUMMAX", Value: fmt.Sprintf("%g", fi.IllumAtMax), Comment: "The exposure (lux) the stack is scaled to"},
+		eio.FITSComment("Linear RGB in the output color space (" + fi.Config.ColorSpace.Name + "), and its luminance"))
+}
+
+// A radianceImage is the fused image, scaled to cd/m², for eio.WriteHDR.
+type radianceImage struct {
+	*FusedImage
+	scale  float64
+}
+
+func (ri *radianceImage)At(x, y int) color.Color { return ri.HDRAt(x, y) }
+func (ri *radianceImage)HDRAt(x, y int) hdrcolor.Color {
+	p := ri.Pix(x, y).DevelopedRGB
+	return hdrcolor.RGB{R: p.R * ri.scale, G: p.G * ri.scale, B: p.B * ri.scale}
+}
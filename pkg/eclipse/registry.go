@@ -0,0 +1,139 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"sort"
+
+	"github.com/mdouchement/hdr/tmo"
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/estack"
+)
+
+// Other Go code can add its own algorithms, by registering them under
+// a name (from an init() func, before anything runs); the config then
+// picks them by that name, just like the built-in ones:
+//
+//   RegisterFuser         fuser: <name>          how to stack the exposures into one HDR pixel
+//   RegisterDeveloper     developer: <name>      how to develop the fused pixel's color
+//   RegisterLimbDetector  limbdetector: <name>   how to find the lunar limb in a photo
+//   RegisterTonemapper    tonemapper: <name>     how to tonemap from HDR to LDR
+//   RegisterStage         pipeline: [...]        a post-fusion filter, run by Enhance()
+//
+// To build them into the eclipse-hdr command, import the package for
+// its side effects in cmd/eclipse-hdr/plugins.go.
+
+// A LimbDetector finds the lunar limb in a photo. It should give up
+// (with ctx.Err()) if ctx is cancelled.
+type LimbDetector func(ctx context.Context, cfg Config, img image.Image) (LunarLimb, error)
+
+// A TonemapperFunc sets up a tonemapping operator over the fused image.
+type TonemapperFunc func(fi *FusedImage) tmo.ToneMappingOperator
+
+// A registered post-fusion stage gets its settings from its own entry
+// under `extensions:` in the config (or from a pipeline step's params),
+// which it can read with Config.ExtensionConfig. If it returns an
+// error, the run stops there; it should give up (with ctx.Err()) if
+// ctx is cancelled.
+type StageFunc func(ctx context.Context, fi *FusedImage) error
+
+var(
+	fusers = map[string]PixelFunc{
+		"mostexposed": estack.FuseByPickMostExposed,
+		"sector":      estack.FuseBySector,
+		"avg":         estack.FuseByAverage,
+	}
+	developers = map[string]PixelFunc{
+		"layer": estack.DevelopByLayer,
+		"dng":   estack.DevelopByDNG,
+		"wb":    estack.DevelopByWhiteBalanceOnly,
+		"mono":  estack.DevelopByMono,
+		"":      estack.DevelopByNone,
+	}
+	limbDetectors = map[string]LimbDetector{
+		"floodfill": FindLunarLimb,
+	}
+	tonemapperFuncs = map[string]TonemapperFunc{}
+	registeredStages = map[string]bool{} // The ones that take their settings from `extensions:`
+)
+
+func RegisterFuser(name string, f PixelFunc) {
+	mustBeNew("fuser", name, fusers[name] != nil)
+	fusers[name] = f
+}
+
+func RegisterDeveloper(name string, f PixelFunc) {
+	mustBeNew("developer", name, developers[name] != nil)
+	developers[name] = f
+}
+
+func RegisterLimbDetector(name string, f LimbDetector) {
+	mustBeNew("limb detector", name, limbDetectors[name] != nil)
+	limbDetectors[name] = f
+}
+
+// RegisterTonemapper adds a tonemapper; it is also run by `tonemapper: all`.
+func RegisterTonemapper(name string, f TonemapperFunc) {
+	mustBeNew("tonemapper", name, tonemapperFuncs[name] != nil || name == "all" || contains(Tonemappers, name))
+	tonemapperFuncs[name] = f
+	Tonemappers = append(Tonemappers, name)
+	sort.Strings(Tonemappers)
+}
+
+// RegisterStage adds a post-fusion stage. Without a pipeline in the
+// config, it runs (after the built-in stages) when the config has an
+// entry for it under `extensions:`; a pipeline can run it anywhere.
+func RegisterStage(name string, run StageFunc) {
+	_, exists := lookupEnhanceStage(name)
+	mustBeNew("stage", name, exists || contains(hookStages, name))
+	enabled := func(c Config) bool { _, exists := c.Extensions[name]; return exists }
+	enhanceStages = append(enhanceStages, enhanceStage{name, enabled, run})
+	registeredStages[name] = true
+}
+
+// Registering happens as the program starts, so a clash is a bug in
+// the plugin.
+func mustBeNew(kind, name string, exists bool) {
+	if exists {
+		panic(fmt.Sprintf("eclipse: %s '%s' is already registered", kind, name))
+	}
+}
+
+func sortedNames[T any](m map[string]T) []string {
+	names := []string{}
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtensionConfig decodes the settings for a registered stage (or
+// other extension) from its entry under `extensions:`, into v (which
+// should be a pointer to a struct with yaml tags, or similar). It
+// leaves v alone if there is no entry.
+func (c Config)ExtensionConfig(name string, v interface{}) error {
+	settings, exists := c.Extensions[name]
+	if !exists || settings == nil {
+		return nil
+	}
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("extensions.%s: %v", name, err)
+	}
+	if err := yaml.UnmarshalStrict(b, v); err != nil {
+		return fmt.Errorf("extensions.%s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A RenditionConfig asks for an extra, resized copy of each
+// tonemapped output; e.g. a small one for the web.
+type RenditionConfig struct {
+	Name   string  // Added to the output filename, e.g. tmo-fattal02-web.png
+	Width  int     // In pixels; the height keeps the aspect ratio
+}
+
+// writeRenditions writes out a resized copy of `img` for each configured rendition.
+func (fi *FusedImage)writeRenditions(img image.Image, basename string) {
+	for _, r := range fi.Config.Renditions {
+		if r.Width <= 0 || r.Name == "" {
+			fi.Config.warnf("Rendition %+v needs a name and a width, skipping\n", r)
+			continue
+		}
+		h := int(math.Round(float64(r.Width) * float64(img.Bounds().Dy()) / float64(img.Bounds().Dx())))
+		filename := fmt.Sprintf("%s-%s.png", basename, r.Name)
+		fi.Config.debugf("Writing %dx%d rendition %s\n", r.Width, h, filename)
+		cfg, path, w := fi.Config, fi.Config.OutputPath(FinalOutput, filename), r.Width
+		cfg.outputs.write(func() error { // the resizing happens in the background too
+			if err := cfg.writePNG(ResizeLanczos(img, w, h, cfg.ColorSpace), path); err != nil {
+				fi.Config.warnf("Rendition %s: %v\n", filename, err)
+			}
+			return nil
+		})
+	}
+}
+
+// ResizeLanczos resamples an image (encoded with the transfer curve of
+// color space `cs`) to the new size, using a Lanczos3 filter. The
+// resampling is done in linear light, so that fine bright detail (like
+// coronal streamers on a dark sky) doesn't get dimmed by averaging
+// gamma-encoded values.
+func ResizeLanczos(src image.Image, w, h int, cs ecolor.OutputColorSpace) image.Image {
+	const lobes = 3.0
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	// Decode into linear floats
+	lin := make([][3]float64, sw*sh)
+	for y:=0; y<sh; y++ {
+		for x:=0; x<sw; x++ {
+			r, g, bl, _ := src.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			lin[y*sw+x] = [3]float64{
+				cs.Decode(float64(r)/0xFFFF),
+				cs.Decode(float64(g)/0xFFFF),
+				cs.Decode(float64(bl)/0xFFFF),
+			}
+		}
+	}
+
+	// resample1D resamples `n` values read via `get`, into `m` values
+	resample1D := func(n, m int, get func(i int) [3]float64, set func(j int, v [3]float64)) {
+		scale := float64(n) / float64(m)
+		support := lobes * math.Max(1.0, scale) // widen the kernel when shrinking
+		for j:=0; j<m; j++ {
+			center := (float64(j) + 0.5) * scale - 0.5
+			lo, hi := int(math.Floor(center - support)), int(math.Ceil(center + support))
+			tot, totW := [3]float64{}, 0.0
+			for i:=lo; i<=hi; i++ {
+				wt := emath.Lanczos((float64(i) - center) / math.Max(1.0, scale), lobes)
+				if wt == 0 {
+					continue
+				}
+				ii := i
+				if ii < 0 { ii = 0 }
+				if ii >= n { ii = n-1 }
+				v := get(ii)
+				tot[0], tot[1], tot[2] = tot[0] + wt*v[0], tot[1] + wt*v[1], tot[2] + wt*v[2]
+				totW += wt
+			}
+			set(j, [3]float64{tot[0]/totW, tot[1]/totW, tot[2]/totW})
+		}
+	}
+
+	// Horizontal pass, then vertical
+	tmp := make([][3]float64, w*sh)
+	for y:=0; y<sh; y++ {
+		resample1D(sw, w, func(i int) [3]float64 { return lin[y*sw+i] }, func(j int, v [3]float64) { tmp[y*w+j] = v })
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, w, h))
+	encode := func(f float64) uint16 {
+		f = cs.Encode(math.Max(0.0, math.Min(1.0, f)))
+		return uint16(math.Round(f * 0xFFFF))
+	}
+	for x:=0; x<w; x++ {
+		resample1D(sh, h, func(i int) [3]float64 { return tmp[i*w+x] }, func(j int, v [3]float64) {
+			dst.SetRGBA64(x, j, color.RGBA64{encode(v[0]), encode(v[1]), encode(v[2]), 0xFFFF})
+		})
+	}
+
+	return dst
+}
@@ -0,0 +1,136 @@
+package eclipse
+
+import(
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// Review steps through the frames in the terminal, after lunar limb
+// detection and alignment but before the expensive stacking, showing
+// a sketch of each photo with its detected limb, and the numbers. For
+// each frame the user can accept it, reject it (it gets excluded), or
+// flag it for a manual fix (it gets listed at the top of the output
+// file, so its limb or alignment can be fixed by hand). Frames that
+// look like outliers are pointed out.
+//
+// It returns the yaml for a config snapshot with the decisions in it;
+// pass that on to `eclipse-hdr stack`.
+func (fi *FusedImage)Review(in io.Reader, out io.Writer) ([]byte, error) {
+	if err := fi.needLayers("review"); err != nil {
+		return nil, err
+	}
+	decisions := make([]string, len(fi.Layers)) // "", accept, reject, flag
+	radii := []float64{}
+	for _, l := range fi.Layers {
+		radii = append(radii, float64(l.LunarLimb.Radius()))
+	}
+	medianRadius := medianOf(radii)
+
+	scanner := bufio.NewScanner(in)
+	for i:=0; i<len(fi.Layers); {
+		fmt.Fprint(out, fi.reviewFrame(i, medianRadius, decisions[i]))
+		fmt.Fprint(out, "[a]ccept [r]eject [f]lag [b]ack [q]uit (accept the rest) [x] abandon > ")
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("review: input ended")
+		}
+		switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+		case "a", "": decisions[i] = "accept"; i++
+		case "r":     decisions[i] = "reject"; i++
+		case "f":     decisions[i] = "flag"; i++
+		case "b":     if i > 0 { i-- }
+		case "q":     i = len(fi.Layers)
+		case "x":     return nil, fmt.Errorf("review: abandoned")
+		default:      fmt.Fprintf(out, "?\n")
+		}
+	}
+
+	return fi.reviewResults(decisions)
+}
+
+func (fi *FusedImage)reviewFrame(i int, medianRadius float64, decision string) string {
+	l := fi.Layers[i]
+	lines := []string{"", fmt.Sprintf("=== Frame %d/%d: %s  [%s]", i+1, len(fi.Layers), l.Filename(), decision)}
+	lines = append(lines, asciiSketch(l, 48, 24)...)
+	lines = append(lines, fmt.Sprintf("  exposure: %s, %s", l.ExposureValue, l.CaptureTime.Format("15:04:05")))
+
+	ll := l.LunarLimb
+	note := ""
+	if r := float64(ll.Radius()); len(fi.Layers) >= 3 && math.Abs(r - medianRadius) > fi.Config.LimbRadiusTolerance * medianRadius {
+		note = fmt.Sprintf("   <- SUSPECT: median radius is %.0f", medianRadius)
+	}
+	lines = append(lines, fmt.Sprintf("  lunar limb: center %v, radius %d, brightness 0x%04x%s", ll.Center(), ll.Radius(), ll.Brightness, note))
+	if fs := ll.Frame; fs.Pixels > 0 {
+		lines = append(lines, fmt.Sprintf("  levels: median 0x%04x, 99%% 0x%04x, saturated %.2f%%",
+			fs.Percentile(50), fs.Percentile(99), 100 * fs.SaturatedFraction()))
+	}
+
+	if i == 0 {
+		lines = append(lines, "  alignment: this is the base frame; the others are aligned onto it")
+	} else {
+		xf := l.AlignmentTransform
+		lines = append(lines, fmt.Sprintf("  alignment: translate (%.2f, %.2f), rotate %.3fdeg, error %.4g",
+			xf.TranslateByX, xf.TranslateByY, xf.RotateByDeg, xf.ErrorMetric))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// asciiSketch draws the area around the lunar limb (3 radii each way)
+// as text, with the detected limb drawn in as `o`.
+func asciiSketch(l Layer, w, h int) []string {
+	ramp := " .:-=+*#%@"
+	if l.LoadedImage == nil || l.LunarLimb.Radius() == 0 {
+		return []string{"  (no image)"}
+	}
+	c, r := l.LunarLimb.Center(), float64(l.LunarLimb.Radius())
+	bounds := l.LoadedImage.Bounds()
+	lines := []string{}
+	for y:=0; y<h; y++ {
+		line := "  "
+		for x:=0; x<w; x++ {
+			// Terminal chars are about twice as tall as they are wide
+			dx := (float64(x) - float64(w)/2) / float64(w/2) * 3 * r
+			dy := (float64(y) - float64(h)/2) / float64(h/2) * 3 * r
+			px, py := c.X + int(dx), c.Y + int(dy)
+			if d := math.Hypot(dx, dy); math.Abs(d - r) < 3 * r / float64(h) {
+				line += "o"
+			} else if px < bounds.Min.X || px >= bounds.Max.X || py < bounds.Min.Y || py >= bounds.Max.Y {
+				line += " "
+			} else {
+				v := math.Sqrt(float64(eimage.GrayU16At(l.LoadedImage, px, py)) / 0xFFFF) // shows the faint corona
+				line += string(ramp[int(v * float64(len(ramp)-1))])
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// reviewResults is a config snapshot with the rejected frames excluded,
+// and a header that lists the flagged frames.
+func (fi *FusedImage)reviewResults(decisions []string) ([]byte, error) {
+	cfg := fi.Config
+	cfg.Images = mergeMaps(cfg.Images, nil) // don't touch the original
+	header := []string{"# Written by `eclipse-hdr review`"}
+	nRejected := 0
+	for i, l := range fi.Layers {
+		switch decisions[i] {
+		case "reject":
+			o := cfg.Images[l.Filename()]
+			o.Exclude = true
+			cfg.Images[l.Filename()] = o
+			nRejected++
+		case "flag":
+			header = append(header, fmt.Sprintf("# FLAGGED %s; fix its entries under lunarlimbs (and alignments), or exclude it", l.Filename()))
+		}
+	}
+	if nRejected == len(fi.Layers) {
+		return nil, fmt.Errorf("review: every frame was rejected")
+	}
+	header = append(header, fmt.Sprintf("# %d frames, %d rejected", len(fi.Layers), nRejected), "")
+	return append([]byte(strings.Join(header, "\n")), []byte(cfg.AsYaml())...), nil
+}
@@ -0,0 +1,154 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// A Pipeline is the way to use eclipse-hdr from other Go programs: it
+// loads the photos and configs, and runs a phase (by default, all of
+// them: detect, align, stack, enhance and then writes the outputs), in
+// just the same way as the command does.
+//
+//   fi, err := eclipse.NewPipeline(
+//     eclipse.WithInputs("eclipse2024/"),
+//     eclipse.WithPreset("druckmuller-style"),
+//     eclipse.WithSettings("output.dir=/tmp/out"),
+//   ).Run(ctx)
+type Pipeline struct {
+	inputs     []string
+	photos     []Photo  // Instead of inputs, to run in memory
+	config     Config
+	overrides  []string
+	configure  []func(*Config)
+	phase      string
+	err        error    // From an option, reported by Run
+}
+
+// A PipelineOption sets up part of a Pipeline; see the With* funcs.
+// They apply in order, so e.g. WithPreset should come after WithConfig.
+type PipelineOption func(*Pipeline)
+
+func NewPipeline(opts ...PipelineOption) *Pipeline {
+	p := &Pipeline{config: NewConfig(), phase: "all"}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// WithInputs adds photos, dirs of photos, conf.yaml files, and HDR
+// files from earlier phases, just like the command's args.
+func WithInputs(args ...string) PipelineOption {
+	return func(p *Pipeline) { p.inputs = append(p.inputs, args...) }
+}
+
+// WithPhotos runs the pipeline in memory, on photos that are already
+// decoded, instead of on files: nothing is read or written (the config
+// comes from WithConfig, WithPreset and WithSettings), and the result
+// is only in the returned FusedImage; use its Render method to get a
+// tonemapped image. It can't be used along with WithInputs.
+func WithPhotos(photos ...Photo) PipelineOption {
+	return func(p *Pipeline) { p.photos = append(p.photos, photos...) }
+}
+
+// WithConfig starts from this config, instead of the defaults. Any
+// conf.yaml inputs are loaded on top of it.
+func WithConfig(c Config) PipelineOption {
+	return func(p *Pipeline) { p.config = c }
+}
+
+// WithPreset starts from one of the presets (see ListPresets).
+func WithPreset(name string) PipelineOption {
+	return func(p *Pipeline) {
+		if err := p.config.ApplyPreset(name); err != nil && p.err == nil {
+			p.err = err
+		}
+	}
+}
+
+// WithSettings adds `key=value` settings, as for `-set`; they are
+// applied after any conf.yaml inputs.
+func WithSettings(settings ...string) PipelineOption {
+	return func(p *Pipeline) { p.overrides = append(p.overrides, settings...) }
+}
+
+// WithConfigFunc calls fn on the config once everything is loaded,
+// just before the run; it gets the last word.
+func WithConfigFunc(fn func(*Config)) PipelineOption {
+	return func(p *Pipeline) { p.configure = append(p.configure, fn) }
+}
+
+// WithDebugSink sends the debug images (see DebugSink) somewhere;
+// without it, they aren't drawn.
+func WithDebugSink(sink DebugSink) PipelineOption {
+	return WithConfigFunc(func(c *Config) { c.DebugSink = sink })
+}
+
+// WithProgress sends progress reports for the slow stages (loading
+// onwards) to prog, instead of the terminal.
+func WithProgress(prog Progress) PipelineOption {
+	return func(p *Pipeline) { p.config.Progress = prog }
+}
+
+// WithLogger sends the run's messages and events to l, as records
+// with the message and `stage` & `frame` attrs (where there is one),
+// instead of to the default logger (see SetDefaultLogger); its handler
+// decides which levels to keep (e.g. by LogLevel). There is no progress
+// line on the terminal, unless WithProgress asks for one.
+func WithLogger(l *slog.Logger) PipelineOption {
+	return func(p *Pipeline) { p.config.Logger = l }
+}
+
+// WithMetrics sends each stage's timing and memory metrics to the
+// exporter (see ExpvarMetrics), as well as into the run manifest.
+func WithMetrics(exporter MetricsExporter) PipelineOption {
+	return func(p *Pipeline) { p.config.Metrics = exporter }
+}
+
+// WithPhase runs just one phase (see Phases), instead of all of them.
+func WithPhase(phase string) PipelineOption {
+	return func(p *Pipeline) {
+		if !IsPhase(phase) && p.err == nil {
+			p.err = fmt.Errorf("phase '%s' not recognized, wanted %s", phase, ListPhases())
+		}
+		p.phase = phase
+	}
+}
+
+// Run loads everything and runs the phase (in memory, if there are
+// photos from WithPhotos; see RunInMemory). It returns the image, with
+// its pixels, so the caller can do more with it. If ctx is cancelled
+// (or times out), it stops as soon as it can, and returns ctx.Err().
+func (p *Pipeline)Run(ctx context.Context) (*FusedImage, error) {
+	if p.err != nil {
+		return nil, p.err
+	} else if len(p.photos) > 0 && len(p.inputs) > 0 {
+		return nil, fmt.Errorf("can't have both photos in memory (WithPhotos) and inputs (WithInputs)")
+	}
+
+	fi := NewFusedImage()
+	fi.Config = p.config.Clone() // So the same Pipeline can Run more than once at a time
+	fi.Overrides = p.overrides
+	inMemory := len(p.photos) > 0
+	if inMemory {
+		if err := fi.LoadPhotos(ctx, p.photos...); err != nil {
+			return nil, err
+		}
+	} else if err := fi.LoadFilesAndDirs(ctx, p.inputs...); err != nil {
+		return nil, err
+	}
+	for _, fn := range p.configure {
+		fn(&fi.Config)
+	}
+
+	run := fi.RunPhase
+	if inMemory {
+		run = fi.RunInMemory
+	}
+	if err := run(ctx, p.phase); err != nil {
+		return nil, err
+	}
+	return &fi, nil
+}
@@ -0,0 +1,20 @@
+package eclipse
+
+import(
+	"github.com/abworrall/eclipse-hdr/pkg/eenhance"
+)
+
+// AdjustRadialSaturation scales the saturation of each developed
+// pixel by an amount that depends on how far it is from the sun, as
+// given by `Config.RadialSaturation`. This lets the prominences keep
+// (or boost) their color, while damping down the chroma noise that
+// shows up in the faint outer corona.
+func (fi *FusedImage)AdjustRadialSaturation() {
+	if !fi.needsLunarLimb("RadialSaturation") {
+		return
+	}
+	profile := fi.Config.RadialSaturation
+	fi.Config.infof("Adjusting saturation by radius: %v\n", profile)
+
+	fi.adjustPixels(eenhance.RadialSaturation(profile))
+}
@@ -0,0 +1,165 @@
+package eclipse
+
+import(
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config.Select picks out which photos to use by their metadata,
+// rather than by listing files. Each entry is a predicate like
+// `exposure >= 1/500`, and a photo has to match all of them:
+//
+//   exposure  shutter speed in seconds; e.g. 1/500, 0.002, 2
+//   iso       e.g. 800
+//   aperture  the f-number; e.g. 5.6
+//   ev        the exposure value (after any override in Config.Images)
+//   time      the EXIF capture time; either a time of day (18:17:30),
+//             or a date and time (2024-04-08 18:17:30), in camera time
+//   camera    the EXIF camera model (only == and !=)
+//
+// The comparisons are <, <=, >, >=, == and !=.
+var selectFields = []string{"exposure", "iso", "aperture", "ev", "time", "camera"}
+
+type framePredicate struct {
+	field  string
+	op     string
+	value  string
+}
+
+func (p framePredicate)String() string { return p.field + " " + p.op + " " + p.value }
+
+func parsePredicate(s string) (framePredicate, error) {
+	for _, op := range []string{"<=", ">=", "==", "!=", "<", ">"} { // the two-char ops first
+		if i := strings.Index(s, op); i >= 0 {
+			p := framePredicate{
+				field: strings.ToLower(strings.TrimSpace(s[:i])),
+				op:    op,
+				value: strings.TrimSpace(s[i+len(op):]),
+			}
+			return p, p.check()
+		}
+	}
+	return framePredicate{}, fmt.Errorf("'%s': no comparison, wanted e.g. `iso <= 800`", s)
+}
+
+// check makes sure the value makes sense for the field.
+func (p framePredicate)check() error {
+	var err error
+	switch p.field {
+	case "exposure":       _, err = parseExposureTime(p.value)
+	case "iso", "ev":      _, err = strconv.Atoi(p.value)
+	case "aperture":       _, err = strconv.ParseFloat(strings.TrimPrefix(p.value, "f/"), 64)
+	case "time":           _, err = parseSelectTime(p.value, time.Time{})
+	case "camera":
+		if p.op != "==" && p.op != "!=" {
+			err = fmt.Errorf("camera can only be compared with == or !=")
+		}
+	default:
+		err = fmt.Errorf("field '%s' not recognized, wanted one of %q", p.field, selectFields)
+	}
+	if err != nil {
+		return fmt.Errorf("'%s': %v", p, err)
+	}
+	return nil
+}
+
+// matches says whether the photo passes. (The value was checked when
+// the predicate was parsed.)
+func (p framePredicate)matches(l Layer) bool {
+	cmp := 0
+	switch p.field {
+	case "exposure":
+		v, _ := parseExposureTime(p.value)
+		cmp = compareFloats(float64(l.ShutterSpeed[0]) / float64(l.ShutterSpeed[1]), v)
+	case "iso":
+		v, _ := strconv.Atoi(p.value)
+		cmp = compareFloats(float64(l.ISO), float64(v))
+	case "ev":
+		v, _ := strconv.Atoi(p.value)
+		cmp = compareFloats(float64(l.EV), float64(v))
+	case "aperture":
+		v, _ := strconv.ParseFloat(strings.TrimPrefix(p.value, "f/"), 64)
+		cmp = compareFloats(float64(l.ApertureX10) / 10.0, v)
+	case "time":
+		if l.CaptureTime.IsZero() {
+			return false // can't tell, so be safe
+		}
+		v, _ := parseSelectTime(p.value, l.CaptureTime)
+		cmp = l.CaptureTime.Compare(v)
+	case "camera":
+		if l.CameraModel != p.value {
+			cmp = 1
+		}
+	}
+
+	switch p.op {
+	case "<":  return cmp < 0
+	case "<=": return cmp <= 0
+	case ">":  return cmp > 0
+	case ">=": return cmp >= 0
+	case "==": return cmp == 0
+	case "!=": return cmp != 0
+	}
+	return false
+}
+
+// compareFloats is like strings.Compare, but allows for the rounding
+// in values like 1/3 (which might be 0.3 in the EXIF data).
+func compareFloats(a, b float64) int {
+	if d := a - b; d > 1e-3 * math.Abs(b) {
+		return 1
+	} else if d < -1e-3 * math.Abs(b) {
+		return -1
+	}
+	return 0
+}
+
+// parseExposureTime parses 1/500, 0.002, 2 etc.
+func parseExposureTime(s string) (float64, error) {
+	if num, denom, found := strings.Cut(s, "/"); found {
+		n, err1 := strconv.ParseFloat(num, 64)
+		d, err2 := strconv.ParseFloat(denom, 64)
+		if err1 != nil || err2 != nil || d == 0 {
+			return 0, fmt.Errorf("bad exposure time '%s'", s)
+		}
+		return n / d, nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad exposure time '%s'", s)
+	}
+	return v, nil
+}
+
+// parseSelectTime parses a time of day (which is taken to be on the
+// same day as `on`), or a full date and time, in the same timezone as
+// `on` (EXIF times are in camera time, with no zone).
+func parseSelectTime(s string, on time.Time) (time.Time, error) {
+	loc := on.Location()
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006:01:02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			y, m, d := on.Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, loc), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time '%s', wanted 18:17:30 or 2024-04-08 18:17:30", s)
+}
+
+// selectPhoto returns "" if the photo passes all of the predicates in
+// Config.Select, else the one it failed.
+func (c Config)selectPhoto(l Layer) string {
+	for _, s := range c.Select {
+		if p, err := parsePredicate(s); err == nil && !p.matches(l) {
+			return p.String()
+		}
+	}
+	return ""
+}
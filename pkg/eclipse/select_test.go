@@ -0,0 +1,104 @@
+package eclipse
+
+import(
+	"testing"
+	"time"
+)
+
+func TestParsePredicate(t *testing.T) {
+	tests := []struct {
+		in                    string
+		field, op, value      string
+		wantErr               bool
+	}{
+		{"iso <= 800", "iso", "<=", "800", false},
+		{"iso<=800", "iso", "<=", "800", false}, // not `<` with a value of "=800"
+		{"ISO >= 800", "iso", ">=", "800", false},
+		{"exposure == 1/500", "exposure", "==", "1/500", false},
+		{"camera != NIKON Df", "camera", "!=", "NIKON Df", false},
+		{"aperture < f/5.6", "aperture", "<", "f/5.6", false},
+		{"time > 18:17:30", "time", ">", "18:17:30", false},
+		{"ev > 3", "ev", ">", "3", false},
+		{"iso 800", "", "", "", true},
+		{"speed < 2", "", "", "", true},
+		{"camera < NIKON Df", "", "", "", true},
+		{"exposure < 1/0", "", "", "", true},
+		{"iso >= lots", "", "", "", true},
+		{"time < noon", "", "", "", true},
+	}
+	for _, test := range tests {
+		p, err := parsePredicate(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': wanted an error, got %s", test.in, p)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("'%s': %v", test.in, err)
+			continue
+		}
+		if p.field != test.field || p.op != test.op || p.value != test.value {
+			t.Errorf("'%s': got [%s] [%s] [%s], wanted [%s] [%s] [%s]", test.in, p.field, p.op, p.value, test.field, test.op, test.value)
+		}
+	}
+}
+
+func TestPredicateMatches(t *testing.T) {
+	l := Layer{
+		CameraModel:   "NIKON Df",
+		CaptureTime:   time.Date(2024, 4, 8, 18, 17, 30, 0, time.UTC),
+		ExposureValue: ExposureValue{ISO: 800, ApertureX10: 56, ShutterSpeed: rat64{1, 500}, EV: 9},
+	}
+	tests := []struct {
+		in    string
+		want  bool
+	}{
+		{"iso <= 800", true},
+		{"iso < 800", false},
+		{"iso >= 800", true},
+		{"iso > 800", false},
+		{"iso == 800", true},
+		{"iso != 800", false},
+		{"exposure == 0.002", true},
+		{"exposure >= 1/250", false},
+		{"exposure < 1/250", true},
+		{"aperture == f/5.6", true},
+		{"aperture > 8", false},
+		{"ev >= 9", true},
+		{"ev < 9", false},
+		{"time > 18:17", true},
+		{"time <= 18:17:29", false},
+		{"time == 2024-04-08 18:17:30", true},
+		{"time < 2024-04-07 18:17:30", false},
+		{"camera == NIKON Df", true},
+		{"camera != NIKON Df", false},
+		{"camera == Canon EOS R5", false},
+	}
+	for _, test := range tests {
+		p, err := parsePredicate(test.in)
+		if err != nil {
+			t.Errorf("'%s': %v", test.in, err)
+			continue
+		}
+		if got := p.matches(l); got != test.want {
+			t.Errorf("'%s': got %v, wanted %v", test.in, got, test.want)
+		}
+	}
+
+	// No capture time means the time predicates can't pass
+	if p, _ := parsePredicate("time != 18:17"); p.matches(Layer{}) {
+		t.Errorf("'%s' matched a photo with no capture time", p)
+	}
+}
+
+func TestSelectPhoto(t *testing.T) {
+	l := Layer{ExposureValue: ExposureValue{ISO: 800, ApertureX10: 56, ShutterSpeed: rat64{1, 500}}}
+	cfg := Config{Select: []string{"iso >= 400", "exposure <= 1/500"}}
+	if failed := cfg.selectPhoto(l); failed != "" {
+		t.Errorf("photo failed '%s', wanted it to pass", failed)
+	}
+	cfg.Select = append(cfg.Select, "aperture>=8")
+	if failed := cfg.selectPhoto(l); failed != "aperture >= 8" {
+		t.Errorf("photo failed '%s', wanted 'aperture >= 8'", failed)
+	}
+}
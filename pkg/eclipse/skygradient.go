@@ -0,0 +1,58 @@
+package eclipse
+
+import(
+	"image"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eenhance"
+)
+
+// SkyGradientConfig controls the removal of a smooth background
+// gradient from the fused image; twilight sky near the horizon, or
+// thin cloud, can leave one side of the frame brighter than the other.
+type SkyGradientConfig struct {
+	Order          int      // 0 (off), 1 (a plane), or 2 (a quadratic surface)
+	ExcludeRadius  float64  // Don't fit to pixels closer than this to the sun, in solar radii; if zero, 3.0
+	SampleStep     int      // Only fit to every Nth pixel in each direction; if zero, 8
+}
+
+// RemoveSkyGradient fits a low order 2D polynomial to the sky (see
+// eenhance.FitSkyGradient), staying clear of the sun and corona, and
+// subtracts it from the whole image.
+func (fi *FusedImage)RemoveSkyGradient() {
+	cfg := fi.Config.SkyGradient
+	if cfg.ExcludeRadius == 0.0 { cfg.ExcludeRadius = 3.0 }
+	if cfg.SampleStep == 0 { cfg.SampleStep = 8 }
+	if cfg.Order > 2 {
+		fi.Config.warnf("SkyGradient: order %d too high, using 2\n", cfg.Order)
+		cfg.Order = 2
+	}
+
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+
+	samples := []image.Point{}
+	for x:=0; x<w; x+=cfg.SampleStep {
+		for y:=0; y<h; y+=cfg.SampleStep {
+			if r := fi.SolarRadii(x, y); r >= 0 && r < cfg.ExcludeRadius {
+				continue
+			}
+			samples = append(samples, image.Point{x, y})
+		}
+	}
+	if len(samples) < 10 {
+		fi.Config.warnf("SkyGradient: only %d sky samples outside %.1f solar radii, skipping\n", len(samples), cfg.ExcludeRadius)
+		return
+	}
+
+	g, err := eenhance.FitSkyGradient(developedImage{fi}, cfg.Order, samples)
+	if err != nil {
+		fi.Config.warnf("SkyGradient: fit failed: %v\n", err)
+		return
+	}
+
+	fi.Config.infof("SkyGradient: fitted order %d over %d samples; R%v G%v B%v\n", cfg.Order, len(samples),
+		g.Coeffs[0], g.Coeffs[1], g.Coeffs[2])
+
+	fi.forEachPixel("", func(x, y int, p *Pixel) {
+		p.DevelopedRGB = g.Remove(p.DevelopedRGB, x, y)
+	})
+}
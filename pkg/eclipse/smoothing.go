@@ -0,0 +1,158 @@
+package eclipse
+
+import(
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// AlignmentSmoothingConfig fits a smooth curve, over capture time, to
+// the frames' alignment transforms (their translation and rotation,
+// relative to the base frame): over a minute or two of totality the
+// camera drifts, and the moon moves across the sun, steadily, so most
+// of the frame to frame differences between the fitted transforms are
+// noise. With Replace, the frames are warped by the fitted transforms
+// instead (all of them, or just those further than Tolerance from the
+// fit), which takes the jitter out of the timelapse; without it, the
+// fit is only reported.
+type AlignmentSmoothingConfig struct {
+	Enabled    bool
+	Degree     int      // Of the polynomial in time; if zero, 2 (the drift speeding up or slowing down)
+	Replace    bool     // Warp the frames by the fitted transforms
+	Tolerance  float64  // With Replace, only the frames more than this many pixels from the fit; if zero, all of them
+}
+
+func (sc AlignmentSmoothingConfig)withDefaults() AlignmentSmoothingConfig {
+	if sc.Degree == 0 { sc.Degree = 2 }
+	return sc
+}
+
+// smoothAlignments fits the curve to the layers' transforms, and (with
+// Replace) re-warps the frames whose transforms it replaces. Frames
+// without a capture time are left alone. The fit is robust to a frame
+// or two that's badly off: it's done twice, the second time without
+// the frames that were more than 3 sigma (by the MAD) off the first.
+func (fi *FusedImage)smoothAlignments(ctx context.Context) error {
+	cfg := fi.Config.AlignmentSmoothing.withDefaults()
+	if !cfg.Enabled || len(fi.Layers) < 2 {
+		return nil
+	}
+	defer fi.measureStage(ctx, "smoothing")()
+
+	timed := []int{}
+	for i, l := range fi.Layers {
+		if !l.CaptureTime.IsZero() {
+			timed = append(timed, i)
+		}
+	}
+	if len(timed) < cfg.Degree + 2 {
+		fi.Config.warnf("Alignment smoothing: %d frames have a capture time, but a degree %d fit needs at least %d; not smoothing\n",
+			len(timed), cfg.Degree, cfg.Degree + 2)
+		return nil
+	}
+
+	// Time, scaled into [-1,1], to keep the fit well conditioned
+	start, end := fi.Layers[timed[0]].CaptureTime, fi.Layers[timed[0]].CaptureTime
+	for _, i := range timed {
+		t := fi.Layers[i].CaptureTime
+		if t.Before(start) { start = t }
+		if t.After(end)    { end = t }
+	}
+	half := end.Sub(start).Seconds() / 2.0
+	if half == 0.0 {
+		fi.Config.warnf("Alignment smoothing: the frames all have the same capture time; not smoothing\n")
+		return nil
+	}
+	tOf := func(i int) float64 { return fi.Layers[i].CaptureTime.Sub(start).Seconds() / half - 1.0 }
+	powers := func(t float64) []float64 {
+		row := make([]float64, cfg.Degree + 1)
+		for k := range row {
+			row[k] = math.Pow(t, float64(k))
+		}
+		return row
+	}
+	eval := func(c []float64, t float64) float64 {
+		v := 0.0
+		for k, p := range powers(t) {
+			v += c[k] * p
+		}
+		return v
+	}
+	components := func(i int) [3]float64 { // the base frame's transform is zero
+		xf := fi.Layers[i].AlignmentTransform
+		return [3]float64{xf.TranslateByX, xf.TranslateByY, xf.RotateByDeg}
+	}
+
+	fit := func(use []int) ([3][]float64, error) {
+		coeffs := [3][]float64{}
+		for ch := 0; ch < 3; ch++ {
+			rows, vals := [][]float64{}, []float64{}
+			for _, i := range use {
+				rows, vals = append(rows, powers(tOf(i))), append(vals, components(i)[ch])
+			}
+			c, err := emath.LeastSquares(rows, vals)
+			if err != nil {
+				return coeffs, err
+			}
+			coeffs[ch] = c
+		}
+		return coeffs, nil
+	}
+	// How far off a frame is, in pixels: the translation, plus the
+	// rotation's movement at the lunar limb
+	radius := float64(fi.Layers[0].LunarLimb.Radius())
+	offBy := func(coeffs [3][]float64, i int) float64 {
+		c, t := components(i), tOf(i)
+		return math.Hypot(c[0] - eval(coeffs[0], t), c[1] - eval(coeffs[1], t)) +
+			math.Abs(c[2] - eval(coeffs[2], t)) * math.Pi / 180.0 * radius
+	}
+
+	coeffs, err := fit(timed)
+	if err != nil {
+		return fmt.Errorf("alignment smoothing: %v", err)
+	}
+	offs := []float64{}
+	for _, i := range timed {
+		offs = append(offs, offBy(coeffs, i))
+	}
+	mad := medianOf(offs) * 1.4826
+	inliers := []int{}
+	for j, i := range timed {
+		if offs[j] <= math.Max(3.0 * mad, 0.5) {
+			inliers = append(inliers, i)
+		}
+	}
+	if len(inliers) >= cfg.Degree + 2 && len(inliers) < len(timed) {
+		if coeffs, err = fit(inliers); err != nil {
+			return fmt.Errorf("alignment smoothing: %v", err)
+		}
+	}
+
+	sumSq, replaced := 0.0, 0
+	for _, i := range timed {
+		l := &fi.Layers[i]
+		off, t := offBy(coeffs, i), tOf(i)
+		sumSq += off * off
+		fi.Config.debugf("Alignment smoothing: %s is %.2fpx off the fit\n", l.Filename(), off)
+		if !cfg.Replace || i == 0 || off <= cfg.Tolerance {
+			continue
+		}
+		xf := l.AlignmentTransform
+		xf.TranslateByX, xf.TranslateByY, xf.RotateByDeg = eval(coeffs[0], t), eval(coeffs[1], t), eval(coeffs[2], t)
+		fi.Config.timeEvent("smoothing", l.CaptureTime, "frame", l.Filename(), "offby", off,
+			"translatex", xf.TranslateByX, "translatey", xf.TranslateByY, "rotatedeg", xf.RotateByDeg)
+		if p, ok := l.Image.(*eimage.Planar); ok {
+			p.Release()
+		}
+		l.AlignmentTransform = xf
+		fi.Config.warpLayer(ctx, l)
+		fi.Config.Alignments[xf.Name] = xf // so later phases get the smoothed one
+		replaced++
+	}
+	fi.Config.infof("Alignment smoothing: a degree %d fit to %d frames (%d used), RMS %.2fpx off it; replaced %d transforms\n",
+		cfg.Degree, len(timed), len(inliers), math.Sqrt(sumSq / float64(len(timed))), replaced)
+	return ctx.Err()
+}
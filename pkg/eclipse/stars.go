@@ -0,0 +1,208 @@
+package eclipse
+
+import(
+	"image"
+	"sort"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// StarsConfig controls the detection of background stars in the long
+// exposures, and their re-injection into the final image. Fusion tends
+// to pick shorter exposures away from the dark sky, which lose the
+// faint stars, so we put them back.
+type StarsConfig struct {
+	Enabled      bool
+	Layers       int      // How many of the longest exposures to look for stars in; if zero, 1
+	Threshold    uint16   // How much brighter than local background a peak must be (gray [0,0xFFFF]); if zero, 0x0400
+	MinRadius    float64  // Ignore anything closer to the sun than this, in solar radii; if zero, 1.5
+	PatchRadius  int      // Radius (pixels) of the patch copied around each star; if zero, 3
+	Gain         float64  // How much to enhance the star over the background; if zero, 1.5
+	MaxStars     int      // Only keep the brightest N stars; if zero, 200
+}
+
+// A Star is a point source found in one of the layers.
+type Star struct {
+	Pos        image.Point  // In output coords
+	Peak       uint16       // Gray value of the brightest pixel
+	Background uint16       // Gray value of the surrounding sky
+	Layer      int          // Which layer it was found in
+}
+
+func (sc StarsConfig)withDefaults() StarsConfig {
+	if sc.Layers      == 0   { sc.Layers = 1 }
+	if sc.Threshold   == 0   { sc.Threshold = 0x0400 }
+	if sc.MinRadius   == 0.0 { sc.MinRadius = 1.5 }
+	if sc.PatchRadius == 0   { sc.PatchRadius = 3 }
+	if sc.Gain        == 0.0 { sc.Gain = 1.5 }
+	if sc.MaxStars    == 0   { sc.MaxStars = 200 }
+	return sc
+}
+
+// OverlayStars detects stars in the longest exposures, and adds them
+// back into the developed HDR image. The layers are already aligned
+// (using the corona alignment), so the star positions line up with
+// the fused image.
+func (fi *FusedImage)OverlayStars() {
+	if !fi.needsLunarLimb("Stars") {
+		return
+	}
+	cfg := fi.Config.Stars.withDefaults()
+
+	fi.Stars = fi.DetectStars(cfg)
+	fi.Config.infof("Stars: found %d stars, re-injecting with gain %.1f\n", len(fi.Stars), cfg.Gain)
+
+	for _, star := range fi.Stars {
+		fi.injectStar(cfg, star)
+	}
+}
+
+// DetectStars looks for small sharp peaks in the dark sky, well away
+// from the sun. A star is a local maximum that is much brighter than
+// the ring of sky around it.
+func (fi *FusedImage)DetectStars(cfg StarsConfig) []Star {
+	stars := []Star{}
+	ring := cfg.PatchRadius + 2
+	photo := fi.PhotoArea.Sub(fi.InputArea.Min).Inset(ring) // not in the framing's border
+
+	for i:=0; i<cfg.Layers && i<len(fi.Layers); i++ {
+		w := fi.InputArea.Dx()
+		gray := eimage.GrayPlaneU16(fi.Layers[i].Image, fi.InputArea) // in output coords
+		at := func(x, y int) uint16 {
+			return gray[y*w + x]
+		}
+
+		for x:=ring; x<fi.OutputArea.Dx()-ring; x++ {
+			for y:=ring; y<fi.OutputArea.Dy()-ring; y++ {
+				if fi.SolarRadii(x, y) < cfg.MinRadius || !(image.Point{x, y}).In(photo) {
+					continue
+				}
+
+				peak := at(x, y)
+				if peak < cfg.Threshold || !isLocalMax(at, x, y, peak) {
+					continue
+				}
+
+				bg := ringAverage(at, x, y, ring)
+				if int(peak) < int(bg) + int(cfg.Threshold) { // as ints, as a bright sky overflows
+					continue
+				}
+
+				stars = append(stars, Star{Pos: image.Point{x, y}, Peak: peak, Background: bg, Layer: i})
+			}
+		}
+	}
+
+	// The same star will show up in each layer; keep the brightest
+	// detection of each. The ones kept so far are put in cells `ring`
+	// wide, so only the cells around a star need checking.
+	excess := func(s Star) int { return int(s.Peak) - int(s.Background) }
+	sort.SliceStable(stars, func(i, j int) bool { return excess(stars[i]) > excess(stars[j]) })
+	unique := []Star{}
+	cells := map[image.Point][]Star{}
+	for _, s := range stars {
+		cell := image.Point{s.Pos.X / ring, s.Pos.Y / ring}
+		dupe := false
+		for k:=0; k<9 && !dupe; k++ {
+			for _, u := range cells[cell.Add(image.Point{k%3 - 1, k/3 - 1})] {
+				if d := s.Pos.Sub(u.Pos); d.X*d.X + d.Y*d.Y <= ring*ring {
+					dupe = true
+					break
+				}
+			}
+		}
+		if !dupe {
+			unique = append(unique, s)
+			cells[cell] = append(cells[cell], s)
+		}
+		if len(unique) >= cfg.MaxStars {
+			break
+		}
+	}
+
+	return unique
+}
+
+func isLocalMax(at func(x, y int) uint16, x, y int, val uint16) bool {
+	for i:=-2; i<=2; i++ {
+		for j:=-2; j<=2; j++ {
+			if (i != 0 || j != 0) && at(x+i, y+j) > val {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ringAverage averages the values around the edge of the square of
+// width `2r+1` centered on [x,y].
+func ringAverage(at func(x, y int) uint16, x, y, r int) uint16 {
+	tot, n := 0, 0
+	for i:=-r; i<=r; i++ {
+		tot += int(at(x+i, y-r)) + int(at(x+i, y+r)) + int(at(x-r, y+i)) + int(at(x+r, y+i))
+		n += 4
+	}
+	return uint16(tot / n)
+}
+
+// injectStar develops the patch around the star from the layer it
+// was found in, and adds its excess over the local sky back into the
+// fused pixels.
+func (fi *FusedImage)injectStar(cfg StarsConfig, star Star) {
+	develop, err := fi.layerDeveloper(star.Layer)
+	if err != nil {
+		fi.Config.warnf("stars: %v, skipping star at %v\n", err, star.Pos)
+		return
+	}
+
+	// Estimate the sky in the layer, so we only add the star itself
+	r := cfg.PatchRadius + 2
+	bg := hdrcolor.RGB{}
+	for i:=-r; i<=r; i++ {
+		for _, pt := range []image.Point{{star.Pos.X+i, star.Pos.Y-r}, {star.Pos.X+i, star.Pos.Y+r}} {
+			c := develop(pt.X, pt.Y)
+			bg.R, bg.G, bg.B = bg.R + c.R, bg.G + c.G, bg.B + c.B
+		}
+	}
+	n := float64(2 * (2*r+1))
+	bg.R, bg.G, bg.B = bg.R/n, bg.G/n, bg.B/n
+
+	for x:=star.Pos.X-cfg.PatchRadius; x<=star.Pos.X+cfg.PatchRadius; x++ {
+		for y:=star.Pos.Y-cfg.PatchRadius; y<=star.Pos.Y+cfg.PatchRadius; y++ {
+			c := develop(x, y)
+			p := fi.PixRW(x, y)
+			p.DevelopedRGB.R += cfg.Gain * positive(c.R - bg.R)
+			p.DevelopedRGB.G += cfg.Gain * positive(c.G - bg.G)
+			p.DevelopedRGB.B += cfg.Gain * positive(c.B - bg.B)
+		}
+	}
+}
+
+// layerDeveloper returns a func that develops the layer's pixel at
+// [x,y] (in output coords) as if it had been fused, so it is on the
+// same scale as the fused pixels.
+func (fi *FusedImage)layerDeveloper(i int) (func(x, y int) hdrcolor.RGB, error) {
+	layer := fi.Layers[i]
+	develop, err := fi.Config.pixelDeveloper()
+	if err != nil {
+		return nil, err
+	}
+	return func(x, y int) hdrcolor.RGB {
+		p := Pixel{}
+		p.Fused = ecolor.CameraNative{IllumAtMax: layer.ExposureValue.IlluminanceAtMaxExposure}
+		p.Fused.R, p.Fused.G, p.Fused.B = eimage.PixelRGB(layer.Image, x + fi.InputArea.Min.X, y + fi.InputArea.Min.Y)
+		p.Fused.AdjustIllumAtMax(fi.IllumAtMax)
+		develop(&p)
+		return p.DevelopedRGB
+	}, nil
+}
+
+func positive(f float64) float64 {
+	if f < 0.0 {
+		return 0.0
+	}
+	return f
+}
@@ -0,0 +1,212 @@
+package eclipse
+
+import(
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// StreamersConfig asks for a report on the coronal streamers: the
+// bright rays that reach out from the sun. They are found in a ring at
+// `radius`, as position angles where the enhanced image is brighter
+// than the corona's median brightness at that distance, and followed
+// outwards for as long as they stay that way. Position angles are from
+// north through east, with north as in Annotation.NorthAngle.
+type StreamersConfig struct {
+	Enabled    bool
+	Radius     float64  // Where to look for them, in solar radii; if zero, 2.0
+	Threshold  float64  // How much brighter than the median a streamer must be; if zero, 1.25 (i.e. 25%)
+}
+
+func (sc StreamersConfig)withDefaults() StreamersConfig {
+	if sc.Radius    == 0.0 { sc.Radius = 2.0 }
+	if sc.Threshold == 0.0 { sc.Threshold = 1.25 }
+	return sc
+}
+
+// A Streamer is one of the coronal streamers, as measured.
+type Streamer struct {
+	PositionAngle  float64  // Of its brightest part, in degrees from north through east
+	Width          float64  // Full width at half maximum (over the median), in degrees, at the search radius
+	Extent         float64  // How far out it can be followed, in solar radii
+	Contrast       float64  // Its peak brightness, over the median, at the search radius
+}
+
+// A StreamerReport is what goes into `streamers.yaml`, in the reports
+// dir; the time & place come from the annotation config, so reports
+// from different sites can be lined up.
+type StreamerReport struct {
+	Timestamp   string    `yaml:",omitempty"`
+	Location    string    `yaml:",omitempty"`
+	NorthAngle  float64
+	Radius      float64
+	Threshold   float64
+	Streamers []Streamer
+}
+
+// streamerStep is how far apart the samples are, in solar radii, both
+// across the search band and going outwards.
+const streamerStep = 0.05
+
+// FindStreamers measures the streamers in the developed pixels. It needs
+// the lunar limb.
+func (fi *FusedImage)FindStreamers() []Streamer {
+	cfg := fi.Config.Streamers.withDefaults()
+
+	// The relative brightness at each degree of position angle, in a
+	// band around the search radius; NaN where it's off the image
+	rel := fi.ringContrast(cfg.Radius - 2*streamerStep, cfg.Radius + 2*streamerStep)
+	if rel == nil {
+		fi.Config.warnf("Streamers: the ring at %.1f solar radii is mostly off the image\n", cfg.Radius)
+		return nil
+	}
+
+	// A streamer is a run of degrees over the threshold (which may wrap around north)
+	above := func(pa int) bool { v := rel[(pa+360) % 360]; return !math.IsNaN(v) && v >= cfg.Threshold }
+	start := 0
+	for start < 360 && above(start) {
+		start++
+	}
+	if start == 360 {
+		fi.Config.warnf("Streamers: the ring at %.1f solar radii is uniformly bright, nothing to measure\n", cfg.Radius)
+		return nil
+	}
+
+	streamers := []Streamer{}
+	for i:=0; i<360; i++ {
+		pa := (start + i) % 360
+		if !above(pa) || above(pa-1) {
+			continue
+		}
+		run := []int{}
+		for j:=pa; above(j); j++ {
+			run = append(run, j % 360)
+		}
+		streamers = append(streamers, fi.measureStreamer(cfg, rel, run))
+	}
+	sort.Slice(streamers, func(i, j int) bool { return streamers[i].PositionAngle < streamers[j].PositionAngle })
+	return streamers
+}
+
+// measureStreamer works out a streamer's peak, width & extent, from
+// the run of position angles where it is over the threshold.
+func (fi *FusedImage)measureStreamer(cfg StreamersConfig, rel []float64, run []int) Streamer {
+	peak := run[0]
+	for _, pa := range run {
+		if rel[pa] > rel[peak] {
+			peak = pa
+		}
+	}
+	s := Streamer{PositionAngle: float64(peak), Contrast: rel[peak]}
+
+	half := 1.0 + (rel[peak] - 1.0) / 2.0
+	for _, pa := range run {
+		if rel[pa] >= half {
+			s.Width++
+		}
+	}
+
+	// Follow it out, a step at a time, over its central degrees
+	lo, hi := float64(peak) - s.Width/2.0, float64(peak) + s.Width/2.0
+	s.Extent = cfg.Radius
+	for r := cfg.Radius + streamerStep; ; r += streamerStep {
+		ring := fi.ringContrast(r, r + streamerStep)
+		if ring == nil {
+			break
+		}
+		sum, n := 0.0, 0
+		for pa := math.Floor(lo); pa <= math.Ceil(hi); pa++ {
+			if v := ring[(int(pa)+360) % 360]; !math.IsNaN(v) {
+				sum, n = sum + v, n+1
+			}
+		}
+		if n == 0 || sum / float64(n) < cfg.Threshold {
+			break
+		}
+		s.Extent = math.Round((r + streamerStep) * 100) / 100 // not 4.69999999
+	}
+	return s
+}
+
+// ringContrast is the brightness at each degree of position angle, in
+// the band between the two radii (in solar radii), over the median of
+// them all. It is nil if too much of the band is off the image.
+func (fi *FusedImage)ringContrast(inner, outer float64) []float64 {
+	theta0 := fi.Config.Annotation.NorthAngle * math.Pi / 180.0
+	cx, cy, radius := float64(fi.Config.LunarCenter.X), float64(fi.Config.LunarCenter.Y), float64(fi.Config.LunarRadius)
+	bounds := fi.Bounds().Sub(fi.Bounds().Min)
+
+	vals := make([]float64, 360)
+	onImage := []float64{}
+	for pa := range vals {
+		sum, n := 0.0, 0
+		for r := inner; r <= outer; r += streamerStep / 2 {
+			for sub := -0.25; sub <= 0.25; sub += 0.5 { // two samples across each degree
+				// As for the annotation labels; position angle goes counterclockwise
+				theta := theta0 + (float64(pa) + sub) * math.Pi / 180.0
+				x := int(math.Round(cx - math.Sin(theta) * r * radius))
+				y := int(math.Round(cy - math.Cos(theta) * r * radius))
+				if x < bounds.Min.X || y < bounds.Min.Y || x >= bounds.Max.X || y >= bounds.Max.Y {
+					continue
+				}
+				sum += ecolor.LinearSRGBLuminance(fi.Pix(x, y).DevelopedRGB)
+				n++
+			}
+		}
+		if n == 0 {
+			vals[pa] = math.NaN()
+			continue
+		}
+		vals[pa] = sum / float64(n)
+		onImage = append(onImage, vals[pa])
+	}
+	if len(onImage) < 180 {
+		return nil
+	}
+
+	sort.Float64s(onImage)
+	median := onImage[len(onImage)/2]
+	if median <= 0.0 {
+		return nil
+	}
+	for pa := range vals {
+		vals[pa] /= median
+	}
+	return vals
+}
+
+// writeStreamerReport measures the streamers, if the config asks for
+// it, and writes the report.
+func (fi *FusedImage)writeStreamerReport() error {
+	cfg := fi.Config.Streamers.withDefaults()
+	if !cfg.Enabled || !fi.needsLunarLimb("streamers") {
+		return nil
+	}
+	report := StreamerReport{
+		Timestamp:  fi.Config.Annotation.Timestamp,
+		Location:   fi.Config.Annotation.Location,
+		NorthAngle: fi.Config.Annotation.NorthAngle,
+		Radius:     cfg.Radius,
+		Threshold:  cfg.Threshold,
+		Streamers:  fi.FindStreamers(),
+	}
+	for _, s := range report.Streamers {
+		fi.Config.debugf("Streamer at PA %3.0f°: %2.0f° wide, %.1fx the median, out to %.2f solar radii\n", s.PositionAngle, s.Width, s.Contrast, s.Extent)
+	}
+
+	b, err := yaml.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("streamers: %v", err)
+	}
+	filename := fi.Config.OutputPath(ReportOutput, "streamers.yaml")
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("write streamers '%s': %v", filename, err)
+	}
+	fi.Config.infof("Streamers: found %d, wrote %s\n", len(report.Streamers), filename)
+	return nil
+}
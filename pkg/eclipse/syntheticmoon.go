@@ -0,0 +1,147 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/eio"
+)
+
+// SyntheticMoonConfig controls the replacement of the lunar disk with
+// a clean synthetic one. The real disk is mostly noise (and a bit of
+// earthshine), which can look messy in presentation images.
+type SyntheticMoonConfig struct {
+	Mode           string   // "" (leave the disk alone), "black", or "textured"
+	TextureFile    string   // For "textured": an equirectangular albedo map, e.g. from LRO (lon -180->180, lat 90->-90)
+	LibrationLon   float64  // Libration in longitude (degrees); the selenographic longitude of the disk center
+	LibrationLat   float64  // Libration in latitude (degrees); the selenographic latitude of the disk center
+	PositionAngle  float64  // Position angle of lunar north, degrees counterclockwise from image up
+	Brightness     float64  // HDR value for albedo=1.0; if zero, match the average brightness of the real disk
+	RadiusScale    float64  // Multiplies the detected lunar radius; if zero, 1.0
+	Feather        float64  // Width (in pixels) of the blend between the synthetic disk and the real limb
+}
+
+// RenderSyntheticMoon paints a synthetic lunar disk over the limb
+// region of the developed HDR pixels.
+func (fi *FusedImage)RenderSyntheticMoon() {
+	cfg := fi.Config.SyntheticMoon
+	if !fi.needsLunarLimb("SyntheticMoon") {
+		return
+	}
+
+	var texture image.Image
+	if cfg.Mode == "textured" {
+		var err error
+		if texture, err = loadTexture(cfg.TextureFile); err != nil {
+			fi.Config.warnf("SyntheticMoon: %v, falling back to a black disk\n", err)
+		}
+	} else if cfg.Mode != "black" {
+		fi.Config.warnf("SyntheticMoon: mode '%s' not recognized, wanted black or textured\n", cfg.Mode)
+		return
+	}
+
+	radiusScale := cfg.RadiusScale
+	if radiusScale == 0.0 { radiusScale = 1.0 }
+	radius := float64(fi.Config.LunarRadius) * radiusScale
+
+	brightness := cfg.Brightness
+	if brightness == 0.0 && texture != nil {
+		brightness = fi.averageDiskLuminance(radius)
+	}
+
+	fi.Config.infof("Rendering %s synthetic moon, radius %.1f, brightness %g\n", cfg.Mode, radius, brightness)
+
+	center := fi.Config.LunarCenter
+	for x:=0; x<fi.OutputArea.Dx(); x++ {
+		for y:=0; y<fi.OutputArea.Dy(); y++ {
+			// Position on the disk, in units of lunar radius (y increases upwards)
+			dx := float64(x - center.X) / radius
+			dy := float64(center.Y - y) / radius
+			r := math.Sqrt(dx*dx + dy*dy)
+			if r > 1.0 {
+				continue
+			}
+
+			// alpha is 1.0 inside the disk, dropping to 0.0 at the limb
+			alpha := 1.0
+			if cfg.Feather > 0 {
+				alpha = math.Min(1.0, (1.0 - r) * radius / cfg.Feather)
+			}
+
+			synth := hdrcolor.RGB{}
+			if texture != nil {
+				albedo := sampleAlbedo(texture, dx, dy, cfg)
+				synth = hdrcolor.RGB{R: albedo * brightness, G: albedo * brightness, B: albedo * brightness}
+			}
+
+			p := fi.PixRW(x, y)
+			p.DevelopedRGB.R = alpha*synth.R + (1.0-alpha)*p.DevelopedRGB.R
+			p.DevelopedRGB.G = alpha*synth.G + (1.0-alpha)*p.DevelopedRGB.G
+			p.DevelopedRGB.B = alpha*synth.B + (1.0-alpha)*p.DevelopedRGB.B
+		}
+	}
+}
+
+// averageDiskLuminance is the mean luminance of the real lunar disk,
+// used to pick a brightness for the textured moon that won't look out
+// of place (we stay away from the edge, to avoid the inner corona).
+func (fi *FusedImage)averageDiskLuminance(radius float64) float64 {
+	tot, n := 0.0, 0
+	center := fi.Config.LunarCenter
+	for x:=0; x<fi.OutputArea.Dx(); x++ {
+		for y:=0; y<fi.OutputArea.Dy(); y++ {
+			dx, dy := float64(x - center.X), float64(y - center.Y)
+			if math.Sqrt(dx*dx + dy*dy) < 0.8 * radius {
+				tot += ecolor.LinearSRGBLuminance(fi.Pix(x, y).DevelopedRGB)
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 0.0
+	}
+	return tot / float64(n)
+}
+
+// sampleAlbedo maps a point on the visible disk (in units of lunar
+// radius, x right, y up) back onto the lunar sphere, accounting for
+// position angle and libration, and looks up its albedo in the
+// equirectangular texture map.
+func sampleAlbedo(texture image.Image, x, y float64, cfg SyntheticMoonConfig) float64 {
+	// Undo the position angle, so lunar north is straight up
+	pa := cfg.PositionAngle * math.Pi / 180.0
+	x, y = x*math.Cos(pa) + y*math.Sin(pa), -x*math.Sin(pa) + y*math.Cos(pa)
+	z := math.Sqrt(math.Max(0.0, 1.0 - x*x - y*y)) // towards the viewer
+
+	// Rotate from view coords into selenographic coords; the view axis
+	// maps to the sub-observer point at (LibrationLat, LibrationLon).
+	b := cfg.LibrationLat * math.Pi / 180.0
+	l := cfg.LibrationLon * math.Pi / 180.0
+	y, z = y*math.Cos(b) + z*math.Sin(b), -y*math.Sin(b) + z*math.Cos(b)
+	x, z = x*math.Cos(l) + z*math.Sin(l), -x*math.Sin(l) + z*math.Cos(l)
+
+	lat := math.Asin(math.Max(-1.0, math.Min(1.0, y)))
+	lon := math.Atan2(x, z)
+
+	tb := texture.Bounds()
+	u := tb.Min.X + int((lon / (2.0*math.Pi) + 0.5) * float64(tb.Dx()-1))
+	v := tb.Min.Y + int((0.5 - lat / math.Pi) * float64(tb.Dy()-1))
+
+	return float64(eimage.GrayU16At(texture, u, v)) / float64(0xFFFF)
+}
+
+func loadTexture(filename string) (image.Image, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("no TextureFile configured")
+	}
+	img, err := eio.ReadImage(filename)
+	if err != nil {
+		return nil, fmt.Errorf("texture: %v", err)
+	}
+	return img, nil
+}
@@ -0,0 +1,238 @@
+package eclipse
+
+import(
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// TimelapseConfig asks for the aligned frames to be made into a movie,
+// in the order they were taken, so that the corona and prominences can
+// be watched changing through totality, without the sun jumping around.
+// The frames are all on the stack's common exposure, so they can share
+// one tone curve: a log stretch over Range stops, down from the
+// brightest part of the stack. Where a frame's pixels can't be used
+// (clipped, or off the edge of the photo) the stack's are used instead.
+// It needs ffmpeg, to encode the MP4.
+type TimelapseConfig struct {
+	Enabled      bool
+	FPS          float64  // Frames per second; if zero, 10
+	Width        int      // Of the movie, in pixels (the height follows); if zero, the output's width, up to 1080
+	Range        float64  // Stops of brightness the tone curve covers, down from the stack's 99.9th percentile; if zero, 12
+	CRF          int      // libx264's quality, 1-51 (lower is better); if zero, 18
+	FFmpeg       string   // The ffmpeg to run; if empty, "ffmpeg" on the PATH
+	Interpolate  int      // How many frames to make up between each pair of real ones, by optical flow, to smooth out a sparse sequence
+}
+
+func (tc TimelapseConfig)withDefaults() TimelapseConfig {
+	if tc.FPS    == 0.0 { tc.FPS = 10.0 }
+	if tc.Range  == 0.0 { tc.Range = 12.0 }
+	if tc.CRF    == 0   { tc.CRF = 18 }
+	if tc.FFmpeg == ""  { tc.FFmpeg = "ffmpeg" }
+	return tc
+}
+
+// size is the movie's width & height; both even, as yuv420p needs.
+func (tc TimelapseConfig)size(w, h int) (int, int) {
+	mw := tc.Width
+	if mw == 0 {
+		mw = w
+		if mw > 1080 { mw = 1080 }
+	}
+	mh := int(math.Round(float64(h) * float64(mw) / float64(w)))
+	return mw &^ 1, mh &^ 1
+}
+
+// writeTimelapse renders the aligned frames as `timelapse.mp4`, if the
+// config asks for it. It comes after Fuse, as the tone curve comes from
+// the stack.
+func (fi *FusedImage)writeTimelapse(ctx context.Context) error {
+	cfg := fi.Config.Timelapse.withDefaults()
+	if !cfg.Enabled {
+		return nil
+	}
+	defer fi.measureStage(ctx, "timelapse")()
+	mw, mh := cfg.size(fi.OutputArea.Dx(), fi.OutputArea.Dy())
+	tr, err := fi.newTimelapseRenderer(mw, mh, cfg.Range)
+	if err != nil {
+		return fmt.Errorf("timelapse: %v", err)
+	}
+	filename := fi.Config.OutputPath(FinalOutput, "timelapse.mp4")
+	fi.Config.infof("Rendering %d aligned frames as a %dx%d movie, to %s\n", len(tr.order), mw, mh, filename)
+	return fi.encodeWithFFmpeg(ctx, tr, cfg.Interpolate, cfg.FFmpeg, cfg.FPS, filename, "-c:v", "libx264", "-pix_fmt", "yuv420p", "-crf", fmt.Sprint(cfg.CRF), "-movflags", "+faststart")
+}
+
+// encodeWithFFmpeg pipes the rendered frames (with `between` made up
+// between each pair), as raw RGB, into ffmpeg, to be encoded (as the
+// args say) into filename.
+func (fi *FusedImage)encodeWithFFmpeg(ctx context.Context, tr *timelapseRenderer, between int, ffmpeg string, fps float64, filename string, args ...string) error {
+	args = append([]string{"-y", "-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "rgb24", "-s", fmt.Sprintf("%dx%d", tr.mw, tr.mh), "-r", fmt.Sprintf("%g", fps), "-i", "-"},
+		append(args, filename)...)
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	fi.Config.debugf("Running %s %s\n", ffmpeg, strings.Join(args, " "))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: couldn't run ffmpeg (set timelapse.ffmpeg, or put it on the PATH): %v", filename, err)
+	}
+
+	bw := bufio.NewWriter(stdin)
+	errPipe := fmt.Errorf("ffmpeg has stopped reading")
+	err = tr.each(ctx, between, "Rendering " + filepath.Base(filename), func(frame []byte) error {
+		if _, err := bw.Write(frame); err != nil {
+			return errPipe
+		}
+		return nil
+	})
+	if err == nil {
+		bw.Flush()
+	}
+	stdin.Close()
+	if waitErr := cmd.Wait(); waitErr != nil && (err == nil || err == errPipe) {
+		return fmt.Errorf("%s: ffmpeg: %v", filename, waitErr)
+	}
+	return err
+}
+
+// A timelapseRenderer draws the aligned frames, downscaled to mw x mh,
+// in capture order (frames without a time go last, by EV), all with the
+// same tone curve: log, from black up to white, applied to luminance
+// (so the colors keep their hue).
+type timelapseRenderer struct {
+	fi            *FusedImage
+	develop       func(*Pixel)
+	mw, mh        int
+	black, white  float64
+	order       []int  // Of the layers
+}
+
+// newTimelapseRenderer sets the tone curve to cover rangeStops, down
+// from the stack's 99.9th percentile.
+func (fi *FusedImage)newTimelapseRenderer(mw, mh int, rangeStops float64) (*timelapseRenderer, error) {
+	if mw < 2 || mh < 2 {
+		return nil, fmt.Errorf("%dx%d is too small", mw, mh)
+	}
+	develop, err := fi.Config.pixelDeveloper()
+	if err != nil {
+		return nil, err
+	}
+	lums := []float64{}
+	for i:=0; i<len(fi.Pixels); i+=7 {
+		if l := ecolor.LinearSRGBLuminance(fi.Pixels[i].DevelopedRGB); l > 0.0 {
+			lums = append(lums, l)
+		}
+	}
+	if len(lums) == 0 {
+		return nil, fmt.Errorf("the stack is black")
+	}
+	sort.Float64s(lums)
+	tr := &timelapseRenderer{fi: fi, develop: develop, mw: mw, mh: mh, white: lums[len(lums) * 999 / 1000]}
+	tr.black = tr.white / math.Pow(2.0, rangeStops)
+
+	tr.order = make([]int, len(fi.Layers))
+	for i := range tr.order {
+		tr.order[i] = i
+	}
+	sort.SliceStable(tr.order, func(i, j int) bool {
+		ti, tj := fi.Layers[tr.order[i]].CaptureTime, fi.Layers[tr.order[j]].CaptureTime
+		if ti.IsZero() || tj.IsZero() {
+			return !ti.IsZero() && tj.IsZero()
+		}
+		return ti.Before(tj)
+	})
+	return tr, nil
+}
+
+func (tr *timelapseRenderer)stretch(rgb hdrcolor.RGB) (uint8, uint8, uint8) {
+	l := ecolor.LinearSRGBLuminance(rgb)
+	if l <= 0.0 {
+		return 0, 0, 0
+	}
+	scale := math.Log1p(l / tr.black) / math.Log1p(tr.white / tr.black) / l
+	to8 := func(v float64) uint8 { return uint8(math.Round(255.0 * math.Max(0.0, math.Min(1.0, v * scale)))) }
+	return to8(rgb.R), to8(rgb.G), to8(rgb.B)
+}
+
+// each renders every frame in turn, with `between` more made up between
+// each pair of them by optical flow (see eimage.OpticalFlow), and
+// passes them to fn. The frame it's given is reused for the next one.
+func (tr *timelapseRenderer)each(ctx context.Context, between int, name string, fn func(frame []byte) error) error {
+	prev, frame, tween := []byte(nil), make([]byte, tr.mw * tr.mh * 3), make([]byte, tr.mw * tr.mh * 3)
+	progress := tr.fi.Config.newProgress(name, len(tr.order))
+	defer progress.Done()
+	for k := range tr.order {
+		if err := tr.render(ctx, k, frame); err != nil {
+			return err
+		}
+		if prev != nil && between > 0 {
+			flow := eimage.OpticalFlow(prev, frame, tr.mw, tr.mh)
+			for j := 1; j <= between; j++ {
+				flow.Interpolate(prev, frame, float64(j) / float64(between + 1), tween)
+				if err := fn(tween); err != nil {
+					return err
+				}
+			}
+		}
+		if err := fn(frame); err != nil {
+			return err
+		}
+		if between > 0 {
+			if prev == nil {
+				prev = make([]byte, len(frame))
+			}
+			copy(prev, frame)
+		}
+		progress.Add(1)
+	}
+	return nil
+}
+
+// render draws the k'th frame (in capture order) into frame, as RGB
+// bytes. Each of its pixels is the average of the box of output pixels
+// under it, in linear light; where the frame's pixels can't be used, the
+// stack's are.
+func (tr *timelapseRenderer)render(ctx context.Context, k int, frame []byte) error {
+	fi := tr.fi
+	w, h := fi.OutputArea.Dx(), fi.OutputArea.Dy()
+	fv := frameView{fi, tr.order[k], fi.commonIllumAtMax(), true}
+	return eimage.ParallelFor(ctx, fi.workers("timelapse"), tr.mh, func(_, my int) {
+		y0, y1 := my * h / tr.mh, (my + 1) * h / tr.mh
+		for mx:=0; mx<tr.mw; mx++ {
+			x0, x1 := mx * w / tr.mw, (mx + 1) * w / tr.mw
+			sum, n := hdrcolor.RGB{}, 0.0
+			for y:=y0; y<y1; y++ {
+				for x:=x0; x<x1; x++ {
+					var rgb hdrcolor.RGB
+					if in, ok := fv.at(x, y); ok {
+						p := Pixel{Fused: ecolor.CameraNative{RGB: in, IllumAtMax: fv.illumAtMax}}
+						tr.develop(&p)
+						rgb = p.DevelopedRGB
+					} else {
+						rgb = fi.Pix(x, y).DevelopedRGB
+					}
+					sum.R, sum.G, sum.B, n = sum.R + rgb.R, sum.G + rgb.G, sum.B + rgb.B, n + 1
+				}
+			}
+			if n > 0 {
+				sum = hdrcolor.RGB{R: sum.R / n, G: sum.G / n, B: sum.B / n}
+			}
+			o := (my * tr.mw + mx) * 3
+			frame[o], frame[o+1], frame[o+2] = tr.stretch(sum)
+		}
+	})
+}
@@ -1,11 +1,18 @@
 package eclipse
 
 import(
+	"context"
 	"fmt"
-	"log"
+	"image"
+	"image/color"
+	"math"
+	"time"
 
 	"github.com/mdouchement/hdr/tmo"
 
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
 	"github.com/abworrall/eclipse-hdr/pkg/fattal02"
 )
 
@@ -17,71 +24,198 @@ func ListTonemappers() string {
 	return fmt.Sprintf("%v", Tonemappers)
 }
 
-func (fi *FusedImage)Tonemap() {
+func (fi *FusedImage)Tonemap(ctx context.Context) error {
+	if fi.Config.Isophotes.Enabled {
+		fi.writeIsophotes()
+	}
+	fi.loadLUT()
+
 	if fi.Config.Tonemapper == "all" {
-		log.Printf("Tonemapping (using all operators)")
+		fi.Config.infof("Tonemapping (using all operators)")
+		progress := fi.Config.newProgress("Tonemapping (operators)", len(Tonemappers))
 		for _, name := range Tonemappers {
-			op := fi.SetupTonemapper(name)
-			fi.ApplyTonemapper(op, name)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fi.tonemapWith(name); err != nil {
+				return err
+			}
+			progress.Add(1)
+		}
+		progress.Done()
+		return nil
+	}
+	return fi.tonemapWith(fi.Config.Tonemapper)
+}
+
+// These take image statistics over tiles in parallel, and add them up
+// in whatever order the tiles finish, so the last bits can vary.
+var unreproducibleTonemappers = []string{"drago03", "durand", "reinhard05"}
+
+// These apply the output color space's transfer curve themselves; the
+// others (the tmo ones, and any registered) come out sRGB encoded.
+var colorSpaceTonemappers = []string{"fattal02"}
+
+func (fi *FusedImage)tonemapWith(name string) error {
+	if fi.Config.Deterministic && contains(unreproducibleTonemappers, name) {
+		ok := []string{}
+		for _, tm := range Tonemappers {
+			if !contains(unreproducibleTonemappers, tm) {
+				ok = append(ok, tm)
+			}
 		}
+		fi.Config.warnf("Tonemapper %s isn't bit-for-bit reproducible; for deterministic outputs, use one of %v\n", name, ok)
+	}
+	op, err := fi.SetupTonemapper(name)
+	if err != nil {
+		return err
+	}
+	return fi.ApplyTonemapper(op, name)
+}
+
+func (fi *FusedImage)loadLUT() {
+	if fi.Config.LUTFile == "" || fi.lut != nil {
+		return
+	}
+	if lut, err := LoadCubeLUT(fi.Config.LUTFile); err != nil {
+		fi.Config.warnf("LUT: %v, skipping\n", err)
 	} else {
-		op := fi.SetupTonemapper(fi.Config.Tonemapper)
-		fi.ApplyTonemapper(op, fi.Config.Tonemapper)
+		fi.Config.infof("LUT: loaded '%s' (%q, size %d)\n", fi.Config.LUTFile, lut.Title, lut.Size)
+		fi.lut = lut
 	}
 }
 
-func (fi *FusedImage)ApplyTonemapper(op tmo.ToneMappingOperator, name string) {
-	log.Printf("Tonemapping: %s", name)
-	newImg := op.Perform()
-	
-	WritePNG(newImg, fmt.Sprintf("tmo-%s.png", name))
+// Render tonemaps the fused pixels with the named tonemapper, and
+// returns the image (after the LUT, if there is one), without writing
+// it out anywhere; it is for running in memory (see WithPhotos).
+func (fi *FusedImage)Render(name string) (image.Image, error) {
+	fi.loadLUT()
+	op, err := fi.SetupTonemapper(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Config.timeEvent("tonemap", time.Now(), "operator", name)
+	return fi.render(op, name), nil
+}
 
+// render runs the operator, and keeps the result in the pixels.
+func (fi *FusedImage)render(op tmo.ToneMappingOperator, name string) image.Image {
+	fi.Config.infof("Tonemapping: %s", name)
+	newImg := op.Perform()
+	if !contains(colorSpaceTonemappers, name) {
+		newImg = reencodeSRGB(newImg, fi.Config.ColorSpace)
+	}
+	if fi.lut != nil {
+		newImg = fi.lut.Apply(newImg)
+	}
+	if fi.Config.Monochrome {
+		newImg = eimage.ToGray16(newImg)
+	}
 	for x:=0; x<fi.Bounds().Dx(); x++ {
 		for y:=0; y<fi.Bounds().Dy(); y++ {
 			p := fi.PixRW(x, y)
 			p.TonemappedRGB = newImg.At(x, y)
 		}
-	}	
+	}
+	return newImg
+}
+
+// reencodeSRGB swaps the sRGB transfer curve of the image for the one
+// of the output color space (the primaries are already the space's,
+// as the tonemappers work on its RGB). For sRGB, or spaces that share
+// its curve, it's left as it is.
+func reencodeSRGB(img image.Image, cs ecolor.OutputColorSpace) image.Image {
+	if cs.Encode == nil {
+		return img
+	}
+	table := make([]uint16, 0x10000)
+	same := true
+	for i := range table {
+		v := cs.Encode(emath.GammaCompress_F64(float64(i) / 0xFFFF))
+		table[i] = uint16(math.Round(math.Max(0.0, math.Min(1.0, v)) * 0xFFFF))
+		if d := int(table[i]) - i; d > 1 || d < -1 {
+			same = false
+		}
+	}
+	if same {
+		return img
+	}
+	b := img.Bounds()
+	out := image.NewRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			out.SetRGBA64(x, y, color.RGBA64{table[r], table[g], table[bl], uint16(a)})
+		}
+	}
+	return out
+}
+
+func (fi *FusedImage)ApplyTonemapper(op tmo.ToneMappingOperator, name string) error {
+	defer fi.Config.timeEvent("tonemap", time.Now(), "operator", name)
+	newImg := fi.render(op, name)
+	cfg, filename := fi.Config, fi.Config.OutputPath(FinalOutput, fmt.Sprintf("tmo-%s.png", name))
+	err := cfg.outputs.write(func() error {
+		if err := cfg.writePNG(newImg, filename); err != nil {
+			return fmt.Errorf("tonemap %s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fi.writeRenditions(newImg, fmt.Sprintf("tmo-%s", name))
+	if fi.isophotes != nil && fi.Config.Isophotes.Overlay {
+		fi.overlayIsophotes(newImg, fmt.Sprintf("tmo-%s", name))
+	}
+	if fi.Config.Annotation.Enabled {
+		fi.annotate(newImg, fmt.Sprintf("tmo-%s", name))
+	}
+	return nil
 }
 
 // Tweak the tmo parameters to better handle eclipse photos. By default, they
 // almost always overexpose on the small but important bright areas.
-func (fi *FusedImage)SetupTonemapper(name string) tmo.ToneMappingOperator {
+func (fi *FusedImage)SetupTonemapper(name string) (tmo.ToneMappingOperator, error) {
 	switch name {
 	case "drago03":
 		op :=  tmo.NewDefaultDrago03(fi)
 		op.Bias = 1.0            // Otherwise image overexposes, blows out the bright corona
-		return op
+		return op, nil
 
 	case "durand":
-		return tmo.NewDefaultDurand(fi)
+		return tmo.NewDefaultDurand(fi), nil
 
 	case "fattal02":
 		op := fattal02.NewDefaultFattal02(fi)
 		op.WhitePoint  = 0.00001 // We want as close to zero overexposed pixels	as we can get
 		//op.DetailLevel = 1       // If <3, attenuation grids retain and highlight noise
 		op.GammaExpand = true    // image comes out too dark otherwise
-		if fi.Config.Verbosity > 0 {
-			op.DumpGrids   = true
+		op.Transfer    = fi.Config.ColorSpace.EncodeVec3
+		if fi.Config.DebugSink != nil {
+			op.DumpGrids   = true // fattal02 writes these out itself
+			op.DumpDir     = fi.Config.OutputDir(DebugOutput)
 		}
-		return op
+		return op, nil
 
 	case "icam06":
 		op := tmo.NewDefaultICam06(fi)
 		op.Contrast    = 0.65
 		op.MaxClipping = 0.99999 // Otherwise image overexposes, blows out the bright corona
-		return op
+		return op, nil
 
 	case "linear":
-		return tmo.NewLinear(fi)
+		return tmo.NewLinear(fi), nil
 
 	case "reinhard05":
 		op := tmo.NewDefaultReinhard05(fi)
 		op.Chromatic  = 0.005
 		op.Light      = 0.005    // Otherwise image overexposes, blows out the bright corona
-		return op
+		return op, nil
 	}
 
-	log.Fatalf("ToneMapper %q not recognized, wanted %s\n", name, ListTonemappers())
-	return nil
+	if f, exists := tonemapperFuncs[name]; exists {
+		return f(fi), nil
+	}
+	return nil, fmt.Errorf("ToneMapper %q not recognized, wanted %s", name, ListTonemappers())
 }
@@ -0,0 +1,195 @@
+package eclipse
+
+import(
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eastro"
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// Validate checks the values in the config that yaml can't check for
+// us: the enum-like strings, fields that are required by other fields,
+// and out-of-range numbers. (Unknown keys and type errors are caught
+// when the yaml is parsed; see newConfigFromYaml.) All problems are
+// reported at once, each prefixed by the yaml key it relates to.
+func (c Config)Validate() error {
+	errs := []string{}
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+	oneOf := func(val, key string, allowed ...string) {
+		for _, a := range allowed {
+			if val == a {
+				return
+			}
+		}
+		check(false, key, "'%s' not recognized, wanted one of %q", val, allowed)
+	}
+
+	if c.ManualOverrideForwardMatrix != (emath.Mat3{}) {
+		check(c.ManualOverrideAsShotNeutral != (emath.Vec3{}), "manualoverrideasshotneutral",
+			"required when manualoverrideforwardmatrix is set")
+	}
+	_, err := ecolor.LookupOutputColorSpace(c.OutputColorSpace)
+	check(err == nil, "outputcolorspace", "%v", err)
+
+	oneOf(c.Fuser, "fuser", sortedNames(fusers)...)
+	oneOf(c.Developer, "developer", sortedNames(developers)...)
+	oneOf(c.LimbDetector, "limbdetector", sortedNames(limbDetectors)...)
+	oneOf(c.Tonemapper, "tonemapper", append([]string{"all"}, Tonemappers...)...)
+	check(c.Threads >= 0, "threads", "must not be negative")
+	check(c.Preview >= 0, "preview", "must not be negative")
+	if c.MaxMemory != "" {
+		_, err := parseBytes(c.MaxMemory)
+		check(err == nil, "maxmemory", "%v", err)
+	}
+	oneOf(c.Work.Cleanup, "work.cleanup", "always", "onsuccess", "never")
+	oneOf(c.Work.Buffers, "work.buffers", "memory", "disk")
+	oneOf(c.Output.PNG, "output.png", "", "std", "fast")
+	oneOf(c.CoronaProfile.Format, "coronaprofile.format", "", "csv", "json")
+	check(c.CoronaProfile.Step >= 0.0, "coronaprofile.step", "must not be negative")
+	check(c.Streamers.Radius == 0.0 || c.Streamers.Radius > 1.0, "streamers.radius", "%g should be outside the limb (> 1.0)", c.Streamers.Radius)
+	check(c.Streamers.Threshold >= 0.0, "streamers.threshold", "must not be negative")
+	oneOf(c.Radiance.Format, "radiance.format", "", "fits", "hdr")
+	oneOf(c.Cube.Channel, "cube.channel", "", "mean", "r", "g", "b")
+	check(c.AlignmentSmoothing.Degree >= 0, "alignmentsmoothing.degree", "%d is negative", c.AlignmentSmoothing.Degree)
+	check(c.AlignmentSmoothing.Tolerance >= 0.0, "alignmentsmoothing.tolerance", "%g pixels is negative", c.AlignmentSmoothing.Tolerance)
+	oneOf(c.Animation.Format, "animation.format", "", "gif", "webp")
+	check(c.Animation.FPS >= 0.0, "animation.fps", "%g is negative", c.Animation.FPS)
+	check(c.Animation.Width >= 0, "animation.width", "%d is negative", c.Animation.Width)
+	check(c.Animation.Interpolate >= 0, "animation.interpolate", "%d frames is negative", c.Animation.Interpolate)
+	check(c.Timelapse.Interpolate >= 0, "timelapse.interpolate", "%d frames is negative", c.Timelapse.Interpolate)
+	check(c.Animation.Range >= 0.0, "animation.range", "%g stops is negative", c.Animation.Range)
+	check(c.Classify.Threshold >= 0.0, "classify.threshold", "%g mag is negative", c.Classify.Threshold)
+	check(c.Classify.Surround >= 0.0 && c.Classify.Surround <= 1.0, "classify.surround", "%g isn't in [0, 1]", c.Classify.Surround)
+	check(c.Beads.Window >= 0.0, "beads.window", "%g seconds is negative", c.Beads.Window)
+	oneOf(c.Mosaic.Exposures, "mosaic.exposures", "", "match", "exif")
+	check(c.Mosaic.MinOverlap >= 0.0 && c.Mosaic.MinOverlap <= 1.0, "mosaic.minoverlap", "%g is outside [0, 1]", c.Mosaic.MinOverlap)
+	check(c.Mosaic.Feather >= 0.0 && c.Mosaic.Feather <= 0.5, "mosaic.feather", "%g is outside [0, 0.5]", c.Mosaic.Feather)
+	for _, name := range sortedNames(c.Mosaic.Tiles) {
+		check(c.Mosaic.Tiles[name].Gain > 0.0, "mosaic.tiles." + name + ".gain", "must be positive")
+	}
+	oneOf(c.Montage.Layout, "montage.layout", "", "arc", "grid")
+	check(c.Montage.Size >= 0, "montage.size", "%d is negative", c.Montage.Size)
+	check(c.Montage.Spacing >= 0.0, "montage.spacing", "%g is negative", c.Montage.Spacing)
+	check(c.Montage.Arc >= 0.0 && c.Montage.Arc <= 360.0, "montage.arc", "%g degrees isn't in [0, 360]", c.Montage.Arc)
+	check(c.Montage.TotalityScale >= 0.0, "montage.totalityscale", "%g is negative", c.Montage.TotalityScale)
+	check(c.Montage.Columns >= 0, "montage.columns", "%d is negative", c.Montage.Columns)
+	check(c.Timelapse.FPS >= 0.0, "timelapse.fps", "%g is negative", c.Timelapse.FPS)
+	check(c.Timelapse.Width >= 0, "timelapse.width", "%d is negative", c.Timelapse.Width)
+	check(c.Timelapse.Range >= 0.0, "timelapse.range", "%g stops is negative", c.Timelapse.Range)
+	check(c.Timelapse.CRF >= 0 && c.Timelapse.CRF <= 51, "timelapse.crf", "%d is outside [1, 51] (or 0, for the default)", c.Timelapse.CRF)
+	check(c.Radiance.Saturation >= 0.0, "radiance.saturation", "must not be negative")
+	check(c.Scoring.MinSharpness >= 0.0 && c.Scoring.MinSharpness <= 1.0, "scoring.minsharpness", "%g is outside [0, 1]", c.Scoring.MinSharpness)
+	check(c.Scoring.MinTransparency >= 0.0 && c.Scoring.MinTransparency <= 1.0, "scoring.mintransparency", "%g is outside [0, 1]", c.Scoring.MinTransparency)
+	if es := c.Earthshine.withDefaults(); es.Enabled {
+		check(es.Disk > 0.0 && es.Disk < 1.0, "earthshine.disk", "%g is outside (0, 1)", es.Disk)
+		check(es.CoronaInner >= 1.0 && es.CoronaOuter > es.CoronaInner, "earthshine.coronainner", "the annulus [%g, %g] isn't outside the limb", es.CoronaInner, es.CoronaOuter)
+	}
+	check(c.Contacts.Threshold >= 0.0, "contacts.threshold", "%g magnitudes is negative", c.Contacts.Threshold)
+	check(math.Abs(c.Ephemeris.Latitude) <= 90.0, "ephemeris.latitude", "%g is outside [-90, 90]", c.Ephemeris.Latitude)
+	check(math.Abs(c.Ephemeris.Longitude) <= 180.0, "ephemeris.longitude", "%g is outside [-180, 180]", c.Ephemeris.Longitude)
+	check(math.Abs(c.Ephemeris.UTCOffset) <= 14.0, "ephemeris.utcoffset", "%g hours is more than any time zone", c.Ephemeris.UTCOffset)
+	oneOf(c.Polarization.Format, "polarization.format", "", "fits", "tiff")
+	check(c.Polarization.MinSignal >= 0.0 && c.Polarization.MinSignal < 1.0, "polarization.minsignal", "%g is outside [0.0, 1.0)", c.Polarization.MinSignal)
+	check(c.Photometry.MatchRadius >= 0 && c.Photometry.Aperture >= 0, "photometry", "matchradius & aperture must not be negative")
+	check(c.ClipLevel > 0.0 && c.ClipLevel <= 1.0, "cliplevel", "%g is outside (0.0, 1.0]", c.ClipLevel)
+	check(c.LimbRadiusTolerance > 0.0, "limbradiustolerance", "%g should be > 0", c.LimbRadiusTolerance)
+	check(c.AlignmentErrorTolerance > 0.0, "alignmenterrortolerance", "%g should be > 0", c.AlignmentErrorTolerance)
+	for i := range c.BlackPoint {
+		w := c.WhitePoint[i]
+		if w == 0.0 { w = 1.0 }
+		check(c.BlackPoint[i] < w, "blackpoint", "channel %d (%g) is not below the white point (%g)", i, c.BlackPoint[i], w)
+	}
+
+	oneOf(c.WhiteBalance.Mode, "whitebalance.mode", "", "asshot", "daylight", "custom", "graypoint", "solar")
+	if c.WhiteBalance.Mode == "custom" {
+		m := c.WhiteBalance.Multipliers
+		check(m[0] != 0 && m[1] != 0 && m[2] != 0, "whitebalance.multipliers", "three non-zero values required for custom mode")
+	}
+
+	if c.Framing.AspectRatio != "" {
+		_, err := parseAspectRatio(c.Framing.AspectRatio)
+		check(err == nil, "framing.aspectratio", "%v", err)
+	}
+	for i, l := range c.Annotation.Labels {
+		if l.Body != "" {
+			check(contains(eastro.ListBodies(), strings.ToLower(l.Body)), fmt.Sprintf("annotation.labels[%d].body", i), "'%s' not known, wanted one of %v", l.Body, eastro.ListBodies())
+		}
+		check(l.Dec >= -90.0 && l.Dec <= 90.0, fmt.Sprintf("annotation.labels[%d].dec", i), "%g is outside [-90, 90]", l.Dec)
+	}
+	for i, r := range c.Renditions {
+		check(r.Name != "", fmt.Sprintf("renditions[%d].name", i), "required")
+		check(r.Width > 0, fmt.Sprintf("renditions[%d].width", i), "must be positive")
+	}
+
+	names := []string{}
+	for name := range c.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, key := c.Images[name], "images." + name
+		if o.EV != 0 {
+			_, exists := illuminanceLookup[o.EV]
+			check(exists, key+".ev", "%d is outside [6, 18]", o.EV)
+		}
+		check(o.Threshold >= 0.0 && o.Threshold <= 1.0, key+".threshold", "%g is outside [0.0, 1.0]", o.Threshold)
+		check(o.Weight >= 0.0, key+".weight", "can't be negative")
+		check(o.Polarizer >= 0.0 && o.Polarizer <= 180.0, key+".polarizer", "%g is outside [0, 180]", o.Polarizer)
+		check(o.Filter >= 0.0, key+".filter", "%g is negative", o.Filter)
+	}
+	for _, name := range sortedNames(c.Cameras.Solutions) {
+		sol, key := c.Cameras.Solutions[name], "cameras.solutions." + name
+		check(sol.Scale > 0.0, key+".scale", "must be positive")
+		check(sol.Gain > 0.0, key+".gain", "must be positive")
+	}
+
+	for i, s := range c.Select {
+		_, err := parsePredicate(s)
+		check(err == nil, fmt.Sprintf("select[%d]", i), "%v", err)
+	}
+
+	steps, err := c.pipelineSteps()
+	check(err == nil, "pipeline", "%v", err)
+	hookable := append([]string{}, hookStages...)
+	for _, step := range steps {
+		hookable = append(hookable, step.Name)
+	}
+	for i, h := range c.Hooks {
+		key := fmt.Sprintf("hooks[%d]", i)
+		oneOf(h.Stage, key+".stage", hookable...)
+		oneOf(h.When, key+".when", "pre", "post")
+		check(len(h.Command) > 0 && h.Command[0] != "", key+".command", "required")
+	}
+
+	if c.ChannelMixer.Enabled() {
+		oneOf(c.ChannelMixer.Space, "channelmixer.space", "", "camera", "output")
+	}
+	oneOf(c.CoronaWhiteBalance.Mode, "coronawhitebalance.mode", "", "auto", "manual")
+	oneOf(c.Denoise.Method, "denoise.method", "", "bilateral", "nlmeans")
+	oneOf(c.SyntheticMoon.Mode, "syntheticmoon.mode", "", "black", "textured")
+	if c.SyntheticMoon.Mode == "textured" {
+		check(c.SyntheticMoon.TextureFile != "", "syntheticmoon.texturefile", "required when mode is textured")
+	}
+	check(c.SkyGradient.Order >= 0, "skygradient.order", "can't be negative")
+
+	for i:=1; i<len(c.RadialSaturation); i++ {
+		check(c.RadialSaturation[i].Radius > c.RadialSaturation[i-1].Radius, fmt.Sprintf("radialsaturation[%d].radius", i),
+			"points must be sorted by increasing radius")
+	}
+	for i, adj := range c.HSL {
+		check(adj.Width >= 0.0 && adj.Feather >= 0.0, fmt.Sprintf("hsl[%d]", i), "width and feather can't be negative")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
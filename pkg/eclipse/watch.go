@@ -0,0 +1,145 @@
+package eclipse
+
+import(
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Watcher keeps an eye on some dirs (e.g. where a tethered camera
+// is writing its photos), and each time new photos show up it re-runs
+// a quick stack (align, fuse, tonemap; no enhancement), so you can see
+// how things are going during the eclipse. Photos are only loaded once,
+// and the lunar limbs and alignments found so far are reused.
+type Watcher struct {
+	Args      []string          // Dirs (and files, e.g. conf.yaml) to watch
+	Base      Config            // Config to start from each time; any conf.yaml is loaded on top
+	Interval  time.Duration     // How often to look for new photos
+	Overrides []string          // `key=value` config settings, applied after any conf.yaml
+	Configure func(*Config)     // If set, called after loading; e.g. to apply command line flags
+
+	seen      map[string]os.FileInfo  // What each file looked like last time we polled
+	done      map[string]bool         // Photos that made it into the last stack
+	cache     map[string]Layer        // Photos we've loaded, by path
+	index     *photoIndex             // ... and their metadata & hashes
+}
+
+func NewWatcher(base Config, interval time.Duration, args ...string) *Watcher {
+	return &Watcher{
+		Args:     args,
+		Base:     base,
+		Interval: interval,
+		seen:     map[string]os.FileInfo{},
+		done:     map[string]bool{},
+		cache:    map[string]Layer{},
+		index:    newPhotoIndex(),
+	}
+}
+
+// Run polls until ctx is cancelled. If a stack fails, it says so, and
+// carries on watching; the next photo to arrive may fix things.
+func (w *Watcher)Run(ctx context.Context) error {
+	w.Base.infof("Watching %v for new photos, every %s\n", w.Args, w.Interval)
+	w.Base.startRun()
+	for {
+		if files, changed := w.poll(); changed {
+			if err := w.stack(ctx, files); err != nil && ctx.Err() == nil {
+				w.Base.warnf("Watch: stack failed: %v\n", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.Interval):
+		}
+	}
+}
+
+// poll returns the files that haven't changed since the last poll
+// (a photo that is still being written will have a different size or
+// modtime), and whether any of them are photos or configs we haven't
+// stacked yet.
+func (w *Watcher)poll() ([]string, bool) {
+	stable, changed := []string{}, false
+	for _, arg := range w.Args {
+		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(path))
+			if ext != ".tif" && ext != ".dng" && ext != ".yaml" {
+				return nil
+			}
+			prev, exists := w.seen[path]
+			w.seen[path] = info
+			if !exists || prev.Size() != info.Size() || !prev.ModTime().Equal(info.ModTime()) {
+				if ext == ".yaml" && exists {
+					delete(w.done, path) // Config was edited; restack once it settles
+				}
+				return nil
+			}
+			stable = append(stable, path)
+			if !w.done[path] {
+				changed = true
+			}
+			return nil
+		})
+	}
+	sort.Strings(stable)
+	return stable, changed
+}
+
+// stack runs a quick stack over the files.
+func (w *Watcher)stack(ctx context.Context, files []string) error {
+	nPhotos := 0
+	for _, f := range files {
+		w.done[f] = true
+		if strings.ToLower(filepath.Ext(f)) != ".yaml" {
+			nPhotos++
+		}
+	}
+	if nPhotos == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	fi := NewFusedImage()
+	fi.Config = w.Base
+	fi.photoCache = w.cache
+	fi.index = w.index
+	fi.Overrides = w.Overrides
+
+	if err := fi.LoadFilesAndDirs(ctx, files...); err != nil {
+		return err
+	}
+	if w.Configure != nil {
+		w.Configure(&fi.Config)
+	}
+	if len(fi.Layers) == 0 {
+		return nil // all excluded
+	}
+	defer fi.releaseLayers() // the next stack can reuse them
+
+	err := fi.writingOutputs(func() error {
+		if err := fi.Align(ctx); err != nil {
+			return err
+		} else if err := fi.Fuse(ctx); err != nil {
+			return err
+		}
+		return fi.Tonemap(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The limbs & alignments are keyed by filename, so can carry over
+	w.Base.LunarLimbs = fi.Config.LunarLimbs
+	w.Base.Alignments = fi.Config.Alignments
+
+	fi.Config.infof("Updated quick stack with %d photos, in %s\n", len(fi.Layers), time.Since(start).Round(time.Second))
+	fi.Config.timeEvent("watch.stack", start, "frames", len(fi.Layers))
+	return nil
+}
@@ -0,0 +1,176 @@
+package eclipse
+
+import(
+	"fmt"
+	"image"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// WhiteBalanceConfig picks the white balance used to develop the
+// fused image. The same white balance is applied to every layer, as
+// part of the CameraToPCS matrix.
+type WhiteBalanceConfig struct {
+	Mode             string       // "" or "asshot" (from the camera), "daylight", "custom", "graypoint", or "solar"
+	Multipliers      emath.Vec3   // For "custom": RGB multipliers for camera native channels
+	DaylightNeutral  emath.Vec3   // For "daylight": a daylight white in camera native RGB; if zero, from the camera profile
+	GrayPoint        image.Point  // For "graypoint": something that should be neutral, in input image coords
+	GrayPointRadius  int          // For "graypoint": radius (in pixels) of the area to average; if zero, 5
+	SolarInnerRadius float64      // For "solar": inner edge of the sampled corona, in solar radii; if zero, 1.1
+	SolarOuterRadius float64      // For "solar": outer edge of the sampled corona, in solar radii; if zero, 3.0
+	SolarTemperature float64      // For "solar": blackbody temperature of the reference spectrum; if zero, 5778K (G2V)
+}
+
+// ApplyWhiteBalance adjusts Config.CameraWhite and Config.CameraToPCS
+// for the chosen white balance mode. CameraToPCS already incorporates
+// the as-shot white balance, so we undo that and apply the new one.
+func (fi *FusedImage)ApplyWhiteBalance() error {
+	cfg := fi.Config.WhiteBalance
+	neutral := emath.Vec3{}
+
+	switch cfg.Mode {
+	case "", "asshot":
+		return nil
+
+	case "daylight":
+		neutral = cfg.DaylightNeutral
+		if neutral == (emath.Vec3{}) {
+			cp, model, exists := fi.lookupCameraProfile()
+			if !exists {
+				return fmt.Errorf("WhiteBalance daylight: no DaylightNeutral in config, and no profile for camera '%s'", model)
+			}
+			neutral = cp.AsShotNeutral
+		}
+
+	case "custom":
+		m := cfg.Multipliers
+		if m[0] == 0 || m[1] == 0 || m[2] == 0 {
+			return fmt.Errorf("WhiteBalance custom: need three non-zero Multipliers, got %s", m)
+		}
+		neutral = emath.Vec3{m[1]/m[0], 1.0, m[1]/m[2]}
+
+	case "solar":
+		return nil // Needs the fused corona, so happens during Fuse(); see CalibrateToSolarSpectrum
+
+	case "graypoint":
+		var err error
+		if neutral, err = fi.sampleGrayPoint(cfg); err != nil {
+			return fmt.Errorf("WhiteBalance graypoint: %v", err)
+		}
+
+	default:
+		return fmt.Errorf("WhiteBalance mode '%s' not recognized, wanted asshot, daylight, custom, graypoint or solar", cfg.Mode)
+	}
+
+	fi.setCameraWhite(neutral)
+	return nil
+}
+
+// setCameraWhite swaps out the white balance baked into CameraToPCS.
+func (fi *FusedImage)setCameraWhite(neutral emath.Vec3) {
+	fi.Config.infof("White balance (%s): camera white %s -> %s\n", fi.Config.WhiteBalance.Mode, fi.Config.CameraWhite, neutral)
+
+	old := fi.Config.CameraWhite
+	fi.Config.CameraToPCS = fi.Config.CameraToPCS.Mult(old.Diag()).Mult(neutral.InvertDiag())
+	fi.Config.CameraWhite = neutral
+}
+
+// CalibrateToSolarSpectrum picks the white balance so that the
+// integrated corona develops to the color of sunlight. The K-corona is
+// sunlight scattered off free electrons, which doesn't change its
+// spectrum, so it should have the color of a G2V star; we take that to
+// be a blackbody at the Sun's effective temperature, as seen by a
+// viewer adapted to D65 (i.e. a typical display). It needs the fused
+// camera native pixels, so Fuse() calls it before developing.
+func (fi *FusedImage)CalibrateToSolarSpectrum() error {
+	cfg := fi.Config.WhiteBalance
+	if !fi.needsLunarLimb("WhiteBalance solar") {
+		return fmt.Errorf("no lunar limb")
+	}
+	inner, outer, temp := cfg.SolarInnerRadius, cfg.SolarOuterRadius, cfg.SolarTemperature
+	if inner == 0.0 { inner = 1.1 }
+	if outer == 0.0 { outer = 3.0 }
+	if temp  == 0.0 { temp = ecolor.SolarEffectiveTemperature }
+
+	// The integrated corona, in camera native space. We use the fused
+	// values; each is scaled by the IllumAtMax of the layer(s) it came
+	// from, and the develop pass hasn't yet put them all on the stack's
+	// scale, so do that for each sample.
+	avg, n := emath.Vec3{}, 0
+	for x:=0; x<fi.OutputArea.Dx(); x++ {
+		for y:=0; y<fi.OutputArea.Dy(); y++ {
+			if r := fi.SolarRadii(x, y); r < inner || r > outer {
+				continue
+			}
+			p := fi.Pix(x, y)
+			if p.Clipped {
+				continue
+			}
+			k := 1.0
+			if fi.IllumAtMax > 0.0 {
+				k = p.Fused.IllumAtMax / fi.IllumAtMax
+			}
+			avg[0], avg[1], avg[2] = avg[0]+k*p.Fused.R, avg[1]+k*p.Fused.G, avg[2]+k*p.Fused.B
+			n++
+		}
+	}
+	if n == 0 || avg[0] <= 0.0 || avg[1] <= 0.0 || avg[2] <= 0.0 {
+		return fmt.Errorf("nothing usable in the corona annulus [%.1f,%.1f]", inner, outer)
+	}
+
+	// The forward matrix maps white balanced camera native into XYZ(D50).
+	// We want the corona to land on the solar color (expressed in the
+	// D50 PCS), so find what white balanced value produces that, and
+	// then the white balance that gets us there from the corona average.
+	x, y := ecolor.PlanckianXY(temp)
+	target := ecolor.BradfordD65toD50.Apply(ecolor.XYToXYZ(x, y))
+	fm := fi.Config.CameraToPCS.Mult(fi.Config.CameraWhite.Diag())
+	wb := fm.Invert().Apply(target)
+	if wb[0] <= 0.0 || wb[1] <= 0.0 || wb[2] <= 0.0 {
+		return fmt.Errorf("solar reference %s is outside the camera gamut", target)
+	}
+
+	neutral := emath.Vec3{avg[0] / wb[0], avg[1] / wb[1], avg[2] / wb[2]}
+	neutral = emath.Vec3{neutral[0] / neutral[1], 1.0, neutral[2] / neutral[1]}
+
+	fi.Config.infof("WhiteBalance solar: %.0fK reference xy=[%.4f, %.4f], corona annulus [%.1f,%.1f] (%d pix) averaged %s\n",
+		temp, x, y, inner, outer, n, avg)
+	fi.setCameraWhite(neutral)
+	return nil
+}
+
+// sampleGrayPoint averages the camera native color around the gray
+// point, using the most exposed layer that isn't clipped there.
+func (fi *FusedImage)sampleGrayPoint(cfg WhiteBalanceConfig) (emath.Vec3, error) {
+	r := cfg.GrayPointRadius
+	if r == 0 { r = 5 }
+
+	for _, l := range fi.Layers {
+		avg, clipped, n := emath.Vec3{}, false, 0
+		for x:=cfg.GrayPoint.X-r; x<=cfg.GrayPoint.X+r; x++ {
+			for y:=cfg.GrayPoint.Y-r; y<=cfg.GrayPoint.Y+r; y++ {
+				if !(image.Point{x, y}).In(l.LoadedImage.Bounds()) {
+					continue
+				}
+				cr, cg, cb, _ := l.LoadedImage.At(x, y).RGBA()
+				c := emath.Vec3{float64(cr)/0xFFFF, float64(cg)/0xFFFF, float64(cb)/0xFFFF}
+				if c[0] >= fi.Config.ClipLevel || c[1] >= fi.Config.ClipLevel || c[2] >= fi.Config.ClipLevel {
+					clipped = true
+				}
+				avg[0], avg[1], avg[2] = avg[0]+c[0], avg[1]+c[1], avg[2]+c[2]
+				n++
+			}
+		}
+		if n == 0 {
+			return emath.Vec3{}, fmt.Errorf("point %v is outside the image", cfg.GrayPoint)
+		}
+		if clipped || avg[0] == 0 || avg[1] == 0 || avg[2] == 0 {
+			continue
+		}
+		fi.Config.debugf("White balance: gray point %v sampled from %s\n", cfg.GrayPoint, l.Filename())
+		return emath.Vec3{avg[0]/avg[1], 1.0, avg[2]/avg[1]}, nil
+	}
+
+	return emath.Vec3{}, fmt.Errorf("point %v is clipped (or black) in every layer", cfg.GrayPoint)
+}
@@ -0,0 +1,57 @@
+package eclipse
+
+import(
+	"fmt"
+	"os"
+)
+
+// WorkConfig says where scratch files go - the files handed to hooks,
+// which nobody needs once the run is over - and when they're cleaned
+// up. Each run gets its own new dir inside Dir, so runs don't trip
+// over each other. (The stage cache is not scratch; it is meant to
+// last, and goes in CacheDir.)
+type WorkConfig struct {
+	Dir      string  // Where the runs' scratch dirs go; if empty, the system temp dir ($TMPDIR, or /tmp)
+	Cleanup  string  // When to delete a run's scratch dir: always (the default), onsuccess (keep it to look at if the run fails), or never
+	Buffers  string  // Where the aligned frames, and each fused pixel's inputs, are kept: memory (the default), or disk (files mapped into memory, in the scratch dir)
+}
+
+// workDir returns the run's scratch dir, making it the first time.
+func (fi *FusedImage)workDir() (string, error) {
+	if fi.scratchDir != "" {
+		return fi.scratchDir, nil
+	}
+	if fi.Config.Work.Dir != "" {
+		if err := os.MkdirAll(fi.Config.Work.Dir, 0755); err != nil {
+			return "", fmt.Errorf("work dir: %v", err)
+		}
+	}
+	dir, err := os.MkdirTemp(fi.Config.Work.Dir, "eclipse-hdr-")
+	if err != nil {
+		return "", fmt.Errorf("work dir: %v", err)
+	}
+	fi.Config.debugf("Scratch files go in %s\n", dir)
+	fi.scratchDir = dir
+	return dir, nil
+}
+
+// cleanupWork deletes the scratch dir (if there is one), as the
+// cleanup policy says, at the end of a run that failed with err (or
+// didn't, if nil).
+func (fi *FusedImage)cleanupWork(err error) {
+	if fi.scratchDir == "" {
+		return
+	}
+	switch {
+	case fi.Config.Work.Cleanup == "never":
+		fi.Config.infof("Kept scratch files in %s\n", fi.scratchDir)
+		return
+	case fi.Config.Work.Cleanup == "onsuccess" && err != nil:
+		fi.Config.infof("Run failed; kept scratch files in %s\n", fi.scratchDir)
+		return
+	}
+	if err := os.RemoveAll(fi.scratchDir); err != nil {
+		fi.Config.warnf("Cleaning up scratch files: %v\n", err)
+	}
+	fi.scratchDir = ""
+}
@@ -67,6 +67,21 @@ func (cn *CameraNative)AdjustIllumAtMax(newIllumAtMax float64) {
 	cn.IllumAtMax = newIllumAtMax
 }
 
+// ApplyLevels subtracts a per-channel black point, and scales by a
+// per-channel white point, so that `black` maps to 0.0 and `white`
+// maps to 1.0. A zero white point channel is treated as 1.0.
+func (cn *CameraNative)ApplyLevels(black, white emath.Vec3) {
+	level := func(v, b, w float64) float64 {
+		if w == 0.0 { w = 1.0 }
+		v = (v - b) / (w - b)
+		if v < 0.0 { v = 0.0 }
+		return v
+	}
+	cn.RGB.R = level(cn.RGB.R, black[0], white[0])
+	cn.RGB.G = level(cn.RGB.G, black[1], white[1])
+	cn.RGB.B = level(cn.RGB.B, black[2], white[2])
+}
+
 // ApplyCameraWhite performs white balancing. After this operation,
 // the color is no longer CameraNative, it is camera-neutral (i.e.
 // white balanced), so return as arbitrary RGB.
@@ -114,6 +129,13 @@ func XYZToSRGB(xyz hdrcolor.XYZ) hdrcolor.RGB {
 // AverageBalancedCameraNativeRGBs accounts for the different exposures that
 // each CameraNative may have
 func AverageBalancedCameraNativeRGBs(in []CameraNative) CameraNative {
+	return WeightedAverageBalancedCameraNativeRGBs(in, nil)
+}
+
+// WeightedAverageBalancedCameraNativeRGBs is like
+// AverageBalancedCameraNativeRGBs, but weights each input; if weights
+// is nil, they all count the same.
+func WeightedAverageBalancedCameraNativeRGBs(in []CameraNative, weights []float64) CameraNative {
 	maxIllum := 0.0
 	for i:=0; i<len(in); i++ {
 		if in[i].IllumAtMax > maxIllum { maxIllum = in[i].IllumAtMax }
@@ -121,15 +143,19 @@ func AverageBalancedCameraNativeRGBs(in []CameraNative) CameraNative {
 
 	ret := CameraNative{IllumAtMax: maxIllum}
 
+	sumW := 0.0
 	for i:=0; i<len(in); i++ {
-		ret.RGB.R += (in[i].RGB.R * in[i].IllumAtMax / maxIllum)
-		ret.RGB.G += (in[i].RGB.G * in[i].IllumAtMax / maxIllum)
-		ret.RGB.B += (in[i].RGB.B * in[i].IllumAtMax / maxIllum)
+		w := 1.0
+		if weights != nil { w = weights[i] }
+		ret.RGB.R += w * (in[i].RGB.R * in[i].IllumAtMax / maxIllum)
+		ret.RGB.G += w * (in[i].RGB.G * in[i].IllumAtMax / maxIllum)
+		ret.RGB.B += w * (in[i].RGB.B * in[i].IllumAtMax / maxIllum)
+		sumW += w
 	}
 
-	ret.RGB.R /= float64(len(in))
-	ret.RGB.G /= float64(len(in))
-	ret.RGB.B /= float64(len(in))
+	ret.RGB.R /= sumW
+	ret.RGB.G /= sumW
+	ret.RGB.B /= sumW
 
 	return ret
 }
@@ -141,3 +167,9 @@ func HDRRGBFloorAt(c1 hdrcolor.RGB, min float64) hdrcolor.RGB {
 	if c2.B < min { c2.B = min }
 	return c2
 }
+
+// LinearSRGBLuminance returns the relative luminance (CIE Y) of a
+// linear sRGB(D65) color, e.g. a developed pixel.
+func LinearSRGBLuminance(rgb hdrcolor.RGB) float64 {
+	return 0.2126*rgb.R + 0.7152*rgb.G + 0.0722*rgb.B
+}
@@ -0,0 +1,40 @@
+package ecolor
+
+import(
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A CameraProfile holds the color data that a DNG file would provide,
+// for cameras whose files don't carry it (e.g. TIFFs exported from a
+// raw developer). The values come from `dng_validate.exe -v`.
+type CameraProfile struct {
+	AsShotNeutral  emath.Vec3  // A daylight white, in camera native RGB
+	ForwardMatrix  emath.Mat3  // Maps white-balanced camera native RGB into XYZ(D50); row at a time
+	Saturation     float64     `yaml:",omitempty"` // K in Lsat = K N²/(S t), the luminance (cd/m²) that saturates the sensor; if zero, unknown (see eclipse.RadianceConfig)
+}
+
+// CameraProfiles is the built-in table, keyed by the EXIF `Model` tag.
+var CameraProfiles = map[string]CameraProfile{
+	"NIKON Df": {
+		AsShotNeutral: emath.Vec3{0.501, 1, 0.7014},
+		ForwardMatrix: emath.Mat3{
+			0.6227,  0.3389,  0.0026,
+			0.2548,  0.9378, -0.1926,
+			0.0156, -0.1330,  0.9425,
+		},
+	},
+}
+
+// LookupCameraProfile looks in `extra` (e.g. from config) first, then the built-in table.
+func LookupCameraProfile(model string, extra map[string]CameraProfile) (CameraProfile, bool) {
+	if cp, exists := extra[model]; exists {
+		return cp, true
+	}
+	cp, exists := CameraProfiles[model]
+	return cp, exists
+}
+
+// CameraToPCS builds the single camera native -> XYZ(D50) matrix for this profile.
+func (cp CameraProfile)CameraToPCS() emath.Mat3 {
+	return MakeCameraToPCS(cp.AsShotNeutral, cp.ForwardMatrix)
+}
@@ -0,0 +1,141 @@
+package ecolor
+
+import(
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// An OutputColorSpace is an RGB space that we can develop into. As
+// for sRGB, the matrices map from XYZ(D50) and bundle in a Bradford
+// chromatic adaptation to the space's own reference white.
+//
+// Matrices computed from the primaries & white points in each spec;
+// they match the tables on http://www.brucelindbloom.com/
+type OutputColorSpace struct {
+	Name        string
+	FromXYZD50  emath.Mat3
+	Encode      func(float64) float64  // The transfer curve, linear -> encoded; both in [0,1]
+	Decode      func(float64) float64  // The inverse of Encode
+
+	// For tagging the PNGs: the xy chromaticities of the red, green &
+	// blue primaries and of the white point, and the plain power law
+	// closest to Decode
+	Chromaticities  [4][2]float64
+	Gamma           float64
+}
+
+var(
+	OutputColorSpaces = map[string]OutputColorSpace{
+		"srgb": {
+			Name:           "srgb",
+			FromXYZD50:     XYZD50_to_linear_sRGBD65,
+			Encode:         emath.GammaExpand_F64,
+			Decode:         emath.GammaCompress_F64,
+			Chromaticities: [4][2]float64{{0.64, 0.33}, {0.30, 0.60}, {0.15, 0.06}, {0.3127, 0.3290}},
+			Gamma:          2.2,
+		},
+		"adobergb": {
+			Name:           "adobergb",
+			FromXYZD50:     emath.Mat3{
+				 1.9624274, -0.6105343, -0.3413404,
+				-0.9787684,  1.9161415,  0.0334540,
+				 0.0286869, -0.1406752,  1.3487655,
+			},
+			Encode:         gammaFunc(1.0 / (563.0/256.0)),
+			Decode:         gammaFunc(563.0/256.0),
+			Chromaticities: [4][2]float64{{0.64, 0.33}, {0.21, 0.71}, {0.15, 0.06}, {0.3127, 0.3290}},
+			Gamma:          563.0/256.0,
+		},
+		"displayp3": {
+			Name:           "displayp3",
+			FromXYZD50:     emath.Mat3{
+				 2.4038183, -0.9897174, -0.3975865,
+				-0.8422290,  1.7988454,  0.0160549,
+				 0.0481867, -0.0973766,  1.2735110,
+			},
+			Encode:         emath.GammaExpand_F64, // Display P3 uses the sRGB curve
+			Decode:         emath.GammaCompress_F64,
+			Chromaticities: [4][2]float64{{0.680, 0.320}, {0.265, 0.690}, {0.150, 0.060}, {0.3127, 0.3290}},
+			Gamma:          2.2,
+		},
+		"prophoto": {
+			Name:           "prophoto",
+			FromXYZD50:     emath.Mat3{ // D50 native, so no adaptation needed
+				 1.3459433, -0.2556075, -0.0511118,
+				-0.5445989,  1.5081673,  0.0205351,
+				 0.0000000,  0.0000000,  1.2118128,
+			},
+			Encode:         encodeROMM,
+			Decode:         decodeROMM,
+			Chromaticities: [4][2]float64{{0.7347, 0.2653}, {0.1596, 0.8404}, {0.0366, 0.0001}, {0.3457, 0.3585}},
+			Gamma:          1.8,
+		},
+		"rec2020-linear": {
+			Name:           "rec2020-linear",
+			FromXYZD50:     emath.Mat3{
+				 1.6472027, -0.3935353, -0.2359769,
+				-0.6826124,  1.6476100,  0.0128192,
+				 0.0296587, -0.0629128,  1.2533965,
+			},
+			Encode:         func(f float64) float64 { return f },
+			Decode:         func(f float64) float64 { return f },
+			Chromaticities: [4][2]float64{{0.708, 0.292}, {0.170, 0.797}, {0.131, 0.046}, {0.3127, 0.3290}},
+			Gamma:          1.0,
+		},
+	}
+)
+
+// LookupOutputColorSpace finds the named space; "" means sRGB.
+func LookupOutputColorSpace(name string) (OutputColorSpace, error) {
+	if name == "" {
+		name = "srgb"
+	}
+	if cs, exists := OutputColorSpaces[name]; exists {
+		return cs, nil
+	}
+	return OutputColorSpace{}, fmt.Errorf("output color space '%s' not recognized, wanted %s", name, ListOutputColorSpaces())
+}
+
+func ListOutputColorSpaces() string {
+	names := []string{}
+	for name := range OutputColorSpaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%v", names)
+}
+
+// FromXYZ maps an XYZ(D50) color into linear RGB in this space
+func (cs OutputColorSpace)FromXYZ(xyz hdrcolor.XYZ) hdrcolor.RGB {
+	rgb := cs.FromXYZD50.Apply(emath.Vec3{xyz.X, xyz.Y, xyz.Z})
+	return hdrcolor.RGB{R: rgb[0], G: rgb[1], B: rgb[2]}
+}
+
+// EncodeVec3 applies the transfer curve to each channel
+func (cs OutputColorSpace)EncodeVec3(v emath.Vec3) emath.Vec3 {
+	return emath.Vec3{cs.Encode(v[0]), cs.Encode(v[1]), cs.Encode(v[2])}
+}
+
+func gammaFunc(gamma float64) func(float64) float64 {
+	return func(f float64) float64 { return math.Pow(math.Max(f, 0.0), gamma) }
+}
+
+// The ProPhoto (ROMM RGB) curve has a short linear segment near black
+func encodeROMM(f float64) float64 {
+	if f < 1.0/512.0 {
+		return 16.0 * f
+	}
+	return math.Pow(f, 1.0/1.8)
+}
+
+func decodeROMM(f float64) float64 {
+	if f < 16.0/512.0 {
+		return f / 16.0
+	}
+	return math.Pow(f, 1.8)
+}
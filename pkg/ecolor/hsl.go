@@ -0,0 +1,77 @@
+package ecolor
+
+import(
+	"math"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// RGBToHSL splits an RGB color into hue (degrees, [0,360)), saturation
+// ([0,1]) and lightness, by the bi-hexcone model: lightness is halfway
+// between the brightest & dimmest channels, so lightening a color takes
+// it towards white (and darkening it, towards black). Lightness only
+// goes up to 1.0, so colors need to be scaled into [0,1] first.
+func RGBToHSL(c hdrcolor.RGB) (h, s, l float64) {
+	max := math.Max(c.R, math.Max(c.G, c.B))
+	min := math.Min(c.R, math.Min(c.G, c.B))
+	chroma := max - min
+	l = (max + min) / 2.0
+	if d := 1.0 - math.Abs(2.0*l - 1.0); d > 0.0 {
+		s = chroma / d
+	}
+	return hue(c, max, chroma), s, l
+}
+
+// HSLToRGB is the inverse of RGBToHSL.
+func HSLToRGB(h, s, l float64) hdrcolor.RGB {
+	chroma := (1.0 - math.Abs(2.0*l - 1.0)) * s
+	return fromHue(h, chroma, l - chroma/2.0)
+}
+
+// hue is the hexcone hue (degrees) of a color, given its brightest
+// channel and chroma; grays are 0.
+func hue(c hdrcolor.RGB, max, chroma float64) float64 {
+	if chroma == 0.0 {
+		return 0.0
+	}
+	var h float64
+	switch max {
+	case c.R: h = math.Mod((c.G - c.B) / chroma, 6.0)
+	case c.G: h = (c.B - c.R) / chroma + 2.0
+	default:  h = (c.R - c.G) / chroma + 4.0
+	}
+	h *= 60.0
+	if h < 0.0 {
+		h += 360.0
+	}
+	return h
+}
+
+// fromHue is the color of hue h with the given chroma, plus m of each channel.
+func fromHue(h, chroma, m float64) hdrcolor.RGB {
+	h = math.Mod(h, 360.0)
+	if h < 0.0 {
+		h += 360.0
+	}
+	x := chroma * (1.0 - math.Abs(math.Mod(h / 60.0, 2.0) - 1.0))
+
+	var r, g, b float64
+	switch {
+	case h < 60.0:  r, g, b = chroma, x, 0.0
+	case h < 120.0: r, g, b = x, chroma, 0.0
+	case h < 180.0: r, g, b = 0.0, chroma, x
+	case h < 240.0: r, g, b = 0.0, x, chroma
+	case h < 300.0: r, g, b = x, 0.0, chroma
+	default:        r, g, b = chroma, 0.0, x
+	}
+	return hdrcolor.RGB{R: r + m, G: g + m, B: b + m}
+}
+
+// HueDistance is the shortest angle (degrees) between two hues.
+func HueDistance(h1, h2 float64) float64 {
+	d := math.Mod(math.Abs(h1 - h2), 360.0)
+	if d > 180.0 {
+		d = 360.0 - d
+	}
+	return d
+}
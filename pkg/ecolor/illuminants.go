@@ -0,0 +1,47 @@
+package ecolor
+
+import(
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+var(
+	// Bradford chromatic adaptation, from a D65 reference white to D50
+	// http://www.brucelindbloom.com/index.html?Eqn_ChromAdapt.html
+	BradfordD65toD50 = emath.Mat3{
+		 1.0478112,  0.0228866, -0.0501270,
+		 0.0295424,  0.9904844, -0.0170491,
+		-0.0092345,  0.0150436,  0.7521316,
+	}
+
+	// The Sun is a G2V star; its spectrum above the atmosphere is close
+	// to a blackbody at its effective temperature.
+	SolarEffectiveTemperature = 5778.0
+)
+
+// PlanckianXY returns the CIE 1931 xy chromaticity of a blackbody at
+// the given temperature, using the cubic spline approximation of
+// Kim et al. (valid from 1667K to 25000K).
+func PlanckianXY(kelvin float64) (float64, float64) {
+	t := kelvin
+	var x, y float64
+	if t <= 4000.0 {
+		x = -0.2661239e9/(t*t*t) - 0.2343589e6/(t*t) + 0.8776956e3/t + 0.179910
+	} else {
+		x = -3.0258469e9/(t*t*t) + 2.1070379e6/(t*t) + 0.2226347e3/t + 0.240390
+	}
+
+	switch {
+	case t <= 2222.0:
+		y = -1.1063814*x*x*x - 1.34811020*x*x + 2.18555832*x - 0.20219683
+	case t <= 4000.0:
+		y = -0.9549476*x*x*x - 1.37418593*x*x + 2.09137015*x - 0.16748867
+	default:
+		y =  3.0817580*x*x*x - 5.87338670*x*x + 3.75112997*x - 0.37001483
+	}
+	return x, y
+}
+
+// XYToXYZ returns the XYZ color with chromaticity xy, and Y=1.
+func XYToXYZ(x, y float64) emath.Vec3 {
+	return emath.Vec3{x / y, 1.0, (1.0 - x - y) / y}
+}
@@ -0,0 +1,98 @@
+package ecolor
+
+import(
+	"fmt"
+	"math"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A Lab color is CIE L*a*b*. L* is perceptual lightness, which is
+// what filters like denoise should touch if they don't want to shift
+// colors. HDR values have L* > 100, which is fine.
+type Lab struct {
+	L, A, B float64
+}
+
+var(
+	// Reference whites, as XYZ (Y=1)
+	WhiteD50 = emath.Vec3{0.96422, 1.0, 0.82521}
+	WhiteD65 = emath.Vec3{0.95047, 1.0, 1.08883}
+)
+
+func (c Lab)String() string {
+	return fmt.Sprintf("Lab[%8.4f, %8.4f, %8.4f]", c.L, c.A, c.B)
+}
+
+// XYZToLab converts relative to the given reference white.
+func XYZToLab(xyz hdrcolor.XYZ, white emath.Vec3) Lab {
+	f := func(t float64) float64 {
+		if t > 216.0/24389.0 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27.0 * t + 16.0) / 116.0
+	}
+	fx, fy, fz := f(xyz.X / white[0]), f(xyz.Y / white[1]), f(xyz.Z / white[2])
+
+	return Lab{
+		L: 116.0 * fy - 16.0,
+		A: 500.0 * (fx - fy),
+		B: 200.0 * (fy - fz),
+	}
+}
+
+// LabToXYZ is the inverse of XYZToLab.
+func LabToXYZ(lab Lab, white emath.Vec3) hdrcolor.XYZ {
+	finv := func(t float64) float64 {
+		if t*t*t > 216.0/24389.0 {
+			return t*t*t
+		}
+		return (116.0 * t - 16.0) / (24389.0/27.0)
+	}
+	fy := (lab.L + 16.0) / 116.0
+	fx := fy + lab.A / 500.0
+	fz := fy - lab.B / 200.0
+
+	return hdrcolor.XYZ{
+		X: white[0] * finv(fx),
+		Y: white[1] * finv(fy),
+		Z: white[2] * finv(fz),
+	}
+}
+
+// ToXYZ maps linear RGB in this space back to XYZ(D50). This is the
+// inverse of FromXYZ.
+func (cs OutputColorSpace)ToXYZ(rgb hdrcolor.RGB) hdrcolor.XYZ {
+	xyz := cs.FromXYZD50.Invert().Apply(emath.Vec3{rgb.R, rgb.G, rgb.B})
+	return hdrcolor.XYZ{X: xyz[0], Y: xyz[1], Z: xyz[2]}
+}
+
+// ToLab maps linear RGB in this space into L*a*b*(D50)
+func (cs OutputColorSpace)ToLab(rgb hdrcolor.RGB) Lab {
+	return XYZToLab(cs.ToXYZ(rgb), WhiteD50)
+}
+
+// FromLab maps L*a*b*(D50) into linear RGB in this space
+func (cs OutputColorSpace)FromLab(lab Lab) hdrcolor.RGB {
+	return cs.FromXYZ(LabToXYZ(lab, WhiteD50))
+}
+
+// LinearSRGBToXYZ maps linear sRGB to XYZ(D65), with no chromatic adaptation.
+func LinearSRGBToXYZ(rgb hdrcolor.RGB) hdrcolor.XYZ {
+	return hdrcolor.XYZ{
+		X: 0.4124564*rgb.R + 0.3575761*rgb.G + 0.1804375*rgb.B,
+		Y: 0.2126729*rgb.R + 0.7151522*rgb.G + 0.0721750*rgb.B,
+		Z: 0.0193339*rgb.R + 0.1191920*rgb.G + 0.9503041*rgb.B,
+	}
+}
+
+// XYZToLinearSRGB maps XYZ(D65) to linear sRGB, with no chromatic adaptation.
+func XYZToLinearSRGB(xyz hdrcolor.XYZ) hdrcolor.RGB {
+	return hdrcolor.RGB{
+		R:  3.2404542*xyz.X - 1.5371385*xyz.Y - 0.4985314*xyz.Z,
+		G: -0.9692660*xyz.X + 1.8760108*xyz.Y + 0.0415560*xyz.Z,
+		B:  0.0556434*xyz.X - 0.2040259*xyz.Y + 1.0572252*xyz.Z,
+	}
+}
@@ -0,0 +1,89 @@
+package eenhance
+
+import(
+	"math"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// An HSLAdjustment tweaks the pixels whose hue falls in a range, e.g.
+// the red of the prominences (around 0), or a blue sky fringe (around
+// 220). Hues are in degrees, in the developed (linear) RGB space.
+type HSLAdjustment struct {
+	Hue         float64  // Center of the hue range
+	Width       float64  // Pixels within Width/2 of Hue get the full adjustment
+	Feather     float64  // ... fading out to nothing over this many more degrees
+	HueShift    float64  // Degrees to rotate the hue by
+	Saturation  float64  // Saturation multiplier; if zero, 1.0
+	Lightness   float64  // Lightness multiplier (so above 1.0 heads towards white); if zero, 1.0
+}
+
+// weight is how much of the adjustment applies to a pixel of hue `h`.
+func (a HSLAdjustment)weight(h float64) float64 {
+	d := ecolor.HueDistance(h, a.Hue) - a.Width/2.0
+	if d <= 0.0 {
+		return 1.0
+	} else if d >= a.Feather {
+		return 0.0
+	}
+	return 1.0 - d / a.Feather
+}
+
+// WithDefaults fills in the multipliers that were left at zero.
+func (a HSLAdjustment)WithDefaults() HSLAdjustment {
+	if a.Saturation == 0.0 { a.Saturation = 1.0 }
+	if a.Lightness  == 0.0 { a.Lightness = 1.0 }
+	return a
+}
+
+// Adjust applies the adjustment (which should have its defaults). Gray
+// pixels have no hue, so are left alone. HSL lightness only goes up to
+// white, so HDR pixels brighter than that are scaled down into range,
+// adjusted, and scaled back up.
+func (a HSLAdjustment)Adjust(c hdrcolor.RGB, _ float64) hdrcolor.RGB {
+	k := math.Max(1.0, math.Max(c.R, math.Max(c.G, c.B)))
+	h, s, l := ecolor.RGBToHSL(hdrcolor.RGB{R: c.R / k, G: c.G / k, B: c.B / k})
+	if s == 0.0 {
+		return c
+	}
+	w := a.weight(h)
+	if w == 0.0 {
+		return c
+	}
+
+	h += w * a.HueShift
+	s *= 1.0 + w * (a.Saturation - 1.0)
+	l *= 1.0 + w * (a.Lightness - 1.0)
+	if s > 1.0 { s = 1.0 }
+	if l > 1.0 { l = 1.0 }
+
+	c = ecolor.HSLToRGB(h, s, l)
+	return hdrcolor.RGB{R: c.R * k, G: c.G * k, B: c.B * k}
+}
+
+// RadialSaturation scales the saturation of each pixel by the profile,
+// at its distance from the sun. Each channel moves towards (or away
+// from) the luminance, which is left unchanged.
+type RadialSaturation RadialProfile
+
+func (rs RadialSaturation)Adjust(c hdrcolor.RGB, r float64) hdrcolor.RGB {
+	s := RadialProfile(rs).At(r)
+	lum := ecolor.LinearSRGBLuminance(c)
+	c.R = lum + s * (c.R - lum)
+	c.G = lum + s * (c.G - lum)
+	c.B = lum + s * (c.B - lum)
+	return ecolor.HDRRGBFloorAt(c, 0.0)
+}
+
+// A ChannelMixer blends the RGB channels through a 3x3 matrix; each
+// output channel is a weighted sum of the input channels (row major,
+// so the first row gives the new red).
+type ChannelMixer emath.Mat3
+
+func (cm ChannelMixer)Adjust(c hdrcolor.RGB, _ float64) hdrcolor.RGB {
+	v := emath.Mat3(cm).Apply(emath.Vec3{c.R, c.G, c.B})
+	return ecolor.HDRRGBFloorAt(hdrcolor.RGB{R: v[0], G: v[1], B: v[2]}, 0.0)
+}
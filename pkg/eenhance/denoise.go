@@ -0,0 +1,71 @@
+package eenhance
+
+import(
+	"math"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+)
+
+// The denoising filters compare pixels relative to the brightness of
+// the one being filtered, because the brightness of the corona falls
+// off by orders of magnitude. They read from src (which should clamp
+// at its edges, as a Plane does), so they don't see what they've
+// already filtered.
+
+// relDiff is the difference in luminance, relative to the reference.
+func relDiff(ref, c hdrcolor.RGB) float64 {
+	lRef := ecolor.LinearSRGBLuminance(ref)
+	return (ecolor.LinearSRGBLuminance(c) - lRef) / (lRef + 1e-9)
+}
+
+// Bilateral is a classic bilateral filter: neighbours are weighted by
+// both distance and similarity.
+func Bilateral(src Image, x, y, radius int, sigma float64) hdrcolor.RGB {
+	ref := src.RGB(x, y)
+	spatialSigma := float64(radius) / 2.0
+
+	out, totW := hdrcolor.RGB{}, 0.0
+	for i:=-radius; i<=radius; i++ {
+		for j:=-radius; j<=radius; j++ {
+			c := src.RGB(x+i, y+j)
+			d := relDiff(ref, c)
+			w := math.Exp(-float64(i*i+j*j) / (2*spatialSigma*spatialSigma)) * math.Exp(-d*d / (2*sigma*sigma))
+			out.R, out.G, out.B = out.R + w*c.R, out.G + w*c.G, out.B + w*c.B
+			totW += w
+		}
+	}
+	out.R, out.G, out.B = out.R/totW, out.G/totW, out.B/totW
+	return out
+}
+
+// NLMeans is a small non-local means filter: neighbours in the search
+// window are weighted by how similar the 3x3 patch around them is to
+// the patch around [x,y].
+func NLMeans(src Image, x, y, radius int, sigma float64) hdrcolor.RGB {
+	ref := src.RGB(x, y)
+
+	patchDist := func(x2, y2 int) float64 {
+		tot := 0.0
+		for i:=-1; i<=1; i++ {
+			for j:=-1; j<=1; j++ {
+				d := relDiff(ref, src.RGB(x+i, y+j)) - relDiff(ref, src.RGB(x2+i, y2+j))
+				tot += d*d
+			}
+		}
+		return tot / 9.0
+	}
+
+	out, totW := hdrcolor.RGB{}, 0.0
+	for i:=-radius; i<=radius; i++ {
+		for j:=-radius; j<=radius; j++ {
+			c := src.RGB(x+i, y+j)
+			w := math.Exp(-patchDist(x+i, y+j) / (sigma*sigma))
+			out.R, out.G, out.B = out.R + w*c.R, out.G + w*c.G, out.B + w*c.B
+			totW += w
+		}
+	}
+	out.R, out.G, out.B = out.R/totW, out.G/totW, out.B/totW
+	return out
+}
@@ -0,0 +1,82 @@
+// Package eenhance has the post-fusion filters, which work on the
+// developed (linear HDR) pixels: per-pixel adjustments (HSL, radial
+// saturation, channel mixing), the denoising filters, and the sky
+// gradient fit. They see the pixels as an Image, and how far each one
+// is from the sun as a radius; running them over a stack (in parallel,
+// with the config, logging etc) is up to the caller.
+package eenhance
+
+import(
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// An Image is the developed pixels that a filter reads (and the
+// caller writes back to); x and y run from zero.
+type Image interface {
+	Dims() (w, h int)
+	RGB(x, y int) hdrcolor.RGB
+}
+
+// An Adjuster changes each pixel on its own; r is how far the pixel
+// is from the center of the sun, in solar radii (-1 if that isn't
+// known).
+type Adjuster interface {
+	Adjust(c hdrcolor.RGB, r float64) hdrcolor.RGB
+}
+
+// A Plane is an Image in memory, e.g. a snapshot for a filter to read
+// from while the original is overwritten.
+type Plane struct {
+	W, H  int
+	Pix   []hdrcolor.RGB  // Row by row
+}
+
+// Snapshot copies the image into a Plane.
+func Snapshot(img Image) *Plane {
+	w, h := img.Dims()
+	p := &Plane{W: w, H: h, Pix: make([]hdrcolor.RGB, w*h)}
+	for y:=0; y<h; y++ {
+		for x:=0; x<w; x++ {
+			p.Pix[y*w + x] = img.RGB(x, y)
+		}
+	}
+	return p
+}
+
+func (p *Plane)Dims() (int, int) { return p.W, p.H }
+
+// RGB clamps to the edges, so the filters can read past them.
+func (p *Plane)RGB(x, y int) hdrcolor.RGB {
+	if x < 0 { x = 0 }
+	if y < 0 { y = 0 }
+	if x >= p.W { x = p.W-1 }
+	if y >= p.H { y = p.H-1 }
+	return p.Pix[y*p.W + x]
+}
+
+// A RadialProfile is a piecewise-linear function of the distance from
+// the sun's center; it is a list of points, with the radius in solar
+// radii, sorted by radius. Beyond the first and last points, the value
+// is held constant.
+type RadialProfile []RadialPoint
+
+type RadialPoint struct {
+	Radius float64
+	Value  float64
+}
+
+// At interpolates the profile at radius `r`. An empty profile is 1.0 everywhere.
+func (rp RadialProfile)At(r float64) float64 {
+	if len(rp) == 0 {
+		return 1.0
+	} else if r <= rp[0].Radius {
+		return rp[0].Value
+	}
+	for i:=1; i<len(rp); i++ {
+		if r <= rp[i].Radius {
+			frac := (r - rp[i-1].Radius) / (rp[i].Radius - rp[i-1].Radius)
+			return rp[i-1].Value + frac * (rp[i].Value - rp[i-1].Value)
+		}
+	}
+	return rp[len(rp)-1].Value
+}
@@ -0,0 +1,97 @@
+package eenhance
+
+import(
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/mdouchement/hdr/hdrcolor"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A SkyGradient is a smooth background across the image, e.g. from
+// twilight sky near the horizon, or thin cloud: a low order 2D
+// polynomial for each channel, in coords scaled to [-1,1] (to keep the
+// normal equations well conditioned).
+type SkyGradient struct {
+	Order   int            // 1 (a plane), or 2 (a quadratic surface)
+	W, H    int            // Of the image it was fitted to
+	Coeffs  [3][]float64   // For R, G & B
+}
+
+func (g SkyGradient)terms(x, y int) []float64 {
+	u := 2.0*float64(x)/float64(g.W) - 1.0
+	v := 2.0*float64(y)/float64(g.H) - 1.0
+	if g.Order == 1 {
+		return []float64{1, u, v}
+	}
+	return []float64{1, u, v, u*u, u*v, v*v}
+}
+
+// FitSkyGradient fits the gradient to the image at the sample points
+// (which should stay clear of the sun and corona), each channel
+// separately. Outliers (stars, hot pixels) are rejected and the fit is
+// repeated.
+func FitSkyGradient(img Image, order int, samples []image.Point) (SkyGradient, error) {
+	g := SkyGradient{Order: order}
+	g.W, g.H = img.Dims()
+	if order < 1 || order > 2 {
+		return g, fmt.Errorf("order %d not supported, wanted 1 or 2", order)
+	}
+
+	for ch:=0; ch<3; ch++ {
+		val := func(s image.Point) float64 {
+			rgb := img.RGB(s.X, s.Y)
+			return [3]float64{rgb.R, rgb.G, rgb.B}[ch]
+		}
+
+		keep := samples
+		for pass:=0; pass<3; pass++ {
+			rows, vals := make([][]float64, len(keep)), make([]float64, len(keep))
+			for i, s := range keep {
+				rows[i], vals[i] = g.terms(s.X, s.Y), val(s)
+			}
+			c, err := emath.LeastSquares(rows, vals)
+			if err != nil {
+				return g, err
+			}
+			g.Coeffs[ch] = c
+
+			// Sigma-clip, and refit
+			sumSq := 0.0
+			for i := range keep {
+				d := vals[i] - dot(c, rows[i])
+				sumSq += d*d
+			}
+			sigma := math.Sqrt(sumSq / float64(len(keep)))
+			next := []image.Point{}
+			for i, s := range keep {
+				if math.Abs(vals[i] - dot(c, rows[i])) <= 3.0*sigma {
+					next = append(next, s)
+				}
+			}
+			keep = next
+		}
+	}
+	return g, nil
+}
+
+// Remove subtracts the gradient from the pixel at [x,y] (and stops it
+// going negative).
+func (g SkyGradient)Remove(c hdrcolor.RGB, x, y int) hdrcolor.RGB {
+	t := g.terms(x, y)
+	return hdrcolor.RGB{
+		R: math.Max(0.0, c.R - dot(g.Coeffs[0], t)),
+		G: math.Max(0.0, c.G - dot(g.Coeffs[1], t)),
+		B: math.Max(0.0, c.B - dot(g.Coeffs[2], t)),
+	}
+}
+
+func dot(a, b []float64) float64 {
+	tot := 0.0
+	for i := range a {
+		tot += a[i] * b[i]
+	}
+	return tot
+}
@@ -0,0 +1,135 @@
+// Package egpu runs the heaviest per-pixel kernels - warping frames,
+// the bilateral filter, and the frame differences that fine-tuned
+// alignment scores each candidate by - on a GPU. The GPU code (OpenCL,
+// which there's a driver for on Linux, Windows and macOS) is only
+// built with `-tags opencl`, and needs cgo. Without it, or if the GPU
+// can't do something (no device, out of memory), the Device methods say
+// so, and the caller does the work on the CPU as usual.
+package egpu
+
+import(
+	"fmt"
+	"image"
+	"sync/atomic"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A Backend is a GPU API that can run the kernels. Images that are
+// given to it more than once (e.g. the two frames that fine tuning
+// compares, over and over) can be kept on the device; they mustn't
+// change in the meantime.
+type Backend interface {
+	Name() string
+
+	// Warp is eimage.Planar.WarpInto: dst gets src (which has the same
+	// bounds) moved by s2d.
+	Warp(dst *eimage.Planar, src image.Image, s2d emath.Aff3) error
+
+	// Diff compares a with b (moved by s2d, as by Warp), over r. Pixels
+	// which have a channel below lo, or above hi, in either image are
+	// skipped; for the rest, it sums |wa.a - wb.b|, and counts them.
+	Diff(a, b image.Image, s2d emath.Aff3, r image.Rectangle, wa, wb [3]float64, lo, hi float64) (float64, int, error)
+
+	// Bilateral filters the w*h RGB float triples in src (x varying
+	// fastest) into dst, as the `bilateral` denoise does; each pixel has
+	// its own range sigma, and is left as is if that's zero.
+	Bilateral(dst, src []float32, w, h, radius int, sigma []float32) error
+}
+
+// opener opens the GPU; the build with `-tags opencl` sets it.
+var opener func() (Backend, error)
+
+// A Device is a Backend that gets out of the way if it fails: after
+// the first error nothing more is sent to it, and every call says to
+// use the CPU. A nil Device is the CPU.
+type Device struct {
+	backend  Backend
+	failed  *atomic.Bool                               // Shared with the copies from WithWarnf
+	Warnf    func(format string, args ...interface{}) // If set, told when the device fails
+}
+
+// Open opens the first GPU there is; it fails if there isn't one, or
+// this build doesn't have GPU support.
+func Open() (*Device, error) {
+	if opener == nil {
+		return nil, fmt.Errorf("this build has no GPU support (build with -tags opencl)")
+	}
+	b, err := opener()
+	if err != nil {
+		return nil, err
+	}
+	return &Device{backend: b, failed: new(atomic.Bool)}, nil
+}
+
+// WithWarnf is the same device, telling warnf (rather than d.Warnf)
+// if it fails; for when several users share a device, with their own
+// logs.
+func (d *Device)WithWarnf(warnf func(format string, args ...interface{})) *Device {
+	if d == nil {
+		return nil
+	}
+	shared := *d
+	shared.Warnf = warnf
+	return &shared
+}
+
+// Name names the device, or is "cpu".
+func (d *Device)Name() string {
+	if !d.usable() {
+		return "cpu"
+	}
+	return d.backend.Name()
+}
+
+func (d *Device)usable() bool {
+	return d != nil && !d.failed.Load()
+}
+
+func (d *Device)fail(kernel string, err error) {
+	if d.failed.CompareAndSwap(false, true) && d.Warnf != nil {
+		d.Warnf("GPU: %s failed (%v); using the CPU from now on\n", kernel, err)
+	}
+}
+
+// Warp runs Backend.Warp, and says if it did; if not, dst is still
+// black, for the CPU to warp into.
+func (d *Device)Warp(dst *eimage.Planar, src image.Image, s2d emath.Aff3) bool {
+	if !d.usable() {
+		return false
+	}
+	if err := d.backend.Warp(dst, src, s2d); err != nil {
+		clear(dst.R)
+		clear(dst.G)
+		clear(dst.B)
+		d.fail("warp", err)
+		return false
+	}
+	return true
+}
+
+// Diff runs Backend.Diff, and says if it did.
+func (d *Device)Diff(a, b image.Image, s2d emath.Aff3, r image.Rectangle, wa, wb [3]float64, lo, hi float64) (float64, int, bool) {
+	if !d.usable() {
+		return 0, 0, false
+	}
+	sum, n, err := d.backend.Diff(a, b, s2d, r, wa, wb, lo, hi)
+	if err != nil {
+		d.fail("diff", err)
+		return 0, 0, false
+	}
+	return sum, n, true
+}
+
+// Bilateral runs Backend.Bilateral, and says if it did.
+func (d *Device)Bilateral(dst, src []float32, w, h, radius int, sigma []float32) bool {
+	if !d.usable() {
+		return false
+	}
+	if err := d.backend.Bilateral(dst, src, w, h, radius, sigma); err != nil {
+		d.fail("bilateral", err)
+		return false
+	}
+	return true
+}
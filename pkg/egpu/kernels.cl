@@ -0,0 +1,164 @@
+// The OpenCL kernels; see opencl.go. Each mirrors the Go code it
+// replaces, in float rather than double (not every GPU has doubles).
+//
+// An image is its three planes one after another in a single buffer,
+// R then G then B, each w*h floats; (ox,oy) is its top left corner.
+
+float catmullRom(float t) {
+	t = fabs(t);
+	if (t < 1.0f) {
+		return (1.5f*t - 2.5f)*t*t + 1.0f;
+	} else if (t < 2.0f) {
+		return ((-0.5f*t + 2.5f)*t - 4.0f)*t + 2.0f;
+	}
+	return 0.0f;
+}
+
+// warpAt samples src at the pixel whose center maps (by d2s) to (x,y)
+// in the destination, as eimage.Planar.WarpInto does; it's black if it
+// comes from beyond the edge.
+float3 warpAt(__global const float *src, int ox, int oy, int w, int h, __constant float *d2s, int x, int y) {
+	float dx = (float)x + 0.5f, dy = (float)y + 0.5f;
+	float sx = d2s[0]*dx + d2s[1]*dy + d2s[2];
+	float sy = d2s[3]*dx + d2s[4]*dy + d2s[5];
+	if (sx < (float)ox || sx >= (float)(ox+w) || sy < (float)oy || sy >= (float)(oy+h)) {
+		return (float3)(0.0f);
+	}
+
+	float px = sx - 0.5f, py = sy - 0.5f;
+	int ix = (int)floor(px) - 1, iy = (int)floor(py) - 1;
+	float wx[4], wy[4];
+	for (int k=0; k<4; k++) {
+		wx[k] = catmullRom(px - (float)(ix+k));
+		wy[k] = catmullRom(py - (float)(iy+k));
+	}
+
+	int n = w*h;
+	float3 sum = (float3)(0.0f);
+	float wsum = 0.0f;
+	for (int j=0; j<4; j++) {
+		int ty = iy + j;
+		if (ty < oy || ty >= oy+h) {
+			continue;
+		}
+		for (int k=0; k<4; k++) {
+			int tx = ix + k;
+			if (tx < ox || tx >= ox+w) {
+				continue;
+			}
+			float wt = wx[k] * wy[j];
+			int i = (ty-oy)*w + (tx-ox);
+			sum += wt * (float3)(src[i], src[n+i], src[2*n+i]);
+			wsum += wt;
+		}
+	}
+	if (wsum == 0.0f) {
+		return (float3)(0.0f);
+	}
+	return clamp(sum / wsum, 0.0f, 1.0f);
+}
+
+// warp fills every pixel of dst, which has src's bounds.
+__kernel void warp(__global const float *src, __global float *dst, int ox, int oy, int w, int h, __constant float *d2s) {
+	int x = get_global_id(0), y = get_global_id(1);
+	if (x >= w || y >= h) {
+		return;
+	}
+	float3 c = warpAt(src, ox, oy, w, h, d2s, ox+x, oy+y);
+	int i = y*w + x, n = w*h;
+	dst[i] = c.x;
+	dst[n+i] = c.y;
+	dst[2*n+i] = c.z;
+}
+
+// diff is the per-pixel part of Backend.Diff, over the rw*rh rectangle
+// at (rx,ry); skipped pixels get -1.
+__kernel void diff(__global const float *a, int aox, int aoy, int aw, int ah,
+                   __global const float *b, int box, int boy, int bw, int bh, __constant float *d2s,
+                   int rx, int ry, int rw, int rh, float4 wa, float4 wb, float lo, float hi,
+                   __global float *out) {
+	int x = get_global_id(0), y = get_global_id(1);
+	if (x >= rw || y >= rh) {
+		return;
+	}
+	int ax = rx+x-aox, ay = ry+y-aoy, an = aw*ah;
+	float3 c1 = (float3)(0.0f);
+	if (ax >= 0 && ax < aw && ay >= 0 && ay < ah) {
+		int i = ay*aw + ax;
+		c1 = (float3)(a[i], a[an+i], a[2*an+i]);
+	}
+	float3 c2 = warpAt(b, box, boy, bw, bh, d2s, rx+x, ry+y);
+
+	float e = -1.0f;
+	if (all(c1 >= lo) && all(c2 >= lo) && all(c1 <= hi) && all(c2 <= hi)) {
+		e = fabs(dot(wa.xyz, c1) - dot(wb.xyz, c2));
+	}
+	out[y*rw + x] = e;
+}
+
+// sumRows adds up each row of diff's output (ignoring the skipped
+// pixels), and counts the pixels that weren't; the host adds up the
+// rows. Kahan summation, as the rows can be long.
+__kernel void sumRows(__global const float *in, int rw, int rh, __global float *sums, __global int *counts) {
+	int y = get_global_id(0);
+	if (y >= rh) {
+		return;
+	}
+	float sum = 0.0f, carry = 0.0f;
+	int n = 0;
+	for (int x=0; x<rw; x++) {
+		float e = in[y*rw + x];
+		if (e < 0.0f) {
+			continue;
+		}
+		float v = e - carry;
+		float t = sum + v;
+		carry = (t - sum) - v;
+		sum = t;
+		n++;
+	}
+	sums[y] = sum;
+	counts[y] = n;
+}
+
+float luminance(float3 c) {
+	return 0.2126f*c.x + 0.7152f*c.y + 0.0722f*c.z; // ecolor.LinearSRGBLuminance
+}
+
+float3 rgbAt(__global const float *src, int w, int h, int x, int y) {
+	x = clamp(x, 0, w-1);
+	y = clamp(y, 0, h-1);
+	int i = 3*(y*w + x);
+	return (float3)(src[i], src[i+1], src[i+2]);
+}
+
+// bilateral is fi.bilateralAt, for every pixel.
+__kernel void bilateral(__global const float *src, __global float *dst, __global const float *sigmas, int w, int h, int radius) {
+	int x = get_global_id(0), y = get_global_id(1);
+	if (x >= w || y >= h) {
+		return;
+	}
+	int o = 3*(y*w + x);
+	float sigma = sigmas[y*w + x];
+	float3 ref = rgbAt(src, w, h, x, y);
+	if (sigma <= 0.0f) {
+		dst[o] = ref.x; dst[o+1] = ref.y; dst[o+2] = ref.z;
+		return;
+	}
+
+	float spatialSigma = (float)radius / 2.0f;
+	float lRef = luminance(ref);
+	float3 out = (float3)(0.0f);
+	float totW = 0.0f;
+	for (int i=-radius; i<=radius; i++) {
+		for (int j=-radius; j<=radius; j++) {
+			float3 c = rgbAt(src, w, h, x+i, y+j);
+			float d = (luminance(c) - lRef) / (lRef + 1e-9f);
+			float wt = exp(-(float)(i*i+j*j) / (2.0f*spatialSigma*spatialSigma)) * exp(-d*d / (2.0f*sigma*sigma));
+			out += wt * c;
+			totW += wt;
+		}
+	}
+	out /= totW;
+	dst[o] = out.x; dst[o+1] = out.y; dst[o+2] = out.z;
+}
@@ -0,0 +1,373 @@
+//go:build opencl && cgo
+
+package egpu
+
+/*
+#cgo linux   LDFLAGS: -lOpenCL
+#cgo windows LDFLAGS: -lOpenCL
+#cgo darwin  LDFLAGS: -framework OpenCL
+
+#define CL_TARGET_OPENCL_VERSION 120
+#ifdef __APPLE__
+#include <OpenCL/opencl.h>
+#else
+#include <CL/cl.h>
+#endif
+#include <stdlib.h>
+*/
+import "C"
+
+import(
+	_ "embed"
+	"fmt"
+	"image"
+	"sync"
+	"unsafe"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+//go:embed kernels.cl
+var kernelSource string
+
+var kernelNames = []string{"warp", "diff", "sumRows", "bilateral"}
+
+// maxCached is how many images Diff keeps on the device: the pair that
+// fine tuning keeps comparing.
+const maxCached = 2
+
+func init() {
+	opener = openCL
+}
+
+// clBackend runs the kernels on one OpenCL device. OpenCL objects can
+// be shared between threads, but a kernel's arguments can't, so it
+// runs one call at a time.
+type clBackend struct {
+	mu       sync.Mutex
+	name     string
+	ctx      C.cl_context
+	queue    C.cl_command_queue
+	program  C.cl_program
+	kernels  map[string]C.cl_kernel
+	cached   []cachedImage  // Most recently used first
+}
+
+type cachedImage struct {
+	img   image.Image
+	mem   C.cl_mem
+}
+
+func clErr(what string, status C.cl_int) error {
+	if status != C.CL_SUCCESS {
+		return fmt.Errorf("OpenCL %s: error %d", what, int(status))
+	}
+	return nil
+}
+
+// openCL opens the first GPU on any platform.
+func openCL() (Backend, error) {
+	var platforms [8]C.cl_platform_id
+	var np C.cl_uint
+	if err := clErr("clGetPlatformIDs", C.clGetPlatformIDs(C.cl_uint(len(platforms)), &platforms[0], &np)); err != nil {
+		return nil, err
+	}
+	for i:=0; i<int(np) && i<len(platforms); i++ {
+		var dev C.cl_device_id
+		var nd C.cl_uint
+		if C.clGetDeviceIDs(platforms[i], C.CL_DEVICE_TYPE_GPU, 1, &dev, &nd) == C.CL_SUCCESS && nd > 0 {
+			return newCLBackend(dev)
+		}
+	}
+	return nil, fmt.Errorf("no OpenCL GPU found")
+}
+
+func newCLBackend(dev C.cl_device_id) (*clBackend, error) {
+	b := &clBackend{kernels: map[string]C.cl_kernel{}}
+
+	var name [256]C.char
+	C.clGetDeviceInfo(dev, C.CL_DEVICE_NAME, C.size_t(len(name)-1), unsafe.Pointer(&name[0]), nil)
+	b.name = "opencl: " + C.GoString(&name[0])
+
+	var status C.cl_int
+	if b.ctx = C.clCreateContext(nil, 1, &dev, nil, nil, &status); status != C.CL_SUCCESS {
+		return nil, clErr("clCreateContext", status)
+	}
+	if b.queue = C.clCreateCommandQueue(b.ctx, dev, 0, &status); status != C.CL_SUCCESS {
+		b.close()
+		return nil, clErr("clCreateCommandQueue", status)
+	}
+
+	src := C.CString(kernelSource)
+	defer C.free(unsafe.Pointer(src))
+	length := C.size_t(len(kernelSource))
+	if b.program = C.clCreateProgramWithSource(b.ctx, 1, &src, &length, &status); status != C.CL_SUCCESS {
+		b.close()
+		return nil, clErr("clCreateProgramWithSource", status)
+	}
+	if status = C.clBuildProgram(b.program, 1, &dev, nil, nil, nil); status != C.CL_SUCCESS {
+		var log [4096]C.char
+		C.clGetProgramBuildInfo(b.program, dev, C.CL_PROGRAM_BUILD_LOG, C.size_t(len(log)-1), unsafe.Pointer(&log[0]), nil)
+		b.close()
+		return nil, fmt.Errorf("%v: %s", clErr("clBuildProgram", status), C.GoString(&log[0]))
+	}
+
+	for _, k := range kernelNames {
+		cname := C.CString(k)
+		kernel := C.clCreateKernel(b.program, cname, &status)
+		C.free(unsafe.Pointer(cname))
+		if status != C.CL_SUCCESS {
+			b.close()
+			return nil, clErr("clCreateKernel "+k, status)
+		}
+		b.kernels[k] = kernel
+	}
+
+	return b, nil
+}
+
+func (b *clBackend)close() {
+	for _, c := range b.cached {
+		C.clReleaseMemObject(c.mem)
+	}
+	b.cached = nil
+	for _, k := range b.kernels {
+		C.clReleaseKernel(k)
+	}
+	if b.program != nil { C.clReleaseProgram(b.program) }
+	if b.queue != nil   { C.clReleaseCommandQueue(b.queue) }
+	if b.ctx != nil     { C.clReleaseContext(b.ctx) }
+}
+
+func (b *clBackend)Name() string { return b.name }
+
+// buffer makes a device buffer of n bytes, copied from host if that's
+// not nil.
+func (b *clBackend)buffer(n int, host unsafe.Pointer) (C.cl_mem, error) {
+	flags := C.cl_mem_flags(C.CL_MEM_READ_WRITE)
+	if host != nil {
+		flags |= C.CL_MEM_COPY_HOST_PTR
+	}
+	var status C.cl_int
+	mem := C.clCreateBuffer(b.ctx, flags, C.size_t(n), host, &status)
+	return mem, clErr("clCreateBuffer", status)
+}
+
+func (b *clBackend)write(mem C.cl_mem, offset int, data []float32) error {
+	return clErr("clEnqueueWriteBuffer", C.clEnqueueWriteBuffer(b.queue, mem, C.CL_TRUE, C.size_t(offset*4),
+		C.size_t(len(data)*4), unsafe.Pointer(unsafe.SliceData(data)), 0, nil, nil))
+}
+
+func (b *clBackend)read(mem C.cl_mem, offset int, data unsafe.Pointer, n int) error {
+	return clErr("clEnqueueReadBuffer", C.clEnqueueReadBuffer(b.queue, mem, C.CL_TRUE, C.size_t(offset),
+		C.size_t(n), data, 0, nil, nil))
+}
+
+// upload copies the image's planes into one buffer, as the kernels
+// expect.
+func (b *clBackend)upload(img image.Image) (C.cl_mem, error) {
+	p := eimage.ToPlanar(img)
+	if p != img {
+		defer p.Release()
+	}
+	n := len(p.R)
+	mem, err := b.buffer(3*n*4, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, plane := range [][]float32{p.R, p.G, p.B} {
+		if err := b.write(mem, i*n, plane); err != nil {
+			C.clReleaseMemObject(mem)
+			return nil, err
+		}
+	}
+	return mem, nil
+}
+
+// uploadCached is upload, for an image that's likely to come again.
+func (b *clBackend)uploadCached(img image.Image) (C.cl_mem, error) {
+	for i, c := range b.cached {
+		if c.img == img {
+			copy(b.cached[1:i+1], b.cached[:i])
+			b.cached[0] = c
+			return c.mem, nil
+		}
+	}
+	mem, err := b.upload(img)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.cached) == maxCached {
+		C.clReleaseMemObject(b.cached[maxCached-1].mem)
+		b.cached = b.cached[:maxCached-1]
+	}
+	b.cached = append([]cachedImage{{img, mem}}, b.cached...)
+	return mem, nil
+}
+
+// matrix puts the inverse of s2d (what the kernels want) on the device.
+func (b *clBackend)matrix(s2d emath.Aff3) (C.cl_mem, error) {
+	d2s := s2d.Invert()
+	var m [6]float32
+	for i := range m {
+		m[i] = float32(d2s[i])
+	}
+	return b.buffer(len(m)*4, unsafe.Pointer(&m[0]))
+}
+
+// run sets the kernel's arguments (buffers, ints, floats or float4s),
+// and queues it over the global work size.
+func (b *clBackend)run(kernel string, global []int, args ...interface{}) error {
+	k := b.kernels[kernel]
+	for i, arg := range args {
+		var p unsafe.Pointer
+		var size uintptr
+		switch v := arg.(type) {
+		case C.cl_mem:     p, size = unsafe.Pointer(&v), unsafe.Sizeof(v)
+		case int:          x := C.cl_int(v); p, size = unsafe.Pointer(&x), unsafe.Sizeof(x)
+		case float32:      x := C.cl_float(v); p, size = unsafe.Pointer(&x), unsafe.Sizeof(x)
+		case [4]float32:   p, size = unsafe.Pointer(&v[0]), unsafe.Sizeof(v)
+		default:
+			return fmt.Errorf("%s: argument %d has unsupported type %T", kernel, i, arg)
+		}
+		if err := clErr("clSetKernelArg "+kernel, C.clSetKernelArg(k, C.cl_uint(i), C.size_t(size), p)); err != nil {
+			return err
+		}
+	}
+
+	var gws [2]C.size_t
+	for i, g := range global {
+		gws[i] = C.size_t(g)
+	}
+	return clErr("clEnqueueNDRangeKernel "+kernel, C.clEnqueueNDRangeKernel(b.queue, k, C.cl_uint(len(global)), nil,
+		&gws[0], nil, 0, nil, nil))
+}
+
+func (b *clBackend)Warp(dst *eimage.Planar, src image.Image, s2d emath.Aff3) error {
+	r := dst.Rect
+	if r.Empty() {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	in, err := b.upload(src)
+	if err != nil {
+		return err
+	}
+	defer C.clReleaseMemObject(in)
+	n := r.Dx() * r.Dy()
+	out, err := b.buffer(3*n*4, nil)
+	if err != nil {
+		return err
+	}
+	defer C.clReleaseMemObject(out)
+	d2s, err := b.matrix(s2d)
+	if err != nil {
+		return err
+	}
+	defer C.clReleaseMemObject(d2s)
+
+	if err := b.run("warp", []int{r.Dx(), r.Dy()}, in, out, r.Min.X, r.Min.Y, r.Dx(), r.Dy(), d2s); err != nil {
+		return err
+	}
+	for i, plane := range [][]float32{dst.R, dst.G, dst.B} {
+		if err := b.read(out, i*n*4, unsafe.Pointer(unsafe.SliceData(plane)), n*4); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *clBackend)Diff(a, bImg image.Image, s2d emath.Aff3, r image.Rectangle, wa, wb [3]float64, lo, hi float64) (float64, int, error) {
+	if r.Empty() {
+		return 0, 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	memA, err := b.uploadCached(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	memB, err := b.uploadCached(bImg)
+	if err != nil {
+		return 0, 0, err
+	}
+	d2s, err := b.matrix(s2d)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer C.clReleaseMemObject(d2s)
+
+	w, h := r.Dx(), r.Dy()
+	errs, err := b.buffer(w*h*4, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer C.clReleaseMemObject(errs)
+	sums, err := b.buffer(h*4, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer C.clReleaseMemObject(sums)
+	counts, err := b.buffer(h*4, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer C.clReleaseMemObject(counts)
+
+	ab, bb := a.Bounds(), bImg.Bounds()
+	f4 := func(v [3]float64) [4]float32 { return [4]float32{float32(v[0]), float32(v[1]), float32(v[2]), 0} }
+	if err := b.run("diff", []int{w, h}, memA, ab.Min.X, ab.Min.Y, ab.Dx(), ab.Dy(), memB, bb.Min.X, bb.Min.Y, bb.Dx(), bb.Dy(),
+		d2s, r.Min.X, r.Min.Y, w, h, f4(wa), f4(wb), float32(lo), float32(hi), errs); err != nil {
+		return 0, 0, err
+	}
+	if err := b.run("sumRows", []int{h}, errs, w, h, sums, counts); err != nil {
+		return 0, 0, err
+	}
+
+	rowSums, rowCounts := make([]float32, h), make([]int32, h)
+	if err := b.read(sums, 0, unsafe.Pointer(&rowSums[0]), h*4); err != nil {
+		return 0, 0, err
+	}
+	if err := b.read(counts, 0, unsafe.Pointer(&rowCounts[0]), h*4); err != nil {
+		return 0, 0, err
+	}
+	sum, n := 0.0, 0
+	for y := range rowSums {
+		sum += float64(rowSums[y])
+		n += int(rowCounts[y])
+	}
+	return sum, n, nil
+}
+
+func (b *clBackend)Bilateral(dst, src []float32, w, h, radius int, sigma []float32) error {
+	if w*h == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	in, err := b.buffer(len(src)*4, unsafe.Pointer(&src[0]))
+	if err != nil {
+		return err
+	}
+	defer C.clReleaseMemObject(in)
+	sigmas, err := b.buffer(len(sigma)*4, unsafe.Pointer(&sigma[0]))
+	if err != nil {
+		return err
+	}
+	defer C.clReleaseMemObject(sigmas)
+	out, err := b.buffer(len(dst)*4, nil)
+	if err != nil {
+		return err
+	}
+	defer C.clReleaseMemObject(out)
+
+	if err := b.run("bilateral", []int{w, h}, in, out, sigmas, w, h, radius); err != nil {
+		return err
+	}
+	return b.read(out, 0, unsafe.Pointer(&dst[0]), len(dst)*4)
+}
@@ -0,0 +1,82 @@
+package eimage
+
+import(
+	"fmt"
+	"image"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// DiskBuffers hands out pixel buffers that live in files in Dir, mapped
+// into memory, rather than on the Go heap; the OS pages them in and out
+// as they're used, so a stack can hold more frames than fit in RAM.
+// Each file is deleted as soon as it is mapped, so nothing is left
+// behind, even by a crash. The buffers mustn't hold Go pointers, and
+// nothing may use them once Close is called.
+type DiskBuffers struct {
+	Dir    string
+
+	mu     sync.Mutex
+	maps   [][]byte
+	total  uint64
+}
+
+// Bytes returns a buffer of n zero bytes.
+func (db *DiskBuffers)Bytes(n int) ([]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	f, err := os.CreateTemp(db.Dir, "pixels-*.buf")
+	if err != nil {
+		return nil, fmt.Errorf("disk buffer: %v", err)
+	}
+	defer f.Close() // the mapping outlives the file
+	defer os.Remove(f.Name())
+	if err := f.Truncate(int64(n)); err != nil {
+		return nil, fmt.Errorf("disk buffer: %v", err)
+	}
+	b, err := mapFile(f, n)
+	if err != nil {
+		return nil, fmt.Errorf("disk buffer: %v", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.maps = append(db.maps, b)
+	db.total += uint64(n)
+	return b, nil
+}
+
+// NewPlanar returns a black image with its planes on disk; unlike one
+// from NewPlanar, releasing it doesn't pool the planes.
+func (db *DiskBuffers)NewPlanar(r image.Rectangle) (*Planar, error) {
+	n := r.Dx() * r.Dy()
+	b, err := db.Bytes(3 * n * 4)
+	if err != nil {
+		return nil, err
+	}
+	planes := unsafe.Slice((*float32)(unsafe.Pointer(unsafe.SliceData(b))), 3*n)
+	return &Planar{Rect: r, R: planes[:n:n], G: planes[n:2*n:2*n], B: planes[2*n:], onDisk: true}, nil
+}
+
+// Size is how many bytes of buffers are on disk.
+func (db *DiskBuffers)Size() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.total
+}
+
+// Close unmaps all the buffers, which frees their disk space.
+func (db *DiskBuffers)Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var firstErr error
+	for _, b := range db.maps {
+		if err := unmapFile(b); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("disk buffer: %v", err)
+		}
+	}
+	db.maps, db.total = nil, 0
+	return firstErr
+}
@@ -0,0 +1,194 @@
+package eimage
+
+import(
+	"math"
+)
+
+// A Flow is a dense optical flow field, w x h: how far each pixel of one
+// frame moved to get to the next (so a(x, y) ends up at b(x+U, y+V)).
+type Flow struct {
+	W, H  int
+	U, V  []float32
+}
+
+// flowWindow is the half width of the window Lucas-Kanade solves each
+// pixel's flow over; flowIterations is how many times it refines the
+// flow at each level of the pyramid; and flowMinTexture is how much
+// gradient, in both directions, the window needs to go on.
+const(
+	flowWindow     = 3
+	flowIterations = 3
+	flowMinTexture = 1e-6  // The smaller eigenvalue of the window's structure tensor; gray levels are in [0, 1]
+)
+
+// OpticalFlow estimates the flow from frame a to frame b, both RGB
+// bytes (3 per pixel, row by row), w x h. It is pyramidal Lucas-Kanade
+// on the gray levels: the flow is solved at a quarter, then half, then
+// full size, each level starting from the one before, so it can follow
+// motions of more than a pixel or two. Where there's no texture to go
+// on (flat sky, say), the flow is left as the coarser level had it.
+func OpticalFlow(a, b []byte, w, h int) Flow {
+	ga, gb := grayPlane(a, w, h), grayPlane(b, w, h)
+	type level struct {
+		a, b  []float32
+		w, h  int
+	}
+	levels := []level{{ga, gb, w, h}}
+	for len(levels) < 4 {
+		l := levels[len(levels)-1]
+		if l.w < 64 || l.h < 64 {
+			break
+		}
+		ha, hw, hh := halve(l.a, l.w, l.h)
+		hb, _, _ := halve(l.b, l.w, l.h)
+		levels = append(levels, level{ha, hb, hw, hh})
+	}
+
+	var f Flow
+	for i := len(levels)-1; i >= 0; i-- {
+		l := levels[i]
+		if i == len(levels)-1 {
+			f = Flow{W: l.w, H: l.h, U: make([]float32, l.w*l.h), V: make([]float32, l.w*l.h)}
+		} else {
+			f = f.upsample(l.w, l.h)
+		}
+		for iter := 0; iter < flowIterations; iter++ {
+			f.refine(l.a, l.b)
+		}
+	}
+	return f
+}
+
+// refine is one Lucas-Kanade step: warp b back by the flow so far, and
+// solve for what's left, over a window around each pixel.
+func (f *Flow)refine(a, b []float32) {
+	w, h := f.W, f.H
+	ixx, ixy, iyy := make([]float32, w*h), make([]float32, w*h), make([]float32, w*h)
+	ixt, iyt := make([]float32, w*h), make([]float32, w*h)
+	for y:=0; y<h; y++ {
+		for x:=0; x<w; x++ {
+			i := y*w + x
+			ix := (samplePlane(a, w, h, float64(x+1), float64(y)) - samplePlane(a, w, h, float64(x-1), float64(y))) / 2
+			iy := (samplePlane(a, w, h, float64(x), float64(y+1)) - samplePlane(a, w, h, float64(x), float64(y-1))) / 2
+			it := samplePlane(b, w, h, float64(x) + float64(f.U[i]), float64(y) + float64(f.V[i])) - a[i]
+			ixx[i], ixy[i], iyy[i], ixt[i], iyt[i] = ix*ix, ix*iy, iy*iy, ix*it, iy*it
+		}
+	}
+	for _, p := range [][]float32{ixx, ixy, iyy, ixt, iyt} {
+		boxBlur(p, w, h, flowWindow)
+	}
+	for i := range f.U {
+		det := ixx[i]*iyy[i] - ixy[i]*ixy[i]
+		tr := ixx[i] + iyy[i]
+		if minEigen := (tr - float32(math.Sqrt(math.Max(0, float64(tr*tr - 4*det))))) / 2; minEigen < flowMinTexture {
+			continue // no texture, or only an edge (the aperture problem)
+		}
+		f.U[i] -= (iyy[i]*ixt[i] - ixy[i]*iyt[i]) / det
+		f.V[i] -= (ixx[i]*iyt[i] - ixy[i]*ixt[i]) / det
+	}
+}
+
+// upsample doubles the flow field (and the flow) up to w x h.
+func (f Flow)upsample(w, h int) Flow {
+	up := Flow{W: w, H: h, U: make([]float32, w*h), V: make([]float32, w*h)}
+	for y:=0; y<h; y++ {
+		for x:=0; x<w; x++ {
+			fx, fy := (float64(x) + 0.5) / 2 - 0.5, (float64(y) + 0.5) / 2 - 0.5
+			up.U[y*w + x] = 2 * samplePlane(f.U, f.W, f.H, fx, fy)
+			up.V[y*w + x] = 2 * samplePlane(f.V, f.W, f.H, fx, fy)
+		}
+	}
+	return up
+}
+
+// Interpolate makes up the frame a fraction t of the way from a to b
+// (RGB bytes, as for OpticalFlow), into out: each pixel is found part
+// way along its path in both frames, and the two cross faded.
+func (f Flow)Interpolate(a, b []byte, t float64, out []byte) {
+	w, h := f.W, f.H
+	for y:=0; y<h; y++ {
+		for x:=0; x<w; x++ {
+			i := y*w + x
+			u, v := float64(f.U[i]), float64(f.V[i])
+			for ch := 0; ch < 3; ch++ {
+				va := sampleRGB(a, w, h, ch, float64(x) - t*u, float64(y) - t*v)
+				vb := sampleRGB(b, w, h, ch, float64(x) + (1-t)*u, float64(y) + (1-t)*v)
+				out[i*3 + ch] = uint8(math.Round(math.Max(0, math.Min(255, (1-t)*va + t*vb))))
+			}
+		}
+	}
+}
+
+// grayPlane is the gray level of each RGB pixel, in [0, 1].
+func grayPlane(rgb []byte, w, h int) []float32 {
+	p := make([]float32, w*h)
+	for i := range p {
+		r, g, b := uint32(rgb[i*3]), uint32(rgb[i*3+1]), uint32(rgb[i*3+2])
+		p[i] = float32(grayU16(r*0x101, g*0x101, b*0x101)) / 0xFFFF
+	}
+	return p
+}
+
+// halve averages each 2x2 block of the plane.
+func halve(p []float32, w, h int) ([]float32, int, int) {
+	hw, hh := w/2, h/2
+	out := make([]float32, hw*hh)
+	for y:=0; y<hh; y++ {
+		for x:=0; x<hw; x++ {
+			out[y*hw + x] = (p[2*y*w + 2*x] + p[2*y*w + 2*x+1] + p[(2*y+1)*w + 2*x] + p[(2*y+1)*w + 2*x+1]) / 4
+		}
+	}
+	return out, hw, hh
+}
+
+// boxBlur averages each value over the (2r+1)^2 box around it, in place;
+// a running sum along the rows, then the columns. The box is cut short
+// at the edges.
+func boxBlur(p []float32, w, h, r int) {
+	tmp := make([]float32, len(p))
+	line := func(get func(int) float32, set func(int, float32), n int) {
+		sum, count := float32(0), 0
+		for i := 0; i < r && i < n; i++ {
+			sum, count = sum + get(i), count + 1
+		}
+		for i := 0; i < n; i++ {
+			if i+r < n { sum, count = sum + get(i+r), count + 1 }
+			if i-r-1 >= 0 { sum, count = sum - get(i-r-1), count - 1 }
+			set(i, sum / float32(count))
+		}
+	}
+	for y:=0; y<h; y++ {
+		line(func(x int) float32 { return p[y*w + x] }, func(x int, v float32) { tmp[y*w + x] = v }, w)
+	}
+	for x:=0; x<w; x++ {
+		line(func(y int) float32 { return tmp[y*w + x] }, func(y int, v float32) { p[y*w + x] = v }, h)
+	}
+}
+
+// samplePlane is the plane at (x, y), interpolated bilinearly, and
+// clamped to the edges.
+func samplePlane(p []float32, w, h int, x, y float64) float32 {
+	x, y = math.Max(0, math.Min(float64(w-1), x)), math.Max(0, math.Min(float64(h-1), y))
+	x0, y0 := int(x), int(y)
+	x1, y1 := x0+1, y0+1
+	if x1 >= w { x1 = w-1 }
+	if y1 >= h { y1 = h-1 }
+	fx, fy := float32(x - float64(x0)), float32(y - float64(y0))
+	top := p[y0*w + x0]*(1-fx) + p[y0*w + x1]*fx
+	bottom := p[y1*w + x0]*(1-fx) + p[y1*w + x1]*fx
+	return top*(1-fy) + bottom*fy
+}
+
+// sampleRGB is samplePlane, for one channel of RGB bytes.
+func sampleRGB(rgb []byte, w, h, ch int, x, y float64) float64 {
+	x, y = math.Max(0, math.Min(float64(w-1), x)), math.Max(0, math.Min(float64(h-1), y))
+	x0, y0 := int(x), int(y)
+	x1, y1 := x0+1, y0+1
+	if x1 >= w { x1 = w-1 }
+	if y1 >= h { y1 = h-1 }
+	fx, fy := x - float64(x0), y - float64(y0)
+	at := func(x, y int) float64 { return float64(rgb[(y*w + x)*3 + ch]) }
+	top := at(x0, y0)*(1-fx) + at(x1, y0)*fx
+	bottom := at(x0, y1)*(1-fx) + at(x1, y1)*fx
+	return top*(1-fy) + bottom*fy
+}
@@ -0,0 +1,126 @@
+package eimage
+
+import(
+	"image"
+	"image/color"
+)
+
+// Gray values are in the range [0, 0xFFFF], weighted towards green as
+// the eye is; if we had more of a handle on the color, maybe we'd map
+// it to XYZ and pick out the luminance, but this works just fine. The
+// weights are 0.2989, 0.5870 and 0.1140, in 16.16 fixed point, so the
+// sum fits in a uint32 and stays under 0xFFFF.
+const(
+	grayR = 19589
+	grayG = 38470
+	grayB = 7471
+)
+
+func grayU16(r, g, b uint32) uint16 {
+	return uint16((r*grayR + g*grayG + b*grayB) >> 16)
+}
+
+// ColToGrayU16 maps a color into a gray value.
+func ColToGrayU16(c color.Color) uint16 {
+	r, g, b, _ := c.RGBA() // channel values in range [0, 0xFFFF]
+	return grayU16(r, g, b)
+}
+
+// GrayU16At is ColToGrayU16(img.At(x, y)), reading the pixel directly
+// for the image types that the decoders produce; going via At boxes a
+// color.Color for every pixel, which adds up. Out of bounds is black,
+// as for At. To read lots of pixels, GrayRowU16 is faster still.
+func GrayU16At(img image.Image, x, y int) uint16 {
+	if !(image.Point{x, y}.In(img.Bounds())) {
+		return 0
+	}
+	var r, g, b uint32
+	switch src := img.(type) {
+	case *image.RGBA64:
+		s := src.Pix[src.PixOffset(x, y):]
+		r, g, b = uint32(s[0])<<8|uint32(s[1]), uint32(s[2])<<8|uint32(s[3]), uint32(s[4])<<8|uint32(s[5])
+	case *image.NRGBA64:
+		s := src.Pix[src.PixOffset(x, y):]
+		a := uint32(s[6])<<8|uint32(s[7])
+		r, g, b = uint32(s[0])<<8|uint32(s[1]), uint32(s[2])<<8|uint32(s[3]), uint32(s[4])<<8|uint32(s[5])
+		r, g, b = r*a/0xFFFF, g*a/0xFFFF, b*a/0xFFFF // premultiplied, as RGBA() gives
+	case *image.Gray16:
+		s := src.Pix[src.PixOffset(x, y):]
+		r = uint32(s[0])<<8|uint32(s[1])
+		g, b = r, r
+	case *Planar:
+		c := src.RGBA64At(x, y)
+		r, g, b = uint32(c.R), uint32(c.G), uint32(c.B)
+	default:
+		return ColToGrayU16(img.At(x, y))
+	}
+	return grayU16(r, g, b)
+}
+
+// GrayRowU16 fills dst with the gray values of the pixels from (x0, y)
+// rightwards, as GrayU16At would give. It works on the raw pixel data
+// a row at a time, with the type switch outside the loop, and integer
+// math inside it.
+func GrayRowU16(dst []uint16, img image.Image, x0, y int) {
+	b := img.Bounds()
+	lo, hi := x0, x0 + len(dst)
+	if lo < b.Min.X { lo = b.Min.X }
+	if hi > b.Max.X { hi = b.Max.X }
+	if y < b.Min.Y || y >= b.Max.Y || lo >= hi {
+		clear(dst)
+		return
+	}
+	clear(dst[:lo-x0])
+	clear(dst[hi-x0:])
+	out := dst[lo-x0 : hi-x0]
+
+	switch src := img.(type) {
+	case *image.RGBA64:
+		pix := src.Pix[src.PixOffset(lo, y):][:len(out)*8]
+		for i := range out {
+			s := pix[i*8 : i*8+6 : i*8+6]
+			out[i] = grayU16(uint32(s[0])<<8|uint32(s[1]), uint32(s[2])<<8|uint32(s[3]), uint32(s[4])<<8|uint32(s[5]))
+		}
+	case *image.NRGBA64:
+		pix := src.Pix[src.PixOffset(lo, y):][:len(out)*8]
+		for i := range out {
+			s := pix[i*8 : i*8+8 : i*8+8]
+			a := uint32(s[6])<<8|uint32(s[7])
+			r, g, bl := uint32(s[0])<<8|uint32(s[1]), uint32(s[2])<<8|uint32(s[3]), uint32(s[4])<<8|uint32(s[5])
+			out[i] = grayU16(r*a/0xFFFF, g*a/0xFFFF, bl*a/0xFFFF)
+		}
+	case *image.Gray16:
+		pix := src.Pix[src.PixOffset(lo, y):][:len(out)*2]
+		for i := range out {
+			v := uint32(pix[i*2])<<8|uint32(pix[i*2+1])
+			out[i] = grayU16(v, v, v)
+		}
+	case *image.RGBA:
+		pix := src.Pix[src.PixOffset(lo, y):][:len(out)*4]
+		for i := range out {
+			s := pix[i*4 : i*4+3 : i*4+3]
+			out[i] = grayU16(uint32(s[0])*0x101, uint32(s[1])*0x101, uint32(s[2])*0x101)
+		}
+	case *Planar:
+		j := src.offset(lo, y)
+		rs, gs, bs := src.R[j:j+len(out)], src.G[j:j+len(out)], src.B[j:j+len(out)]
+		for i := range out {
+			out[i] = grayU16(uint32(to16(rs[i])), uint32(to16(gs[i])), uint32(to16(bs[i])))
+		}
+	default:
+		for i := range out {
+			out[i] = ColToGrayU16(img.At(lo+i, y))
+		}
+	}
+}
+
+// GrayPlaneU16 returns the gray values over r (row by row, r.Dx() per
+// row), as GrayU16At would give; beyond the image, they're zero.
+func GrayPlaneU16(img image.Image, r image.Rectangle) []uint16 {
+	plane := make([]uint16, r.Dx() * r.Dy())
+	for y:=r.Min.Y; y<r.Max.Y; y++ {
+		i := (y - r.Min.Y) * r.Dx()
+		GrayRowU16(plane[i:i+r.Dx()], img, r.Min.X, y)
+	}
+	return plane
+}
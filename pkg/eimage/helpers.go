@@ -1,12 +1,10 @@
-package eclipse
+package eimage
 
 // A few helper routines for golang's image libraries
 
 import(
-	"fmt"
 	"image"
-	"image/png"
-	"os"
+	"image/draw"
 )
 
 func RectCenter(b image.Rectangle) image.Point {
@@ -29,11 +27,9 @@ func GrowRectangle(r image.Rectangle, p image.Point) image.Rectangle {
 	return r
 }
 
-func WritePNG(img image.Image, filename string) error {
-	if writer, err := os.Create(filename); err != nil {
-		return fmt.Errorf("open+w '%s': %v", filename, err)
-	} else {
-		defer writer.Close()
-		return png.Encode(writer, img)
-	}
+// ToGray16 converts the image into 16 bit grayscale
+func ToGray16(img image.Image) *image.Gray16 {
+	gray := image.NewGray16(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+	return gray
 }
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package eimage
+
+import(
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func mapFile(f *os.File, n int) ([]byte, error) {
+	return nil, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
+
+func unmapFile(b []byte) error {
+	return nil
+}
+
+// DiskBuffersSupported is whether DiskBuffers work here.
+func DiskBuffersSupported() bool { return false }
@@ -0,0 +1,19 @@
+//go:build unix
+
+package eimage
+
+import(
+	"os"
+	"syscall"
+)
+
+func mapFile(f *os.File, n int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func unmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
+
+// DiskBuffersSupported is whether DiskBuffers work here.
+func DiskBuffersSupported() bool { return true }
@@ -0,0 +1,51 @@
+package eimage
+
+import(
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ParallelFor calls fn(worker, i) for every i in [0,n), spread over (at
+// most) `workers` goroutines - GOMAXPROCS of them if workers < 1 - and
+// waits for them all to finish. Each worker has an id in [0,workers),
+// e.g. for its own scratch space or accumulators. The i's are handed
+// out one at a time, so slow ones don't hold the rest up. If ctx is
+// cancelled, no more calls are started, and it returns the context's
+// error once the running ones finish.
+func ParallelFor(ctx context.Context, workers, n int, fn func(worker, i int)) error {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i:=0; i<n; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			fn(0, i)
+		}
+		return ctx.Err()
+	}
+
+	var wg sync.WaitGroup
+	var next int64 = -1
+	for w:=0; w<workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n || ctx.Err() != nil {
+					return
+				}
+				fn(worker, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
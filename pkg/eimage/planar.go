@@ -0,0 +1,277 @@
+// Package eimage holds the images that the pipeline keeps in memory -
+// planar float32 RGB, pooled by size - and fast ways to read pixels
+// out of them, and out of the image types that photo decoders produce.
+package eimage
+
+import(
+	"context"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A Planar holds an RGB image as three planes of float32s, with the
+// sensor values mapped to [0.0, 1.0] (as for ecolor.CameraNative). The
+// aligned layers are kept like this: warping them keeps the fractions
+// that interpolation produces, and the stacker and filters can read
+// the values directly (see PixelRGB), without boxing each one up into
+// a color.Color. It also implements image.Image, for everything else.
+type Planar struct {
+	Rect     image.Rectangle
+	R, G, B  []float32
+
+	onDisk   bool  // The planes are from DiskBuffers, not the pool
+}
+
+// NewPlanar returns a black image; its planes come from the pool (see
+// pool.go).
+func NewPlanar(r image.Rectangle) *Planar {
+	return allocPlanar(r, true)
+}
+
+func allocPlanar(r image.Rectangle, zero bool) *Planar {
+	n := r.Dx() * r.Dy()
+	return &Planar{Rect: r, R: getPlane(n, zero), G: getPlane(n, zero), B: getPlane(n, zero)}
+}
+
+func (p *Planar)offset(x, y int) int { return (y - p.Rect.Min.Y) * p.Rect.Dx() + (x - p.Rect.Min.X) }
+
+func (p *Planar)ColorModel() color.Model { return color.RGBA64Model }
+func (p *Planar)Bounds() image.Rectangle { return p.Rect }
+func (p *Planar)At(x, y int) color.Color { return p.RGBA64At(x, y) }
+
+func (p *Planar)RGBA64At(x, y int) color.RGBA64 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.RGBA64{}
+	}
+	i := p.offset(x, y)
+	return color.RGBA64{to16(p.R[i]), to16(p.G[i]), to16(p.B[i]), 0xFFFF}
+}
+
+func to16(v float32) uint16 {
+	if v <= 0 {
+		return 0
+	} else if v >= 1 {
+		return 0xFFFF
+	}
+	return uint16(v * 0xFFFF + 0.5)
+}
+
+// ToPlanar converts an image (taking it as opaque), reading the pixel
+// data directly for the types that the photo decoders produce. If it
+// is a Planar already, it is returned as is.
+func ToPlanar(img image.Image) *Planar {
+	if p, ok := img.(*Planar); ok {
+		return p
+	}
+	b := img.Bounds()
+	p := allocPlanar(b, false) // every pixel gets set
+	set := func(i int, r, g, bl float32) { p.R[i], p.G[i], p.B[i] = r, g, bl }
+	const max16, max8 = float32(0xFFFF), float32(0xFF)
+
+	for y:=b.Min.Y; y<b.Max.Y; y++ {
+		i := p.offset(b.Min.X, y)
+		switch src := img.(type) {
+		case *image.RGBA64:
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x:=0; x<b.Dx(); x, i = x+1, i+1 {
+				s := row[x*8:]
+				set(i, float32(uint16(s[0])<<8|uint16(s[1]))/max16, float32(uint16(s[2])<<8|uint16(s[3]))/max16,
+					float32(uint16(s[4])<<8|uint16(s[5]))/max16)
+			}
+		case *image.NRGBA64:
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x:=0; x<b.Dx(); x, i = x+1, i+1 {
+				s := row[x*8:]
+				set(i, float32(uint16(s[0])<<8|uint16(s[1]))/max16, float32(uint16(s[2])<<8|uint16(s[3]))/max16,
+					float32(uint16(s[4])<<8|uint16(s[5]))/max16)
+			}
+		case *image.RGBA:
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x:=0; x<b.Dx(); x, i = x+1, i+1 {
+				s := row[x*4:]
+				set(i, float32(s[0])/max8, float32(s[1])/max8, float32(s[2])/max8)
+			}
+		case *image.NRGBA:
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x:=0; x<b.Dx(); x, i = x+1, i+1 {
+				s := row[x*4:]
+				set(i, float32(s[0])/max8, float32(s[1])/max8, float32(s[2])/max8)
+			}
+		case *image.Gray16:
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x:=0; x<b.Dx(); x, i = x+1, i+1 {
+				v := float32(uint16(row[x*2])<<8|uint16(row[x*2+1]))/max16
+				set(i, v, v, v)
+			}
+		default:
+			for x:=b.Min.X; x<b.Max.X; x, i = x+1, i+1 {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				set(i, float32(r)/max16, float32(g)/max16, float32(bl)/max16)
+			}
+		}
+	}
+	return p
+}
+
+// PixelRGB reads a pixel as [0.0, 1.0] floats, straight from the planes
+// or the pixel data if it can (else via At()); either way, the same
+// values as At() would give.
+func PixelRGB(img image.Image, x, y int) (float64, float64, float64) {
+	if p, ok := img.(*Planar); ok {
+		if !(image.Point{x, y}.In(p.Rect)) {
+			return 0, 0, 0
+		}
+		i := p.offset(x, y)
+		return float64(p.R[i]), float64(p.G[i]), float64(p.B[i])
+	}
+
+	var r, g, b uint32
+	switch src := img.(type) {
+	case *image.RGBA64:
+		if !(image.Point{x, y}.In(src.Rect)) {
+			return 0, 0, 0
+		}
+		s := src.Pix[src.PixOffset(x, y):]
+		r, g, b = uint32(s[0])<<8|uint32(s[1]), uint32(s[2])<<8|uint32(s[3]), uint32(s[4])<<8|uint32(s[5])
+	case *image.NRGBA64:
+		if !(image.Point{x, y}.In(src.Rect)) {
+			return 0, 0, 0
+		}
+		s := src.Pix[src.PixOffset(x, y):]
+		a := uint32(s[6])<<8|uint32(s[7])
+		r, g, b = uint32(s[0])<<8|uint32(s[1]), uint32(s[2])<<8|uint32(s[3]), uint32(s[4])<<8|uint32(s[5])
+		r, g, b = r*a/0xFFFF, g*a/0xFFFF, b*a/0xFFFF // premultiplied, as RGBA() gives
+	case *image.Gray16:
+		if !(image.Point{x, y}.In(src.Rect)) {
+			return 0, 0, 0
+		}
+		s := src.Pix[src.PixOffset(x, y):]
+		r = uint32(s[0])<<8|uint32(s[1])
+		g, b = r, r
+	default:
+		r, g, b, _ = img.At(x, y).RGBA()
+	}
+	return float64(r) / 0xFFFF, float64(g) / 0xFFFF, float64(b) / 0xFFFF
+}
+
+// Warp returns the image moved by s2d (which maps src coords to dst
+// coords, as for draw.Transform), over the same bounds. It samples with
+// a Catmull-Rom kernel (as draw.CatmullRom does), and leaves black the
+// pixels that come from beyond the edge. The work is split into tiles
+// over `workers` goroutines (see ForTiles). It checks ctx every tile,
+// and stops (leaving the rest black) if it is cancelled.
+func (src *Planar)Warp(ctx context.Context, s2d emath.Aff3, workers int) *Planar {
+	return src.WarpInto(ctx, NewPlanar(src.Rect), s2d, workers)
+}
+
+// WarpInto is Warp, into dst (e.g. from DiskBuffers), which must be
+// black. It usually has the same bounds as src; if not, whatever s2d
+// moves outside dst is cut off.
+func (src *Planar)WarpInto(ctx context.Context, dst *Planar, s2d emath.Aff3, workers int) *Planar {
+	return src.WarpWith(ctx, dst, s2d, CatmullRom, workers)
+}
+
+// An Interpolation is how WarpWith samples between source pixels.
+type Interpolation int
+
+const(
+	CatmullRom Interpolation = iota // Sharp: 4x4 source pixels for each
+	Bilinear                        // Softer, and about four times quicker: 2x2
+)
+
+// WarpWith is WarpInto, sampling with the given kernel.
+func (src *Planar)WarpWith(ctx context.Context, dst *Planar, s2d emath.Aff3, interp Interpolation, workers int) *Planar {
+	kernel, taps := catmullRom, 4
+	if interp == Bilinear {
+		kernel, taps = triangle, 2
+	}
+	b := src.Rect
+	d2s := s2d.Invert()
+	minX, minY, maxX, maxY := float64(b.Min.X), float64(b.Min.Y), float64(b.Max.X), float64(b.Max.Y)
+
+	ForTiles(ctx, workers, dst.Rect, func(_ int, t image.Rectangle) {
+		for y:=t.Min.Y; y<t.Max.Y; y++ {
+			dy := float64(y) + 0.5 // Pixel centers
+			for x:=t.Min.X; x<t.Max.X; x++ {
+				dx := float64(x) + 0.5
+				sx := d2s[0]*dx + d2s[1]*dy + d2s[2]
+				sy := d2s[3]*dx + d2s[4]*dy + d2s[5]
+				if sx < minX || sx >= maxX || sy < minY || sy >= maxY {
+					continue
+				}
+
+				// The source pixels either side (two, or one), in each direction
+				px, py := sx - 0.5, sy - 0.5
+				ix, iy := int(math.Floor(px)) - (taps/2 - 1), int(math.Floor(py)) - (taps/2 - 1)
+				var wx, wy [4]float64
+				for k:=0; k<taps; k++ {
+					wx[k] = kernel(px - float64(ix+k))
+					wy[k] = kernel(py - float64(iy+k))
+				}
+
+				r, g, bl, wsum := 0.0, 0.0, 0.0, 0.0
+				for j:=0; j<taps; j++ {
+					ty := iy + j
+					if ty < b.Min.Y || ty >= b.Max.Y {
+						continue
+					}
+					for k:=0; k<taps; k++ {
+						tx := ix + k
+						if tx < b.Min.X || tx >= b.Max.X {
+							continue
+						}
+						w := wx[k] * wy[j]
+						i := src.offset(tx, ty)
+						r  += w * float64(src.R[i])
+						g  += w * float64(src.G[i])
+						bl += w * float64(src.B[i])
+						wsum += w
+					}
+				}
+				if wsum == 0 {
+					continue
+				}
+				i := dst.offset(x, y)
+				dst.R[i], dst.G[i], dst.B[i] = clamp01(r/wsum), clamp01(g/wsum), clamp01(bl/wsum)
+			}
+		}
+	})
+	return dst
+}
+
+func catmullRom(t float64) float64 {
+	if t < 0 {
+		t = -t
+	}
+	if t < 1 {
+		return (1.5*t - 2.5)*t*t + 1
+	} else if t < 2 {
+		return ((-0.5*t + 2.5)*t - 4)*t + 2
+	}
+	return 0
+}
+
+func triangle(t float64) float64 {
+	if t < 0 {
+		t = -t
+	}
+	if t < 1 {
+		return 1 - t
+	}
+	return 0
+}
+
+func clamp01(v float64) float32 {
+	if v < 0 {
+		return 0
+	} else if v > 1 {
+		return 1
+	}
+	return float32(v)
+}
+
+// OnDisk is whether the planes are from DiskBuffers.
+func (p *Planar)OnDisk() bool { return p.onDisk }
@@ -0,0 +1,59 @@
+package eimage
+
+import(
+	"sync"
+)
+
+// The planes of the Planars are frame-sized (often hundreds of
+// MB per layer), and a run goes through a lot of them: every candidate
+// alignment warps a whole layer, and a watcher re-stacks over and over.
+// So they are pooled, by size, rather than left for the GC.
+var(
+	planePoolsMu sync.Mutex
+	planePools   = map[int]*sync.Pool{}
+)
+
+func planePool(n int) *sync.Pool {
+	planePoolsMu.Lock()
+	defer planePoolsMu.Unlock()
+	pool, exists := planePools[n]
+	if !exists {
+		pool = &sync.Pool{}
+		planePools[n] = pool
+	}
+	return pool
+}
+
+// getPlane returns a plane of n floats; if `zero`, they are all zero,
+// else whatever was left in it.
+func getPlane(n int, zero bool) []float32 {
+	if v := planePool(n).Get(); v != nil {
+		plane := *(v.(*[]float32))
+		if zero {
+			clear(plane)
+		}
+		return plane
+	}
+	return make([]float32, n)
+}
+
+func putPlane(plane []float32) {
+	if plane != nil {
+		planePool(len(plane)).Put(&plane)
+	}
+}
+
+// Release hands the image's planes back to the pool; nothing may use
+// the image afterwards.
+func (p *Planar)Release() {
+	if p == nil {
+		return
+	} else if p.onDisk {
+		p.R, p.G, p.B = nil, nil, nil // DiskBuffers.Close unmaps them
+		return
+	}
+	putPlane(p.R)
+	putPlane(p.G)
+	putPlane(p.B)
+	p.R, p.G, p.B = nil, nil, nil
+}
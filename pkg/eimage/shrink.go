@@ -0,0 +1,35 @@
+package eimage
+
+import(
+	"context"
+	"image"
+)
+
+// Shrink makes a copy of img at 1/n of the width and height, each pixel
+// the average of an n*n block; the last few rows & columns are dropped
+// if the size isn't a multiple of n. It is split into tiles, as for
+// Warp, and stops (leaving the rest black) if ctx is cancelled.
+func Shrink(ctx context.Context, img image.Image, n, workers int) *Planar {
+	b := img.Bounds()
+	min := b.Min.Div(n)
+	r := image.Rectangle{min, min.Add(image.Point{b.Dx() / n, b.Dy() / n})}
+	dst := NewPlanar(r)
+	scale := 1.0 / float64(n*n)
+
+	ForTiles(ctx, workers, r, func(_ int, t image.Rectangle) {
+		for y:=t.Min.Y; y<t.Max.Y; y++ {
+			for x:=t.Min.X; x<t.Max.X; x++ {
+				sr, sg, sb := 0.0, 0.0, 0.0
+				for j:=0; j<n; j++ {
+					for k:=0; k<n; k++ {
+						cr, cg, cb := PixelRGB(img, b.Min.X + (x-min.X)*n + k, b.Min.Y + (y-min.Y)*n + j)
+						sr, sg, sb = sr+cr, sg+cg, sb+cb
+					}
+				}
+				i := dst.offset(x, y)
+				dst.R[i], dst.G[i], dst.B[i] = float32(sr*scale), float32(sg*scale), float32(sb*scale)
+			}
+		}
+	})
+	return dst
+}
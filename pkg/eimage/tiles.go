@@ -0,0 +1,39 @@
+package eimage
+
+import(
+	"context"
+	"image"
+)
+
+// TileSize is the width & height of the tiles that the per-pixel
+// stages split their work into; small enough that a tile's pixels stay
+// in cache, big enough that handing them out costs nothing.
+const TileSize = 64
+
+// NumTiles is how many tiles ForTiles splits r into.
+func NumTiles(r image.Rectangle) int {
+	return ((r.Dx() + TileSize-1) / TileSize) * ((r.Dy() + TileSize-1) / TileSize)
+}
+
+// tile is the i'th tile of r, in rows; those on the right & bottom
+// edges can be smaller.
+func tile(r image.Rectangle, i int) image.Rectangle {
+	across := (r.Dx() + TileSize-1) / TileSize
+	corner := r.Min.Add(image.Point{(i % across) * TileSize, (i / across) * TileSize})
+	return image.Rectangle{corner, corner.Add(image.Point{TileSize, TileSize})}.Intersect(r)
+}
+
+// ForTiles calls fn(worker, tile) for every tile of r, with
+// ParallelFor. Each worker has its own id, so the memory a stage needs
+// is bounded by the number of workers, and not the size of the image.
+// The tiles never overlap, so fn can write to its own tile's pixels
+// without locking.
+func ForTiles(ctx context.Context, workers int, r image.Rectangle, fn func(worker int, tile image.Rectangle)) error {
+	n := NumTiles(r)
+	if r.Empty() {
+		n = 0
+	}
+	return ParallelFor(ctx, workers, n, func(worker, i int) {
+		fn(worker, tile(r, i))
+	})
+}
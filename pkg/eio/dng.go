@@ -0,0 +1,32 @@
+//go:build cgo
+
+package eio
+
+import(
+	"github.com/abworrall/go-dng/pkg/dng"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// ReadDNG uses the DNG SDK (via cgo) to get at the photo's stage 3
+// data, which is linear camera RGB, and its color matrices. The
+// camera model isn't filled in; DNG files are TIFFs, with regular
+// EXIF data, so ReadMetadata has it.
+func ReadDNG(filename string) (DNG, error) {
+	img := dng.Image{ImageKind:dng.ImageStage3}
+	if err := img.Load(filename); err != nil {
+		return DNG{}, err
+	}
+
+	fnum := img.ExifFNumber()
+	exposure := img.ExifExposureTime()
+
+	d := DNG{Image: img}
+	d.ISO = img.ExifISO()
+	d.FNumber = [2]int64{int64(fnum[0]), int64(fnum[1])}
+	d.ExposureTime = [2]int64{int64(exposure[0]), int64(exposure[1])}
+	d.Dims = img.Bounds().Size()
+	d.CameraWhite = emath.Vec3(img.CameraWhite())
+	d.CameraToPCS = emath.Mat3(img.CameraToPCS())
+	return d, nil
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+
+package eio
+
+import(
+	"fmt"
+)
+
+// ReadDNG needs the DNG SDK, which needs cgo; builds without it (e.g.
+// WebAssembly) can't read DNGs. Use TIFFs, or decode the photos some
+// other way and pass them to pkg/eclipse with WithPhotos.
+func ReadDNG(filename string) (DNG, error) {
+	return DNG{}, fmt.Errorf("%s: this build can't read DNG files (it was built without cgo); use TIFFs instead", filename)
+}
@@ -0,0 +1,53 @@
+// Package eio reads and writes the files the pipeline works with: the
+// photos (TIFFs and DNGs, and their EXIF data), the fused HDR images
+// (Radiance RGBE), and the outputs (PNG, FITS and TIFF). It only deals
+// in pixels, and what the files say about them; making layers of them
+// is up to pkg/eclipse.
+package eio
+
+import(
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"time"
+
+	_ "golang.org/x/image/tiff"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// Metadata is what a photo's file says about how it was taken.
+type Metadata struct {
+	CameraModel   string       // As in EXIF, e.g. "NIKON Df"
+	CaptureTime   time.Time    // Zero, if the file doesn't say
+	ISO           int
+	FNumber       [2]int64     // As a fraction, e.g. {56, 10}
+	ExposureTime  [2]int64     // Seconds, as a fraction, e.g. {1, 500}
+	Dims          image.Point  // Of the main image; see ReadMetadata
+}
+
+// A DNG is the stage 3 pixels of a DNG photo, and what it says about
+// them; see ReadDNG.
+type DNG struct {
+	Image         image.Image
+	Metadata                   // Without the camera model or capture time
+	CameraWhite   emath.Vec3   // AsShotNeutral
+	CameraToPCS   emath.Mat3
+}
+
+// ReadImage reads a PNG, JPEG or TIFF.
+func ReadImage(filename string) (image.Image, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open+r '%s': %v", filename, err)
+	}
+	defer reader.Close()
+
+	img, _, err := image.Decode(reader)
+	if err != nil {
+		return nil, fmt.Errorf("decoding '%s': %v", filename, err)
+	}
+	return img, nil
+}
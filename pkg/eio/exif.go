@@ -0,0 +1,142 @@
+package eio
+
+import(
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/tiff"
+)
+
+// ReadExif gets the camera model and exposure from the EXIF data in a
+// photo (a TIFF or DNG; the whole file, not just the EXIF block). The
+// exposure - ISO, f-number and exposure time - has to be there; the
+// camera model and capture time are optional. Exposure compensation is
+// ignored, as it is informational: the f-number, exposure time and ISO
+// fully define how much light would expose a pixel.
+func ReadExif(reader io.Reader) (Metadata, error) {
+	m := Metadata{}
+	ex, err := exif.Decode(reader)
+	if err != nil {
+		return m, fmt.Errorf("exif parsing: %v", err)
+	}
+
+	if tag, err := ex.Get(exif.Model); err == nil {
+		m.CameraModel, _ = tag.StringVal() // Not needed, so ignore errors
+	}
+	if t, err := ex.DateTime(); err == nil {
+		m.CaptureTime = t // Not needed either
+	}
+	if xTag, err := ex.Get(exif.PixelXDimension); err == nil {
+		if yTag, err := ex.Get(exif.PixelYDimension); err == nil {
+			m.Dims.X, _ = xTag.Int(0)
+			m.Dims.Y, _ = yTag.Int(0)
+		}
+	}
+
+	if tag, err := ex.Get(exif.ISOSpeedRatings); err != nil {
+		return m, fmt.Errorf("exif ISO: %v", err)
+	} else if val, err := tag.Int64(0); err != nil {
+		return m, fmt.Errorf("exif ISO: %v", err)
+	} else {
+		m.ISO = int(val)
+	}
+
+	if tag, err := ex.Get(exif.FNumber); err != nil {
+		return m, fmt.Errorf("exif FNumber: %v", err)
+	} else if num, denom, err := tag.Rat2(0); err != nil {
+		return m, fmt.Errorf("exif FNumber: %v", err)
+	} else {
+		m.FNumber = [2]int64{num, denom}
+	}
+
+	if tag, err := ex.Get(exif.ExposureTime); err != nil {
+		return m, fmt.Errorf("exif ExposureTime: %v", err)
+	} else if num, denom, err := tag.Rat2(0); err != nil {
+		return m, fmt.Errorf("exif ExposureTime: %v", err)
+	} else {
+		m.ExposureTime = [2]int64{num, denom}
+	}
+
+	return m, nil
+}
+
+// ReadMetadata is ReadExif for a file, without loading its pixels.
+// DNGs often have a thumbnail as their first image, so the dimensions
+// come from the EXIF data, if it has them, else from the TIFF header.
+func ReadMetadata(filename string) (Metadata, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("open+r exif '%s': %v", filename, err)
+	}
+	defer reader.Close()
+
+	m, err := ReadExif(reader)
+	if err != nil {
+		return m, fmt.Errorf("'%s': %v", filename, err)
+	}
+	if m.Dims == (image.Point{}) {
+		reader.Seek(0, 0)
+		if cfg, err := tiff.DecodeConfig(reader); err == nil {
+			m.Dims = image.Point{cfg.Width, cfg.Height}
+		}
+	}
+	return m, nil
+}
+
+/* Example EXIF dump from a 16-bit TIFF exported by lightroom from a DNG imported from a Nikon Df.
+
+ApertureValue: "4970854/1000000"
+SceneType: ""
+SceneCaptureType: 0
+Flash: 0
+ColorSpace: 65535
+FocalLengthIn35mmFilm: 480
+MeteringMode: 5
+LensModel: "200.0-500.0 mm f/5.6"
+SamplesPerPixel: 3
+PlanarConfiguration: 1
+FNumber: "56/10"
+DateTimeDigitized: "2017:08:21 11:34:53"
+FocalPlaneYResolution: "44855751/32768"
+FileSource: ""
+DigitalZoomRatio: "1/1"
+GainControl: 1
+Compression: 1
+XResolution: "72/1"
+ExifIFDPointer: 15320
+ShutterSpeedValue: "10965784/1000000"
+ImageWidth: 4928
+ResolutionUnit: 2
+ExposureMode: 1
+Saturation: 0
+MaxApertureValue: "50/10"
+FocalPlaneResolutionUnit: 3
+SensingMethod: 2
+Contrast: 0
+ImageLength: 3280
+DateTime: "2019:06:29 15:38:50"
+ExposureProgram: 1
+ExposureBiasValue: "-12/6"
+SubjectDistanceRange: 0
+ISOSpeedRatings: 800
+DateTimeOriginal: "2017:08:21 11:34:53"
+FocalLength: "4800/10"
+SubSecTimeOriginal: "4"
+PhotometricInterpretation: 2
+Model: "NIKON Df"
+YResolution: "72/1"
+ExposureTime: "1/2000"
+SubSecTimeDigitized: "40"
+CFAPattern: ""
+WhiteBalance: 0
+FocalPlaneXResolution: "44855751/32768"
+CustomRendered: 0
+BitsPerSample: [16,16,16]
+Make: "NIKON CORPORATION"
+ExifVersion: "0231"
+LightSource: 0
+
+ */
@@ -0,0 +1,129 @@
+package eio
+
+import(
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// fitsBlock is the size of FITS records; the header and the data are
+// each padded out to a whole number of them.
+const fitsBlock = 2880
+
+// A FITSPlane is one plane of a FITS image cube: w*h values, row by row
+// from the top (as in image.Image), and a name for the header.
+type FITSPlane struct {
+	Name  string
+	Pix []float32
+}
+
+// A FITSCard is an extra header record, e.g. {"BUNIT", "'cd/m2'", ""};
+// the value is as it should appear (strings quoted, logicals as T/F).
+// With a Key of "COMMENT", the Comment is the whole of it.
+type FITSCard struct {
+	Key, Value, Comment  string
+}
+
+// FITSComment is a COMMENT card.
+func FITSComment(s string) FITSCard { return FITSCard{Key: "COMMENT", Comment: s} }
+
+// WriteFITS writes the planes as a single FITS image, of 32 bit floats,
+// for astronomy tools (DS9, Siril, astropy etc.). With more than one plane
+// it is a cube (NAXIS3), and the header says what each plane is, as
+// PLANEn keys. FITS rows go from the bottom up, so the image is flipped
+// as it's written, to display the right way up. The extra cards go in
+// the header after those.
+func WriteFITS(filename string, w, h int, planes []FITSPlane, extra ...FITSCard) error {
+	names := []string{}
+	for _, p := range planes {
+		if len(p.Pix) != w*h {
+			return fmt.Errorf("fits '%s': plane %s has %d values, wanted %dx%d", filename, p.Name, len(p.Pix), w, h)
+		}
+		names = append(names, p.Name)
+	}
+	return WriteFITSCube(filename, w, h, names, func(i int, pix []float32) error {
+		copy(pix, planes[i].Pix)
+		return nil
+	}, extra...)
+}
+
+// WriteFITSCube is WriteFITS for a cube too big to hold in memory all at
+// once: each plane is filled in by plane(i, pix) (w*h values, as for
+// FITSPlane) just before it's written, into the same buffer each time.
+func WriteFITSCube(filename string, w, h int, names []string, plane func(i int, pix []float32) error, extra ...FITSCard) error {
+	cards := []string{
+		fitsCard("SIMPLE", "T", "Standard FITS"),
+		fitsCard("BITPIX", "-32", "32 bit floats"),
+	}
+	if len(names) == 1 {
+		cards = append(cards, fitsCard("NAXIS", "2", ""))
+	} else {
+		cards = append(cards, fitsCard("NAXIS", "3", ""))
+	}
+	cards = append(cards, fitsCard("NAXIS1", fmt.Sprint(w), "Width"), fitsCard("NAXIS2", fmt.Sprint(h), "Height"))
+	if len(names) > 1 {
+		cards = append(cards, fitsCard("NAXIS3", fmt.Sprint(len(names)), "Planes"))
+	}
+	for i, name := range names {
+		cards = append(cards, fitsCard(fmt.Sprintf("PLANE%d", i+1), FITSString(name), ""))
+	}
+	for _, c := range extra {
+		if c.Key == "COMMENT" {
+			cards = append(cards, fmt.Sprintf("%-80.80s", "COMMENT " + c.Comment))
+		} else {
+			cards = append(cards, fitsCard(c.Key, c.Value, c.Comment))
+		}
+	}
+	cards = append(cards, fmt.Sprintf("%-80s", "END"))
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("open+w '%s': %v", filename, err)
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+
+	header := strings.Join(cards, "")
+	header += strings.Repeat(" ", (fitsBlock - len(header) % fitsBlock) % fitsBlock)
+	bw.WriteString(header)
+
+	buf, pix := make([]byte, 4), make([]float32, w*h)
+	for i := range names {
+		if err := plane(i, pix); err != nil {
+			return fmt.Errorf("fits '%s': plane %s: %v", filename, names[i], err)
+		}
+		for y:=h-1; y>=0; y-- {
+			for _, v := range pix[y*w : (y+1)*w] {
+				binary.BigEndian.PutUint32(buf, math.Float32bits(v))
+				bw.Write(buf)
+			}
+		}
+	}
+	n := 4 * w * h * len(names)
+	bw.Write(make([]byte, (fitsBlock - n % fitsBlock) % fitsBlock))
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("fits '%s': %v", filename, err)
+	}
+	return f.Close()
+}
+
+// FITSString quotes s as a FITS string value.
+func FITSString(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+
+// fitsCard is one 80 character header record; the value is already
+// formatted (strings quoted, logicals as T/F). Numbers & logicals end
+// in column 30, strings start in column 11, as the fixed format has it.
+func fitsCard(key, val, comment string) string {
+	card := fmt.Sprintf("%-8s= %20s", key, val)
+	if strings.HasPrefix(val, "'") {
+		card = fmt.Sprintf("%-8s= %-20s", key, val)
+	}
+	if comment != "" {
+		card += " / " + comment
+	}
+	return fmt.Sprintf("%-80.80s", card)
+}
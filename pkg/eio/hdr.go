@@ -0,0 +1,60 @@
+package eio
+
+import(
+	"fmt"
+	"image"
+	"os"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/codec/rgbe"
+)
+
+// ReadHDR loads a Radiance RGBE file, e.g. one written by an earlier
+// phase.
+func ReadHDR(filename string) (hdr.Image, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open+r '%s': %v", filename, err)
+	}
+	defer reader.Close()
+
+	decoded, err := rgbe.Decode(reader)
+	if err != nil {
+		return nil, fmt.Errorf("decoding '%s': %v", filename, err)
+	}
+	img, ok := decoded.(hdr.Image)
+	if !ok {
+		return nil, fmt.Errorf("'%s' did not decode as an HDR image", filename)
+	}
+	return img, nil
+}
+
+// ReadHDRDims is how big a Radiance RGBE file's image is, without
+// loading its pixels.
+func ReadHDRDims(filename string) (image.Point, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return image.Point{}, fmt.Errorf("open+r '%s': %v", filename, err)
+	}
+	defer reader.Close()
+
+	cfg, err := rgbe.DecodeConfig(reader)
+	if err != nil {
+		return image.Point{}, fmt.Errorf("decoding '%s': %v", filename, err)
+	}
+	return image.Point{cfg.Width, cfg.Height}, nil
+}
+
+// WriteHDR writes the image as a Radiance RGBE file, which photoshop
+// and other HDR tools can load.
+func WriteHDR(img hdr.Image, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("open+w '%s': %v", filename, err)
+	}
+	defer f.Close()
+	if err := rgbe.Encode(f, img); err != nil {
+		return fmt.Errorf("rgbe '%s': %v", filename, err)
+	}
+	return f.Close()
+}
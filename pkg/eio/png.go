@@ -0,0 +1,349 @@
+package eio
+
+import(
+	"bytes"
+	"context"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"os"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// pngRows is how many rows go in each band that EncodePNG compresses
+// on its own; enough that the deflate window fills up, so the bands
+// don't cost much compression.
+const pngRows = 64
+
+// EncodePNG writes the image as a PNG, like png.Encode, but spreading
+// the work - filtering each row, and compressing the result - over
+// `workers` goroutines (GOMAXPROCS of them, if < 1): bands of rows are
+// deflated separately, and joined up into one zlib stream, which comes
+// out about the same size as png.Encode's. Opaque RGB
+// & gray images (8 or 16 bit, and Planars as 16 bit RGB) are done like
+// this; anything else (e.g. with transparency, or a palette) goes to
+// png.Encode.
+func EncodePNG(w io.Writer, img image.Image, workers int) error {
+	format := pngFormatOf(img)
+	b := img.Bounds()
+	if format.row == nil || b.Empty() {
+		return png.Encode(w, img)
+	}
+
+	// Each band is a run of deflate blocks that ends on a byte boundary
+	// (a sync flush), so they can just be put one after another; the
+	// zlib checksum is combined from theirs.
+	nBands := (b.Dy() + pngRows-1) / pngRows
+	bands := make([]pngBand, nBands)
+	rowBytes := b.Dx() * format.bpp
+	eimage.ParallelFor(context.Background(), workers, nBands, func(_, i int) {
+		y0 := b.Min.Y + i*pngRows
+		y1 := y0 + pngRows
+		if y1 > b.Max.Y {
+			y1 = b.Max.Y
+		}
+		bands[i] = encodeBand(img, format, rowBytes, b.Min.Y, y0, y1, i == nBands-1)
+	})
+
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(b.Dy()))
+	ihdr[8], ihdr[9] = format.depth, format.colorType // then deflate, adaptive filtering, no interlacing
+
+	pw := pngWriter{w: w}
+	pw.write([]byte("\x89PNG\r\n\x1a\n"))
+	pw.chunk("IHDR", ihdr[:])
+	sum := uint32(1)
+	for i, band := range bands {
+		if band.err != nil {
+			return band.err
+		}
+		data := band.data
+		if i == 0 {
+			data = append([]byte{0x78, 0x9C}, data...) // zlib header: deflate with a 32K window, default level
+		}
+		sum = adler32Combine(sum, band.adler, band.n)
+		if i == len(bands)-1 {
+			data = binary.BigEndian.AppendUint32(data, sum)
+		}
+		pw.chunk("IDAT", data)
+	}
+	pw.chunk("IEND", nil)
+	return pw.err
+}
+
+// A pngFormat is how EncodePNG writes a kind of image: its IHDR bit
+// depth & color type, how many bytes a pixel takes, and how to get the
+// raw bytes of a row.
+type pngFormat struct {
+	depth, colorType  byte
+	bpp               int
+	row               func(dst []byte, y int)
+}
+
+func pngFormatOf(img image.Image) pngFormat {
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		return pngFormat{}
+	}
+	const gray, rgb = 0, 2
+	b := img.Bounds()
+
+	switch src := img.(type) {
+	case *image.Gray:
+		return pngFormat{8, gray, 1, func(dst []byte, y int) { copy(dst, src.Pix[src.PixOffset(b.Min.X, y):]) }}
+	case *image.Gray16:
+		return pngFormat{16, gray, 2, func(dst []byte, y int) { copy(dst, src.Pix[src.PixOffset(b.Min.X, y):]) }}
+	case *image.RGBA:
+		return pngFormat{8, rgb, 3, func(dst []byte, y int) { dropAlpha(dst, src.Pix[src.PixOffset(b.Min.X, y):], 3) }}
+	case *image.NRGBA:
+		return pngFormat{8, rgb, 3, func(dst []byte, y int) { dropAlpha(dst, src.Pix[src.PixOffset(b.Min.X, y):], 3) }}
+	case *image.RGBA64:
+		return pngFormat{16, rgb, 6, func(dst []byte, y int) { dropAlpha(dst, src.Pix[src.PixOffset(b.Min.X, y):], 6) }}
+	case *image.NRGBA64:
+		return pngFormat{16, rgb, 6, func(dst []byte, y int) { dropAlpha(dst, src.Pix[src.PixOffset(b.Min.X, y):], 6) }}
+	case *eimage.Planar:
+		return pngFormat{16, rgb, 6, func(dst []byte, y int) {
+			for x:=0; x<b.Dx(); x++ {
+				c := src.RGBA64At(b.Min.X + x, y)
+				binary.BigEndian.PutUint16(dst[6*x:], c.R)
+				binary.BigEndian.PutUint16(dst[6*x+2:], c.G)
+				binary.BigEndian.PutUint16(dst[6*x+4:], c.B)
+			}
+		}}
+	}
+	return pngFormat{}
+}
+
+// dropAlpha copies the color of each pixel (n bytes of it) from the
+// RGBA bytes in src, which has a pixel for each in dst.
+func dropAlpha(dst, src []byte, n int) {
+	for x, s := 0, 0; x+n <= len(dst); x, s = x+n, s+n+n/3 {
+		copy(dst[x:x+n], src[s:s+n])
+	}
+}
+
+// A pngBand is some rows of the image, filtered and deflated.
+type pngBand struct {
+	data   []byte
+	adler  uint32  // Checksum of the filtered rows, before deflating
+	n      int64   // ... and how many bytes they are
+	err    error
+}
+
+func encodeBand(img image.Image, format pngFormat, rowBytes, minY, y0, y1 int, last bool) pngBand {
+	prev, cur := make([]byte, rowBytes), make([]byte, rowBytes)
+	if y0 > minY {
+		format.row(prev, y0-1) // the filters look at the row above
+	}
+	var scratch [5][]byte
+	for i := range scratch {
+		scratch[i] = make([]byte, rowBytes+1)
+	}
+
+	var buf bytes.Buffer
+	zw, _ := flate.NewWriter(&buf, flate.DefaultCompression) // only fails for a bad level
+	sum := adler32.New()
+	band := pngBand{}
+	for y:=y0; y<y1; y++ {
+		format.row(cur, y)
+		filtered := filterRow(&scratch, cur, prev, format.bpp)
+		sum.Write(filtered)
+		if _, err := zw.Write(filtered); err != nil {
+			band.err = err
+			return band
+		}
+		band.n += int64(len(filtered))
+		prev, cur = cur, prev
+	}
+	if last {
+		band.err = zw.Close()
+	} else {
+		band.err = zw.Flush()
+	}
+	band.data, band.adler = buf.Bytes(), sum.Sum32()
+	return band
+}
+
+// filterRow tries each of the five PNG filters on the row (with the
+// filter type byte first), and returns the one that's most likely to
+// compress best: the smallest sum of the bytes taken as signed, as
+// libpng (and image/png) guess.
+func filterRow(out *[5][]byte, cur, prev []byte, bpp int) []byte {
+	for f := range out {
+		out[f][0] = byte(f)
+	}
+	none, sub, up, avg, paeth := out[0][1:], out[1][1:], out[2][1:], out[3][1:], out[4][1:]
+	copy(none, cur)
+	for i := range cur {
+		var a, c byte // left, and up-left
+		if i >= bpp {
+			a, c = cur[i-bpp], prev[i-bpp]
+		}
+		b := prev[i]
+		sub[i] = cur[i] - a
+		up[i] = cur[i] - b
+		avg[i] = cur[i] - byte((int(a) + int(b)) / 2)
+		paeth[i] = cur[i] - paethPredictor(a, b, c)
+	}
+
+	best, bestSum := 0, -1
+	for f := range out {
+		sum := 0
+		for _, v := range out[f][1:] {
+			if int8(v) < 0 {
+				sum -= int(int8(v))
+			} else {
+				sum += int(v)
+			}
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return out[best]
+}
+
+func paethPredictor(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p - int(a)), abs(p - int(b)), abs(p - int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// adler32Combine is the Adler-32 of two runs of bytes one after the
+// other, from the checksum of each, and the length of the second (as
+// zlib's adler32_combine).
+func adler32Combine(adler1, adler2 uint32, len2 int64) uint32 {
+	const base = 65521
+	rem := uint32(len2 % base)
+	sum1 := adler1 & 0xFFFF
+	sum2 := (rem * sum1) % base
+	sum1 += (adler2 & 0xFFFF) + base - 1
+	sum2 += (adler1 >> 16) + (adler2 >> 16) + base - rem
+	if sum1 >= base { sum1 -= base }
+	if sum1 >= base { sum1 -= base }
+	if sum2 >= 2*base { sum2 -= 2*base }
+	if sum2 >= base { sum2 -= base }
+	return sum1 | sum2<<16
+}
+
+// pngWriter writes chunks, keeping the first error.
+type pngWriter struct {
+	w    io.Writer
+	err  error
+}
+
+func (pw *pngWriter)write(b []byte) {
+	if pw.err == nil {
+		_, pw.err = pw.w.Write(b)
+	}
+}
+
+func (pw *pngWriter)chunk(kind string, data []byte) {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], kind)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	pw.write(hdr[:])
+	pw.write(data)
+	pw.write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+}
+
+// A PNGColorTag says how a PNG's values are to be read: it goes in the
+// cHRM and gAMA chunks (and the sRGB chunk, if it's sRGB itself).
+type PNGColorTag struct {
+	SRGB            bool           // Add an sRGB chunk (perceptual intent)
+	Gamma           float64        // The decoding exponent; 1 is linear
+	Chromaticities  [4][2]float64  // CIE xy of the red, green & blue primaries, and the white point
+}
+
+// TagPNG returns a writer that passes a PNG (from png.Encode, or
+// EncodePNG) through to w, with the tag's chunks added after the
+// IHDR; they have to come before any PLTE or IDAT.
+func TagPNG(w io.Writer, tag PNGColorTag) io.Writer {
+	var buf bytes.Buffer
+	pw := pngWriter{w: &buf}
+	if tag.SRGB {
+		pw.chunk("sRGB", []byte{0})
+	}
+	if tag.Gamma > 0 {
+		pw.chunk("gAMA", binary.BigEndian.AppendUint32(nil, uint32(math.Round(100000.0 / tag.Gamma))))
+	}
+	chrm := []byte{}
+	for _, xy := range [4][2]float64{tag.Chromaticities[3], tag.Chromaticities[0], tag.Chromaticities[1], tag.Chromaticities[2]} {
+		chrm = binary.BigEndian.AppendUint32(chrm, uint32(math.Round(xy[0] * 100000.0)))
+		chrm = binary.BigEndian.AppendUint32(chrm, uint32(math.Round(xy[1] * 100000.0)))
+	}
+	pw.chunk("cHRM", chrm) // white point first
+	return &pngTagger{w: w, chunks: buf.Bytes()}
+}
+
+// The signature, and the IHDR chunk (length, type, 13 bytes, crc)
+const pngHeaderLen = 8 + 4 + 4 + 13 + 4
+
+type pngTagger struct {
+	w       io.Writer
+	head    []byte
+	chunks  []byte
+	done    bool
+}
+
+func (t *pngTagger)Write(p []byte) (int, error) {
+	if t.done {
+		return t.w.Write(p)
+	}
+	n := len(p)
+	if need := pngHeaderLen - len(t.head); len(p) < need {
+		t.head = append(t.head, p...)
+		return n, nil
+	} else {
+		t.head, p = append(t.head, p[:need]...), p[need:]
+	}
+	t.done = true
+	if _, err := t.w.Write(append(t.head, t.chunks...)); err != nil {
+		return 0, err
+	}
+	if _, err := t.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func WritePNG(img image.Image, filename string) error {
+	if writer, err := os.Create(filename); err != nil {
+		return fmt.Errorf("open+w '%s': %v", filename, err)
+	} else {
+		defer writer.Close()
+		return png.Encode(writer, img)
+	}
+}
+
+// WritePNGFast is WritePNG, with EncodePNG.
+func WritePNGFast(img image.Image, filename string, workers int) error {
+	if writer, err := os.Create(filename); err != nil {
+		return fmt.Errorf("open+w '%s': %v", filename, err)
+	} else {
+		defer writer.Close()
+		return EncodePNG(writer, img, workers)
+	}
+}
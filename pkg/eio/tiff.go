@@ -0,0 +1,47 @@
+package eio
+
+import(
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"golang.org/x/image/tiff"
+)
+
+// ReadTIFF loads the pixels of a TIFF photo; see ReadMetadata for the
+// rest of it.
+func ReadTIFF(filename string) (image.Image, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open+r img '%s': %v", filename, err)
+	}
+	defer reader.Close()
+	img, err := DecodeTIFF(reader)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %v", filename, err)
+	}
+	return img, nil
+}
+
+// DecodeTIFF is ReadTIFF for a photo that's already open (or in memory).
+func DecodeTIFF(reader io.Reader) (image.Image, error) {
+	img, err := tiff.Decode(reader)
+	if err != nil {
+		return nil, fmt.Errorf("tiff decoding: %v", err)
+	}
+	return img, nil
+}
+
+// WriteTIFF writes the image as a (deflated) TIFF.
+func WriteTIFF(img image.Image, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("open+w '%s': %v", filename, err)
+	}
+	defer f.Close()
+	if err := tiff.Encode(f, img, &tiff.Options{Compression: tiff.Deflate}); err != nil {
+		return fmt.Errorf("tiff '%s': %v", filename, err)
+	}
+	return f.Close()
+}
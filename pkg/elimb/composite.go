@@ -0,0 +1,120 @@
+package elimb
+
+import(
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// A Composite is for debugging - an image that overlays the floodfills
+// of all the lunar limbs, each frame in its own color, in its own pie
+// slices around the first frame's center. Frames can be found
+// concurrently onto the same one.
+type Composite struct {
+	sync.Mutex
+	img       *image.RGBA
+	center    image.Point
+	nFrames   int
+	maxFrames int
+}
+
+func NewComposite() *Composite {
+	return &Composite{maxFrames: 5}
+}
+
+// Image is a copy of the composite so far, or nil if nothing has been
+// drawn on it.
+func (lc *Composite)Image() image.Image {
+	lc.Lock()
+	defer lc.Unlock()
+	if lc.img == nil {
+		return nil
+	}
+	img := *lc.img
+	img.Pix = append([]uint8(nil), lc.img.Pix...)
+	return &img
+}
+
+// A limbSketch is one frame's part of the composite. It is drawn
+// separately, so frames can be floodfilled concurrently, and then
+// added to the composite in one go.
+type limbSketch struct {
+	lc      *Composite
+	frame   int
+	center  image.Point
+	pts     []image.Point
+}
+
+// startFrame returns nil if there is no composite, which is fine to
+// plot on.
+func (lc *Composite)startFrame(bounds image.Rectangle, center image.Point) *limbSketch {
+	if lc == nil {
+		return nil
+	}
+	lc.Lock()
+	defer lc.Unlock()
+	if lc.img == nil {
+		lc.img = image.NewRGBA(bounds)
+		lc.center = center
+	}
+	s := &limbSketch{lc: lc, frame: lc.nFrames, center: center}
+	lc.nFrames++
+	return s
+}
+
+func (lc *Composite)pickColor(frame int) color.RGBA64 {
+	plotColors := []color.RGBA64{
+		color.RGBA64{0xa000, 0, 0, 0xffff},
+		color.RGBA64{0, 0xa000, 0, 0xffff},
+		color.RGBA64{0, 0, 0xa000, 0xffff},
+		color.RGBA64{0x7000, 0x7000, 0, 0xffff},
+		color.RGBA64{0x7000, 0, 0x7000, 0xffff},
+		color.RGBA64{0, 0x7000, 0x7000, 0xffff},
+		color.RGBA64{0xb000, 0x3000, 0x7000, 0xffff},
+	}
+	return plotColors[frame % len(plotColors)]
+}
+
+func (s *limbSketch)plot(p image.Point) {
+	if s == nil {
+		return
+	}
+	thetaRadians := math.Atan2(float64(p.Y-s.lc.center.Y), float64(p.X-s.lc.center.X))
+	thetaDegrees := 180 + thetaRadians * 180.0 / math.Pi
+	segment := int(thetaDegrees / 12)
+	if (segment % s.lc.maxFrames) != s.frame {
+		return
+	}
+	s.pts = append(s.pts, p)
+}
+
+// finish adds the sketch to the composite, with a marker at its
+// center and a box around the limb.
+func (s *limbSketch)finish(limb image.Rectangle) {
+	if s == nil {
+		return
+	}
+	lc := s.lc
+	lc.Lock()
+	defer lc.Unlock()
+	col := lc.pickColor(s.frame)
+	for _, d := range []int{2, 4, 6} {
+		lc.plotRectangle(image.Rect(s.center.X-d, s.center.Y-d, s.center.X+d, s.center.Y+d), col)
+	}
+	for _, p := range s.pts {
+		lc.img.Set(p.X, p.Y, col)
+	}
+	lc.plotRectangle(limb, col)
+}
+
+func (lc *Composite)plotRectangle(r image.Rectangle, col color.RGBA64) {
+	for x:=r.Min.X; x<=r.Max.X; x++ {
+		lc.img.Set(x, r.Min.Y, col)
+		lc.img.Set(x, r.Max.Y, col)
+	}
+	for y:=r.Min.Y; y<=r.Max.Y; y++ {
+		lc.img.Set(r.Min.X, y, col)
+		lc.img.Set(r.Max.X, y, col)
+	}
+}
@@ -0,0 +1,84 @@
+package elimb
+
+import(
+	"image"
+	"math"
+	"sort"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// EdgeWidth measures how sharp the limb is in the photo: along rays out
+// from the limb's center, the distance (in pixels) over which the
+// brightness climbs from 10% to 90% of the way from the moon's dark disk
+// up to the corona just outside it. Focus, seeing and shake all widen
+// it. It is the median over the rays with enough contrast to measure,
+// or zero if there weren't any.
+func (ll LunarLimb)EdgeWidth(img image.Image) float64 {
+	r := float64(ll.Bounds.Dx() + ll.Bounds.Dy()) / 4.0
+	if r == 0.0 {
+		return 0.0
+	}
+	cx, cy := float64(ll.Bounds.Min.X + ll.Bounds.Max.X) / 2.0, float64(ll.Bounds.Min.Y + ll.Bounds.Max.Y) / 2.0
+	span := math.Max(8.0, 0.05 * r) // how far either side of the limb to look
+	const step = 0.25
+
+	widths := []float64{}
+	profile := make([]float64, int(2.0 * span / step) + 1)
+	for deg:=0; deg<360; deg+=2 {
+		dx, dy := math.Cos(float64(deg) * math.Pi / 180.0), math.Sin(float64(deg) * math.Pi / 180.0)
+		for k := range profile {
+			d := r - span + float64(k) * step
+			profile[k] = grayBilinear(img, cx + d*dx, cy + d*dy)
+		}
+
+		// The moon is the bottom of the inner quarter; the corona, the top of the profile
+		inner := append([]float64{}, profile[:len(profile)/4]...)
+		sort.Float64s(inner)
+		lo, hi := inner[len(inner)/2], 0.0
+		for _, v := range profile {
+			hi = math.Max(hi, v)
+		}
+		if hi - lo < 0x400 {
+			continue // not enough contrast (or off the edge of the photo)
+		}
+		k10, k90 := crossing(profile, 0, lo + 0.1*(hi - lo)), -1.0
+		if k10 >= 0.0 {
+			k90 = crossing(profile, int(k10), lo + 0.9*(hi - lo))
+		}
+		if k90 >= 0.0 {
+			widths = append(widths, (k90 - k10) * step)
+		}
+	}
+	if len(widths) == 0 {
+		return 0.0
+	}
+	sort.Float64s(widths)
+	return widths[len(widths)/2]
+}
+
+// crossing is where (in fractional samples) the profile first climbs to
+// the level, from sample `from` on; -1 if it never does.
+func crossing(profile []float64, from int, level float64) float64 {
+	for k:=from+1; k<len(profile); k++ {
+		if profile[k] >= level && profile[k-1] < level {
+			return float64(k-1) + (level - profile[k-1]) / (profile[k] - profile[k-1])
+		}
+	}
+	return -1.0
+}
+
+// grayBilinear is the gray level at (x,y), interpolated from the four
+// pixels around it; zero beyond the edge of the photo.
+func grayBilinear(img image.Image, x, y float64) float64 {
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	b := img.Bounds()
+	if x0 < b.Min.X || y0 < b.Min.Y || x0+1 >= b.Max.X || y0+1 >= b.Max.Y {
+		return 0.0
+	}
+	fx, fy := x - float64(x0), y - float64(y0)
+	g := func(x, y int) float64 { return float64(eimage.GrayU16At(img, x, y)) }
+	top := g(x0, y0) * (1-fx) + g(x0+1, y0) * fx
+	bottom := g(x0, y0+1) * (1-fx) + g(x0+1, y0+1) * fx
+	return top * (1-fy) + bottom * fy
+}
@@ -0,0 +1,202 @@
+// Package elimb finds the lunar limb - the outline of the moon - in a
+// photo of totality (and the sun, in photos of the partial phases; see
+// FitSolarDisk).
+package elimb
+
+import(
+	"context"
+	"fmt"
+	"image"
+	"sync"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+)
+
+// The LunarLimb is the shadow/outline of the moon. We identify it and
+// use it as a starting point for aligning images.
+type LunarLimb struct {
+	LuminalCenter image.Point // The luminance-weighted "center" of the image. Hopefully will be inside the limb.
+	Brightness uint16         // A rough average of the brightness of the pixels in the limb (floodfill needs to know this)
+	Bounds image.Rectangle    // A box around the limb
+	Frame FrameStats `yaml:"-"` // From the same pass over the photo as LuminalCenter; too bulky for config files
+}
+
+func (ll LunarLimb)Radius() int { return (ll.Bounds.Dx() + ll.Bounds.Dy())/4 }
+func (ll LunarLimb)Center() image.Point { return eimage.RectCenter(ll.Bounds) }
+
+func (ll *LunarLimb)Grow(p image.Point) {
+	if ll.Bounds.Max.X == 0 {
+		ll.Bounds.Min = p
+		ll.Bounds.Max = p
+	} else {
+		ll.Bounds =	eimage.GrowRectangle(ll.Bounds, p)
+	}
+}
+
+// A Finder finds the lunar limb in photos; see Find.
+type Finder struct {
+	Workers   int         // How many goroutines scan the photo for the luminal center; if < 2, just this one
+	Composite *Composite  // Optional; the floodfills are sketched onto it
+}
+
+// Find returns a Rectangle that bounds the lunar limb, the outline of
+// the moon. This is a fairly dumb routine; it finds the centroid of all
+// the luminance in the image, assumes that is inside the lunar limb,
+// and then floodfills out until it sees some bright pixels. It fails
+// if it couldn't find anything, or if ctx is cancelled. If comp isn't
+// nil, the floodfill is sketched onto it. (It is Finder.Find, with no
+// extra workers.)
+func Find(ctx context.Context, img image.Image, comp *Composite) (LunarLimb, error) {
+	return Finder{Composite: comp}.Find(ctx, img)
+}
+
+// Find finds the lunar limb in img, as the package's Find does.
+func (f Finder)Find(ctx context.Context, img image.Image) (LunarLimb, error) {
+	ll := LunarLimb{}
+	p := image.Point{}
+	bounds := img.Bounds()
+
+	ll.scanFrame(img, f.Workers)
+	sketch := f.Composite.startFrame(bounds, ll.LuminalCenter)
+	
+	// Any pixel that is brighter than thresh is considered part of the
+	// corona etc., i.e. outside the limb. We set this kinda high,
+	// because some shots can have quite a lot of earthshine (luminance
+	// inside the limb). But if the overall photo looks kinda dim,
+	// reduce the thresh, else the corona will be so dim that the flood
+	// will flow over it and cover the whole image.
+	thresh := uint16(0x1000)
+	if ll.Brightness < 0x0015 {
+		thresh = uint16(0x0040)
+	}
+
+	seenMap := map[image.Point]bool{}
+	seen := func(p image.Point) bool {
+		_, exists := seenMap[p]
+		return exists
+	}
+	
+	// Floodfill out from the LuminalCenter
+	toVisit := newPointQueue(bounds)
+	toVisit.Push(ll.LuminalCenter)
+	for n:=0; ; n++ {
+		if toVisit.Len() == 0 { break }
+		if n % 65536 == 0 && ctx.Err() != nil {
+			return ll, ctx.Err()
+		}
+		p = toVisit.Pop()
+
+		if seen(p) {
+			continue
+		}
+		seenMap[p] = true
+
+		// If we start seeing a bit of luminance, stop - this is the end of the lunar limb
+		if gray := eimage.GrayU16At(img, p.X, p.Y); gray > thresh {
+			continue
+		}
+
+		ll.Grow(p)
+		sketch.plot(p)
+
+		if p.X > bounds.Min.X && !seen(image.Point{p.X-1,p.Y}) {
+			toVisit.Push(image.Point{p.X-1, p.Y})
+		}
+		if p.Y > bounds.Min.Y && !seen(image.Point{p.X, p.Y-1}) {
+			toVisit.Push(image.Point{p.X, p.Y-1})
+		}
+		if p.X < bounds.Max.X && !seen(image.Point{p.X+1,p.Y}) {
+			toVisit.Push(image.Point{p.X+1, p.Y})
+		}
+		if p.Y < bounds.Max.Y && !seen(image.Point{p.X,p.Y+1}) {
+			toVisit.Push(image.Point{p.X, p.Y+1})
+		}
+	}
+	
+	sketch.finish(ll.Bounds)
+
+	if ll.Radius() == 0 {
+		return ll, fmt.Errorf("could not locate lunar limb")
+	}
+	
+	return ll, nil
+}
+
+// scanFrame makes the one pass over the photo that the rest of the
+// pipeline needs; it finds the 'centre of mass' for the image
+// illumination, and fills in ll.Frame. We expect the centre to be
+// somewhere inside the lunar limb, so we can use it as a startpoint
+// for the flood fill.
+//
+// It ignores dim pixels (img noise) and very bright
+// pixels (they tend to pull too far one direction) - what we hope
+// is left are the corona pixels.
+//
+// It also figures out a brightness value that is the average gray
+// color of pixels in the lunar limb. The floodfiller uses this so it
+// can handle images with a very bright (or very dim) initial corona
+// boundary.
+//
+// The scan is split into bands of rows, one per worker, each with its
+// own partial sums; they are integers, so the total doesn't depend on
+// the order they're added up in.
+func (ll *LunarLimb)scanFrame(img image.Image, workers int) {
+	b := img.Bounds()
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > b.Dy() {
+		workers = b.Dy()
+	}
+
+	type sums struct{ x, y, n int; frame FrameStats }
+	partial := make([]sums, workers)
+	band := func(w int) {
+		row := make([]uint16, b.Dx())
+		s := &partial[w]
+		for y:= b.Min.Y + w*b.Dy()/workers; y<b.Min.Y + (w+1)*b.Dy()/workers; y++ {
+			eimage.GrayRowU16(row, img, b.Min.X, y)
+			for i, gray := range row {
+				s.frame.Histogram[gray >> 8]++
+				if gray >= SaturatedGray {
+					s.frame.Saturated++
+				} else if gray > 0x0300 {
+					s.x += b.Min.X + i
+					s.y += y
+					s.n++
+				}
+			}
+			s.frame.Pixels += len(row)
+		}
+	}
+	var wg sync.WaitGroup
+	for w:=1; w<workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			band(w)
+		}(w)
+	}
+	if workers > 0 {
+		band(0)
+	}
+	wg.Wait()
+
+	ll.Frame = FrameStats{}
+	sumX, sumY, n := 0,0,0
+	for _, s := range partial {
+		sumX, sumY, n = sumX + s.x, sumY + s.y, n + s.n
+		ll.Frame.add(s.frame)
+	}
+	if n == 0 {
+		return
+	}
+
+	ll.LuminalCenter.X = sumX/n
+	ll.LuminalCenter.Y = sumY/n
+
+	for i:=-5; i<5; i++ {
+		ll.Brightness += eimage.GrayU16At(img, ll.LuminalCenter.X+i, ll.LuminalCenter.Y)  // [0, 0xFFFF]
+	}
+	ll.Brightness /= 10
+}
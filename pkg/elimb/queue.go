@@ -0,0 +1,43 @@
+package elimb
+
+import(
+	"image"
+)
+
+// A pointQueue is the floodfill's queue of points to visit: a ring
+// buffer, so popping off the front doesn't leave the slice to creep
+// through memory (and be copied each time append outgrows it). It only
+// grows if the frontier is bigger than it has ever been.
+type pointQueue struct {
+	buf   []image.Point
+	head  int  // Index of the front
+	n     int  // How many are queued
+}
+
+// newPointQueue preallocates room for a frontier that goes all round
+// the bounds a few times over; a breadth first fill's frontier is about
+// its perimeter, plus the points queued more than once.
+func newPointQueue(b image.Rectangle) *pointQueue {
+	return &pointQueue{buf: make([]image.Point, 4 * (b.Dx() + b.Dy() + 1))}
+}
+
+func (q *pointQueue)Len() int { return q.n }
+
+func (q *pointQueue)Push(p image.Point) {
+	if q.n == len(q.buf) {
+		bigger := make([]image.Point, 2*len(q.buf))
+		copied := copy(bigger, q.buf[q.head:])
+		copy(bigger[copied:], q.buf[:q.head])
+		q.buf, q.head = bigger, 0
+	}
+	q.buf[(q.head + q.n) % len(q.buf)] = p
+	q.n++
+}
+
+// Pop takes the point off the front; the queue must not be empty.
+func (q *pointQueue)Pop() image.Point {
+	p := q.buf[q.head]
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	return p
+}
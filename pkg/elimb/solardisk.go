@@ -0,0 +1,358 @@
+package elimb
+
+import(
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// A SolarDisk is the sun, as fitted to a photo of a partial phase (taken
+// through a solar filter): where it is, how big, and how bright, with
+// its limb darkening. Brightnesses are linear gray, [0,1].
+type SolarDisk struct {
+	X, Y           float64  // The center, in photo coords (to a fraction of a pixel)
+	Radius         float64
+	Brightness     float64  // At the center of the disk (even if the moon is in front of it)
+	LimbDarkening  float64  // u, in the linear law I(μ) = Brightness * (1 - u(1-μ)), where μ is 1.0 at the center, 0.0 at the limb
+	Sky            float64  // The background, beyond the limb
+	Edge           float64  // How soft the limb is, in pixels (from seeing, focus etc)
+	Visible        float64  // How much of the disk's light got past the moon, [0,1]
+	Residual       float64  // RMS error of the fit, as a fraction of Brightness
+}
+
+func (sd SolarDisk)Center() image.Point { return image.Point{int(math.Round(sd.X)), int(math.Round(sd.Y))} }
+
+func (sd SolarDisk)String() string {
+	return fmt.Sprintf("center (%.2f,%.2f), radius %.2f, brightness %.4f, limb darkening %.3f, %.1f%% visible",
+		sd.X, sd.Y, sd.Radius, sd.Brightness, sd.LimbDarkening, 100.0 * sd.Visible)
+}
+
+// solarThresh is how bright (as a fraction of the brightest) a pixel
+// has to be, to count as part of the sun's disk.
+const solarThresh = 0.3
+
+// FitSolarDisk finds the sun in a partial phase photo. A first guess at
+// the disk comes from a circle fitted to the solar limb: the edge of the
+// bright crescent, where it is convex (the moon's edge is concave, so it
+// is left out). Then a limb darkened disk is fitted to the brightness
+// of the crescent itself, by least squares, which pins the center &
+// radius down more precisely than the edge alone (and gives the sun's
+// brightness, for normalizing a sequence of them). The pixels that the
+// moon covers, and those near its edge, are left out of the fit.
+func FitSolarDisk(img image.Image) (SolarDisk, error) {
+	b := img.Bounds()
+	gray := make([]uint16, b.Dx() * b.Dy())
+	hist := [256]int{}
+	for y:=b.Min.Y; y<b.Max.Y; y++ {
+		row := gray[(y-b.Min.Y)*b.Dx() : (y-b.Min.Y+1)*b.Dx()]
+		eimage.GrayRowU16(row, img, b.Min.X, y)
+		for _, g := range row {
+			hist[g >> 8]++
+		}
+	}
+	at := func(x, y int) float64 { return float64(gray[(y-b.Min.Y)*b.Dx() + x-b.Min.X]) / 0xFFFF }
+
+	// The brightest 0.01% sets the scale; the disk is much bigger than that
+	brightest, n := 0xFFFF, 0
+	for i:=255; i>=0; i-- {
+		if n += hist[i]; n >= len(gray) / 10000 {
+			brightest = i<<8 | 0xFF
+			break
+		}
+	}
+	thresh := solarThresh * float64(brightest) / 0xFFFF
+	bright := func(x, y int) bool { return at(x, y) > thresh }
+
+	// The edge of the bright bits (not counting the edges of the photo)
+	edge := []image.Point{}
+	for y:=b.Min.Y+1; y<b.Max.Y-1; y++ {
+		for x:=b.Min.X+1; x<b.Max.X-1; x++ {
+			if bright(x, y) && (!bright(x-1, y) || !bright(x+1, y) || !bright(x, y-1) || !bright(x, y+1)) {
+				edge = append(edge, image.Point{x, y})
+			}
+		}
+	}
+	limb := onConvexHull(edge, 1.5)
+	if len(limb) < 20 {
+		return SolarDisk{}, fmt.Errorf("could not see enough of the solar limb (%d points)", len(limb))
+	}
+
+	x, y, r, err := fitCircle(limb)
+	if err != nil {
+		return SolarDisk{}, err
+	} else if r < 10.0 {
+		return SolarDisk{}, fmt.Errorf("the solar disk is too small to fit (radius %.1f)", r)
+	}
+	sd := SolarDisk{X: x, Y: y, Radius: r, Brightness: float64(brightest) / 0xFFFF, LimbDarkening: 0.6, Edge: 1.0}
+	if err := sd.refine(at, b, thresh); err != nil {
+		return SolarDisk{}, err
+	}
+	return sd, nil
+}
+
+// onConvexHull is the points that are (within tol pixels of) the edge
+// of their convex hull.
+func onConvexHull(pts []image.Point, tol float64) []image.Point {
+	if len(pts) < 3 {
+		return nil
+	}
+	sorted := append([]image.Point{}, pts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].X != sorted[j].X {
+			return sorted[i].X < sorted[j].X
+		}
+		return sorted[i].Y < sorted[j].Y
+	})
+	cross := func(o, a, b image.Point) int { return (a.X-o.X)*(b.Y-o.Y) - (a.Y-o.Y)*(b.X-o.X) }
+
+	// Andrew's monotone chain
+	hull := []image.Point{}
+	for pass:=0; pass<2; pass++ {
+		start := len(hull)
+		for _, p := range sorted {
+			for len(hull) >= start+2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+				hull = hull[:len(hull)-1]
+			}
+			hull = append(hull, p)
+		}
+		hull = hull[:len(hull)-1]
+		for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+			sorted[i], sorted[j] = sorted[j], sorted[i]
+		}
+	}
+
+	near := []image.Point{}
+	for _, p := range pts {
+		for i := range hull {
+			if segmentDist(p, hull[i], hull[(i+1) % len(hull)]) <= tol {
+				near = append(near, p)
+				break
+			}
+		}
+	}
+	return near
+}
+
+func segmentDist(p, a, b image.Point) float64 {
+	dx, dy := float64(b.X-a.X), float64(b.Y-a.Y)
+	t := 0.0
+	if l2 := dx*dx + dy*dy; l2 > 0 {
+		t = math.Max(0.0, math.Min(1.0, (float64(p.X-a.X)*dx + float64(p.Y-a.Y)*dy) / l2))
+	}
+	return math.Hypot(float64(p.X-a.X) - t*dx, float64(p.Y-a.Y) - t*dy)
+}
+
+// fitCircle fits a circle to the points (algebraically, as x²+y²+Dx+Ey+F
+// = 0), and fits it again without the points that are over 3 pixels
+// off, in case some of the moon's edge got in.
+func fitCircle(pts []image.Point) (x, y, r float64, err error) {
+	for round:=0; round<3; round++ {
+		rows, vals := [][]float64{}, []float64{}
+		for _, p := range pts {
+			if round > 0 && math.Abs(math.Hypot(float64(p.X)-x, float64(p.Y)-y) - r) > 3.0 {
+				continue
+			}
+			rows = append(rows, []float64{float64(p.X), float64(p.Y), 1.0})
+			vals = append(vals, -float64(p.X*p.X + p.Y*p.Y))
+		}
+		c, err := emath.LeastSquares(rows, vals)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("fitting the solar limb: %v", err)
+		}
+		x, y = -c[0]/2.0, -c[1]/2.0
+		r = math.Sqrt(x*x + y*y - c[2])
+	}
+	return x, y, r, nil
+}
+
+// The parameters of the refined fit, in order
+const(
+	fitX = iota
+	fitY
+	fitRadius
+	fitBrightness
+	fitLimbDarkening
+	fitSky
+	fitEdge
+	fitParams
+)
+
+// diskModel is the brightness at (x,y) of a limb darkened disk, with a soft
+// (logistic) edge, on a flat sky.
+func diskModel(p [fitParams]float64, x, y float64) float64 {
+	r := math.Hypot(x - p[fitX], y - p[fitY])
+	d := math.Min(1.0, r / p[fitRadius])
+	mu := math.Sqrt(1.0 - d*d)
+	soft := 1.0 / (1.0 + math.Exp(-(p[fitRadius] - r) / p[fitEdge]))
+	return p[fitSky] + p[fitBrightness] * (1.0 - p[fitLimbDarkening] * (1.0 - mu)) * soft
+}
+
+// maxFitSamples is about how many pixels the refined fit looks at; it
+// strides over the disk to keep to it.
+const maxFitSamples = 100000
+
+// refine fits the limb darkened disk (Levenberg-Marquardt) to the pixels
+// around sd's first guess, leaving out the moon: pixels inside the disk
+// that are darker than thresh, and any within a few pixels of them.
+func (sd *SolarDisk)refine(at func(x, y int) float64, b image.Rectangle, thresh float64) error {
+	area := image.Rect(int(sd.X - 1.2*sd.Radius), int(sd.Y - 1.2*sd.Radius), int(sd.X + 1.2*sd.Radius) + 1, int(sd.Y + 1.2*sd.Radius) + 1).Intersect(b)
+	w, h := area.Dx(), area.Dy()
+
+	// Where the moon is, spread out by a few pixels
+	const margin = 3
+	moon := make([]bool, w*h)
+	for j:=0; j<h; j++ {
+		for i:=0; i<w; i++ {
+			x, y := area.Min.X + i, area.Min.Y + j
+			moon[j*w+i] = math.Hypot(float64(x) - sd.X, float64(y) - sd.Y) < 0.98*sd.Radius && at(x, y) <= thresh
+		}
+	}
+	moon = dilate(moon, w, h, margin)
+
+	stride := int(math.Max(1.0, math.Sqrt(float64(w*h) / maxFitSamples)))
+	xs, ys, vs := []float64{}, []float64{}, []float64{}
+	sky, nSky := 0.0, 0
+	for j:=0; j<h; j+=stride {
+		for i:=0; i<w; i+=stride {
+			x, y := area.Min.X + i, area.Min.Y + j
+			if moon[j*w+i] || math.Hypot(float64(x) - sd.X, float64(y) - sd.Y) > 1.2*sd.Radius {
+				continue
+			}
+			xs, ys, vs = append(xs, float64(x)), append(ys, float64(y)), append(vs, at(x, y))
+			if math.Hypot(float64(x) - sd.X, float64(y) - sd.Y) > 1.05*sd.Radius {
+				sky, nSky = sky + at(x, y), nSky+1
+			}
+		}
+	}
+	if len(vs) < 100 {
+		return fmt.Errorf("too little of the solar disk is visible to fit (%d samples)", len(vs))
+	}
+	if nSky > 0 {
+		sky /= float64(nSky)
+	}
+
+	p := [fitParams]float64{sd.X, sd.Y, sd.Radius, sd.Brightness, sd.LimbDarkening, sky, sd.Edge}
+	steps := [fitParams]float64{0.01, 0.01, 0.01, 1e-4 * sd.Brightness, 1e-4, 1e-4 * sd.Brightness, 0.01}
+	cost := func(p [fitParams]float64) float64 {
+		c := 0.0
+		for k := range vs {
+			e := vs[k] - diskModel(p, xs[k], ys[k])
+			c += e*e
+		}
+		return c
+	}
+	bounded := func(p [fitParams]float64) [fitParams]float64 {
+		p[fitLimbDarkening] = math.Max(0.0, math.Min(1.0, p[fitLimbDarkening]))
+		p[fitEdge] = math.Max(0.1, p[fitEdge])
+		return p
+	}
+
+	lambda, c := 1e-3, cost(p)
+	for iter:=0; iter<30; iter++ {
+		JtJ := make([][]float64, fitParams)
+		for i := range JtJ {
+			JtJ[i] = make([]float64, fitParams)
+		}
+		Jtr := make([]float64, fitParams)
+		for k := range vs {
+			var grad [fitParams]float64
+			for i:=0; i<fitParams; i++ {
+				hi, lo := p, p
+				hi[i] += steps[i]
+				lo[i] -= steps[i]
+				grad[i] = (diskModel(hi, xs[k], ys[k]) - diskModel(lo, xs[k], ys[k])) / (2.0 * steps[i])
+			}
+			e := vs[k] - diskModel(p, xs[k], ys[k])
+			for i:=0; i<fitParams; i++ {
+				Jtr[i] += grad[i] * e
+				for j:=0; j<fitParams; j++ {
+					JtJ[i][j] += grad[i] * grad[j]
+				}
+			}
+		}
+		for ; lambda < 1e6; lambda *= 4.0 {
+			A := make([][]float64, fitParams)
+			for i := range A {
+				A[i] = append([]float64{}, JtJ[i]...)
+				A[i][i] *= 1.0 + lambda
+			}
+			delta, err := emath.SolveLinear(A, append([]float64{}, Jtr...))
+			if err != nil {
+				return fmt.Errorf("fitting the solar disk: %v", err)
+			}
+			next := p
+			for i := range next {
+				next[i] += delta[i]
+			}
+			if next = bounded(next); cost(next) < c {
+				moved := math.Abs(next[fitX]-p[fitX]) + math.Abs(next[fitY]-p[fitY]) + math.Abs(next[fitRadius]-p[fitRadius])
+				p, c, lambda = next, cost(next), lambda / 3.0
+				if moved < 1e-4 {
+					iter = 30
+				}
+				break
+			}
+		}
+		if lambda >= 1e6 {
+			break // nowhere better to go
+		}
+	}
+	if p[fitRadius] <= 0.0 || p[fitBrightness] <= 0.0 || math.Hypot(p[fitX]-sd.X, p[fitY]-sd.Y) > 0.1*sd.Radius {
+		return fmt.Errorf("the solar disk fit went astray (radius %.1f, brightness %.3g)", p[fitRadius], p[fitBrightness])
+	}
+
+	sd.X, sd.Y, sd.Radius, sd.Brightness = p[fitX], p[fitY], p[fitRadius], p[fitBrightness]
+	sd.LimbDarkening, sd.Sky, sd.Edge = p[fitLimbDarkening], p[fitSky], p[fitEdge]
+	sd.Residual = math.Sqrt(c / float64(len(vs))) / sd.Brightness
+
+	// How much light there is on the disk, against how much there would be
+	seen, all := 0.0, 0.0
+	for j:=0; j<h; j++ {
+		for i:=0; i<w; i++ {
+			x, y := float64(area.Min.X + i), float64(area.Min.Y + j)
+			if math.Hypot(x - sd.X, y - sd.Y) >= sd.Radius {
+				continue
+			}
+			seen += math.Max(0.0, at(area.Min.X + i, area.Min.Y + j) - sd.Sky)
+			all += diskModel(p, x, y) - sd.Sky
+		}
+	}
+	if all > 0.0 {
+		sd.Visible = math.Min(1.0, seen / all)
+	}
+	return nil
+}
+
+// dilate spreads the true values out by r pixels (in a square), as a
+// max filter along the rows, then the columns.
+func dilate(mask []bool, w, h, r int) []bool {
+	pass := func(in []bool, n, m, step, stride int) []bool {
+		out := make([]bool, len(in))
+		for a:=0; a<m; a++ {
+			last := -r-1 // where the last true value was
+			for i:=0; i<n; i++ {
+				if in[a*stride + i*step] {
+					last = i
+				}
+				if i - last <= r {
+					out[a*stride + i*step] = true
+				}
+			}
+			last = n+r+1
+			for i:=n-1; i>=0; i-- {
+				if in[a*stride + i*step] {
+					last = i
+				}
+				if last - i <= r {
+					out[a*stride + i*step] = true
+				}
+			}
+		}
+		return out
+	}
+	return pass(pass(mask, w, h, 1, w), h, w, w, 1)
+}
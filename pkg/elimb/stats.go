@@ -0,0 +1,44 @@
+package elimb
+
+// SaturatedGray is the gray level at (or above) which a pixel counts
+// as saturated; the luminal center ignores these too.
+const SaturatedGray = 0xfff0
+
+// FrameStats summarize the gray levels of a photo. They come from the
+// same pass that finds the luminal center, so later stages can use
+// them without scanning the photo again.
+type FrameStats struct {
+	Histogram  [256]int  // Pixel counts by gray level, in bins of 0x100
+	Saturated  int       // Pixels at or above SaturatedGray
+	Pixels     int       // All of the pixels; zero if the photo wasn't scanned (e.g. the limb came from a config file)
+}
+
+func (fs *FrameStats)add(o FrameStats) {
+	for i := range fs.Histogram {
+		fs.Histogram[i] += o.Histogram[i]
+	}
+	fs.Saturated += o.Saturated
+	fs.Pixels += o.Pixels
+}
+
+// SaturatedFraction is how much of the photo is saturated, [0,1].
+func (fs FrameStats)SaturatedFraction() float64 {
+	if fs.Pixels == 0 {
+		return 0.0
+	}
+	return float64(fs.Saturated) / float64(fs.Pixels)
+}
+
+// Percentile is the gray level that p percent of the pixels are at or
+// below, to the nearest histogram bin (it returns the top of the bin).
+func (fs FrameStats)Percentile(p float64) uint16 {
+	want := int(p / 100.0 * float64(fs.Pixels) + 0.5)
+	n := 0
+	for i, count := range fs.Histogram {
+		n += count
+		if n >= want && n > 0 {
+			return uint16(i<<8 | 0xff)
+		}
+	}
+	return 0xffff
+}
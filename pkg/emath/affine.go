@@ -23,6 +23,15 @@ func (p Aff3)Mult(q Aff3) Aff3 {
 	}
 }
 
+// Invert returns the transform that undoes this one.
+func (m Aff3)Invert() Aff3 {
+	det := m[0]*m[4] - m[1]*m[3]
+	return Aff3{
+		 m[4]/det, -m[1]/det, (m[1]*m[5] - m[2]*m[4])/det,
+		-m[3]/det,  m[0]/det, (m[2]*m[3] - m[0]*m[5])/det,
+	}
+}
+
 func Identity() Aff3 {
 	return Aff3{1, 0, 0,   0, 1, 0}
 }
@@ -37,6 +46,15 @@ func (m1 Aff3)Rotate(thetaDeg float64) Aff3 {
 	return m1.Mult(Aff3{cosTheta, -1*sinTheta, 0,    sinTheta, cosTheta, 0})
 }
 
+func (m1 Aff3)Scale(s float64) Aff3 {
+	return m1.Mult(Aff3{s, 0, 0,   0, s, 0})
+}
+
+// Apply maps the point (x,y).
+func (m Aff3)Apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[1]*y + m[2], m[3]*x + m[4]*y + m[5]
+}
+
 func RotateAbout(thetaDeg, x, y float64) Aff3 {
 	// Remember they compose back to front - rightmost operations performed first
 	return Identity().Translate(x, y).Rotate(thetaDeg).Translate(-1*x, -1*y)
@@ -70,6 +88,20 @@ func (m Mat3)Apply(v Vec3) Vec3 {
 	}
 }
 
+// Invert returns the inverse matrix (via the adjugate). A singular
+// matrix comes back full of NaNs & Infs.
+func (m Mat3)Invert() Mat3 {
+	a, b, c := m[0], m[1], m[2]
+	d, e, f := m[3], m[4], m[5]
+	g, h, i := m[6], m[7], m[8]
+	det := a*(e*i-f*h) - b*(d*i-f*g) + c*(d*h-e*g)
+	return Mat3{
+		(e*i-f*h)/det, (c*h-b*i)/det, (b*f-c*e)/det,
+		(f*g-d*i)/det, (a*i-c*g)/det, (c*d-a*f)/det,
+		(d*h-e*g)/det, (b*g-a*h)/det, (a*e-b*d)/det,
+	}
+}
+
 func (m Mat3)String() string {
 	str := fmt.Sprintf("[%10f, %10f, %10f]\n", m[3*0+0], m[3*0+1], m[3*0+2])
 	str += fmt.Sprintf("[%10f, %10f, %10f]\n", m[3*1+0], m[3*1+1], m[3*1+2])
@@ -80,6 +112,15 @@ func (v Vec3)String() string {
 	return fmt.Sprintf("[%12.10f, %12.10f, %12.10f]", v[0], v[1], v[2])
 }
 
+// Places the vector on the diagonal of a matrix
+func (v Vec3)Diag() Mat3 {
+	return Mat3{
+		v[0],    0,    0,
+		   0, v[1],    0,
+		   0,    0, v[2],
+	}
+}
+
 // Places the vector on the diagonal of a matrix, then inverts it
 func (v Vec3)InvertDiag() Mat3 {
 	return Mat3{
@@ -179,6 +179,12 @@ func (fg *FloatGrid)Stats() string {
 // ToImg saves a simple grayscale, based on the range of values in the grid, and gamma scaling the
 // gray to look normal for human vision
 func (fg *FloatGrid)ToImg(title, filename string) {
+	gg.SavePNG(filename, fg.Image(title))
+}
+
+// Image renders the grid as a grayscale image (scaled from its min to
+// its max), with the title written in the top left.
+func (fg *FloatGrid)Image(title string) image.Image {
 	min, max := 1000.0, -1000.0
 	for i:=0; i<len(fg.values); i++ {
 		if fg.values[i] > max { max = fg.values[i] }
@@ -198,5 +204,5 @@ func (fg *FloatGrid)ToImg(title, filename string) {
 	dc := gg.NewContextForImage(img)
 	dc.SetRGB(1,1,1)
 	dc.DrawString(title, 50, 50)
-	dc.SavePNG(filename)
+	return dc.Image()
 }
@@ -0,0 +1,67 @@
+package emath
+
+import(
+	"fmt"
+	"math"
+)
+
+// SolveLinear solves the square system `A.x = b` by Gaussian
+// elimination with partial pivoting. A and b are modified.
+func SolveLinear(A [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for col:=0; col<n; col++ {
+		// Pivot on the largest remaining value in this column
+		pivot := col
+		for row:=col+1; row<n; row++ {
+			if math.Abs(A[row][col]) > math.Abs(A[pivot][col]) { pivot = row }
+		}
+		if math.Abs(A[pivot][col]) < 1e-12 {
+			return nil, fmt.Errorf("SolveLinear: matrix is singular")
+		}
+		A[col], A[pivot] = A[pivot], A[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for row:=col+1; row<n; row++ {
+			f := A[row][col] / A[col][col]
+			for k:=col; k<n; k++ {
+				A[row][k] -= f * A[col][k]
+			}
+			b[row] -= f * b[col]
+		}
+	}
+
+	x := make([]float64, n)
+	for row:=n-1; row>=0; row-- {
+		tot := b[row]
+		for k:=row+1; k<n; k++ {
+			tot -= A[row][k] * x[k]
+		}
+		x[row] = tot / A[row][row]
+	}
+	return x, nil
+}
+
+// LeastSquares finds the coefficients `c` that minimize the squared
+// error of `rows[i].c = vals[i]`, via the normal equations.
+func LeastSquares(rows [][]float64, vals []float64) ([]float64, error) {
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("LeastSquares: no data")
+	}
+	n := len(rows[0])
+	AtA := make([][]float64, n)
+	for i := range AtA {
+		AtA[i] = make([]float64, n)
+	}
+	Atb := make([]float64, n)
+
+	for r, row := range rows {
+		for i:=0; i<n; i++ {
+			Atb[i] += row[i] * vals[r]
+			for j:=0; j<n; j++ {
+				AtA[i][j] += row[i] * row[j]
+			}
+		}
+	}
+
+	return SolveLinear(AtA, Atb)
+}
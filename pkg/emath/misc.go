@@ -21,3 +21,23 @@ func GammaExpand_F64(f float64) float64 {
 	return 1.055 * math.Pow(f, 1.0/2.4) - 0.055
 }
 
+
+// GammaCompress_F64 is the inverse of GammaExpand_F64; it maps an sRGB
+// encoded value in [0,1] back to linear.
+func GammaCompress_F64(f float64) float64 {
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f + 0.055) / 1.055, 2.4)
+}
+
+// Lanczos is the Lanczos windowed sinc kernel, with `a` lobes.
+func Lanczos(x float64, a float64) float64 {
+	if x == 0 {
+		return 1.0
+	} else if x <= -a || x >= a {
+		return 0.0
+	}
+	px := math.Pi * x
+	return a * math.Sin(px) * math.Sin(px/a) / (px * px)
+}
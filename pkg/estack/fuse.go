@@ -1,23 +1,59 @@
-package eclipse
+// Package estack stacks the aligned exposures into HDR pixels: the
+// fusers, which pick (or blend) the layers at each pixel, and the
+// developers, which turn the fused camera color into an output color.
+// They only see a pixel, and the Settings that go with it; gathering
+// the pixel's inputs from the layers is up to the caller.
+package estack
 
 import(
+	"image"
 	"math"
 
 	"github.com/mdouchement/hdr/hdrcolor"
 
 	"github.com/abworrall/eclipse-hdr/pkg/ecolor"
+	"github.com/abworrall/eclipse-hdr/pkg/eimage"
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
 )
 
 // A PixelFunc mutates a pixel. There are two families of these functions:
 // - FuseBy: examine LDR pixels from all layers to generate a single HDR pixel
 // - DevelopBy: perform color correction to the HDR pixel prior to tonemapping
-type PixelFunc func(Config, *Pixel)
+// A fuser shouldn't hang on to p.In; under a memory budget it is reused
+// for the next pixel.
+type PixelFunc func(Settings, *Pixel)
+
+// Settings are everything the fusers and developers look at. They are
+// set up once for a stack, so needn't be cheap to build.
+type Settings struct {
+	FuserLuminance  float64                  // A layer is too exposed at a pixel brighter than this (0.0->1.0)
+	Layers        []LayerSettings            // In layer order (ascending EV); any missing are zero
+	OutputArea      image.Rectangle          // Where the output pixels are
+
+	CameraWhite     emath.Vec3               // The as-shot white, for white balancing
+	CameraToPCS     emath.Mat3               // Camera color to XYZ(D50), incl. white balancing
+	ColorSpace      ecolor.OutputColorSpace  // What DevelopByDNG develops into
+}
+
+// LayerSettings override the stack's settings for a layer.
+type LayerSettings struct {
+	Threshold  float64  // The layer is too exposed above this, instead of FuserLuminance; zero means no override
+	Weight     float64  // How much the layer counts when the `avg` fuser averages layers; if zero, 1.0
+}
+
+// Layer is the settings for the i'th layer; empty if there are none.
+func (s Settings)Layer(i int) LayerSettings {
+	if i < len(s.Layers) {
+		return s.Layers[i]
+	}
+	return LayerSettings{}
+}
 
 // FuseByPickMostExposed is the default algorithm for image fusion:
 // look for the image that is most-exposed (i.e. has received the most
 // photons and will thus have lowest noise), but not over-exposed at
 // this pixel (e.g. no channel more than ~80%).
-func FuseByPickMostExposed(cfg Config, p *Pixel) {
+func FuseByPickMostExposed(cfg Settings, p *Pixel) {
 	// pixel is too exposed if luminosity greater than this.
 	// Good values in range [0.6, 0.8].
 	maxY := cfg.FuserLuminance
@@ -27,8 +63,12 @@ func FuseByPickMostExposed(cfg Config, p *Pixel) {
 	for i:=0; i<len(p.In); i++ {
 		// If this looks too exposed, and we can move on to another layer, move on.
 		if i < len(p.In)-1 {
+			layerMaxY := maxY
+			if o := cfg.Layer(i); o.Threshold > 0.0 {
+				layerMaxY = o.Threshold
+			}
 			_, Y, _, _ := p.In[i].HDRXYZA()
-			if Y > maxY {
+			if Y > layerMaxY {
 				continue
 			}
 		}
@@ -44,8 +84,8 @@ func FuseByPickMostExposed(cfg Config, p *Pixel) {
 // a source layer based on which pie segment the pixel lies inside.
 // It's useful for comparing the source images to see how well
 // they've been aligned.
-func FuseBySector(cfg Config, p *Pixel) {
-	center              := RectCenter(cfg.OutputArea)
+func FuseBySector(cfg Settings, p *Pixel) {
+	center              := eimage.RectCenter(cfg.OutputArea)
 	pos                 := p.OutputPos
 	thetaRadians        := math.Atan2(float64(pos.Y-center.Y), float64(pos.X-center.X))
 	thetaDegrees        := 180 + thetaRadians * 180.0 / math.Pi
@@ -60,38 +100,49 @@ func FuseBySector(cfg Config, p *Pixel) {
 
 // FuseByAverage averages the non-overexposed layers together. It produces poor results, with notable
 // color fringes forming near the boundary of each layer's area.
-func FuseByAverage(cfg Config, p *Pixel) {
+func FuseByAverage(cfg Settings, p *Pixel) {
 	max := 0.8 // pixel is too exposed if any channel recorded more than this (range [0.0, 1.0])
 
 	toAvg := []ecolor.CameraNative{}
+	weights := []float64{}
 
 	// The images are pre-sorted in asc EV; slowest exposures first, most likely to over-expose.
 	for i:=0; i<len(p.In); i++ {
+		o := cfg.Layer(i)
+
 		// If this looks too exposed, and we have less-exposed layers left, move on.
 		if i < len(p.In)-1 {
+			layerMax := max
+			if o.Threshold > 0.0 {
+				layerMax = o.Threshold
+			}
 			r, g, b, _ := p.In[i].HDRRGBA()
-			if r > max || g > max || b > max {
+			if r > layerMax || g > layerMax || b > layerMax {
 				continue
 			}
 		}
 
+		w := o.Weight
+		if w == 0.0 { w = 1.0 }
 		toAvg = append(toAvg, p.In[i])
+		weights = append(weights, w)
 	}
 
-	p.Fused = ecolor.AverageBalancedCameraNativeRGBs(toAvg)
+	p.Fused = ecolor.WeightedAverageBalancedCameraNativeRGBs(toAvg, weights)
 	p.LayerNumber = len(toAvg)
 }
 
 // DevelopDNG follows the DNG spec's algorithm for mapping a
 // CameraNative sensor reading into a camera-neutral XYZ(D50) color,
-// and then into a standard sRGB(D65) output color. This requires
+// and then into a standard output color (sRGB(D65), unless another
+// color space was picked). This requires
 // data from the camera, that is written into the DNG files
 // - AsShotNeutral (the white balance correction)
 // - ForwardMatrix (the camera's color correction matrix)
-func DevelopByDNG(cfg Config, p *Pixel) {
+func DevelopByDNG(cfg Settings, p *Pixel) {
 	
 	xyzD50 := p.Fused.ToPCS(cfg.CameraToPCS)
-	sRgb   := ecolor.XYZToSRGB(xyzD50)
+	sRgb   := cfg.ColorSpace.FromXYZ(xyzD50)
 
 	// In eclipse shots, there are lots of near-black pixels. The above
 	// transforms leave those pixels with slightly -ve values, which
@@ -99,23 +150,30 @@ func DevelopByDNG(cfg Config, p *Pixel) {
 	// This is one of a few places in the pipeline where clipping happens.
 	sRgb = ecolor.HDRRGBFloorAt(sRgb, 0.0)
 
-	// [If we were developing for final output, we would gamma expand to get final sRGB]
+	// [If we were developing for final output, we would apply the color space's transfer curve]
 
 	p.DevelopedRGB = sRgb
 }
 
-func DevelopByWhiteBalanceOnly(cfg Config, p *Pixel) {
+func DevelopByWhiteBalanceOnly(cfg Settings, p *Pixel) {
 	wbRgb  := ecolor.ApplyCameraWhite(p.Fused, cfg.CameraWhite)
 	p.DevelopedRGB = wbRgb
 }
 
-func DevelopByNone(cfg Config, p *Pixel) {
+// DevelopByMono is for monochrome cameras; there is no color to
+// correct, so we just collapse the channels into a single gray value.
+func DevelopByMono(cfg Settings, p *Pixel) {
+	gray := (p.Fused.RGB.R + p.Fused.RGB.G + p.Fused.RGB.B) / 3.0
+	p.DevelopedRGB = hdrcolor.RGB{R: gray, G: gray, B: gray}
+}
+
+func DevelopByNone(cfg Settings, p *Pixel) {
 	p.DevelopedRGB = p.Fused.RGB
 }
 
 // DevelopAsLayer is for debugging - it colors the pixel based on
 // which layer it came from. (White balances it too)
-func DevelopByLayer(cfg Config, p *Pixel) {
+func DevelopByLayer(cfg Settings, p *Pixel) {
 	wbRgb  := ecolor.ApplyCameraWhite(p.Fused, cfg.CameraWhite)
 	r, g, b, _ := wbRgb.HDRRGBA()
 
@@ -129,5 +187,5 @@ func DevelopByLayer(cfg Config, p *Pixel) {
 	case 6:
 	}
 
-	p.DevelopedRGB = hdrcolor.RGB{r, g, b}
+	p.DevelopedRGB = hdrcolor.RGB{R: r, G: g, B: b}
 }
@@ -7,6 +7,7 @@ import(
 	"image/color"
 	"fmt"
 	"math"
+	"path/filepath"
 
 	"github.com/mdouchement/hdr"
 	"github.com/mdouchement/hdr/hdrcolor"
@@ -30,8 +31,10 @@ type Fattal02 struct {
 	Saturation     float64
 
 	// Our extra params
-	GammaExpand    bool        // whether to perform sRGB gamma expansion on final output
+	GammaExpand    bool        // whether to perform gamma expansion on final output
+	Transfer       func(emath.Vec3) emath.Vec3 // the gamma expansion to use; if nil, sRGB
 	DumpGrids      bool        // whether to write greyscale image files for the intermediate grids
+	DumpDir        string      // where to write them; if empty, the current dir
 
 	input          hdr.Image   // HDR image
 	output         image.Image // LDR image
@@ -88,7 +91,7 @@ func (f02 *Fattal02)Perform() image.Image {
 
 func (f02 *Fattal02)maybeDumpGrid(f emath.FloatGrid, comment, filename string) {
 	if f02.DumpGrids {
-		f.ToImg(comment, filename)
+		f.ToImg(comment, filepath.Join(f02.DumpDir, filename))
 	}
 }
 
@@ -329,7 +332,9 @@ func (f02 *Fattal02)fillOutputImage() {
 				math.Pow( MaxOf2((C_in.B / L_before), 0.0), f02.Saturation ) * L_after,
 			}
 
-			if f02.GammaExpand {
+			if f02.GammaExpand && f02.Transfer != nil {
+				C_after = f02.Transfer(C_after)
+			} else if f02.GammaExpand {
 				C_after = emath.GammaExpand_sRGB(C_after)
 			}
 
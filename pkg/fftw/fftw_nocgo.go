@@ -0,0 +1,53 @@
+//go:build !cgo
+
+package fftw
+
+import(
+	"gonum.org/v1/gonum/dsp/fourier"
+
+	"github.com/abworrall/eclipse-hdr/pkg/emath"
+)
+
+// FftwPlan is a pure Go stand-in for the fftw3 plan, for builds that
+// can't use cgo (e.g. WebAssembly). It does the same 2D transform as
+// fftw_plan_r2r_2d with FFTW_REDFT00 in both directions (a DCT-I,
+// unnormalized, along the rows and then the columns); gonum's DCT is
+// that same transform. It is slower than fftw3, but needs no C.
+type FftwPlan struct {
+	in, out emath.FloatGrid
+}
+
+func (p *FftwPlan) Execute() *FftwPlan {
+	width, height := p.in.Dx(), p.in.Dy()
+
+	row := fourier.NewDCT(width)
+	buf := make([]float64, width)
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			buf[x] = p.in.Get(x, y)
+		}
+		row.Transform(buf, buf)
+		for x:=0; x<width; x++ {
+			p.out.Set(x, y, buf[x])
+		}
+	}
+
+	col := fourier.NewDCT(height)
+	buf = make([]float64, height)
+	for x:=0; x<width; x++ {
+		for y:=0; y<height; y++ {
+			buf[y] = p.out.Get(x, y)
+		}
+		col.Transform(buf, buf)
+		for y:=0; y<height; y++ {
+			p.out.Set(x, y, buf[y])
+		}
+	}
+	return p
+}
+
+func (p *FftwPlan) Destroy() {}
+
+func NewFftwPlan(in, out emath.FloatGrid) *FftwPlan {
+	return &FftwPlan{in: in, out: out}
+}